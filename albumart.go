@@ -0,0 +1,247 @@
+package itunes
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/rclancey/itunes/artwork"
+	"github.com/rclancey/itunes/persistentId"
+)
+
+type AlbumArtwork struct {
+	Key string `json:"key"`
+	Album string `json:"album"`
+	AlbumArtist string `json:"album_artist"`
+	TrackIDs []pid.PersistentID `json:"track_ids"`
+	// RepresentativeID is the track whose artwork stands for the album.
+	RepresentativeID *pid.PersistentID `json:"representative_id,omitempty"`
+	// Hash is the content hash of the album's artwork.
+	Hash string `json:"hash,omitempty"`
+	// Missing lists tracks without artwork.  It is only filled in by Scan.
+	Missing []pid.PersistentID `json:"missing,omitempty"`
+	// Variants maps the hash of each distinct image found on the album's
+	// tracks to the tracks that have it.  It is only filled in by Scan.
+	Variants map[string][]pid.PersistentID `json:"variants,omitempty"`
+	resolved bool
+}
+
+// Inconsistent is true when tracks of the album have different artwork.
+func (a *AlbumArtwork) Inconsistent() bool {
+	return len(a.Variants) > 1
+}
+
+// AlbumArtworkIndex resolves artwork once per album instead of once per
+// track.  Images are identified by content hash and only the hashes are
+// kept; an album's artwork is read from its representative track's
+// source when asked for.  It is itself an ArtworkSource.
+type AlbumArtworkIndex struct {
+	src artwork.ArtworkSource
+	albums map[string]*AlbumArtwork
+	byTrack map[pid.PersistentID]string
+	mutex sync.Mutex
+}
+
+func NewAlbumArtworkIndex(lib *Library, src artwork.ArtworkSource) *AlbumArtworkIndex {
+	idx := &AlbumArtworkIndex{
+		src: src,
+		albums: map[string]*AlbumArtwork{},
+		byTrack: map[pid.PersistentID]string{},
+	}
+	for _, tr := range lib.Tracks {
+		key := tr.AlbumKey()
+		if key == "" {
+			continue
+		}
+		album, ok := idx.albums[key]
+		if !ok {
+			album = &AlbumArtwork{Key: key, Album: tr.Album, AlbumArtist: tr.AlbumArtist}
+			if album.AlbumArtist == "" {
+				album.AlbumArtist = tr.Artist
+			}
+			idx.albums[key] = album
+		}
+		album.TrackIDs = append(album.TrackIDs, tr.PersistentID)
+		idx.byTrack[tr.PersistentID] = key
+	}
+	return idx
+}
+
+func imageHash(data []byte) string {
+	sum := sha1.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// lookup returns the album a track is on and, if its artwork has already
+// been resolved, the track that represents it.
+func (idx *AlbumArtworkIndex) lookup(id pid.PersistentID) (*AlbumArtwork, *pid.PersistentID, bool) {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+	key, ok := idx.byTrack[id]
+	if !ok {
+		return nil, nil, false
+	}
+	album := idx.albums[key]
+	return album, album.RepresentativeID, album.resolved
+}
+
+// resolve finds the first track of the album, trying first before the
+// others, that has artwork, and returns the artwork.  The source is read
+// without holding the lock, so lookups of other albums aren't held up.
+func (idx *AlbumArtworkIndex) resolve(album *AlbumArtwork, first pid.PersistentID) ([]byte, error) {
+	ids := append([]pid.PersistentID{first}, album.TrackIDs...)
+	for i, id := range ids {
+		if i > 0 && id == first {
+			continue
+		}
+		data, err := idx.src.GetJPEG(id)
+		if err != nil || len(data) == 0 {
+			continue
+		}
+		idx.mutex.Lock()
+		if !album.resolved {
+			album.Hash = imageHash(data)
+			album.RepresentativeID = id.Pointer()
+			album.resolved = true
+		}
+		idx.mutex.Unlock()
+		return data, nil
+	}
+	idx.mutex.Lock()
+	album.resolved = true
+	idx.mutex.Unlock()
+	return nil, os.ErrNotExist
+}
+
+// Album returns the artwork record of the album a track is on.
+func (idx *AlbumArtworkIndex) Album(id pid.PersistentID) *AlbumArtwork {
+	album, _, resolved := idx.lookup(id)
+	if album != nil && !resolved {
+		idx.resolve(album, id)
+	}
+	return album
+}
+
+// RepresentativeID returns the track whose artwork stands for id's album,
+// so that per track caches such as artwork.ThumbnailCache hold a single
+// copy for the whole album.  Tracks without an album stand for
+// themselves.
+func (idx *AlbumArtworkIndex) RepresentativeID(id pid.PersistentID) pid.PersistentID {
+	album := idx.Album(id)
+	if album == nil {
+		return id
+	}
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+	if album.RepresentativeID == nil {
+		return id
+	}
+	return *album.RepresentativeID
+}
+
+func (idx *AlbumArtworkIndex) GetJPEG(id pid.PersistentID) ([]byte, error) {
+	album, rep, resolved := idx.lookup(id)
+	if album == nil {
+		return idx.src.GetJPEG(id)
+	}
+	if !resolved {
+		return idx.resolve(album, id)
+	}
+	if rep == nil {
+		return nil, os.ErrNotExist
+	}
+	return idx.src.GetJPEG(*rep)
+}
+
+func (idx *AlbumArtworkIndex) Close() error {
+	return idx.src.Close()
+}
+
+// Scan looks up the artwork of every track, recording which tracks have
+// none and which albums have more than one image.  The most common image
+// becomes the album's artwork.
+func (idx *AlbumArtworkIndex) Scan() {
+	idx.mutex.Lock()
+	albums := make([]*AlbumArtwork, 0, len(idx.albums))
+	for _, album := range idx.albums {
+		albums = append(albums, album)
+	}
+	idx.mutex.Unlock()
+	for _, album := range albums {
+		missing := []pid.PersistentID{}
+		variants := map[string][]pid.PersistentID{}
+		for _, id := range album.TrackIDs {
+			data, err := idx.src.GetJPEG(id)
+			if err != nil || len(data) == 0 {
+				missing = append(missing, id)
+				continue
+			}
+			hash := imageHash(data)
+			variants[hash] = append(variants[hash], id)
+		}
+		idx.mutex.Lock()
+		album.Missing = missing
+		album.Variants = variants
+		album.Hash = ""
+		album.RepresentativeID = nil
+		album.resolved = true
+		best := 0
+		for hash, ids := range album.Variants {
+			if len(ids) > best || (len(ids) == best && hash < album.Hash) {
+				best = len(ids)
+				album.Hash = hash
+				album.RepresentativeID = ids[0].Pointer()
+			}
+		}
+		idx.mutex.Unlock()
+	}
+}
+
+type AlbumArtworkReport struct {
+	Albums int `json:"albums"`
+	UniqueImages int `json:"unique_images"`
+	// Missing lists albums where no track has artwork.
+	Missing []*AlbumArtwork `json:"missing"`
+	// Partial lists albums where only some of the tracks have artwork.
+	Partial []*AlbumArtwork `json:"partial"`
+	Inconsistent []*AlbumArtwork `json:"inconsistent"`
+}
+
+// Report summarizes the results of Scan.
+func (idx *AlbumArtworkIndex) Report() *AlbumArtworkReport {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+	report := &AlbumArtworkReport{
+		Albums: len(idx.albums),
+		Missing: []*AlbumArtwork{},
+		Partial: []*AlbumArtwork{},
+		Inconsistent: []*AlbumArtwork{},
+	}
+	keys := make([]string, 0, len(idx.albums))
+	for k := range idx.albums {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	images := map[string]bool{}
+	for _, k := range keys {
+		album := idx.albums[k]
+		if album.Variants == nil {
+			continue
+		}
+		if len(album.Variants) == 0 {
+			report.Missing = append(report.Missing, album)
+		} else if len(album.Missing) > 0 {
+			report.Partial = append(report.Partial, album)
+		}
+		if album.Inconsistent() {
+			report.Inconsistent = append(report.Inconsistent, album)
+		}
+		for hash := range album.Variants {
+			images[hash] = true
+		}
+	}
+	report.UniqueImages = len(images)
+	return report
+}
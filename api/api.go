@@ -0,0 +1,169 @@
+// Package api serves an itunes.Library as JSON over HTTP.
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/rclancey/itunes"
+	"github.com/rclancey/itunes/persistentId"
+)
+
+var (
+	ErrNotFound = errors.New("not found")
+	ErrMethodNotAllowed = errors.New("method not allowed")
+)
+
+type HTTPError struct {
+	Status int
+	Err error
+}
+
+func (e *HTTPError) Error() string {
+	return e.Err.Error()
+}
+
+func badRequest(err error) error {
+	return &HTTPError{http.StatusBadRequest, err}
+}
+
+// Handler serves the library under Prefix:
+//
+//	GET    /tracks                    ?offset=&limit=&sort=&desc=&genre=&artist=&album=
+//	GET    /tracks/{id}
+//	PATCH  /tracks/{id}               partial track JSON
+//	PUT    /tracks/{id}/rating        {"rating": 0-100}
+//	GET    /genres, /artists, /albums ?genre=&artist=
+//	GET    /playlists                 the playlist tree, without tracks
+//	POST   /playlists                 {"name", "parent_persistent_id", "track_ids"}
+//	GET    /playlists/{id}            with tracks; smart playlists are evaluated
+//	PATCH  /playlists/{id}            {"name", "parent_persistent_id"}
+//	DELETE /playlists/{id}
+//	PUT    /playlists/{id}/tracks     {"track_ids"} replaces the tracks
+//	POST   /playlists/{id}/tracks     {"track_ids"} appends tracks
+//	DELETE /playlists/{id}/tracks     {"track_ids"} removes tracks
+//	POST   /smart                     {"info", "criteria"} base64 as in the
+//	                                  library XML; returns matching tracks
+type Handler struct {
+	lib *itunes.Library
+	Prefix string
+	// MaxLimit caps the page size of track listings.
+	MaxLimit int
+}
+
+func NewHandler(lib *itunes.Library) *Handler {
+	return &Handler{lib: lib, MaxLimit: 1000}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, h.Prefix), "/")
+	parts := strings.Split(path, "/")
+	obj, err := h.route(r, parts)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if obj == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, http.StatusOK, obj)
+}
+
+func writeJSON(w http.ResponseWriter, status int, obj interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(obj)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	var herr *HTTPError
+	switch {
+	case errors.As(err, &herr):
+		status = herr.Status
+	case errors.Is(err, ErrNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, ErrMethodNotAllowed):
+		status = http.StatusMethodNotAllowed
+	}
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func (h *Handler) route(r *http.Request, parts []string) (interface{}, error) {
+	switch parts[0] {
+	case "tracks":
+		switch len(parts) {
+		case 1:
+			return h.listTracks(r)
+		case 2:
+			return h.track(r, parts[1])
+		case 3:
+			if parts[2] == "rating" {
+				return h.rating(r, parts[1])
+			}
+		}
+	case "genres", "artists", "albums":
+		if len(parts) == 1 {
+			return h.index(r, parts[0])
+		}
+	case "playlists":
+		switch len(parts) {
+		case 1:
+			return h.playlists(r)
+		case 2:
+			return h.playlist(r, parts[1])
+		case 3:
+			if parts[2] == "tracks" {
+				return h.playlistTracks(r, parts[1])
+			}
+		}
+	case "smart":
+		if len(parts) == 1 {
+			return h.smart(r)
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func parseID(s string) (pid.PersistentID, error) {
+	var id pid.PersistentID
+	err := (&id).Decode(s)
+	if err != nil {
+		return id, badRequest(errors.New("invalid persistent id " + s))
+	}
+	return id, nil
+}
+
+func readJSON(r *http.Request, obj interface{}) error {
+	err := json.NewDecoder(r.Body).Decode(obj)
+	if err != nil {
+		return badRequest(err)
+	}
+	return nil
+}
+
+func queryInt(r *http.Request, key string, def int) (int, error) {
+	s := r.URL.Query().Get(key)
+	if s == "" {
+		return def, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < 0 {
+		return 0, badRequest(errors.New("invalid " + key))
+	}
+	return v, nil
+}
+
+// write runs f with the library locked for writing, committing its
+// events once the lock is released.
+func (h *Handler) write(f func() (interface{}, error)) (interface{}, error) {
+	h.lib.Begin()
+	defer h.lib.Commit()
+	h.lib.Lock()
+	defer h.lib.Unlock()
+	return f()
+}
@@ -0,0 +1,317 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rclancey/itunes"
+	"github.com/rclancey/itunes/persistentId"
+)
+
+type fixture struct {
+	lib *itunes.Library
+	h *Handler
+	tracks []*itunes.Track
+	// folder contains subfolder, which contains playlist; other is at the
+	// top level
+	folder *itunes.Playlist
+	subfolder *itunes.Playlist
+	playlist *itunes.Playlist
+	other *itunes.Playlist
+}
+
+func newFixture() *fixture {
+	lib := itunes.NewLibrary()
+	f := &fixture{lib: lib, h: NewHandler(lib)}
+	for i, meta := range [][]string{
+		{"Blackbird", "The Beatles", "The White Album", "Rock"},
+		{"Yesterday", "The Beatles", "Help!", "Pop"},
+		{"Clocks", "Coldplay", "A Rush of Blood to the Head", "Rock"},
+	} {
+		tr := &itunes.Track{
+			PersistentID: pid.PersistentID(i + 1),
+			Name: meta[0],
+			Artist: meta[1],
+			Album: meta[2],
+			Genre: meta[3],
+		}
+		lib.AddTrack(tr)
+		f.tracks = append(f.tracks, tr)
+	}
+	f.folder = lib.CreateFolder("Folder", nil)
+	f.subfolder = lib.CreateFolder("Subfolder", &f.folder.PersistentID)
+	f.playlist = lib.CreatePlaylist("Playlist", &f.subfolder.PersistentID)
+	lib.AddToPlaylist(f.playlist, f.tracks[0], f.tracks[1])
+	f.other = lib.CreatePlaylist("Other", nil)
+	return f
+}
+
+func (f *fixture) do(t *testing.T, method, path string, body interface{}, out interface{}) int {
+	t.Helper()
+	var r *http.Request
+	if body != nil {
+		js, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = httptest.NewRequest(method, path, bytes.NewReader(js))
+	} else {
+		r = httptest.NewRequest(method, path, nil)
+	}
+	w := httptest.NewRecorder()
+	f.h.ServeHTTP(w, r)
+	if out != nil && w.Code == http.StatusOK {
+		err := json.Unmarshal(w.Body.Bytes(), out)
+		if err != nil {
+			t.Fatalf("%s %s: %s", method, path, err)
+		}
+	}
+	return w.Code
+}
+
+func expectStatus(t *testing.T, what string, got, want int) {
+	t.Helper()
+	if got != want {
+		t.Errorf("%s: got status %d, want %d", what, got, want)
+	}
+}
+
+func playlistPath(p *itunes.Playlist) string {
+	return "/playlists/" + p.PersistentID.String()
+}
+
+func TestListTracks(t *testing.T) {
+	f := newFixture()
+	page := &TrackPage{}
+	expectStatus(t, "list", f.do(t, "GET", "/tracks", nil, page), http.StatusOK)
+	if page.Total != 3 || len(page.Tracks) != 3 {
+		t.Errorf("got %d of %d tracks, want 3", len(page.Tracks), page.Total)
+	}
+
+	page = &TrackPage{}
+	f.do(t, "GET", "/tracks?genre=rock", nil, page)
+	if page.Total != 2 {
+		t.Errorf("genre filter: got %d tracks, want 2", page.Total)
+	}
+
+	page = &TrackPage{}
+	f.do(t, "GET", "/tracks?sort=name&desc=1&offset=1&limit=1", nil, page)
+	if page.Total != 3 || len(page.Tracks) != 1 || page.Tracks[0].Name != "Clocks" {
+		t.Errorf("sorted page: got %+v", page)
+	}
+
+	expectStatus(t, "bad sort", f.do(t, "GET", "/tracks?sort=nonsense", nil, nil), http.StatusBadRequest)
+	expectStatus(t, "bad limit", f.do(t, "GET", "/tracks?limit=x", nil, nil), http.StatusBadRequest)
+	expectStatus(t, "post", f.do(t, "POST", "/tracks", nil, nil), http.StatusMethodNotAllowed)
+}
+
+func TestTrack(t *testing.T) {
+	f := newFixture()
+	path := "/tracks/" + f.tracks[0].PersistentID.String()
+	tr := &itunes.Track{}
+	expectStatus(t, "get", f.do(t, "GET", path, nil, tr), http.StatusOK)
+	if tr.Name != "Blackbird" {
+		t.Errorf("got track %q, want Blackbird", tr.Name)
+	}
+	expectStatus(t, "missing", f.do(t, "GET", "/tracks/FFFF", nil, nil), http.StatusNotFound)
+	expectStatus(t, "bad id", f.do(t, "GET", "/tracks/xyz", nil, nil), http.StatusBadRequest)
+
+	tr = &itunes.Track{}
+	code := f.do(t, "PATCH", path, map[string]interface{}{"name": "Blackbird 2"}, tr)
+	expectStatus(t, "patch", code, http.StatusOK)
+	if tr.Name != "Blackbird 2" || f.tracks[0].Name != "Blackbird 2" || tr.Genre != "Rock" {
+		t.Errorf("patch didn't rename the track and only that")
+	}
+	code = f.do(t, "PATCH", path, map[string]interface{}{"name": 5}, nil)
+	expectStatus(t, "patch with a bad type", code, http.StatusBadRequest)
+	if f.tracks[0].Name != "Blackbird 2" {
+		t.Errorf("failed patch changed the track")
+	}
+	code = f.do(t, "PATCH", path, map[string]interface{}{"persistent_id": "0000000000000009"}, nil)
+	expectStatus(t, "patch persistent id", code, http.StatusBadRequest)
+	expectStatus(t, "patch missing", f.do(t, "PATCH", "/tracks/FFFF", map[string]interface{}{}, nil), http.StatusNotFound)
+	expectStatus(t, "delete", f.do(t, "DELETE", path, nil, nil), http.StatusMethodNotAllowed)
+
+	expectStatus(t, "rating", f.do(t, "PUT", path + "/rating", map[string]int{"rating": 80}, nil), http.StatusOK)
+	if f.tracks[0].Rating != 80 {
+		t.Errorf("got rating %d, want 80", f.tracks[0].Rating)
+	}
+	expectStatus(t, "bad rating", f.do(t, "PUT", path + "/rating", map[string]int{"rating": 101}, nil), http.StatusBadRequest)
+}
+
+func TestListPlaylists(t *testing.T) {
+	f := newFixture()
+	tree := []*itunes.Playlist{}
+	expectStatus(t, "list", f.do(t, "GET", "/playlists", nil, &tree), http.StatusOK)
+	if len(tree) != 2 {
+		t.Fatalf("got %d top level playlists, want 2", len(tree))
+	}
+	var folder *itunes.Playlist
+	for _, p := range tree {
+		if p.PersistentID == f.folder.PersistentID {
+			folder = p
+		}
+	}
+	if folder == nil || len(folder.Children) != 1 || len(folder.Children[0].Children) != 1 {
+		t.Errorf("folder tree not nested: %+v", folder)
+	}
+
+	p := &itunes.Playlist{}
+	expectStatus(t, "get", f.do(t, "GET", playlistPath(f.playlist), nil, p), http.StatusOK)
+	if len(p.PlaylistItems) != 2 {
+		t.Errorf("got %d items, want 2", len(p.PlaylistItems))
+	}
+	expectStatus(t, "missing", f.do(t, "GET", "/playlists/FFFF", nil, nil), http.StatusNotFound)
+}
+
+func TestCreatePlaylist(t *testing.T) {
+	f := newFixture()
+	p := &itunes.Playlist{}
+	body := map[string]interface{}{
+		"name": "New",
+		"parent_persistent_id": f.subfolder.PersistentID,
+		"track_ids": []pid.PersistentID{f.tracks[2].PersistentID},
+	}
+	expectStatus(t, "post", f.do(t, "POST", "/playlists", body, p), http.StatusOK)
+	created, ok := f.lib.Playlists[p.PersistentID]
+	if !ok || created.ParentPersistentID == nil || *created.ParentPersistentID != f.subfolder.PersistentID {
+		t.Fatalf("playlist not created in the subfolder")
+	}
+	if len(created.TrackIDs) != 1 || len(f.subfolder.Children) != 2 {
+		t.Errorf("playlist has %d tracks and the subfolder %d children", len(created.TrackIDs), len(f.subfolder.Children))
+	}
+
+	n := len(f.lib.Playlists)
+	tests := []struct {
+		what string
+		body map[string]interface{}
+	}{
+		{"no name", map[string]interface{}{}},
+		{"missing parent", map[string]interface{}{"name": "x", "parent_persistent_id": "FFFF"}},
+		{"parent not a folder", map[string]interface{}{"name": "x", "parent_persistent_id": f.other.PersistentID}},
+		{"missing track", map[string]interface{}{"name": "x", "track_ids": []string{"FFFF"}}},
+	}
+	for _, test := range tests {
+		expectStatus(t, test.what, f.do(t, "POST", "/playlists", test.body, nil), http.StatusBadRequest)
+	}
+	if len(f.lib.Playlists) != n {
+		t.Errorf("failed requests created playlists")
+	}
+}
+
+func TestEditPlaylist(t *testing.T) {
+	f := newFixture()
+	path := playlistPath(f.playlist)
+	p := &itunes.Playlist{}
+	code := f.do(t, "PATCH", path, map[string]interface{}{"name": "Renamed", "parent_persistent_id": nil}, p)
+	expectStatus(t, "rename and move to top", code, http.StatusOK)
+	if f.playlist.Name != "Renamed" || f.playlist.ParentPersistentID != nil {
+		t.Errorf("playlist not renamed and moved: %+v", f.playlist)
+	}
+	if len(f.lib.PlaylistTree) != 3 || len(f.subfolder.Children) != 0 {
+		t.Errorf("playlist tree not updated")
+	}
+
+	code = f.do(t, "PATCH", path, map[string]interface{}{"parent_persistent_id": f.folder.PersistentID}, nil)
+	expectStatus(t, "move into folder", code, http.StatusOK)
+	if f.playlist.ParentPersistentID == nil || *f.playlist.ParentPersistentID != f.folder.PersistentID {
+		t.Errorf("playlist not moved into the folder")
+	}
+
+	code = f.do(t, "PATCH", path, map[string]interface{}{"name": "Again", "parent_persistent_id": "FFFF"}, nil)
+	expectStatus(t, "missing parent", code, http.StatusBadRequest)
+	code = f.do(t, "PATCH", path, map[string]interface{}{"parent_persistent_id": f.other.PersistentID}, nil)
+	expectStatus(t, "parent not a folder", code, http.StatusBadRequest)
+	if f.playlist.Name != "Renamed" || *f.playlist.ParentPersistentID != f.folder.PersistentID {
+		t.Errorf("failed edits changed the playlist")
+	}
+	expectStatus(t, "missing", f.do(t, "PATCH", "/playlists/FFFF", map[string]interface{}{}, nil), http.StatusNotFound)
+}
+
+func TestMoveFolderCycle(t *testing.T) {
+	f := newFixture()
+	path := playlistPath(f.folder)
+	for _, parent := range []*itunes.Playlist{f.folder, f.subfolder} {
+		code := f.do(t, "PATCH", path, map[string]interface{}{"parent_persistent_id": parent.PersistentID}, nil)
+		expectStatus(t, "move into " + parent.Name, code, http.StatusBadRequest)
+	}
+	if f.folder.ParentPersistentID != nil {
+		t.Errorf("folder moved")
+	}
+	// the tree must still be walkable
+	tree := []*itunes.Playlist{}
+	expectStatus(t, "list", f.do(t, "GET", "/playlists", nil, &tree), http.StatusOK)
+	if len(tree) != 2 {
+		t.Errorf("got %d top level playlists, want 2", len(tree))
+	}
+
+	// moving the subfolder out and then the folder into it is fine
+	code := f.do(t, "PATCH", playlistPath(f.subfolder), map[string]interface{}{"parent_persistent_id": nil}, nil)
+	expectStatus(t, "move subfolder to top", code, http.StatusOK)
+	code = f.do(t, "PATCH", path, map[string]interface{}{"parent_persistent_id": f.subfolder.PersistentID}, nil)
+	expectStatus(t, "move folder into former subfolder", code, http.StatusOK)
+}
+
+func TestDeletePlaylist(t *testing.T) {
+	f := newFixture()
+	expectStatus(t, "delete playlist", f.do(t, "DELETE", playlistPath(f.other), nil, nil), http.StatusNoContent)
+	if _, ok := f.lib.Playlists[f.other.PersistentID]; ok {
+		t.Errorf("playlist not deleted")
+	}
+
+	events := []*itunes.Event{}
+	f.lib.Subscribe(func(evs []*itunes.Event) {
+		events = append(events, evs...)
+	})
+	expectStatus(t, "delete folder", f.do(t, "DELETE", playlistPath(f.folder), nil, nil), http.StatusNoContent)
+	for _, p := range []*itunes.Playlist{f.folder, f.subfolder, f.playlist} {
+		if _, ok := f.lib.Playlists[p.PersistentID]; ok {
+			t.Errorf("%s not deleted with its folder", p.Name)
+		}
+	}
+	if len(f.lib.PlaylistTree) != 0 {
+		t.Errorf("playlist tree still has %d playlists", len(f.lib.PlaylistTree))
+	}
+	removed := 0
+	for _, ev := range events {
+		if ev.Type == itunes.PlaylistRemoved {
+			removed++
+		}
+	}
+	if removed != 3 {
+		t.Errorf("got %d removal events, want 3", removed)
+	}
+	expectStatus(t, "get deleted", f.do(t, "GET", playlistPath(f.playlist), nil, nil), http.StatusNotFound)
+	expectStatus(t, "delete again", f.do(t, "DELETE", playlistPath(f.folder), nil, nil), http.StatusNotFound)
+}
+
+func TestPlaylistTracks(t *testing.T) {
+	f := newFixture()
+	path := playlistPath(f.playlist) + "/tracks"
+	ids := func(trs ...*itunes.Track) map[string]interface{} {
+		list := []pid.PersistentID{}
+		for _, tr := range trs {
+			list = append(list, tr.PersistentID)
+		}
+		return map[string]interface{}{"track_ids": list}
+	}
+	expectStatus(t, "append", f.do(t, "POST", path, ids(f.tracks[2]), nil), http.StatusOK)
+	if len(f.playlist.TrackIDs) != 3 {
+		t.Errorf("got %d tracks after appending, want 3", len(f.playlist.TrackIDs))
+	}
+	expectStatus(t, "remove", f.do(t, "DELETE", path, ids(f.tracks[0]), nil), http.StatusOK)
+	if len(f.playlist.TrackIDs) != 2 {
+		t.Errorf("got %d tracks after removing, want 2", len(f.playlist.TrackIDs))
+	}
+	expectStatus(t, "replace", f.do(t, "PUT", path, ids(f.tracks[2]), nil), http.StatusOK)
+	if len(f.playlist.TrackIDs) != 1 || f.playlist.TrackIDs[0] != f.tracks[2].PersistentID {
+		t.Errorf("got %v after replacing", f.playlist.TrackIDs)
+	}
+	code := f.do(t, "POST", path, map[string]interface{}{"track_ids": []string{"FFFF"}}, nil)
+	expectStatus(t, "missing track", code, http.StatusBadRequest)
+	code = f.do(t, "POST", playlistPath(f.folder) + "/tracks", ids(f.tracks[0]), nil)
+	expectStatus(t, "folder", code, http.StatusBadRequest)
+}
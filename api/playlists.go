@@ -0,0 +1,212 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+
+	"github.com/rclancey/itunes"
+	"github.com/rclancey/itunes/persistentId"
+)
+
+type playlistEdit struct {
+	Name *string `json:"name"`
+	// ParentID is a pointer to a pointer so that moving a playlist to the
+	// top level (null) can be told apart from not moving it (absent).
+	ParentID **pid.PersistentID `json:"parent_persistent_id"`
+	TrackIDs []pid.PersistentID `json:"track_ids"`
+}
+
+func (e *playlistEdit) UnmarshalJSON(data []byte) error {
+	var raw map[string]json.RawMessage
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return err
+	}
+	if v, ok := raw["name"]; ok {
+		err = json.Unmarshal(v, &e.Name)
+		if err != nil {
+			return err
+		}
+	}
+	if v, ok := raw["parent_persistent_id"]; ok {
+		var parent *pid.PersistentID
+		err = json.Unmarshal(v, &parent)
+		if err != nil {
+			return err
+		}
+		e.ParentID = &parent
+	}
+	if v, ok := raw["track_ids"]; ok {
+		err = json.Unmarshal(v, &e.TrackIDs)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *Handler) tracks(ids []pid.PersistentID) ([]*itunes.Track, error) {
+	tracks := make([]*itunes.Track, len(ids))
+	for i, id := range ids {
+		tracks[i] = h.lib.GetTrack(id)
+		if tracks[i] == nil {
+			return nil, badRequest(errors.New("no such track " + id.String()))
+		}
+	}
+	return tracks, nil
+}
+
+// checkParent makes sure a playlist can be put in parentID.
+func (h *Handler) checkParent(parentID *pid.PersistentID) error {
+	if parentID == nil {
+		return nil
+	}
+	parent, ok := h.lib.Playlists[*parentID]
+	if !ok || !parent.Folder {
+		return badRequest(errors.New("parent is not a folder"))
+	}
+	return nil
+}
+
+func (h *Handler) getPlaylist(idstr string) (*itunes.Playlist, error) {
+	id, err := parseID(idstr)
+	if err != nil {
+		return nil, err
+	}
+	p, ok := h.lib.Playlists[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return p, nil
+}
+
+func (h *Handler) playlists(r *http.Request) (interface{}, error) {
+	switch r.Method {
+	case http.MethodGet:
+		h.lib.RLock()
+		defer h.lib.RUnlock()
+		tree := make([]*itunes.Playlist, len(h.lib.PlaylistTree))
+		for i, p := range h.lib.PlaylistTree {
+			tree[i] = p.Prune()
+		}
+		sort.Sort(itunes.SortablePlaylistList(tree))
+		return tree, nil
+	case http.MethodPost:
+		edit := &playlistEdit{}
+		err := readJSON(r, edit)
+		if err != nil {
+			return nil, err
+		}
+		if edit.Name == nil || *edit.Name == "" {
+			return nil, badRequest(errors.New("playlist name is required"))
+		}
+		return h.write(func() (interface{}, error) {
+			var parentID *pid.PersistentID
+			if edit.ParentID != nil {
+				parentID = *edit.ParentID
+			}
+			err := h.checkParent(parentID)
+			if err != nil {
+				return nil, err
+			}
+			tracks, err := h.tracks(edit.TrackIDs)
+			if err != nil {
+				return nil, err
+			}
+			p := h.lib.CreatePlaylist(*edit.Name, parentID)
+			h.lib.AddToPlaylist(p, tracks...)
+			return p.Populate(h.lib), nil
+		})
+	}
+	return nil, ErrMethodNotAllowed
+}
+
+func (h *Handler) playlist(r *http.Request, idstr string) (interface{}, error) {
+	switch r.Method {
+	case http.MethodGet:
+		h.lib.RLock()
+		defer h.lib.RUnlock()
+		p, err := h.getPlaylist(idstr)
+		if err != nil {
+			return nil, err
+		}
+		if p.Folder {
+			return p.Prune(), nil
+		}
+		return p.Populate(h.lib), nil
+	case http.MethodPatch:
+		edit := &playlistEdit{}
+		err := readJSON(r, edit)
+		if err != nil {
+			return nil, err
+		}
+		return h.write(func() (interface{}, error) {
+			p, err := h.getPlaylist(idstr)
+			if err != nil {
+				return nil, err
+			}
+			if edit.ParentID != nil {
+				err = h.checkParent(*edit.ParentID)
+				if err != nil {
+					return nil, err
+				}
+				err = h.lib.MovePlaylist(p, *edit.ParentID)
+				if err != nil {
+					return nil, badRequest(err)
+				}
+			}
+			if edit.Name != nil && *edit.Name != "" {
+				h.lib.RenamePlaylist(p, *edit.Name)
+			}
+			return p.Prune(), nil
+		})
+	case http.MethodDelete:
+		return h.write(func() (interface{}, error) {
+			p, err := h.getPlaylist(idstr)
+			if err != nil {
+				return nil, err
+			}
+			h.lib.DeletePlaylist(p)
+			return nil, nil
+		})
+	}
+	return nil, ErrMethodNotAllowed
+}
+
+func (h *Handler) playlistTracks(r *http.Request, idstr string) (interface{}, error) {
+	if r.Method != http.MethodPut && r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		return nil, ErrMethodNotAllowed
+	}
+	edit := &playlistEdit{}
+	err := readJSON(r, edit)
+	if err != nil {
+		return nil, err
+	}
+	return h.write(func() (interface{}, error) {
+		p, err := h.getPlaylist(idstr)
+		if err != nil {
+			return nil, err
+		}
+		if p.Folder || p.Smart != nil {
+			return nil, badRequest(errors.New("can't edit the tracks of folders or smart playlists"))
+		}
+		tracks, err := h.tracks(edit.TrackIDs)
+		if err != nil {
+			return nil, err
+		}
+		switch r.Method {
+		case http.MethodPut:
+			orig := *p
+			cur := *p
+			cur.TrackIDs = edit.TrackIDs
+			h.lib.UpdatePlaylist(p, &orig, &cur)
+		case http.MethodPost:
+			h.lib.AddToPlaylist(p, tracks...)
+		case http.MethodDelete:
+			h.lib.RemoveFromPlaylist(p, edit.TrackIDs...)
+		}
+		return p.Populate(h.lib), nil
+	})
+}
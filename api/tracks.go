@@ -0,0 +1,190 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/rclancey/itunes"
+)
+
+type TrackPage struct {
+	Total int `json:"total"`
+	Offset int `json:"offset"`
+	Limit int `json:"limit"`
+	Tracks []*itunes.Track `json:"tracks"`
+}
+
+func (h *Handler) listTracks(r *http.Request) (interface{}, error) {
+	if r.Method != http.MethodGet {
+		return nil, ErrMethodNotAllowed
+	}
+	q := r.URL.Query()
+	offset, err := queryInt(r, "offset", 0)
+	if err != nil {
+		return nil, err
+	}
+	limit, err := queryInt(r, "limit", 100)
+	if err != nil {
+		return nil, err
+	}
+	if h.MaxLimit > 0 && (limit == 0 || limit > h.MaxLimit) {
+		limit = h.MaxLimit
+	}
+	h.lib.RLock()
+	defer h.lib.RUnlock()
+	tl := h.lib.TrackList().Filter(q.Get("genre"), q.Get("artist"), q.Get("album")).Clone()
+	if key := q.Get("sort"); key != "" {
+		desc := q.Get("desc") == "true" || q.Get("desc") == "1"
+		err = tl.SortBy(key, desc)
+		if err != nil {
+			return nil, badRequest(err)
+		}
+	}
+	page := &TrackPage{Total: len(*tl), Offset: offset, Limit: limit}
+	if offset > len(*tl) {
+		offset = len(*tl)
+	}
+	end := offset + limit
+	if end > len(*tl) {
+		end = len(*tl)
+	}
+	page.Tracks = []*itunes.Track((*tl)[offset:end])
+	return page, nil
+}
+
+func (h *Handler) track(r *http.Request, idstr string) (interface{}, error) {
+	id, err := parseID(idstr)
+	if err != nil {
+		return nil, err
+	}
+	switch r.Method {
+	case http.MethodGet:
+		h.lib.RLock()
+		defer h.lib.RUnlock()
+		tr := h.lib.GetTrack(id)
+		if tr == nil {
+			return nil, ErrNotFound
+		}
+		return tr, nil
+	case http.MethodPatch:
+		// read the body before taking the lock, so that a slow client
+		// doesn't hold up everyone else; the fields it names are applied
+		// to a copy of the track once locked
+		var patch json.RawMessage
+		err = readJSON(r, &patch)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(patch, &itunes.Track{})
+		if err != nil {
+			return nil, badRequest(err)
+		}
+		return h.write(func() (interface{}, error) {
+			tr := h.lib.GetTrack(id)
+			if tr == nil {
+				return nil, ErrNotFound
+			}
+			orig := *tr
+			cur := *tr
+			err := json.Unmarshal(patch, &cur)
+			if err != nil {
+				return nil, badRequest(err)
+			}
+			if cur.PersistentID != tr.PersistentID {
+				return nil, badRequest(errors.New("persistent id can't be changed"))
+			}
+			h.lib.UpdateTrack(tr, &orig, &cur)
+			return tr, nil
+		})
+	}
+	return nil, ErrMethodNotAllowed
+}
+
+func (h *Handler) rating(r *http.Request, idstr string) (interface{}, error) {
+	id, err := parseID(idstr)
+	if err != nil {
+		return nil, err
+	}
+	if r.Method != http.MethodPut {
+		return nil, ErrMethodNotAllowed
+	}
+	var body struct {
+		Rating *int `json:"rating"`
+	}
+	err = readJSON(r, &body)
+	if err != nil {
+		return nil, err
+	}
+	if body.Rating == nil || *body.Rating < 0 || *body.Rating > 100 {
+		return nil, badRequest(errors.New("rating must be between 0 and 100"))
+	}
+	return h.write(func() (interface{}, error) {
+		tr := h.lib.GetTrack(id)
+		if tr == nil {
+			return nil, ErrNotFound
+		}
+		orig := *tr
+		cur := *tr
+		cur.Rating = uint8(*body.Rating)
+		h.lib.UpdateTrack(tr, &orig, &cur)
+		return tr, nil
+	})
+}
+
+type IndexEntry struct {
+	Name string `json:"name"`
+	Key string `json:"key"`
+	Artist string `json:"artist,omitempty"`
+}
+
+func (h *Handler) index(r *http.Request, kind string) (interface{}, error) {
+	if r.Method != http.MethodGet {
+		return nil, ErrMethodNotAllowed
+	}
+	q := r.URL.Query()
+	h.lib.RLock()
+	defer h.lib.RUnlock()
+	tl := h.lib.TrackList().Filter(q.Get("genre"), q.Get("artist"), "")
+	entries := []*IndexEntry{}
+	switch kind {
+	case "genres":
+		for _, v := range tl.Genres() {
+			entries = append(entries, &IndexEntry{Name: v[0], Key: v[1]})
+		}
+	case "artists":
+		for _, v := range tl.Artists() {
+			entries = append(entries, &IndexEntry{Name: v[0], Key: v[1]})
+		}
+	case "albums":
+		for _, v := range tl.Albums() {
+			entries = append(entries, &IndexEntry{Name: v[1], Key: v[2], Artist: v[0]})
+		}
+	}
+	return entries, nil
+}
+
+func (h *Handler) smart(r *http.Request) (interface{}, error) {
+	if r.Method != http.MethodPost {
+		return nil, ErrMethodNotAllowed
+	}
+	var body struct {
+		Info string `json:"info"`
+		Criteria string `json:"criteria"`
+	}
+	err := readJSON(r, &body)
+	if err != nil {
+		return nil, err
+	}
+	s, err := itunes.ParseSmartPlaylist([]byte(body.Info), []byte(body.Criteria))
+	if err != nil {
+		return nil, badRequest(err)
+	}
+	h.lib.RLock()
+	defer h.lib.RUnlock()
+	tl, err := h.lib.TrackList().SmartFilter(s, h.lib)
+	if err != nil {
+		return nil, badRequest(err)
+	}
+	return []*itunes.Track(*tl), nil
+}
@@ -74,43 +74,121 @@ type ArtworkItem struct {
 	URL *string `db:"ZURL"`
 }
 
-func (db *ArtworkDB) GetArtworkItem(id pid.PersistentID) (*ArtworkItem, error) {
-	qs := `
+const artworkItemColumns = `
 SELECT db.ZDBID,
        db.ZPERSISTENTID,
        src.ZURL,
-       img.ZHASHSTRING,
-       img.ZKIND,
-       c.ZWIDTH,
-       c.ZHEIGHT,
-       c.ZFORMAT
+       COALESCE(img.ZHASHSTRING, '') AS ZHASHSTRING,
+       COALESCE(img.ZKIND, 0) AS ZKIND,
+       COALESCE(c.ZWIDTH, 0) AS ZWIDTH,
+       COALESCE(c.ZHEIGHT, 0) AS ZHEIGHT,
+       COALESCE(c.ZFORMAT, 0) AS ZFORMAT
   FROM ZDATABASEITEMINFO db
   LEFT JOIN ZSOURCEINFO src ON db.ZSOURCEINFO = src.Z_PK
   LEFT JOIN ZIMAGEINFO img ON src.ZIMAGEINFO = img.Z_PK
-  LEFT JOIN ZCACHEITEM c ON src.ZIMAGEINFO = c.ZIMAGEINFO
- WHERE db.ZDBID = ?
-   AND db.ZPERSISTENTID = ?`
-	rows, err := db.db.Queryx(qs, db.libid, id)
+  LEFT JOIN ZCACHEITEM c ON src.ZIMAGEINFO = c.ZIMAGEINFO`
+
+func (db *ArtworkDB) queryItems(qs string, args ...interface{}) ([]*ArtworkItem, error) {
+	rows, err := db.db.Queryx(qs, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
+	items := []*ArtworkItem{}
 	for rows.Next() {
 		item := &ArtworkItem{}
 		err := rows.StructScan(item)
 		if err != nil {
 			return nil, err
 		}
-		return item, nil
+		items = append(items, item)
 	}
-	return nil, sql.ErrNoRows
+	return items, rows.Err()
 }
 
-func (db *ArtworkDB) GetArtworkFile(id pid.PersistentID) (string, error) {
-	item, err := db.GetArtworkItem(id)
+// GetArtworkItems returns every cached variant of a track's artwork,
+// largest first.  A track with a remote source that hasn't been cached
+// yet has a single item with no dimensions.
+func (db *ArtworkDB) GetArtworkItems(id pid.PersistentID) ([]*ArtworkItem, error) {
+	qs := artworkItemColumns + `
+ WHERE db.ZDBID = ?
+   AND db.ZPERSISTENTID = ?
+ ORDER BY c.ZWIDTH * c.ZHEIGHT DESC`
+	items, err := db.queryItems(qs, db.libid, id)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
+	if len(items) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return items, nil
+}
+
+// GetArtworkItem returns the largest cached variant of a track's artwork.
+func (db *ArtworkDB) GetArtworkItem(id pid.PersistentID) (*ArtworkItem, error) {
+	items, err := db.GetArtworkItems(id)
+	if err != nil {
+		return nil, err
+	}
+	return items[0], nil
+}
+
+// BestFit picks the smallest item that covers a size x size box, or the
+// largest item if none do.  Items without dimensions are skipped.
+func BestFit(items []*ArtworkItem, size int) *ArtworkItem {
+	var best, largest *ArtworkItem
+	for _, item := range items {
+		if item.Width <= 0 || item.Height <= 0 {
+			continue
+		}
+		if largest == nil || item.Width * item.Height > largest.Width * largest.Height {
+			largest = item
+		}
+		if int(item.Width) >= size || int(item.Height) >= size {
+			if best == nil || item.Width * item.Height < best.Width * best.Height {
+				best = item
+			}
+		}
+	}
+	if best != nil {
+		return best
+	}
+	return largest
+}
+
+// GetArtworkItemForSize returns the cached variant best suited to
+// displaying a track's artwork at size x size.
+func (db *ArtworkDB) GetArtworkItemForSize(id pid.PersistentID, size int) (*ArtworkItem, error) {
+	items, err := db.GetArtworkItems(id)
+	if err != nil {
+		return nil, err
+	}
+	item := BestFit(items, size)
+	if item == nil {
+		return nil, sql.ErrNoRows
+	}
+	return item, nil
+}
+
+// ListItems returns the persistent IDs of every item in the library that
+// has artwork, cached or remote.
+func (db *ArtworkDB) ListItems() ([]pid.PersistentID, error) {
+	qs := `
+SELECT DISTINCT db.ZPERSISTENTID
+  FROM ZDATABASEITEMINFO db
+  JOIN ZSOURCEINFO src ON db.ZSOURCEINFO = src.Z_PK
+ WHERE db.ZDBID = ?
+ ORDER BY db.ZPERSISTENTID`
+	ids := []pid.PersistentID{}
+	err := db.db.Select(&ids, qs, db.libid)
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// ItemFile returns where artworkd keeps the image of a cached item.
+func (db *ArtworkDB) ItemFile(item *ArtworkItem) (string, error) {
 	var ext string
 	switch item.Format.String() {
 	case "JPEG":
@@ -121,13 +199,21 @@ func (db *ArtworkDB) GetArtworkFile(id pid.PersistentID) (string, error) {
 		return "", errors.New("unknown format " + item.Format.String())
 	}
 	fn := filepath.Join(db.root, "artwork", fmt.Sprintf("%s_sk_%d_cid_1.%s", item.Hash, item.Kind, ext))
-	_, err = os.Stat(fn)
+	_, err := os.Stat(fn)
 	if err != nil {
 		return "", err
 	}
 	return fn, nil
 }
 
+func (db *ArtworkDB) GetArtworkFile(id pid.PersistentID) (string, error) {
+	item, err := db.GetArtworkItem(id)
+	if err != nil {
+		return "", err
+	}
+	return db.ItemFile(item)
+}
+
 func (db *ArtworkDB) GetArtworkURL(id pid.PersistentID) (string, error) {
 	item, err := db.GetArtworkItem(id)
 	if err != nil {
@@ -139,8 +225,43 @@ func (db *ArtworkDB) GetArtworkURL(id pid.PersistentID) (string, error) {
 	return *item.URL, nil
 }
 
+// GetArtworkURLs returns the distinct remote sources of a track's artwork.
+func (db *ArtworkDB) GetArtworkURLs(id pid.PersistentID) ([]string, error) {
+	items, err := db.GetArtworkItems(id)
+	if err != nil {
+		return nil, err
+	}
+	urls := []string{}
+	seen := map[string]bool{}
+	for _, item := range items {
+		if item.URL != nil && *item.URL != "" && !seen[*item.URL] {
+			seen[*item.URL] = true
+			urls = append(urls, *item.URL)
+		}
+	}
+	return urls, nil
+}
+
 func (db *ArtworkDB) GetJPEG(id pid.PersistentID) ([]byte, error) {
-	fn, err := db.GetArtworkFile(id)
+	item, err := db.GetArtworkItem(id)
+	if err != nil {
+		return nil, err
+	}
+	return db.ItemJPEG(item)
+}
+
+// GetJPEGForSize is like GetJPEG but reads the cached variant that best
+// fits a size x size box rather than the largest one.
+func (db *ArtworkDB) GetJPEGForSize(id pid.PersistentID, size int) ([]byte, error) {
+	item, err := db.GetArtworkItemForSize(id, size)
+	if err != nil {
+		return nil, err
+	}
+	return db.ItemJPEG(item)
+}
+
+func (db *ArtworkDB) ItemJPEG(item *ArtworkItem) ([]byte, error) {
+	fn, err := db.ItemFile(item)
 	if err != nil {
 		return nil, err
 	}
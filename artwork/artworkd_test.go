@@ -0,0 +1,259 @@
+package artwork
+
+import (
+	"bytes"
+	"database/sql"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+
+	"github.com/rclancey/itunes/persistentId"
+)
+
+const (
+	testLibID = pid.PersistentID(0x1000)
+	otherLibID = pid.PersistentID(0x2000)
+	formatJPEG = Format(0x4a504547)
+	formatPNG = Format(0x504e4766)
+)
+
+const artworkdSchema = `
+CREATE TABLE ZDATABASEITEMINFO (Z_PK INTEGER PRIMARY KEY, ZDBID INTEGER, ZPERSISTENTID INTEGER, ZSOURCEINFO INTEGER);
+CREATE TABLE ZSOURCEINFO (Z_PK INTEGER PRIMARY KEY, ZURL VARCHAR, ZIMAGEINFO INTEGER);
+CREATE TABLE ZIMAGEINFO (Z_PK INTEGER PRIMARY KEY, ZHASHSTRING VARCHAR, ZKIND INTEGER);
+CREATE TABLE ZCACHEITEM (Z_PK INTEGER PRIMARY KEY, ZIMAGEINFO INTEGER, ZWIDTH FLOAT, ZHEIGHT FLOAT, ZFORMAT INTEGER);
+`
+
+func writeImage(t *testing.T, fn string, size int, asPNG bool) {
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	buf := &bytes.Buffer{}
+	var err error
+	if asPNG {
+		err = png.Encode(buf, img)
+	} else {
+		err = jpeg.Encode(buf, img, nil)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(fn, buf.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestArtworkDB builds an artworkd database in a temporary home
+// directory:
+//   track 1: a 600px JPEG and a 100px PNG of the same image, from a URL
+//   track 2: a remote source that hasn't been cached
+//   track 4: in another library only
+func newTestArtworkDB(t *testing.T) *ArtworkDB {
+	home, err := ioutil.TempDir("", "artworkd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(home) })
+	root := filepath.Join(home, "Library", "Containers", "com.apple.AMPArtworkAgent", "Data", "Documents")
+	err = os.MkdirAll(filepath.Join(root, "artwork"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sqlx.Connect("sqlite3", filepath.Join(root, "artworkd.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stmts := []string{
+		artworkdSchema,
+		`INSERT INTO ZIMAGEINFO VALUES (1, 'abc', 2)`,
+		`INSERT INTO ZCACHEITEM VALUES (1, 1, 600, 600, ?)`,
+		`INSERT INTO ZCACHEITEM VALUES (2, 1, 100, 100, ?)`,
+		`INSERT INTO ZSOURCEINFO VALUES (1, 'http://example.com/1.jpg', 1)`,
+		`INSERT INTO ZSOURCEINFO VALUES (2, 'http://example.com/2.jpg', NULL)`,
+		`INSERT INTO ZDATABASEITEMINFO VALUES (1, ?, 1, 1)`,
+		`INSERT INTO ZDATABASEITEMINFO VALUES (2, ?, 2, 2)`,
+		`INSERT INTO ZDATABASEITEMINFO VALUES (3, ?, 4, 1)`,
+	}
+	args := [][]interface{}{
+		nil,
+		nil,
+		{formatJPEG},
+		{formatPNG},
+		nil,
+		nil,
+		{testLibID},
+		{testLibID},
+		{otherLibID},
+	}
+	for i, qs := range stmts {
+		_, err = db.Exec(qs, args[i]...)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+	writeImage(t, filepath.Join(root, "artwork", "abc_sk_2_cid_1.jpeg"), 600, false)
+	writeImage(t, filepath.Join(root, "artwork", "abc_sk_2_cid_1.png"), 100, true)
+	adb, err := NewArtworkDB(home, testLibID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { adb.Close() })
+	return adb
+}
+
+func TestGetArtworkItems(t *testing.T) {
+	db := newTestArtworkDB(t)
+	items, err := db.GetArtworkItems(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 {
+		t.Fatalf("got %d items, want 2", len(items))
+	}
+	if items[0].Width != 600 || items[1].Width != 100 {
+		t.Errorf("items not largest first: %v, %v", items[0].Width, items[1].Width)
+	}
+	if items[0].Format.String() != "JPEG" || items[1].Format.String() != "PNGf" {
+		t.Errorf("wrong formats %s, %s", items[0].Format, items[1].Format)
+	}
+	if items[0].Hash != "abc" || items[0].Kind != 2 {
+		t.Errorf("wrong hash or kind %q %d", items[0].Hash, items[0].Kind)
+	}
+
+	items, err = db.GetArtworkItems(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].Width != 0 || items[0].URL == nil {
+		t.Errorf("uncached remote artwork should be one item with a URL and no size")
+	}
+
+	for _, id := range []pid.PersistentID{3, 4} {
+		_, err = db.GetArtworkItems(id)
+		if err != sql.ErrNoRows {
+			t.Errorf("track %d: got %v, want sql.ErrNoRows", id, err)
+		}
+	}
+}
+
+func TestBestFit(t *testing.T) {
+	items := []*ArtworkItem{
+		{Width: 0, Height: 0},
+		{Width: 1200, Height: 1200},
+		{Width: 300, Height: 300},
+		{Width: 600, Height: 400},
+	}
+	tests := []struct {
+		size int
+		want float64
+	}{
+		{100, 300},
+		{300, 300},
+		{500, 600},
+		{1000, 1200},
+		{2000, 1200},
+	}
+	for _, test := range tests {
+		item := BestFit(items, test.size)
+		if item == nil || item.Width != test.want {
+			t.Errorf("BestFit(%d) = %v, want width %v", test.size, item, test.want)
+		}
+	}
+	if item := BestFit(items[:1], 100); item != nil {
+		t.Errorf("BestFit with no sized items = %v, want nil", item)
+	}
+	if item := BestFit(nil, 100); item != nil {
+		t.Errorf("BestFit(nil) = %v, want nil", item)
+	}
+}
+
+func TestGetArtworkItemForSize(t *testing.T) {
+	db := newTestArtworkDB(t)
+	tests := []struct {
+		size int
+		want float64
+	}{
+		{50, 100},
+		{100, 100},
+		{101, 600},
+		{1000, 600},
+	}
+	for _, test := range tests {
+		item, err := db.GetArtworkItemForSize(1, test.size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if item.Width != test.want {
+			t.Errorf("size %d: got width %v, want %v", test.size, item.Width, test.want)
+		}
+	}
+	_, err := db.GetArtworkItemForSize(2, 100)
+	if err != sql.ErrNoRows {
+		t.Errorf("uncached artwork: got %v, want sql.ErrNoRows", err)
+	}
+}
+
+func TestGetArtworkURLs(t *testing.T) {
+	db := newTestArtworkDB(t)
+	urls, err := db.GetArtworkURLs(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(urls) != 1 || urls[0] != "http://example.com/1.jpg" {
+		t.Errorf("got %v, want the one distinct url", urls)
+	}
+	urls, err = db.GetArtworkURLs(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(urls) != 1 || urls[0] != "http://example.com/2.jpg" {
+		t.Errorf("got %v for uncached artwork", urls)
+	}
+	_, err = db.GetArtworkURLs(3)
+	if err != sql.ErrNoRows {
+		t.Errorf("got %v, want sql.ErrNoRows", err)
+	}
+}
+
+func TestGetJPEGForSize(t *testing.T) {
+	db := newTestArtworkDB(t)
+	tests := []struct {
+		size int
+		want int
+	}{
+		// the png variant, converted
+		{64, 100},
+		{600, 600},
+	}
+	for _, test := range tests {
+		data, err := db.GetJPEGForSize(1, test.size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := jpeg.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("size %d: not a jpeg: %s", test.size, err)
+		}
+		if cfg.Width != test.want {
+			t.Errorf("size %d: got width %d, want %d", test.size, cfg.Width, test.want)
+		}
+	}
+	data, err := db.GetJPEG(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(data))
+	if err != nil || cfg.Width != 600 {
+		t.Errorf("GetJPEG should return the largest variant")
+	}
+	_, err = db.GetJPEGForSize(2, 100)
+	if err == nil {
+		t.Errorf("uncached artwork should fail")
+	}
+}
@@ -0,0 +1,189 @@
+package artwork
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/jpeg"
+	_ "image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dhowden/tag"
+
+	"github.com/rclancey/itunes/persistentId"
+)
+
+// PathResolver finds the media file of a track.
+type PathResolver func(id pid.PersistentID) (string, error)
+
+// toJPEG passes JPEG data through untouched and re-encodes anything else
+// image.Decode understands.
+func toJPEG(data []byte) ([]byte, error) {
+	if len(data) >= 2 && data[0] == 0xff && data[1] == 0xd8 {
+		return data, nil
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	err = jpeg.Encode(buf, img, &jpeg.Options{Quality: 75})
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// EmbeddedSource reads cover art stored in the tags of a track's media
+// file (ID3 APIC frames, MP4 covr atoms, FLAC pictures).
+type EmbeddedSource struct {
+	resolve PathResolver
+}
+
+func NewEmbeddedSource(resolve PathResolver) *EmbeddedSource {
+	return &EmbeddedSource{resolve}
+}
+
+func (src *EmbeddedSource) GetJPEG(id pid.PersistentID) ([]byte, error) {
+	fn, err := src.resolve(id)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m, err := tag.ReadFrom(f)
+	if err != nil {
+		return nil, err
+	}
+	pic := m.Picture()
+	if pic == nil || len(pic.Data) == 0 {
+		return nil, os.ErrNotExist
+	}
+	return toJPEG(pic.Data)
+}
+
+func (src *EmbeddedSource) Close() error {
+	return nil
+}
+
+var DefaultFolderImageNames = []string{
+	"cover.jpg",
+	"cover.jpeg",
+	"cover.png",
+	"folder.jpg",
+	"folder.jpeg",
+	"folder.png",
+	"front.jpg",
+	"front.png",
+	"album.jpg",
+	"albumart.jpg",
+}
+
+// FolderSource reads sidecar images from the directory a track's media
+// file is in.  Names are matched case insensitively, in order.
+type FolderSource struct {
+	resolve PathResolver
+	names []string
+}
+
+func NewFolderSource(resolve PathResolver, names ...string) *FolderSource {
+	if len(names) == 0 {
+		names = DefaultFolderImageNames
+	}
+	return &FolderSource{resolve, names}
+}
+
+func (src *FolderSource) GetJPEG(id pid.PersistentID) ([]byte, error) {
+	fn, err := src.resolve(id)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Dir(fn)
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	files := map[string]string{}
+	for _, info := range infos {
+		if !info.IsDir() {
+			files[strings.ToLower(info.Name())] = info.Name()
+		}
+	}
+	for _, name := range src.names {
+		real, ok := files[strings.ToLower(name)]
+		if !ok {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, real))
+		if err != nil {
+			return nil, err
+		}
+		return toJPEG(data)
+	}
+	return nil, os.ErrNotExist
+}
+
+func (src *FolderSource) Close() error {
+	return nil
+}
+
+// ChainSource tries each of its sources in turn and returns the first
+// artwork found.
+type ChainSource struct {
+	sources []ArtworkSource
+}
+
+func NewChainSource(sources ...ArtworkSource) *ChainSource {
+	return &ChainSource{sources}
+}
+
+func (src *ChainSource) GetJPEG(id pid.PersistentID) ([]byte, error) {
+	var err error = os.ErrNotExist
+	for _, s := range src.sources {
+		var data []byte
+		data, err = s.GetJPEG(id)
+		if err == nil {
+			return data, nil
+		}
+	}
+	return nil, err
+}
+
+func (src *ChainSource) Close() error {
+	errs := []string{}
+	for _, s := range src.sources {
+		err := s.Close()
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// NewFileArtworkSource chains the iTunes artwork stores, when they exist,
+// with embedded and folder artwork, so that artwork still works for
+// libraries copied away from the machine they were made on.
+func NewFileArtworkSource(homedir string, libid pid.PersistentID, resolve PathResolver) ArtworkSource {
+	sources := []ArtworkSource{}
+	if homedir != "" {
+		db, err := NewArtworkDB(homedir, libid)
+		if err == nil {
+			sources = append(sources, db)
+		}
+		itc, err := NewItunesSource(homedir, libid)
+		if err == nil {
+			sources = append(sources, itc)
+		}
+	}
+	sources = append(sources, NewEmbeddedSource(resolve), NewFolderSource(resolve))
+	return NewChainSource(sources...)
+}
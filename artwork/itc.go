@@ -202,7 +202,7 @@ func (item *Item) ParsePNG() (image.Image, error) {
 
 func (item *Item) ParseJPEG() (image.Image, error) {
 	buf := bytes.NewBuffer(item.Data)
-	return png.Decode(buf)
+	return jpeg.Decode(buf)
 }
 
 func (item *Item) ParseARGB() (image.Image, error) {
@@ -0,0 +1,195 @@
+package artwork
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/rclancey/itunes/persistentId"
+)
+
+const itchSize = 8 + 12 + 8 + 256
+
+// NewItemFromImage builds an item for a track's artwork, encoding img as
+// format (FormatPNG, FormatJPEG or FormatARGB).  layout is Itunes9 or
+// ItunesOld.
+func NewItemFromImage(libid, trackid pid.PersistentID, img image.Image, format string, layout uint32) (*Item, error) {
+	if layout != Itunes9 && layout != ItunesOld {
+		return nil, fmt.Errorf("unknown itc layout %d", layout)
+	}
+	b := img.Bounds()
+	item := &Item{
+		Offset: layout,
+		LibraryID: uint64(libid),
+		TrackID: uint64(trackid),
+		Method: MethodLocal,
+		Format: format,
+		Width: b.Dx(),
+		Height: b.Dy(),
+	}
+	buf := &bytes.Buffer{}
+	switch format {
+	case FormatPNG:
+		err := png.Encode(buf, img)
+		if err != nil {
+			return nil, err
+		}
+	case FormatJPEG:
+		err := jpeg.Encode(buf, img, &jpeg.Options{Quality: 90})
+		if err != nil {
+			return nil, err
+		}
+	case FormatARGB:
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+				buf.Write([]byte{c.A, c.R, c.G, c.B})
+			}
+		}
+	default:
+		return nil, errors.New("unknown image format " + format)
+	}
+	item.Data = buf.Bytes()
+	return item, nil
+}
+
+func (item *Item) preambleSize() int {
+	if item.Offset == ItunesOld {
+		return 20
+	}
+	return 16
+}
+
+// WriteTo encodes the item frame.  Offset selects the layout; the
+// preamble is written back as read when the item came from a file.
+func (item *Item) WriteTo(w io.Writer) (int64, error) {
+	if item.Offset != Itunes9 && item.Offset != ItunesOld {
+		return 0, fmt.Errorf("unknown itc layout %d", item.Offset)
+	}
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.BigEndian, uint32(int(item.Offset) + len(item.Data)))
+	buf.WriteString("item")
+	binary.Write(buf, binary.BigEndian, item.Offset)
+	preamble := make([]byte, item.preambleSize())
+	copy(preamble, item.Preamble)
+	buf.Write(preamble)
+	binary.Write(buf, binary.BigEndian, item.LibraryID)
+	binary.Write(buf, binary.BigEndian, item.TrackID)
+	method := []byte(MethodLocal)
+	if len(item.Method) == 4 {
+		method = []byte(item.Method)
+	}
+	buf.Write(method)
+	var format [4]byte
+	switch {
+	case item.Offset == Itunes9 && item.Format == FormatPNG:
+		format[3] = 0x0e
+	case item.Offset == Itunes9 && item.Format == FormatJPEG:
+		format[3] = 0x0d
+	case len(item.Format) == 4:
+		copy(format[:], item.Format)
+	default:
+		return 0, errors.New("unknown image format " + item.Format)
+	}
+	buf.Write(format[:])
+	buf.Write(make([]byte, 4))
+	binary.Write(buf, binary.BigEndian, uint32(item.Width))
+	binary.Write(buf, binary.BigEndian, uint32(item.Height))
+	if buf.Len() > int(item.Offset) {
+		return 0, errors.New("itc item header overflow")
+	}
+	buf.Write(make([]byte, int(item.Offset) - buf.Len()))
+	buf.Write(item.Data)
+	n, err := w.Write(buf.Bytes())
+	return int64(n), err
+}
+
+// WriteITC writes a complete .itc file holding items.
+func WriteITC(w io.Writer, items ...*Item) error {
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.BigEndian, uint32(itchSize))
+	buf.WriteString("itch")
+	buf.Write([]byte{0, 0, 0, 0, 0, 0, 0, 2, 0, 0, 0, 0})
+	binary.Write(buf, binary.BigEndian, uint32(itchSize - 20))
+	buf.WriteString("artw")
+	buf.Write(make([]byte, 256))
+	_, err := w.Write(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		_, err = item.WriteTo(w)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ITCPath is where iTunes caches the artwork of a track under root, the
+// per-library folder of its Album Artwork cache.
+func ITCPath(root string, libid, id pid.PersistentID) string {
+	idbytes := []byte(id.String())
+	n := len(idbytes) - 1
+	return filepath.Join(
+		root,
+		fmt.Sprintf("%02d", idbytes[n]),
+		fmt.Sprintf("%02d", idbytes[n-1]),
+		fmt.Sprintf("%02d", idbytes[n-2]),
+		fmt.Sprintf("%s-%s.itc", libid, id),
+	)
+}
+
+// CreateItunesSource is like NewItunesSource but creates the cache folder
+// if it doesn't exist yet.
+func CreateItunesSource(homedir string, libid pid.PersistentID) (*ItunesSource, error) {
+	root := itunesCacheRoot(homedir, libid)
+	err := os.MkdirAll(root, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &ItunesSource{root: root, libid: libid}, nil
+}
+
+// PutItems replaces the cached artwork of a track.
+func (src *ItunesSource) PutItems(id pid.PersistentID, items ...*Item) error {
+	fn := ITCPath(src.root, src.libid, id)
+	err := os.MkdirAll(filepath.Dir(fn), 0755)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(fn), ".itc")
+	if err != nil {
+		return err
+	}
+	err = WriteITC(tmp, items...)
+	cerr := tmp.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	os.Chmod(tmp.Name(), 0644)
+	return os.Rename(tmp.Name(), fn)
+}
+
+// PutImage caches img as a track's artwork in the layout used by iTunes 9
+// and later.
+func (src *ItunesSource) PutImage(id pid.PersistentID, img image.Image, format string) error {
+	item, err := NewItemFromImage(src.libid, id, img, format, Itunes9)
+	if err != nil {
+		return err
+	}
+	return src.PutItems(id, item)
+}
@@ -0,0 +1,123 @@
+package artwork
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+)
+
+// FitSize returns the dimensions of a w x h image scaled down to fit in a
+// size x size box, keeping its aspect ratio.  Images are never enlarged.
+func FitSize(w, h, size int) (int, int) {
+	if size <= 0 || (w <= size && h <= size) {
+		return w, h
+	}
+	if w >= h {
+		nh := int(math.Round(float64(h) * float64(size) / float64(w)))
+		if nh < 1 {
+			nh = 1
+		}
+		return size, nh
+	}
+	nw := int(math.Round(float64(w) * float64(size) / float64(h)))
+	if nw < 1 {
+		nw = 1
+	}
+	return nw, size
+}
+
+// Resize scales img down to fit in a size x size box.  Each output pixel
+// is the area weighted average of the source pixels it covers, which
+// avoids the aliasing of nearest neighbour scaling on large reductions.
+func Resize(img image.Image, size int) image.Image {
+	b := img.Bounds()
+	w, h := FitSize(b.Dx(), b.Dy(), size)
+	if w == b.Dx() && h == b.Dy() {
+		return img
+	}
+	src := image.NewNRGBA64(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	// resample rows, then columns, in premultiplied floating point
+	tmp := make([]float64, w * b.Dy() * 4)
+	xw := resampleWeights(b.Dx(), w)
+	for y := 0; y < b.Dy(); y++ {
+		for x, ws := range xw {
+			var px [4]float64
+			for _, cw := range ws {
+				addPixel(&px, src.NRGBA64At(cw.idx, y), cw.weight)
+			}
+			copy(tmp[(y * w + x) * 4:], px[:])
+		}
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	yw := resampleWeights(b.Dy(), h)
+	for y, ws := range yw {
+		for x := 0; x < w; x++ {
+			var px [4]float64
+			for _, cw := range ws {
+				i := (cw.idx * w + x) * 4
+				for c := 0; c < 4; c++ {
+					px[c] += tmp[i + c] * cw.weight
+				}
+			}
+			dst.SetNRGBA(x, y, unpremultiply(px))
+		}
+	}
+	return dst
+}
+
+type coverage struct {
+	idx int
+	weight float64
+}
+
+// resampleWeights works out, for each of n output samples, how much of
+// each of the m input samples falls inside it.
+func resampleWeights(m, n int) [][]coverage {
+	scale := float64(m) / float64(n)
+	out := make([][]coverage, n)
+	for i := range out {
+		lo := float64(i) * scale
+		hi := lo + scale
+		ws := []coverage{}
+		for j := int(lo); j < m && float64(j) < hi; j++ {
+			w := math.Min(hi, float64(j + 1)) - math.Max(lo, float64(j))
+			if w > 0 {
+				ws = append(ws, coverage{j, w / scale})
+			}
+		}
+		out[i] = ws
+	}
+	return out
+}
+
+func addPixel(px *[4]float64, c color.NRGBA64, weight float64) {
+	a := float64(c.A) / 0xffff
+	px[0] += float64(c.R) / 0xffff * a * weight
+	px[1] += float64(c.G) / 0xffff * a * weight
+	px[2] += float64(c.B) / 0xffff * a * weight
+	px[3] += a * weight
+}
+
+func unpremultiply(px [4]float64) color.NRGBA {
+	a := px[3]
+	if a <= 0 {
+		return color.NRGBA{}
+	}
+	ch := func(v float64) uint8 {
+		v = v / a * 255
+		if v > 255 {
+			v = 255
+		}
+		if v < 0 {
+			v = 0
+		}
+		return uint8(v + 0.5)
+	}
+	alpha := a * 255
+	if alpha > 255 {
+		alpha = 255
+	}
+	return color.NRGBA{ch(px[0]), ch(px[1]), ch(px[2]), uint8(alpha + 0.5)}
+}
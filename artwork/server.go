@@ -0,0 +1,274 @@
+package artwork
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rclancey/itunes/persistentId"
+)
+
+// Server serves artwork at Prefix + persistent ID, optionally scaled with
+// ?size=N.  JPEG is served unless the client prefers PNG, either through
+// ?format=png or its Accept header.
+type Server struct {
+	src ArtworkSource
+	thumbs *ThumbnailCache
+	// Prefix is stripped from the request path before the ID is parsed.
+	Prefix string
+	// MaxSize caps the size parameter.
+	MaxSize int
+	// Placeholder serves a plain square instead of a 404 when a track
+	// has no artwork.  Errors reading artwork are still reported as
+	// errors, so clients don't cache the placeholder in its place.
+	Placeholder bool
+	// MaxAge is sent in the Cache-Control header of real artwork.
+	MaxAge time.Duration
+	sem chan bool
+	seen map[string]time.Time
+	mutex sync.Mutex
+}
+
+// NewServer serves images from src.  When thumbs is not nil scaled images
+// come from it.  At most concurrency images are fetched and scaled at a
+// time.
+func NewServer(src ArtworkSource, thumbs *ThumbnailCache, concurrency int) *Server {
+	if concurrency <= 0 {
+		concurrency = 4
+	}
+	return &Server{
+		src: src,
+		thumbs: thumbs,
+		Prefix: "/artwork/",
+		MaxSize: 2048,
+		Placeholder: true,
+		MaxAge: 24 * time.Hour,
+		sem: make(chan bool, concurrency),
+		seen: map[string]time.Time{},
+	}
+}
+
+// negotiateFormat picks PNG only when the client asks for it by name or
+// ranks it above JPEG.  Anything else, WebP included, gets JPEG.
+func negotiateFormat(r *http.Request) string {
+	switch strings.ToLower(r.URL.Query().Get("format")) {
+	case "png":
+		return FormatPNG
+	case "jpeg", "jpg":
+		return FormatJPEG
+	}
+	pngQ := -1.0
+	jpegQ := -1.0
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		fields := strings.Split(part, ";")
+		mime := strings.TrimSpace(fields[0])
+		q := 1.0
+		for _, f := range fields[1:] {
+			f = strings.TrimSpace(f)
+			if strings.HasPrefix(f, "q=") {
+				q, _ = strconv.ParseFloat(f[2:], 64)
+			}
+		}
+		switch mime {
+		case "image/png":
+			pngQ = q
+		case "image/jpeg":
+			jpegQ = q
+		}
+	}
+	if pngQ > 0 && pngQ > jpegQ {
+		return FormatPNG
+	}
+	return FormatJPEG
+}
+
+func contentType(format string) string {
+	if format == FormatPNG {
+		return "image/png"
+	}
+	return "image/jpeg"
+}
+
+func (s *Server) acquire(r *http.Request) bool {
+	select {
+	case s.sem <- true:
+		return true
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+func (s *Server) release() {
+	<-s.sem
+}
+
+func hashETag(data []byte, suffix string) string {
+	sum := sha1.Sum(data)
+	return `"` + hex.EncodeToString(sum[:10]) + suffix + `"`
+}
+
+// etagMatch reports whether an If-None-Match header lists etag.
+func etagMatch(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == etag || tag == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// image returns the artwork to serve and its ETag.  Without a thumbnail
+// cache the ETag comes from the original image, so that when it matches
+// ifNoneMatch the image isn't scaled at all and nil data is returned.
+func (s *Server) image(id pid.PersistentID, size int, format string, ifNoneMatch string) ([]byte, string, error) {
+	if s.thumbs != nil {
+		data, err := s.thumbs.GetThumbnail(id, size, format)
+		if err != nil {
+			return nil, "", err
+		}
+		return data, hashETag(data, ""), nil
+	}
+	data, err := s.src.GetJPEG(id)
+	if err != nil {
+		return nil, "", err
+	}
+	if size == 0 && format == FormatJPEG {
+		return data, hashETag(data, ""), nil
+	}
+	etag := hashETag(data, "-" + strconv.Itoa(size) + "-" + format)
+	if ifNoneMatch != "" && etagMatch(ifNoneMatch, etag) {
+		return nil, etag, nil
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+	img = Resize(img, size)
+	buf := &bytes.Buffer{}
+	if format == FormatPNG {
+		err = png.Encode(buf, img)
+	} else {
+		err = encodeJPEG(buf, img)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), etag, nil
+}
+
+// notFound tells a track without artwork from a failure to read it.
+func notFound(err error) bool {
+	return errors.Is(err, os.ErrNotExist) || errors.Is(err, sql.ErrNoRows)
+}
+
+// modTime is when the server first served a particular image, which is
+// the best it can do for Last-Modified without timestamps from sources.
+func (s *Server) modTime(etag string) time.Time {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	t, ok := s.seen[etag]
+	if !ok {
+		if len(s.seen) >= 100000 {
+			s.seen = map[string]time.Time{}
+		}
+		t = time.Now().Truncate(time.Second)
+		s.seen[etag] = t
+	}
+	return t
+}
+
+func encodeJPEG(w io.Writer, img image.Image) error {
+	return jpeg.Encode(w, img, &jpeg.Options{Quality: 85})
+}
+
+func placeholder(size int, format string) []byte {
+	if size <= 0 {
+		size = 256
+	}
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.RGBA{0xcc, 0xcc, 0xcc, 0xff}), image.Point{}, draw.Src)
+	buf := &bytes.Buffer{}
+	if format == FormatPNG {
+		png.Encode(buf, img)
+	} else {
+		encodeJPEG(buf, img)
+	}
+	return buf.Bytes()
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	idstr := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, s.Prefix), "/")
+	var id pid.PersistentID
+	err := (&id).Decode(idstr)
+	if err != nil || idstr == "" || strings.Contains(idstr, "/") {
+		http.Error(w, "invalid persistent id", http.StatusBadRequest)
+		return
+	}
+	size := 0
+	if sizestr := r.URL.Query().Get("size"); sizestr != "" {
+		size, err = strconv.Atoi(sizestr)
+		if err != nil || size < 0 {
+			http.Error(w, "invalid size", http.StatusBadRequest)
+			return
+		}
+		if s.MaxSize > 0 && size > s.MaxSize {
+			size = s.MaxSize
+		}
+	}
+	format := negotiateFormat(r)
+	w.Header().Set("Vary", "Accept")
+	if !s.acquire(r) {
+		http.Error(w, "request cancelled", http.StatusServiceUnavailable)
+		return
+	}
+	data, etag, err := s.image(id, size, format, r.Header.Get("If-None-Match"))
+	s.release()
+	if err != nil && !notFound(err) {
+		log.Println("error reading artwork", id, err)
+		http.Error(w, "error reading artwork", http.StatusInternalServerError)
+		return
+	}
+	if err != nil {
+		if !s.Placeholder {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", contentType(format))
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		w.Header().Set("X-Artwork-Placeholder", "true")
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			w.Write(placeholder(size, format))
+		}
+		return
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Content-Type", contentType(format))
+	w.Header().Set("Cache-Control", "public, max-age=" + strconv.Itoa(int(s.MaxAge.Seconds())))
+	if data == nil {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	http.ServeContent(w, r, "", s.modTime(etag), bytes.NewReader(data))
+}
@@ -3,7 +3,6 @@ package artwork
 import (
 	"bytes"
 	"errors"
-	"fmt"
 	"io"
 	"os"
 	"path/filepath"
@@ -31,8 +30,8 @@ type ItunesSource struct {
 	libid pid.PersistentID
 }
 
-func NewItunesSource(homedir string, libid pid.PersistentID) (*ItunesSource, error) {
-	root := filepath.Join(
+func itunesCacheRoot(homedir string, libid pid.PersistentID) string {
+	return filepath.Join(
 		homedir,
 		"Music",
 		"iTunes",
@@ -40,6 +39,10 @@ func NewItunesSource(homedir string, libid pid.PersistentID) (*ItunesSource, err
 		"Cache",
 		libid.String(),
 	)
+}
+
+func NewItunesSource(homedir string, libid pid.PersistentID) (*ItunesSource, error) {
+	root := itunesCacheRoot(homedir, libid)
 	_, err := os.Stat(root)
 	if err != nil {
 		return nil, err
@@ -48,15 +51,7 @@ func NewItunesSource(homedir string, libid pid.PersistentID) (*ItunesSource, err
 }
 
 func (src *ItunesSource) GetJPEG(id pid.PersistentID) ([]byte, error) {
-	idbytes := []byte(id.String())
-	n := len(idbytes) - 1
-	fn := filepath.Join(
-		src.root,
-		fmt.Sprintf("%02d", idbytes[n]),
-		fmt.Sprintf("%02d", idbytes[n-1]),
-		fmt.Sprintf("%02d", idbytes[n-2]),
-		fmt.Sprintf("%s-%s.itc", src.libid, id),
-	)
+	fn := ITCPath(src.root, src.libid, id)
 	f, err := os.Open(fn)
 	if err != nil {
 		return nil, err
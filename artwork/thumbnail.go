@@ -0,0 +1,176 @@
+package artwork
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rclancey/itunes/persistentId"
+)
+
+var ErrUnknownThumbnailFormat = errors.New("unknown thumbnail format")
+
+type cachedSource struct {
+	hash string
+	checked time.Time
+}
+
+// ThumbnailCache scales artwork from another source and keeps the results
+// on disk.  Files are keyed by persistent ID, size and a hash of the
+// original image, so replaced artwork is picked up once the source is
+// checked again.
+type ThumbnailCache struct {
+	src ArtworkSource
+	dir string
+	// Quality is the JPEG quality of generated thumbnails.
+	Quality int
+	// Recheck is how long the hash of an original is trusted before the
+	// source is asked for it again.
+	Recheck time.Duration
+	hashes map[pid.PersistentID]*cachedSource
+	mutex sync.Mutex
+}
+
+func NewThumbnailCache(src ArtworkSource, dir string) (*ThumbnailCache, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &ThumbnailCache{
+		src: src,
+		dir: dir,
+		Quality: 85,
+		Recheck: time.Hour,
+		hashes: map[pid.PersistentID]*cachedSource{},
+	}, nil
+}
+
+func (c *ThumbnailCache) GetJPEG(id pid.PersistentID) ([]byte, error) {
+	return c.src.GetJPEG(id)
+}
+
+func (c *ThumbnailCache) Close() error {
+	return c.src.Close()
+}
+
+// Invalidate forgets the hash of id's original, so that the next request
+// goes back to the source.
+func (c *ThumbnailCache) Invalidate(id pid.PersistentID) {
+	c.mutex.Lock()
+	delete(c.hashes, id)
+	c.mutex.Unlock()
+}
+
+func (c *ThumbnailCache) path(id pid.PersistentID, size int, hash string, format string) string {
+	ext := ".jpg"
+	if format == FormatPNG {
+		ext = ".png"
+	}
+	s := id.String()
+	return filepath.Join(c.dir, s[len(s)-2:], fmt.Sprintf("%s-%d-%s%s", s, size, hash, ext))
+}
+
+func (c *ThumbnailCache) original(id pid.PersistentID) (string, []byte, error) {
+	c.mutex.Lock()
+	cs, ok := c.hashes[id]
+	c.mutex.Unlock()
+	if ok && time.Since(cs.checked) < c.Recheck {
+		return cs.hash, nil, nil
+	}
+	data, err := c.src.GetJPEG(id)
+	if err != nil {
+		return "", nil, err
+	}
+	sum := sha1.Sum(data)
+	hash := hex.EncodeToString(sum[:8])
+	c.mutex.Lock()
+	c.hashes[id] = &cachedSource{hash, time.Now()}
+	c.mutex.Unlock()
+	return hash, data, nil
+}
+
+// GetThumbnail returns id's artwork scaled to fit in a size x size box,
+// encoded as FormatJPEG or FormatPNG.  A size of 0 keeps the original
+// dimensions.
+func (c *ThumbnailCache) GetThumbnail(id pid.PersistentID, size int, format string) ([]byte, error) {
+	if format != FormatJPEG && format != FormatPNG {
+		return nil, ErrUnknownThumbnailFormat
+	}
+	hash, data, err := c.original(id)
+	if err != nil {
+		return nil, err
+	}
+	fn := c.path(id, size, hash, format)
+	thumb, err := ioutil.ReadFile(fn)
+	if err == nil {
+		return thumb, nil
+	}
+	if data == nil {
+		// not cached at this size yet, so the original is needed
+		c.Invalidate(id)
+		hash, data, err = c.original(id)
+		if err != nil {
+			return nil, err
+		}
+		fn = c.path(id, size, hash, format)
+	}
+	thumb, err = c.makeThumbnail(data, size, format)
+	if err != nil {
+		return nil, err
+	}
+	err = writeAtomic(fn, thumb)
+	if err != nil {
+		return nil, err
+	}
+	return thumb, nil
+}
+
+func (c *ThumbnailCache) makeThumbnail(data []byte, size int, format string) ([]byte, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	img = Resize(img, size)
+	buf := &bytes.Buffer{}
+	if format == FormatPNG {
+		err = png.Encode(buf, img)
+	} else {
+		err = jpeg.Encode(buf, img, &jpeg.Options{Quality: c.Quality})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeAtomic(fn string, data []byte) error {
+	err := os.MkdirAll(filepath.Dir(fn), 0755)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(fn), ".thumb")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	cerr := tmp.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	os.Chmod(tmp.Name(), 0644)
+	return os.Rename(tmp.Name(), fn)
+}
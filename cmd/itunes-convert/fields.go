@@ -0,0 +1,119 @@
+package main
+
+import (
+	"path"
+	"reflect"
+	"strings"
+	"unicode"
+
+	"github.com/rclancey/itunes/loader"
+)
+
+var mediaKinds = []string{
+	"music",
+	"movie",
+	"tvshow",
+	"podcast",
+	"musicvideo",
+	"audiobook",
+	"video",
+}
+
+func validKind(kind string) bool {
+	for _, k := range mediaKinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// mediaKind classifies a track the same way Library.Load decides which
+// tracks aren't music.
+func mediaKind(tr *loader.Track) string {
+	switch {
+	case tr.GetMusicVideo():
+		return "musicvideo"
+	case tr.GetPodcast():
+		return "podcast"
+	case tr.GetMovie():
+		return "movie"
+	case tr.GetTVShow():
+		return "tvshow"
+	case tr.GetHasVideo():
+		return "video"
+	case path.Ext(tr.GetLocation()) == ".m4b":
+		return "audiobook"
+	}
+	return "music"
+}
+
+// mergeLibrary copies the fields set in src into dst.  Loaders send the
+// library header more than once as they learn more about it.
+func mergeLibrary(dst, src *loader.Library) {
+	dv := reflect.ValueOf(dst).Elem()
+	sv := reflect.ValueOf(src).Elem()
+	for i := 0; i < sv.NumField(); i++ {
+		if !sv.Field(i).IsNil() {
+			dv.Field(i).Set(sv.Field(i))
+		}
+	}
+}
+
+type field struct {
+	Name string
+	Key string
+	Value reflect.Value
+}
+
+// fields returns the set fields of a loader struct, dereferenced, with
+// the key iTunes uses for each in its XML.  The parsed smart playlist is
+// left out; its raw info and criteria are kept.
+func fields(obj interface{}) []field {
+	rv := reflect.ValueOf(obj).Elem()
+	rt := rv.Type()
+	fs := []field{}
+	for i := 0; i < rt.NumField(); i++ {
+		rf := rt.Field(i)
+		if rf.Name == "Smart" {
+			continue
+		}
+		v := rv.Field(i)
+		if v.IsNil() {
+			continue
+		}
+		if v.Kind() == reflect.Ptr {
+			v = v.Elem()
+		}
+		fs = append(fs, field{rf.Name, fieldKey(rf), v})
+	}
+	return fs
+}
+
+func fieldKey(rf reflect.StructField) string {
+	if tag := strings.Split(rf.Tag.Get("plist"), ",")[0]; tag != "" {
+		return tag
+	}
+	return splitWords(rf.Name)
+}
+
+// splitWords turns a field name like TVShow or PersistentID into
+// "TV Show" or "Persistent ID".
+func splitWords(name string) string {
+	rs := []rune(name)
+	var b strings.Builder
+	for i, r := range rs {
+		if i > 0 && unicode.IsUpper(r) {
+			prev := rs[i-1]
+			if unicode.IsLower(prev) || (unicode.IsUpper(prev) && i + 1 < len(rs) && unicode.IsLower(rs[i+1])) {
+				b.WriteByte(' ')
+			}
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func columnName(rf reflect.StructField) string {
+	return strings.ToLower(strings.Replace(splitWords(rf.Name), " ", "_", -1))
+}
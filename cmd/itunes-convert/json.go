@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+
+	"github.com/rclancey/itunes/loader"
+)
+
+func record(obj interface{}) map[string]interface{} {
+	rec := map[string]interface{}{}
+	for _, f := range fields(obj) {
+		rec[f.Name] = f.Value.Interface()
+	}
+	return rec
+}
+
+// jsonWriter collects the library and writes it as a single document.
+type jsonWriter struct {
+	out io.WriteCloser
+	pretty bool
+	lib map[string]interface{}
+	tracks []map[string]interface{}
+	playlists []map[string]interface{}
+}
+
+func newJSONWriter(out io.WriteCloser, pretty bool) *jsonWriter {
+	return &jsonWriter{
+		out: out,
+		pretty: pretty,
+		tracks: []map[string]interface{}{},
+		playlists: []map[string]interface{}{},
+	}
+}
+
+func (w *jsonWriter) Library(lib *loader.Library) error {
+	w.lib = record(lib)
+	return nil
+}
+
+func (w *jsonWriter) Track(tr *loader.Track) error {
+	w.tracks = append(w.tracks, record(tr))
+	return nil
+}
+
+func (w *jsonWriter) Playlist(pl *loader.Playlist) error {
+	w.playlists = append(w.playlists, record(pl))
+	return nil
+}
+
+func (w *jsonWriter) Close() error {
+	defer w.out.Close()
+	enc := json.NewEncoder(w.out)
+	enc.SetEscapeHTML(false)
+	if w.pretty {
+		enc.SetIndent("", "  ")
+	}
+	return enc.Encode(map[string]interface{}{
+		"Library": w.lib,
+		"Tracks": w.tracks,
+		"Playlists": w.playlists,
+	})
+}
+
+func (w *jsonWriter) Abort() error {
+	return w.out.Close()
+}
+
+// jsonLinesWriter writes one object per line as records arrive, each
+// wrapped in an object keyed by its type: {"track": {...}}.
+type jsonLinesWriter struct {
+	out io.WriteCloser
+	w *bufio.Writer
+	enc *json.Encoder
+}
+
+func newJSONLinesWriter(out io.WriteCloser) *jsonLinesWriter {
+	w := bufio.NewWriter(out)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return &jsonLinesWriter{out: out, w: w, enc: enc}
+}
+
+func (w *jsonLinesWriter) write(kind string, obj interface{}) error {
+	return w.enc.Encode(map[string]interface{}{kind: record(obj)})
+}
+
+func (w *jsonLinesWriter) Library(lib *loader.Library) error {
+	return w.write("library", lib)
+}
+
+func (w *jsonLinesWriter) Track(tr *loader.Track) error {
+	return w.write("track", tr)
+}
+
+func (w *jsonLinesWriter) Playlist(pl *loader.Playlist) error {
+	return w.write("playlist", pl)
+}
+
+func (w *jsonLinesWriter) Close() error {
+	defer w.out.Close()
+	return w.w.Flush()
+}
+
+func (w *jsonLinesWriter) Abort() error {
+	return w.out.Close()
+}
@@ -0,0 +1,212 @@
+// Command itunes-convert reads an iTunes or Music library in any format
+// the loaders understand (.itl, .musicdb or .xml) and writes it out as
+// JSON, an iTunes style XML plist or an SQLite database.
+package main
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rclancey/itunes"
+	"github.com/rclancey/itunes/loader"
+	"github.com/rclancey/itunes/persistentId"
+)
+
+type writer interface {
+	Library(lib *loader.Library) error
+	Track(tr *loader.Track) error
+	Playlist(pl *loader.Playlist) error
+	Close() error
+	// Abort gives up on the output after an error, without finishing it
+	Abort() error
+}
+
+type options struct {
+	input string
+	output string
+	format string
+	kinds map[string]bool
+	pretty bool
+	stream bool
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s [flags] library-file\n\n", filepath.Base(os.Args[0]))
+	fmt.Fprintf(os.Stderr, "Converts an iTunes library (.itl, .musicdb or .xml) to JSON, XML or SQLite.\n\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	opts := &options{}
+	var kinds string
+	flag.StringVar(&opts.output, "o", "-", "output file, - for standard output")
+	flag.StringVar(&opts.format, "format", "", "output format: json, xml or sqlite (default from the -o extension, else json)")
+	flag.StringVar(&kinds, "kinds", "", "comma separated media kinds to include: " + strings.Join(mediaKinds, ", ") + " (default all)")
+	flag.BoolVar(&opts.pretty, "pretty", false, "indent the output")
+	flag.BoolVar(&opts.stream, "stream", false, "write records as they are read instead of collecting the whole library first")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 1 {
+		usage()
+		os.Exit(2)
+	}
+	opts.input = flag.Arg(0)
+	if opts.format == "" {
+		opts.format = formatFor(opts.output)
+	}
+	if kinds != "" {
+		opts.kinds = map[string]bool{}
+		for _, k := range strings.Split(kinds, ",") {
+			k = strings.ToLower(strings.TrimSpace(k))
+			if !validKind(k) {
+				fmt.Fprintf(os.Stderr, "unknown media kind %q\n", k)
+				os.Exit(2)
+			}
+			opts.kinds[k] = true
+		}
+	}
+	err := convert(opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "itunes-convert:", err)
+		os.Exit(1)
+	}
+}
+
+func formatFor(fn string) string {
+	switch strings.ToLower(filepath.Ext(fn)) {
+	case ".xml", ".plist":
+		return "xml"
+	case ".db", ".sqlite", ".sqlite3":
+		return "sqlite"
+	}
+	return "json"
+}
+
+func newWriter(opts *options) (writer, error) {
+	if opts.format == "sqlite" {
+		if opts.output == "-" {
+			return nil, errors.New("sqlite output needs a file name (-o)")
+		}
+		return newSQLiteWriter(opts.output)
+	}
+	if opts.format != "json" && opts.format != "xml" {
+		return nil, errors.Errorf("unknown output format %q", opts.format)
+	}
+	var out io.WriteCloser = os.Stdout
+	if opts.output != "-" {
+		f, err := os.Create(opts.output)
+		if err != nil {
+			return nil, errors.Wrap(err, "can't create output file")
+		}
+		out = f
+	}
+	switch opts.format {
+	case "json":
+		if opts.stream {
+			return newJSONLinesWriter(out), nil
+		}
+		return newJSONWriter(out, opts.pretty), nil
+	}
+	return newPlistWriter(out, opts.pretty), nil
+}
+
+func convert(opts *options) error {
+	w, err := newWriter(opts)
+	if err != nil {
+		return err
+	}
+	err = copyLibrary(w, opts)
+	if err != nil {
+		w.Abort()
+	} else {
+		err = w.Close()
+	}
+	if err != nil && opts.output != "-" {
+		// don't leave a half written file behind
+		os.Remove(opts.output)
+	}
+	return err
+}
+
+func copyLibrary(w writer, opts *options) error {
+	l := itunes.NewLoader(opts.input)
+	go l.LoadFile(opts.input)
+	fromXML := strings.HasSuffix(opts.input, ".xml")
+	lib := &loader.Library{}
+	tracks := []*loader.Track{}
+	playlists := []*loader.Playlist{}
+	skipped := map[pid.PersistentID]bool{}
+	for item := range l.GetChan() {
+		switch v := item.(type) {
+		case *loader.Library:
+			mergeLibrary(lib, v)
+		case *loader.Track:
+			if opts.kinds != nil && !opts.kinds[mediaKind(v)] {
+				if v.PersistentID != nil {
+					skipped[*v.PersistentID] = true
+				}
+				continue
+			}
+			if !opts.stream {
+				tracks = append(tracks, v)
+			} else if err := w.Track(v); err != nil {
+				return err
+			}
+		case *loader.Playlist:
+			if fromXML {
+				// the plist loader keeps <data> values base64 encoded
+				v.SmartInfo = decodeData(v.SmartInfo)
+				v.SmartCriteria = decodeData(v.SmartCriteria)
+			}
+			if len(skipped) > 0 {
+				ids := make([]pid.PersistentID, 0, len(v.TrackIDs))
+				for _, id := range v.TrackIDs {
+					if !skipped[id] {
+						ids = append(ids, id)
+					}
+				}
+				v.TrackIDs = ids
+			}
+			if !opts.stream {
+				playlists = append(playlists, v)
+			} else if err := w.Playlist(v); err != nil {
+				return err
+			}
+		case error:
+			return v
+		}
+	}
+	// when streaming the library header is only complete at the end, so
+	// the writers accept it after the tracks and playlists
+	err := w.Library(lib)
+	for _, tr := range tracks {
+		if err != nil {
+			break
+		}
+		err = w.Track(tr)
+	}
+	for _, pl := range playlists {
+		if err != nil {
+			break
+		}
+		err = w.Playlist(pl)
+	}
+	return err
+}
+
+func decodeData(data []byte) []byte {
+	if data == nil {
+		return nil
+	}
+	dec, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(data)), ""))
+	if err != nil {
+		return data
+	}
+	return dec
+}
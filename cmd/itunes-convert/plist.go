@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/xml"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rclancey/itunes/loader"
+	"github.com/rclancey/itunes/persistentId"
+)
+
+const plistHeader = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+`
+
+const (
+	plistTop = iota
+	plistTracks
+	plistPlaylists
+	plistDone
+)
+
+var pidType = reflect.TypeOf(pid.PersistentID(0))
+var timeType = reflect.TypeOf(time.Time{})
+
+// plistWriter writes the layout of an iTunes Library.xml file.  Tracks are
+// numbered with their Track ID where the source has one, so playlists can
+// refer to them, which means every track has to be written before the
+// first playlist.
+type plistWriter struct {
+	out io.WriteCloser
+	w *bufio.Writer
+	pretty bool
+	state int
+	ids map[pid.PersistentID]int
+	used map[int]bool
+	nextID int
+}
+
+func newPlistWriter(out io.WriteCloser, pretty bool) *plistWriter {
+	w := &plistWriter{
+		out: out,
+		w: bufio.NewWriter(out),
+		pretty: pretty,
+		ids: map[pid.PersistentID]int{},
+		used: map[int]bool{},
+		nextID: 1,
+	}
+	w.w.WriteString(plistHeader)
+	w.line(0, "<dict>")
+	return w
+}
+
+func (w *plistWriter) line(depth int, s string) {
+	if w.pretty {
+		w.w.WriteString(strings.Repeat("\t", depth))
+	}
+	w.w.WriteString(s)
+	if w.pretty {
+		w.w.WriteByte('\n')
+	}
+}
+
+func (w *plistWriter) key(depth int, k string) {
+	w.line(depth, "<key>" + escape(k) + "</key>")
+}
+
+func escape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func (w *plistWriter) value(depth int, v reflect.Value) {
+	switch v.Type() {
+	case pidType:
+		w.line(depth, "<string>" + v.Interface().(pid.PersistentID).String() + "</string>")
+		return
+	case timeType:
+		t := v.Interface().(time.Time)
+		w.line(depth, "<date>" + t.UTC().Format("2006-01-02T15:04:05Z") + "</date>")
+		return
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			w.line(depth, "<true/>")
+		} else {
+			w.line(depth, "<false/>")
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		w.line(depth, "<integer>" + strconv.FormatInt(v.Int(), 10) + "</integer>")
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		w.line(depth, "<integer>" + strconv.FormatUint(v.Uint(), 10) + "</integer>")
+	case reflect.String:
+		w.line(depth, "<string>" + escape(v.String()) + "</string>")
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			w.line(depth, "<data>" + base64.StdEncoding.EncodeToString(v.Bytes()) + "</data>")
+		}
+	}
+}
+
+func (w *plistWriter) closeContainer() {
+	switch w.state {
+	case plistTracks:
+		w.line(1, "</dict>")
+	case plistPlaylists:
+		w.line(1, "</array>")
+	}
+}
+
+// setState opens the top level Tracks and Playlists containers as the
+// writer moves between them.
+func (w *plistWriter) setState(state int) error {
+	if state == w.state {
+		return nil
+	}
+	if state < w.state {
+		return errors.New("tracks must come before playlists in xml output; don't use -stream")
+	}
+	w.closeContainer()
+	switch state {
+	case plistTracks:
+		w.key(1, "Tracks")
+		w.line(1, "<dict>")
+	case plistPlaylists:
+		w.key(1, "Playlists")
+		w.line(1, "<array>")
+	}
+	w.state = state
+	return nil
+}
+
+func (w *plistWriter) Library(lib *loader.Library) error {
+	// the header may come after the tracks and playlists, once they're
+	// finished
+	if w.state != plistTop {
+		w.closeContainer()
+		w.state = plistDone
+	}
+	for _, f := range fields(lib) {
+		// the counts; Tracks and Playlists are containers in the xml
+		if f.Name == "Tracks" || f.Name == "Playlists" {
+			continue
+		}
+		w.key(1, f.Key)
+		w.value(1, f.Value)
+	}
+	return nil
+}
+
+func (w *plistWriter) trackID(tr *loader.Track) int {
+	id := 0
+	if tr.TrackID != nil && !w.used[*tr.TrackID] {
+		id = *tr.TrackID
+	} else {
+		for w.used[w.nextID] {
+			w.nextID++
+		}
+		id = w.nextID
+	}
+	w.used[id] = true
+	if tr.PersistentID != nil {
+		w.ids[*tr.PersistentID] = id
+	}
+	return id
+}
+
+func (w *plistWriter) Track(tr *loader.Track) error {
+	err := w.setState(plistTracks)
+	if err != nil {
+		return err
+	}
+	id := strconv.Itoa(w.trackID(tr))
+	w.key(2, id)
+	w.line(2, "<dict>")
+	w.key(3, "Track ID")
+	w.line(3, "<integer>" + id + "</integer>")
+	for _, f := range fields(tr) {
+		if f.Name == "TrackID" {
+			continue
+		}
+		w.key(3, f.Key)
+		w.value(3, f.Value)
+	}
+	w.line(2, "</dict>")
+	return nil
+}
+
+func (w *plistWriter) Playlist(pl *loader.Playlist) error {
+	err := w.setState(plistPlaylists)
+	if err != nil {
+		return err
+	}
+	w.line(2, "<dict>")
+	for _, f := range fields(pl) {
+		switch f.Name {
+		case "TrackIDs":
+			continue
+		case "GeniusTrackID":
+			if id, ok := w.ids[*pl.GeniusTrackID]; ok {
+				w.key(3, f.Key)
+				w.line(3, "<integer>" + strconv.Itoa(id) + "</integer>")
+			}
+			continue
+		}
+		w.key(3, f.Key)
+		w.value(3, f.Value)
+	}
+	if len(pl.TrackIDs) > 0 {
+		w.key(3, "Playlist Items")
+		w.line(3, "<array>")
+		for _, tid := range pl.TrackIDs {
+			id, ok := w.ids[tid]
+			if !ok {
+				continue
+			}
+			w.line(4, "<dict>")
+			w.key(5, "Track ID")
+			w.line(5, "<integer>" + strconv.Itoa(id) + "</integer>")
+			w.line(4, "</dict>")
+		}
+		w.line(3, "</array>")
+	}
+	w.line(2, "</dict>")
+	return nil
+}
+
+func (w *plistWriter) Close() error {
+	defer w.out.Close()
+	w.closeContainer()
+	w.line(0, "</dict>")
+	w.line(0, "</plist>")
+	return w.w.Flush()
+}
+
+func (w *plistWriter) Abort() error {
+	return w.out.Close()
+}
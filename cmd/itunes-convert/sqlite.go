@@ -0,0 +1,174 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
+	"github.com/rclancey/itunes/loader"
+	"github.com/rclancey/itunes/persistentId"
+)
+
+// sqliteWriter writes the library, tracks and playlists to tables with a
+// column per loader field, plus a playlist_items table giving each
+// playlist's tracks in order.  Persistent IDs are stored as the usual 16
+// hex digits so they can be compared with other tools' output.
+type sqliteWriter struct {
+	db *sqlx.DB
+	tx *sqlx.Tx
+	inserts map[reflect.Type]string
+}
+
+var sqliteTables = []struct{
+	name string
+	obj interface{}
+}{
+	{"library", &loader.Library{}},
+	{"tracks", &loader.Track{}},
+	{"playlists", &loader.Playlist{}},
+}
+
+func newSQLiteWriter(fn string) (*sqliteWriter, error) {
+	err := os.Remove(fn)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "can't replace output file")
+	}
+	db, err := sqlx.Connect("sqlite3", fn)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't create sqlite database")
+	}
+	w := &sqliteWriter{db: db, inserts: map[reflect.Type]string{}}
+	w.tx, err = db.Beginx()
+	if err != nil {
+		db.Close()
+		os.Remove(fn)
+		return nil, errors.WithStack(err)
+	}
+	for _, t := range sqliteTables {
+		err = w.createTable(t.name, reflect.TypeOf(t.obj).Elem())
+		if err != nil {
+			w.tx.Rollback()
+			db.Close()
+			os.Remove(fn)
+			return nil, err
+		}
+	}
+	_, err = w.tx.Exec(`CREATE TABLE playlist_items (
+		playlist_persistent_id TEXT NOT NULL,
+		position INTEGER NOT NULL,
+		track_persistent_id TEXT NOT NULL
+	)`)
+	if err != nil {
+		w.tx.Rollback()
+		db.Close()
+		os.Remove(fn)
+		return nil, errors.Wrap(err, "can't create playlist_items table")
+	}
+	return w, nil
+}
+
+func columnType(t reflect.Type) string {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t {
+	case pidType, timeType:
+		return "TEXT"
+	}
+	switch t.Kind() {
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "INTEGER"
+	case reflect.String:
+		return "TEXT"
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "BLOB"
+		}
+	}
+	return ""
+}
+
+func (w *sqliteWriter) createTable(name string, rt reflect.Type) error {
+	cols := []string{}
+	names := []string{}
+	for i := 0; i < rt.NumField(); i++ {
+		rf := rt.Field(i)
+		ct := columnType(rf.Type)
+		if ct == "" {
+			continue
+		}
+		cols = append(cols, columnName(rf) + " " + ct)
+		names = append(names, columnName(rf))
+	}
+	_, err := w.tx.Exec("CREATE TABLE " + name + " (" + strings.Join(cols, ", ") + ")")
+	if err != nil {
+		return errors.Wrap(err, "can't create " + name + " table")
+	}
+	w.inserts[rt] = "INSERT INTO " + name + " (" + strings.Join(names, ", ") + ") VALUES (" + strings.TrimSuffix(strings.Repeat("?, ", len(names)), ", ") + ")"
+	return nil
+}
+
+func sqlValue(v reflect.Value) interface{} {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	switch x := v.Interface().(type) {
+	case pid.PersistentID:
+		return x.String()
+	case time.Time:
+		return x.UTC().Format(time.RFC3339)
+	}
+	return v.Interface()
+}
+
+func (w *sqliteWriter) insert(obj interface{}) error {
+	rv := reflect.ValueOf(obj).Elem()
+	rt := rv.Type()
+	args := []interface{}{}
+	for i := 0; i < rt.NumField(); i++ {
+		if columnType(rt.Field(i).Type) != "" {
+			args = append(args, sqlValue(rv.Field(i)))
+		}
+	}
+	_, err := w.tx.Exec(w.inserts[rt], args...)
+	return errors.WithStack(err)
+}
+
+func (w *sqliteWriter) Library(lib *loader.Library) error {
+	return w.insert(lib)
+}
+
+func (w *sqliteWriter) Track(tr *loader.Track) error {
+	return w.insert(tr)
+}
+
+func (w *sqliteWriter) Playlist(pl *loader.Playlist) error {
+	err := w.insert(pl)
+	if err != nil || pl.PersistentID == nil {
+		return err
+	}
+	for i, id := range pl.TrackIDs {
+		_, err = w.tx.Exec("INSERT INTO playlist_items (playlist_persistent_id, position, track_persistent_id) VALUES (?, ?, ?)", pl.PersistentID.String(), i, id.String())
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+func (w *sqliteWriter) Close() error {
+	defer w.db.Close()
+	return errors.WithStack(w.tx.Commit())
+}
+
+func (w *sqliteWriter) Abort() error {
+	defer w.db.Close()
+	return errors.WithStack(w.tx.Rollback())
+}
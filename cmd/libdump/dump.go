@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rclancey/itunes/itl"
+	"github.com/rclancey/itunes/mdb"
+)
+
+type Region struct {
+	Offset int `json:"offset"`
+	Length int `json:"length"`
+	Hex string `json:"hex"`
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+type Node struct {
+	Offset int `json:"offset"`
+	Signature string `json:"signature"`
+	Type string `json:"type"`
+	Size int `json:"size"`
+	Length int `json:"length"`
+	Fields map[string]interface{} `json:"fields,omitempty"`
+	Unknown *Region `json:"unknown,omitempty"`
+	Error string `json:"error,omitempty"`
+	Children []*Node `json:"children,omitempty"`
+
+	remaining int
+	end int
+}
+
+type Dump struct {
+	Format string `json:"format"`
+	Header *Node `json:"header"`
+	Objects []*Node `json:"objects"`
+	Error string `json:"error,omitempty"`
+}
+
+// standardKeys are the StandardObject fields, shown in the node itself
+// rather than among the decoded fields.
+var standardKeys = []string{"Type", "Offset", "Preface", "Size", "ByteOrder", "Data", "Raw"}
+
+func newNode(obj interface{}, offset, length, hexLimit int) *Node {
+	sig, size, data, _ := standard(obj)
+	node := &Node{
+		Offset: offset,
+		Signature: sig,
+		Type: strings.TrimPrefix(fmt.Sprintf("%T", obj), "*"),
+		Size: size,
+		Length: length,
+	}
+	js, err := json.Marshal(obj)
+	if err == nil {
+		err = json.Unmarshal(js, &node.Fields)
+	}
+	if err != nil {
+		node.Fields = map[string]interface{}{"error": err.Error()}
+	}
+	for _, k := range standardKeys {
+		delete(node.Fields, k)
+	}
+	if start, ok := unknownStart(obj, data); ok {
+		node.Unknown = region(data, start, offset, hexLimit)
+	}
+	return node
+}
+
+// unknownStart returns where the bytes no reader understands begin in an
+// object's data: past the parsed header of records, and the whole value
+// of data objects of an unknown type.
+func unknownStart(obj interface{}, data []byte) (int, bool) {
+	var start int
+	switch o := obj.(type) {
+	case *itl.DataObject:
+		if o.Str != "" || o.Parsed == nil {
+			return 0, false
+		}
+		start = len(data) - len(o.Raw)
+	case *mdb.DataObject:
+		if o.Parsed == nil || o.Parsed.Subtype.Kind() != mdb.BomaTypeUnknown {
+			return 0, false
+		}
+		start = binary.Size(o.Parsed)
+	case *mdb.Unhandled:
+		start = 8
+	default:
+		parsed := reflect.ValueOf(obj).Elem().FieldByName("Parsed")
+		if !parsed.IsValid() || parsed.IsNil() {
+			return 0, false
+		}
+		start = binary.Size(parsed.Interface())
+	}
+	return start, start >= 0 && start < len(data)
+}
+
+func region(data []byte, start, offset, limit int) *Region {
+	b := data[start:]
+	r := &Region{Offset: offset + start, Length: len(b)}
+	if limit >= 0 && len(b) > limit {
+		b = b[:limit]
+		r.Truncated = true
+	}
+	r.Hex = fmt.Sprintf("%x", b)
+	return r
+}
+
+// readTree reads every object in the payload, nesting records under the
+// list that holds them and data objects under their record.
+func readTree(f *format, r io.Reader, hexLimit int) ([]*Node, error) {
+	root := &Node{remaining: -1, end: -1}
+	stack := []*Node{root}
+	offset := 0
+	for {
+		n, obj, err := f.read(r, offset)
+		if _, _, _, ok := standard(obj); !ok {
+			if err == nil || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return root.Children, nil
+			}
+			return root.Children, errors.Wrapf(err, "can't read object at offset %d", offset)
+		}
+		for len(stack) > 1 {
+			top := stack[len(stack) - 1]
+			if top.remaining == 0 || (top.end >= 0 && offset >= top.end) {
+				stack = stack[:len(stack) - 1]
+				continue
+			}
+			break
+		}
+		node := newNode(obj, offset, n, hexLimit)
+		if err != nil {
+			node.Error = err.Error()
+		}
+		parent := stack[len(stack) - 1]
+		parent.Children = append(parent.Children, node)
+		if parent.remaining > 0 {
+			parent.remaining--
+		}
+		count, span := f.children(obj)
+		if count > 0 || span > n {
+			node.remaining = -1
+			node.end = -1
+			if count > 0 {
+				node.remaining = count
+			}
+			if span > n {
+				node.end = offset + span
+			}
+			stack = append(stack, node)
+		}
+		offset += n
+	}
+}
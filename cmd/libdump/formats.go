@@ -0,0 +1,125 @@
+package main
+
+import (
+	"io"
+	"reflect"
+
+	"github.com/rclancey/itunes/itl"
+	"github.com/rclancey/itunes/mdb"
+)
+
+// format describes one of the binary library formats: how to get at the
+// decrypted payload, how to read one object, and how many of the
+// following objects belong to it.
+type format struct {
+	name string
+	decrypt func(f io.ReadCloser) (io.ReadCloser, error)
+	read func(r io.Reader, offset int) (int, interface{}, error)
+	// children returns the number of objects that follow obj and belong
+	// to it, or the number of payload bytes, starting at the object's
+	// offset, that it spans.  Both are zero for leaf objects.
+	children func(obj interface{}) (count, span int)
+}
+
+var itlFormat = &format{
+	name: "itl",
+	decrypt: func(f io.ReadCloser) (io.ReadCloser, error) {
+		return itl.NewLoader().Decrypt(f)
+	},
+	read: itl.ReadObject,
+	children: func(obj interface{}) (int, int) {
+		switch o := obj.(type) {
+		case *itl.DataSet:
+			return 0, o.RecordBytes
+		case *itl.HGHM:
+			return o.RecordCount, 0
+		case *itl.AlbumList:
+			return o.RecordCount, 0
+		case *itl.Album:
+			return o.RecordCount, 0
+		case *itl.ArtistList:
+			return o.RecordCount, 0
+		case *itl.Artist:
+			return o.RecordCount, 0
+		case *itl.TrackList:
+			return o.RecordCount, 0
+		case *itl.Track:
+			return o.RecordCount, 0
+		case *itl.PlaylistList:
+			return o.RecordCount, 0
+		case *itl.Playlist:
+			// data objects, then the playlist items
+			return o.RecordCount + o.TrackCount, 0
+		}
+		return 0, 0
+	},
+}
+
+var mdbFormat = &format{
+	name: "musicdb",
+	decrypt: func(f io.ReadCloser) (io.ReadCloser, error) {
+		return mdb.NewLoader().Decrypt(f)
+	},
+	read: mdb.ReadObject,
+	children: func(obj interface{}) (int, int) {
+		switch o := obj.(type) {
+		case *mdb.SectionBoundary:
+			return 0, o.SectionsLength
+		case *mdb.LibraryMaster:
+			return o.DataObjectCount, 0
+		case *mdb.AlbumList:
+			return o.AlbumCount, 0
+		case *mdb.Album:
+			return o.DataObjectCount, 0
+		case *mdb.ArtistList:
+			return o.ArtistCount, 0
+		case *mdb.Artist:
+			return o.DataObjectCount, 0
+		case *mdb.TrackList:
+			return o.TrackCount, 0
+		case *mdb.Track:
+			return o.DataObjectCount, 0
+		case *mdb.PlaylistList:
+			return o.PlaylistCount, 0
+		case *mdb.Playlist:
+			return o.DataObjectCount, 0
+		}
+		return 0, 0
+	},
+}
+
+// detectFormat picks the format from the signature at the start of the
+// file, which is byte swapped in little endian .itl files.
+func detectFormat(head []byte) *format {
+	if len(head) < 4 {
+		return nil
+	}
+	switch string(head[:4]) {
+	case "hdfm", "mfdh":
+		return itlFormat
+	case "hfma":
+		return mdbFormat
+	}
+	return nil
+}
+
+// standard returns the signature, declared size and bytes of the
+// StandardObject every decoded itl and mdb object embeds.
+func standard(obj interface{}) (string, int, []byte, bool) {
+	rv := reflect.ValueOf(obj)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return "", 0, nil, false
+	}
+	rv = rv.Elem()
+	if rv.Kind() != reflect.Struct {
+		return "", 0, nil, false
+	}
+	// a bare *StandardObject, returned when an object header can't be
+	// read, doesn't count
+	so := rv.FieldByName("StandardObject")
+	if !so.IsValid() || so.Kind() != reflect.Ptr || so.IsNil() {
+		return "", 0, nil, false
+	}
+	so = so.Elem()
+	return so.FieldByName("Type").String(), int(so.FieldByName("Size").Int()), so.FieldByName("Data").Bytes(), true
+}
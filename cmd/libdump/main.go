@@ -0,0 +1,155 @@
+// Command libdump prints the raw object tree of an iTunes .itl or Music
+// .musicdb library: every object's offset, signature and size, the fields
+// the itl and mdb readers decode, and hex dumps of the bytes they don't,
+// to help map the formats of new versions.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s [flags] library-file\n\n", filepath.Base(os.Args[0]))
+	fmt.Fprintf(os.Stderr, "Dumps the object tree of an .itl or .musicdb file.\n\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	asJSON := flag.Bool("json", false, "write the tree as JSON")
+	hexLimit := flag.Int("hex", 256, "maximum bytes of each unknown region to dump, -1 for all")
+	payloadFn := flag.String("payload", "", "also save the decrypted, decompressed payload to this file")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 1 {
+		usage()
+		os.Exit(2)
+	}
+	dump, err := load(flag.Arg(0), *hexLimit, *payloadFn)
+	if err != nil && dump == nil {
+		fmt.Fprintln(os.Stderr, "libdump:", err)
+		os.Exit(1)
+	}
+	w := bufio.NewWriter(os.Stdout)
+	if *asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(dump)
+	} else {
+		printDump(w, dump)
+	}
+	w.Flush()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "libdump:", err)
+		os.Exit(1)
+	}
+}
+
+// load reads the whole tree.  When the payload is cut short it returns
+// what it could read along with the error.
+func load(fn string, hexLimit int, payloadFn string) (*Dump, error) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't read library file")
+	}
+	f := detectFormat(data)
+	if f == nil {
+		return nil, errors.Errorf("%s isn't an .itl or .musicdb file", fn)
+	}
+	n, obj, err := f.read(bytes.NewReader(data), 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't read header")
+	}
+	dump := &Dump{Format: f.name, Header: newNode(obj, 0, n, hexLimit)}
+	payload, err := f.decrypt(ioutil.NopCloser(bytes.NewReader(data)))
+	if err != nil {
+		return nil, errors.Wrap(err, "can't decrypt payload")
+	}
+	defer payload.Close()
+	var r io.Reader = payload
+	if payloadFn != "" {
+		out, err := os.Create(payloadFn)
+		if err != nil {
+			return nil, errors.Wrap(err, "can't create payload file")
+		}
+		defer out.Close()
+		r = io.TeeReader(payload, out)
+	}
+	dump.Objects, err = readTree(f, r, hexLimit)
+	if err != nil {
+		dump.Error = err.Error()
+		return dump, err
+	}
+	return dump, nil
+}
+
+func printDump(w io.Writer, dump *Dump) {
+	fmt.Fprintf(w, "format %s\n", dump.Format)
+	fmt.Fprintln(w, "header")
+	printNode(w, dump.Header, 1)
+	fmt.Fprintln(w, "payload")
+	for _, node := range dump.Objects {
+		printNode(w, node, 1)
+	}
+	if dump.Error != "" {
+		fmt.Fprintf(w, "error: %s\n", dump.Error)
+	}
+}
+
+func printNode(w io.Writer, node *Node, depth int) {
+	indent := strings.Repeat("  ", depth)
+	fmt.Fprintf(w, "%s@%08x %s size=%d length=%d %s\n", indent, node.Offset, node.Signature, node.Size, node.Length, node.Type)
+	if node.Error != "" {
+		fmt.Fprintf(w, "%s  ! %s\n", indent, node.Error)
+	}
+	lines := []string{}
+	flatten("", node.Fields, &lines)
+	sort.Strings(lines)
+	for _, line := range lines {
+		fmt.Fprintf(w, "%s  %s\n", indent, line)
+	}
+	if u := node.Unknown; u != nil {
+		more := ""
+		if u.Truncated {
+			more = ", truncated"
+		}
+		fmt.Fprintf(w, "%s  unknown @%08x, %d bytes%s\n", indent, u.Offset, u.Length, more)
+		b, _ := hex.DecodeString(u.Hex)
+		for _, line := range strings.Split(strings.TrimRight(hex.Dump(b), "\n"), "\n") {
+			fmt.Fprintf(w, "%s    %s\n", indent, line)
+		}
+	}
+	for _, child := range node.Children {
+		printNode(w, child, depth + 1)
+	}
+}
+
+// flatten turns nested decoded fields into "Parsed.Size: 96" lines.
+func flatten(prefix string, v interface{}, lines *[]string) {
+	if m, ok := v.(map[string]interface{}); ok {
+		for k, sub := range m {
+			if prefix != "" {
+				k = prefix + "." + k
+			}
+			flatten(k, sub, lines)
+		}
+		return
+	}
+	if prefix == "" || v == nil {
+		return
+	}
+	js, _ := json.Marshal(v)
+	*lines = append(*lines, prefix + ": " + string(js))
+}
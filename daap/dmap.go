@@ -0,0 +1,352 @@
+package daap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+type Type int16
+
+const (
+	TypeByte Type = 1
+	TypeSignedByte Type = 2
+	TypeShort Type = 3
+	TypeSignedShort Type = 4
+	TypeInt Type = 5
+	TypeSignedInt Type = 6
+	TypeLong Type = 7
+	TypeSignedLong Type = 8
+	TypeString Type = 9
+	TypeDate Type = 10
+	TypeVersion Type = 11
+	TypeContainer Type = 12
+)
+
+type Tag struct {
+	Code string
+	Name string
+	Type Type
+}
+
+var tagList = []*Tag{
+	{"mdcl", "dmap.dictionary", TypeContainer},
+	{"mstt", "dmap.status", TypeInt},
+	{"miid", "dmap.itemid", TypeInt},
+	{"minm", "dmap.itemname", TypeString},
+	{"mikd", "dmap.itemkind", TypeByte},
+	{"mper", "dmap.persistentid", TypeLong},
+	{"mcon", "dmap.container", TypeContainer},
+	{"mcti", "dmap.containeritemid", TypeInt},
+	{"mpco", "dmap.parentcontainerid", TypeInt},
+	{"msts", "dmap.statusstring", TypeString},
+	{"mimc", "dmap.itemcount", TypeInt},
+	{"mctc", "dmap.containercount", TypeInt},
+	{"mrco", "dmap.returnedcount", TypeInt},
+	{"mtco", "dmap.specifiedtotalcount", TypeInt},
+	{"mlcl", "dmap.listing", TypeContainer},
+	{"mlit", "dmap.listingitem", TypeContainer},
+	{"mbcl", "dmap.bag", TypeContainer},
+	{"msrv", "dmap.serverinforesponse", TypeContainer},
+	{"msau", "dmap.authenticationmethod", TypeByte},
+	{"mslr", "dmap.loginrequired", TypeByte},
+	{"mpro", "dmap.protocolversion", TypeVersion},
+	{"msal", "dmap.supportsautologout", TypeByte},
+	{"msup", "dmap.supportsupdate", TypeByte},
+	{"mspi", "dmap.supportspersistentids", TypeByte},
+	{"msex", "dmap.supportsextensions", TypeByte},
+	{"msbr", "dmap.supportsbrowse", TypeByte},
+	{"msqy", "dmap.supportsquery", TypeByte},
+	{"msix", "dmap.supportsindex", TypeByte},
+	{"msrs", "dmap.supportsresolve", TypeByte},
+	{"mstm", "dmap.timeoutinterval", TypeInt},
+	{"msdc", "dmap.databasescount", TypeInt},
+	{"mlog", "dmap.loginresponse", TypeContainer},
+	{"mlid", "dmap.sessionid", TypeInt},
+	{"mupd", "dmap.updateresponse", TypeContainer},
+	{"musr", "dmap.serverrevision", TypeInt},
+	{"muty", "dmap.updatetype", TypeByte},
+	{"mudl", "dmap.deletedidlisting", TypeContainer},
+	{"mccr", "dmap.contentcodesresponse", TypeContainer},
+	{"mcnm", "dmap.contentcodesnumber", TypeInt},
+	{"mcna", "dmap.contentcodesname", TypeString},
+	{"mcty", "dmap.contentcodestype", TypeShort},
+	{"apro", "daap.protocolversion", TypeVersion},
+	{"avdb", "daap.serverdatabases", TypeContainer},
+	{"abro", "daap.databasebrowse", TypeContainer},
+	{"adbs", "daap.databasesongs", TypeContainer},
+	{"aply", "daap.databaseplaylists", TypeContainer},
+	{"apso", "daap.playlistsongs", TypeContainer},
+	{"abpl", "daap.baseplaylist", TypeByte},
+	{"aeSP", "com.apple.itunes.smart-playlist", TypeByte},
+	{"asal", "daap.songalbum", TypeString},
+	{"asar", "daap.songartist", TypeString},
+	{"asaa", "daap.songalbumartist", TypeString},
+	{"asbr", "daap.songbitrate", TypeShort},
+	{"ascm", "daap.songcomment", TypeString},
+	{"asco", "daap.songcompilation", TypeByte},
+	{"ascp", "daap.songcomposer", TypeString},
+	{"asda", "daap.songdateadded", TypeDate},
+	{"asdm", "daap.songdatemodified", TypeDate},
+	{"asdc", "daap.songdisccount", TypeShort},
+	{"asdn", "daap.songdiscnumber", TypeShort},
+	{"asfm", "daap.songformat", TypeString},
+	{"asgn", "daap.songgenre", TypeString},
+	{"asgr", "daap.songgrouping", TypeString},
+	{"assr", "daap.songsamplerate", TypeInt},
+	{"assz", "daap.songsize", TypeInt},
+	{"astm", "daap.songtime", TypeInt},
+	{"astc", "daap.songtrackcount", TypeShort},
+	{"astn", "daap.songtracknumber", TypeShort},
+	{"asur", "daap.songuserrating", TypeByte},
+	{"asyr", "daap.songyear", TypeShort},
+	{"asdk", "daap.songdatakind", TypeByte},
+	{"asul", "daap.songdataurl", TypeString},
+	{"aeNV", "com.apple.itunes.norm-volume", TypeInt},
+}
+
+var tagsByCode = map[string]*Tag{}
+var tagsByName = map[string]*Tag{}
+
+func init() {
+	for _, t := range tagList {
+		tagsByCode[t.Code] = t
+		tagsByName[t.Name] = t
+	}
+}
+
+func LookupTag(code string) *Tag {
+	return tagsByCode[code]
+}
+
+func LookupTagName(name string) *Tag {
+	return tagsByName[name]
+}
+
+// Version is a DMAP protocol version.
+type Version struct {
+	Major uint16
+	Minor uint8
+	Patch uint8
+}
+
+// Element is a tagged DMAP value.  Values are Go integers, string,
+// time.Time, Version or []*Element, according to the type of the tag.
+// Values of unknown tags are decoded as []byte.
+type Element struct {
+	Code string
+	Value interface{}
+}
+
+func E(code string, value interface{}) *Element {
+	return &Element{code, value}
+}
+
+// Child returns the first child element with a code, for containers.
+func (e *Element) Child(code string) *Element {
+	children, ok := e.Value.([]*Element)
+	if !ok {
+		return nil
+	}
+	for _, c := range children {
+		if c.Code == code {
+			return c
+		}
+	}
+	return nil
+}
+
+func (e *Element) Children() []*Element {
+	children, _ := e.Value.([]*Element)
+	return children
+}
+
+func toUint64(v interface{}) (uint64, bool) {
+	switch x := v.(type) {
+	case int:
+		return uint64(x), true
+	case int8:
+		return uint64(x), true
+	case int16:
+		return uint64(x), true
+	case int32:
+		return uint64(x), true
+	case int64:
+		return uint64(x), true
+	case uint:
+		return uint64(x), true
+	case uint8:
+		return uint64(x), true
+	case uint16:
+		return uint64(x), true
+	case uint32:
+		return uint64(x), true
+	case uint64:
+		return x, true
+	case bool:
+		if x {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+func (e *Element) encode(buf *bytes.Buffer) error {
+	if len(e.Code) != 4 {
+		return fmt.Errorf("invalid dmap code %q", e.Code)
+	}
+	tag := tagsByCode[e.Code]
+	buf.WriteString(e.Code)
+	start := buf.Len()
+	buf.Write([]byte{0, 0, 0, 0})
+	var typ Type
+	if tag != nil {
+		typ = tag.Type
+	}
+	switch v := e.Value.(type) {
+	case []*Element:
+		for _, child := range v {
+			err := child.encode(buf)
+			if err != nil {
+				return err
+			}
+		}
+	case string:
+		buf.WriteString(v)
+	case []byte:
+		buf.Write(v)
+	case time.Time:
+		binary.Write(buf, binary.BigEndian, uint32(v.Unix()))
+	case Version:
+		binary.Write(buf, binary.BigEndian, v)
+	default:
+		n, ok := toUint64(v)
+		if !ok {
+			return fmt.Errorf("can't encode %T as %s", v, e.Code)
+		}
+		switch typ {
+		case TypeByte, TypeSignedByte:
+			buf.WriteByte(uint8(n))
+		case TypeShort, TypeSignedShort:
+			binary.Write(buf, binary.BigEndian, uint16(n))
+		case TypeInt, TypeSignedInt, TypeDate:
+			binary.Write(buf, binary.BigEndian, uint32(n))
+		case TypeLong, TypeSignedLong:
+			binary.Write(buf, binary.BigEndian, n)
+		default:
+			return fmt.Errorf("can't encode an integer as %s", e.Code)
+		}
+	}
+	binary.BigEndian.PutUint32(buf.Bytes()[start:], uint32(buf.Len() - start - 4))
+	return nil
+}
+
+// Encode serializes elements one after another.
+func Encode(elements ...*Element) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	for _, e := range elements {
+		err := e.encode(buf)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// Decode parses a sequence of elements, descending into containers.
+func Decode(data []byte) ([]*Element, error) {
+	elements := []*Element{}
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, errors.New("truncated dmap element")
+		}
+		code := string(data[:4])
+		size := binary.BigEndian.Uint32(data[4:8])
+		if uint64(size) > uint64(len(data) - 8) {
+			return nil, fmt.Errorf("dmap element %s overruns its container", code)
+		}
+		value := data[8:8+size]
+		data = data[8+size:]
+		e := &Element{Code: code}
+		tag := tagsByCode[code]
+		if tag == nil {
+			e.Value = value
+			elements = append(elements, e)
+			continue
+		}
+		var err error
+		e.Value, err = decodeValue(tag, value)
+		if err != nil {
+			return nil, err
+		}
+		elements = append(elements, e)
+	}
+	return elements, nil
+}
+
+func decodeValue(tag *Tag, value []byte) (interface{}, error) {
+	size := len(value)
+	bad := func() error {
+		return fmt.Errorf("dmap element %s has invalid size %d", tag.Code, size)
+	}
+	switch tag.Type {
+	case TypeContainer:
+		return Decode(value)
+	case TypeString:
+		return string(value), nil
+	case TypeByte:
+		if size != 1 {
+			return nil, bad()
+		}
+		return value[0], nil
+	case TypeSignedByte:
+		if size != 1 {
+			return nil, bad()
+		}
+		return int8(value[0]), nil
+	case TypeShort:
+		if size != 2 {
+			return nil, bad()
+		}
+		return binary.BigEndian.Uint16(value), nil
+	case TypeSignedShort:
+		if size != 2 {
+			return nil, bad()
+		}
+		return int16(binary.BigEndian.Uint16(value)), nil
+	case TypeInt:
+		if size != 4 {
+			return nil, bad()
+		}
+		return binary.BigEndian.Uint32(value), nil
+	case TypeSignedInt:
+		if size != 4 {
+			return nil, bad()
+		}
+		return int32(binary.BigEndian.Uint32(value)), nil
+	case TypeLong:
+		if size != 8 {
+			return nil, bad()
+		}
+		return binary.BigEndian.Uint64(value), nil
+	case TypeSignedLong:
+		if size != 8 {
+			return nil, bad()
+		}
+		return int64(binary.BigEndian.Uint64(value)), nil
+	case TypeDate:
+		if size != 4 {
+			return nil, bad()
+		}
+		return time.Unix(int64(binary.BigEndian.Uint32(value)), 0), nil
+	case TypeVersion:
+		if size != 4 {
+			return nil, bad()
+		}
+		return Version{binary.BigEndian.Uint16(value), value[2], value[3]}, nil
+	}
+	return value, nil
+}
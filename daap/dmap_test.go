@@ -0,0 +1,178 @@
+package daap
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the standard tags have no signed types, so tests add their own
+func init() {
+	for _, t := range []*Tag{
+		{"tsb1", "test.signedbyte", TypeSignedByte},
+		{"tss2", "test.signedshort", TypeSignedShort},
+		{"tsi4", "test.signedint", TypeSignedInt},
+		{"tsl8", "test.signedlong", TypeSignedLong},
+	} {
+		tagsByCode[t.Code] = t
+		tagsByName[t.Name] = t
+	}
+}
+
+func TestRoundTripTypes(t *testing.T) {
+	date := time.Unix(1600000000, 0)
+	tests := []struct {
+		in *Element
+		want interface{}
+		size int
+	}{
+		{E("mikd", 2), uint8(2), 1},
+		{E("tsb1", -3), int8(-3), 1},
+		{E("asbr", 320), uint16(320), 2},
+		{E("tss2", -300), int16(-300), 2},
+		{E("miid", 70000), uint32(70000), 4},
+		{E("tsi4", -70000), int32(-70000), 4},
+		{E("mper", uint64(0xfedcba9876543210)), uint64(0xfedcba9876543210), 8},
+		{E("tsl8", int64(-1) << 40), int64(-1) << 40, 8},
+		{E("minm", "Song ♫"), "Song ♫", len("Song ♫")},
+		{E("asda", date), date, 4},
+		{E("mpro", Version{2, 0, 10}), Version{2, 0, 10}, 4},
+		{E("mslr", true), uint8(1), 1},
+		{E("mcon", []*Element{}), []*Element{}, 0},
+		// unknown tags keep their raw bytes
+		{E("zzzz", []byte{1, 2, 3}), []byte{1, 2, 3}, 3},
+	}
+	for _, test := range tests {
+		data, err := Encode(test.in)
+		if err != nil {
+			t.Errorf("%s: %s", test.in.Code, err)
+			continue
+		}
+		if len(data) != 8 + test.size {
+			t.Errorf("%s: encoded to %d bytes, want %d", test.in.Code, len(data), 8 + test.size)
+		}
+		out, err := Decode(data)
+		if err != nil {
+			t.Errorf("%s: %s", test.in.Code, err)
+			continue
+		}
+		if len(out) != 1 || out[0].Code != test.in.Code {
+			t.Errorf("%s: decoded %v", test.in.Code, out)
+			continue
+		}
+		if !reflect.DeepEqual(out[0].Value, test.want) {
+			t.Errorf("%s: got %#v, want %#v", test.in.Code, out[0].Value, test.want)
+		}
+	}
+}
+
+func TestRoundTripContainers(t *testing.T) {
+	in := E("adbs", []*Element{
+		E("mstt", 200),
+		E("muty", 0),
+		E("mtco", 2),
+		E("mrco", 2),
+		E("mlcl", []*Element{
+			E("mlit", []*Element{
+				E("miid", 1),
+				E("minm", "One"),
+				E("mper", uint64(11)),
+			}),
+			E("mlit", []*Element{
+				E("miid", 2),
+				E("minm", ""),
+				E("mper", uint64(22)),
+			}),
+		}),
+	})
+	data, err := Encode(in, E("mstt", 200))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 2 || out[1].Code != "mstt" {
+		t.Fatalf("got %d top level elements, want 2", len(out))
+	}
+	items := out[0].Child("mlcl").Children()
+	if len(items) != 2 {
+		t.Fatalf("got %d listing items, want 2", len(items))
+	}
+	if v := items[0].Child("minm").Value; v != "One" {
+		t.Errorf("got name %#v, want One", v)
+	}
+	if v := items[1].Child("minm").Value; v != "" {
+		t.Errorf("got name %#v, want empty", v)
+	}
+	if v := items[1].Child("mper").Value; v != uint64(22) {
+		t.Errorf("got persistent id %#v, want 22", v)
+	}
+	if out[0].Child("nope") != nil || items[0].Child("minm").Children() != nil {
+		t.Errorf("Child and Children should be empty for missing codes and non-containers")
+	}
+	again, err := Encode(out...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(again, data) {
+		t.Errorf("re-encoding the decoded elements changed them")
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	item, _ := Encode(E("mlit", []*Element{E("miid", 1)}))
+	tests := []struct {
+		what string
+		data []byte
+		err string
+	}{
+		{"truncated header", []byte("mii"), "truncated"},
+		{"truncated size", []byte("miid\x00\x00"), "truncated"},
+		{"overrun", []byte("minm\x00\x00\x00\x05abc"), "overruns"},
+		{"huge size", []byte("minm\xff\xff\xff\xffabc"), "overruns"},
+		{"short int", []byte("miid\x00\x00\x00\x02\x00\x01"), "invalid size"},
+		{"long byte", []byte("mikd\x00\x00\x00\x02\x00\x01"), "invalid size"},
+		{"short date", []byte("asda\x00\x00\x00\x03abc"), "invalid size"},
+		{"truncated child", append([]byte("mlcl\x00\x00\x00\x03"), item[:3]...), "truncated"},
+		{"child overruns parent", append([]byte("mlcl\x00\x00\x00\x0c"), item[:12]...), "overruns"},
+		{"trailing bytes", append(append([]byte{}, item...), 'm', 'i'), "truncated"},
+	}
+	for _, test := range tests {
+		_, err := Decode(test.data)
+		if err == nil {
+			t.Errorf("%s: no error", test.what)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got error %q, want one mentioning %q", test.what, err, test.err)
+		}
+	}
+	out, err := Decode(nil)
+	if err != nil || len(out) != 0 {
+		t.Errorf("empty input: got %v, %v", out, err)
+	}
+}
+
+func TestEncodeErrors(t *testing.T) {
+	tests := []struct {
+		what string
+		e *Element
+	}{
+		{"short code", E("abc", 1)},
+		{"long code", E("abcde", 1)},
+		{"unsupported value", E("miid", 1.5)},
+		{"integer for a string tag", E("minm", 1)},
+		{"integer for an unknown tag", E("zzzz", 1)},
+		{"bad child", E("mlcl", []*Element{E("mlit", []*Element{E("x", 1)})})},
+	}
+	for _, test := range tests {
+		_, err := Encode(test.e)
+		if err == nil {
+			t.Errorf("%s: no error", test.what)
+		}
+	}
+}
@@ -0,0 +1,524 @@
+// Package daap shares an itunes.Library with DAAP clients.  Advertising
+// the service over Bonjour (_daap._tcp) is left to the caller.
+package daap
+
+import (
+	"errors"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rclancey/itunes"
+	"github.com/rclancey/itunes/persistentId"
+)
+
+const ContentType = "application/x-dmap-tagged"
+
+var (
+	ErrNotFound = errors.New("not found")
+	ErrForbidden = errors.New("invalid session")
+	ErrBadRequest = errors.New("bad request")
+)
+
+const (
+	databaseID = 1
+	basePlaylistID = 1
+)
+
+type songField struct {
+	code string
+	get func(tr *itunes.Track) interface{}
+}
+
+func timeValue(t *itunes.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return t.Time
+}
+
+var songFields = []songField{
+	{"minm", func(tr *itunes.Track) interface{} { return tr.Name }},
+	{"asal", func(tr *itunes.Track) interface{} { return tr.Album }},
+	{"asar", func(tr *itunes.Track) interface{} { return tr.Artist }},
+	{"asaa", func(tr *itunes.Track) interface{} { return tr.AlbumArtist }},
+	{"ascp", func(tr *itunes.Track) interface{} { return tr.Composer }},
+	{"asgn", func(tr *itunes.Track) interface{} { return tr.Genre }},
+	{"asgr", func(tr *itunes.Track) interface{} { return tr.Grouping }},
+	{"ascm", func(tr *itunes.Track) interface{} { return tr.Comments }},
+	{"asfm", func(tr *itunes.Track) interface{} { return songFormat(tr) }},
+	{"astm", func(tr *itunes.Track) interface{} { return tr.TotalTime }},
+	{"assz", func(tr *itunes.Track) interface{} { return tr.Size }},
+	{"astn", func(tr *itunes.Track) interface{} { return tr.TrackNumber }},
+	{"astc", func(tr *itunes.Track) interface{} { return tr.TrackCount }},
+	{"asdn", func(tr *itunes.Track) interface{} { return tr.DiscNumber }},
+	{"asdc", func(tr *itunes.Track) interface{} { return tr.DiscCount }},
+	{"asyr", func(tr *itunes.Track) interface{} {
+		if tr.ReleaseDate == nil {
+			return 0
+		}
+		return tr.ReleaseDate.Year()
+	}},
+	{"asur", func(tr *itunes.Track) interface{} { return tr.Rating }},
+	{"asco", func(tr *itunes.Track) interface{} { return tr.Compilation }},
+	{"asda", func(tr *itunes.Track) interface{} { return timeValue(tr.DateAdded) }},
+	{"asdm", func(tr *itunes.Track) interface{} { return timeValue(tr.DateModified) }},
+	{"asdk", func(tr *itunes.Track) interface{} { return 0 }},
+	{"mper", func(tr *itunes.Track) interface{} { return uint64(tr.PersistentID) }},
+}
+
+func songFormat(tr *itunes.Track) string {
+	return strings.TrimPrefix(strings.ToLower(tr.GetExt()), ".")
+}
+
+// Server serves the library as a single DAAP database.  Tracks and
+// playlists are given 32 bit item ids the first time they are listed;
+// the ids are stable for the lifetime of the server.
+type Server struct {
+	lib *itunes.Library
+	Name string
+	Prefix string
+	// Timeout is how long a session lasts without requests.
+	Timeout time.Duration
+	mutex sync.Mutex
+	sessions map[uint32]time.Time
+	ids map[pid.PersistentID]uint32
+	pids map[uint32]pid.PersistentID
+	nextID uint32
+	revision uint32
+	changed chan bool
+	unsubscribe func()
+}
+
+func NewServer(lib *itunes.Library, name string) *Server {
+	s := &Server{
+		lib: lib,
+		Name: name,
+		Timeout: 30 * time.Minute,
+		sessions: map[uint32]time.Time{},
+		ids: map[pid.PersistentID]uint32{},
+		pids: map[uint32]pid.PersistentID{},
+		nextID: 100,
+		revision: 1,
+		changed: make(chan bool),
+	}
+	s.unsubscribe = lib.Subscribe(func(events []*itunes.Event) {
+		s.mutex.Lock()
+		s.revision++
+		close(s.changed)
+		s.changed = make(chan bool)
+		s.mutex.Unlock()
+	})
+	return s
+}
+
+func (s *Server) Close() {
+	s.unsubscribe()
+}
+
+func (s *Server) itemID(id pid.PersistentID) uint32 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	n, ok := s.ids[id]
+	if !ok {
+		n = s.nextID
+		s.nextID++
+		s.ids[id] = n
+		s.pids[n] = id
+	}
+	return n
+}
+
+func (s *Server) persistentID(n uint32) (pid.PersistentID, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	id, ok := s.pids[n]
+	return id, ok
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, s.Prefix), "/")
+	parts := strings.Split(path, "/")
+	w.Header().Set("DAAP-Server", "itunes-daap/1.0")
+	if len(parts) == 4 && parts[0] == "databases" && parts[2] == "items" && strings.Contains(parts[3], ".") {
+		err := s.stream(w, r, parts[1], parts[3])
+		if err != nil {
+			writeError(w, err)
+		}
+		return
+	}
+	e, err := s.route(r, parts)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	data, err := Encode(e)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", ContentType)
+	w.Write(data)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, ErrNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, ErrForbidden):
+		status = http.StatusForbidden
+	case errors.Is(err, ErrBadRequest):
+		status = http.StatusBadRequest
+	}
+	http.Error(w, err.Error(), status)
+}
+
+func (s *Server) route(r *http.Request, parts []string) (*Element, error) {
+	switch parts[0] {
+	case "server-info":
+		return s.serverInfo(), nil
+	case "content-codes":
+		return contentCodes(), nil
+	case "login":
+		return s.login(), nil
+	}
+	err := s.checkSession(r)
+	if err != nil {
+		return nil, err
+	}
+	switch parts[0] {
+	case "logout":
+		s.logout(r)
+		return E("mlog", []*Element{E("mstt", 204)}), nil
+	case "update":
+		return s.update(r), nil
+	case "databases":
+		if len(parts) == 1 {
+			return s.databases(), nil
+		}
+		if parts[1] != strconv.Itoa(databaseID) {
+			return nil, ErrNotFound
+		}
+		switch {
+		case len(parts) == 3 && parts[2] == "items":
+			return s.items(r), nil
+		case len(parts) == 3 && parts[2] == "containers":
+			return s.containers(), nil
+		case len(parts) == 5 && parts[2] == "containers" && parts[4] == "items":
+			return s.containerItems(r, parts[3])
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *Server) serverInfo() *Element {
+	return E("msrv", []*Element{
+		E("mstt", 200),
+		E("mpro", Version{2, 0, 0}),
+		E("apro", Version{3, 0, 0}),
+		E("minm", s.Name),
+		E("mslr", 0),
+		E("msau", 0),
+		E("mstm", uint32(s.Timeout / time.Second)),
+		E("msal", 1),
+		E("msup", 1),
+		E("mspi", 1),
+		E("msex", 0),
+		E("msbr", 0),
+		E("msqy", 0),
+		E("msix", 0),
+		E("msrs", 0),
+		E("msdc", 1),
+	})
+}
+
+func contentCodes() *Element {
+	children := []*Element{E("mstt", 200)}
+	for _, t := range tagList {
+		code := []byte(t.Code)
+		n := uint32(code[0]) << 24 | uint32(code[1]) << 16 | uint32(code[2]) << 8 | uint32(code[3])
+		children = append(children, E("mdcl", []*Element{
+			E("mcnm", n),
+			E("mcna", t.Name),
+			E("mcty", uint16(t.Type)),
+		}))
+	}
+	return E("mccr", children)
+}
+
+func (s *Server) login() *Element {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var id uint32
+	for id == 0 || !s.sessions[id].IsZero() {
+		id = rand.Uint32()
+	}
+	s.sessions[id] = time.Now()
+	return E("mlog", []*Element{E("mstt", 200), E("mlid", id)})
+}
+
+func sessionID(r *http.Request) uint32 {
+	id, _ := strconv.ParseUint(r.URL.Query().Get("session-id"), 10, 32)
+	return uint32(id)
+}
+
+func (s *Server) checkSession(r *http.Request) error {
+	id := sessionID(r)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	for sid, t := range s.sessions {
+		if now.Sub(t) > s.Timeout {
+			delete(s.sessions, sid)
+		}
+	}
+	if _, ok := s.sessions[id]; !ok {
+		return ErrForbidden
+	}
+	s.sessions[id] = now
+	return nil
+}
+
+func (s *Server) logout(r *http.Request) {
+	s.mutex.Lock()
+	delete(s.sessions, sessionID(r))
+	s.mutex.Unlock()
+}
+
+// update answers immediately when the client is behind; otherwise it
+// holds the request until the library changes, as DAAP clients expect.
+func (s *Server) update(r *http.Request) *Element {
+	rev, _ := strconv.ParseUint(r.URL.Query().Get("revision-number"), 10, 32)
+	s.mutex.Lock()
+	cur := s.revision
+	changed := s.changed
+	s.mutex.Unlock()
+	if uint32(rev) >= cur {
+		timer := time.NewTimer(s.Timeout)
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+		case <-timer.C:
+		}
+		timer.Stop()
+		s.mutex.Lock()
+		cur = s.revision
+		s.mutex.Unlock()
+	}
+	return E("mupd", []*Element{E("mstt", 200), E("musr", cur)})
+}
+
+func listing(code string, items []*Element) *Element {
+	return E(code, []*Element{
+		E("mstt", 200),
+		E("muty", 0),
+		E("mtco", len(items)),
+		E("mrco", len(items)),
+		E("mlcl", items),
+	})
+}
+
+func (s *Server) databases() *Element {
+	s.lib.RLock()
+	defer s.lib.RUnlock()
+	n := 0
+	for _, tr := range s.lib.Tracks {
+		if tr.Location != "" {
+			n++
+		}
+	}
+	db := E("mlit", []*Element{
+		E("miid", databaseID),
+		E("mper", uint64(s.lib.PersistentID)),
+		E("minm", s.Name),
+		E("mimc", n),
+		E("mctc", len(s.lib.Playlists) + 1),
+	})
+	return listing("avdb", []*Element{db})
+}
+
+// meta returns the song fields requested by the meta parameter, or all
+// of them if it is absent.
+func meta(r *http.Request) map[string]bool {
+	q := r.URL.Query().Get("meta")
+	if q == "" || q == "all" {
+		return nil
+	}
+	codes := map[string]bool{}
+	for _, name := range strings.Split(q, ",") {
+		tag := LookupTagName(strings.TrimSpace(name))
+		if tag != nil {
+			codes[tag.Code] = true
+		}
+	}
+	return codes
+}
+
+func (s *Server) song(tr *itunes.Track, codes map[string]bool) *Element {
+	children := []*Element{E("mikd", 2), E("miid", s.itemID(tr.PersistentID))}
+	for _, f := range songFields {
+		if codes != nil && !codes[f.code] {
+			continue
+		}
+		v := f.get(tr)
+		if v != nil {
+			children = append(children, E(f.code, v))
+		}
+	}
+	return E("mlit", children)
+}
+
+func (s *Server) items(r *http.Request) *Element {
+	codes := meta(r)
+	s.lib.RLock()
+	defer s.lib.RUnlock()
+	items := []*Element{}
+	for _, tr := range s.lib.Tracks {
+		if tr.Location != "" {
+			items = append(items, s.song(tr, codes))
+		}
+	}
+	return listing("adbs", items)
+}
+
+func (s *Server) containers() *Element {
+	s.lib.RLock()
+	defer s.lib.RUnlock()
+	n := 0
+	for _, tr := range s.lib.Tracks {
+		if tr.Location != "" {
+			n++
+		}
+	}
+	items := []*Element{E("mlit", []*Element{
+		E("miid", basePlaylistID),
+		E("mper", uint64(s.lib.PersistentID)),
+		E("minm", s.Name),
+		E("mimc", n),
+		E("abpl", 1),
+	})}
+	var add func(pls []*itunes.Playlist)
+	add = func(pls []*itunes.Playlist) {
+		for _, p := range pls {
+			children := []*Element{
+				E("miid", s.itemID(p.PersistentID)),
+				E("mper", uint64(p.PersistentID)),
+				E("minm", p.Name),
+			}
+			if p.ParentPersistentID != nil {
+				children = append(children, E("mpco", s.itemID(*p.ParentPersistentID)))
+			}
+			if p.Smart != nil {
+				children = append(children, E("aeSP", 1))
+			}
+			if !p.Folder {
+				children = append(children, E("mimc", len(p.Populate(s.lib).PlaylistItems)))
+			}
+			items = append(items, E("mlit", children))
+			add(p.Children)
+		}
+	}
+	add(s.lib.PlaylistTree)
+	return listing("aply", items)
+}
+
+func (s *Server) containerItems(r *http.Request, idstr string) (*Element, error) {
+	n, err := strconv.ParseUint(idstr, 10, 32)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+	codes := meta(r)
+	s.lib.RLock()
+	defer s.lib.RUnlock()
+	var tracks []*itunes.Track
+	if n == basePlaylistID {
+		tracks = s.lib.Tracks
+	} else {
+		id, ok := s.persistentID(uint32(n))
+		if !ok {
+			return nil, ErrNotFound
+		}
+		p, ok := s.lib.Playlists[id]
+		if !ok {
+			return nil, ErrNotFound
+		}
+		tracks = p.Populate(s.lib).PlaylistItems
+	}
+	items := []*Element{}
+	for i, tr := range tracks {
+		if tr == nil || tr.Location == "" {
+			continue
+		}
+		e := s.song(tr, codes)
+		e.Value = append(e.Children(), E("mcti", i + 1))
+		items = append(items, e)
+	}
+	return listing("apso", items), nil
+}
+
+// stream serves the file of a track, named {itemid}.{ext}, with support
+// for range requests.
+func (s *Server) stream(w http.ResponseWriter, r *http.Request, dbid, name string) error {
+	if dbid != strconv.Itoa(databaseID) {
+		return ErrNotFound
+	}
+	err := s.checkSession(r)
+	if err != nil {
+		return err
+	}
+	n, err := strconv.ParseUint(strings.SplitN(name, ".", 2)[0], 10, 32)
+	if err != nil {
+		return ErrNotFound
+	}
+	id, ok := s.persistentID(uint32(n))
+	if !ok {
+		return ErrNotFound
+	}
+	s.lib.RLock()
+	tr := s.lib.GetTrack(id)
+	var fn string
+	if tr != nil {
+		fn = tr.Path()
+	}
+	s.lib.RUnlock()
+	if fn == "" {
+		return ErrNotFound
+	}
+	f, err := os.Open(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ErrNotFound
+		}
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", mimeType(filepath.Ext(fn)))
+	http.ServeContent(w, r, "", st.ModTime(), f)
+	return nil
+}
+
+func mimeType(ext string) string {
+	switch strings.ToLower(ext) {
+	case ".mp3":
+		return "audio/mpeg"
+	case ".m4a", ".m4p", ".m4b", ".aac":
+		return "audio/mp4"
+	case ".wav":
+		return "audio/wav"
+	case ".aif", ".aiff":
+		return "audio/aiff"
+	case ".flac":
+		return "audio/flac"
+	}
+	return "application/octet-stream"
+}
@@ -0,0 +1,344 @@
+package daap
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/rclancey/itunes"
+	"github.com/rclancey/itunes/persistentId"
+)
+
+const audioData = "not really an mp3, but the server doesn't care"
+
+type fixture struct {
+	lib *itunes.Library
+	s *Server
+	tracks []*itunes.Track
+	folder *itunes.Playlist
+	playlist *itunes.Playlist
+	session string
+}
+
+// newFixture serves Nardis, whose file exists; Israel, whose file is
+// missing; and Peace Piece, which has no location and so isn't shared.
+// The Evans playlist, in the Jazz folder, holds all three.
+func newFixture(t *testing.T) *fixture {
+	dir, err := ioutil.TempDir("", "daap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	err = ioutil.WriteFile(filepath.Join(dir, "nardis.mp3"), []byte(audioData), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	released := &itunes.Time{Time: time.Date(1961, 2, 2, 0, 0, 0, 0, time.UTC)}
+	added := &itunes.Time{Time: time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)}
+	lib := itunes.NewLibrary()
+	f := &fixture{lib: lib}
+	for i, tr := range []*itunes.Track{
+		{
+			Name: "Nardis",
+			Artist: "Bill Evans Trio",
+			AlbumArtist: "Bill Evans",
+			Album: "Explorations",
+			Composer: "Miles Davis",
+			Genre: "Jazz",
+			TrackNumber: 4,
+			TrackCount: 9,
+			DiscNumber: 1,
+			DiscCount: 1,
+			TotalTime: 353000,
+			Size: uint64(len(audioData)),
+			Rating: 80,
+			ReleaseDate: released,
+			DateAdded: added,
+			Location: "file://" + filepath.ToSlash(filepath.Join(dir, "nardis.mp3")),
+		},
+		{Name: "Israel", Artist: "Bill Evans Trio", Album: "Explorations", TrackNumber: 1, Location: "file://" + filepath.ToSlash(filepath.Join(dir, "israel.m4a"))},
+		{Name: "Peace Piece", Artist: "Bill Evans", Album: "Everybody Digs Bill Evans"},
+	} {
+		tr.PersistentID = pid.PersistentID(0x100 + i)
+		lib.AddTrack(tr)
+		f.tracks = append(f.tracks, tr)
+	}
+	f.folder = lib.CreateFolder("Jazz", nil)
+	f.playlist = lib.CreatePlaylist("Evans", &f.folder.PersistentID)
+	lib.AddToPlaylist(f.playlist, f.tracks[1], f.tracks[2], f.tracks[0])
+	f.s = NewServer(lib, "Test Library")
+	t.Cleanup(f.s.Close)
+	return f
+}
+
+// get makes a request, adding the session id once logged in, and decodes
+// a successful DMAP response.
+func (f *fixture) get(t *testing.T, path string, hdr http.Header) (*httptest.ResponseRecorder, *Element) {
+	t.Helper()
+	if f.session != "" {
+		path += "?session-id=" + f.session
+	}
+	r := httptest.NewRequest("GET", path, nil)
+	for k, v := range hdr {
+		r.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	f.s.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != ContentType {
+		return w, nil
+	}
+	elems, err := Decode(w.Body.Bytes())
+	if err != nil {
+		t.Fatalf("%s: %s", path, err)
+	}
+	if len(elems) != 1 {
+		t.Fatalf("%s: got %d top level elements, want 1", path, len(elems))
+	}
+	return w, elems[0]
+}
+
+func (f *fixture) login(t *testing.T) {
+	t.Helper()
+	_, e := f.get(t, "/login", nil)
+	if e == nil || e.Code != "mlog" || e.Child("mlid") == nil {
+		t.Fatalf("login failed: %v", e)
+	}
+	f.session = strconv.FormatUint(uint64(e.Child("mlid").Value.(uint32)), 10)
+}
+
+// value returns a child's value as a string, or "-" if it's absent.
+func value(e *Element, code string) string {
+	c := e.Child(code)
+	if c == nil {
+		return "-"
+	}
+	if t, ok := c.Value.(time.Time); ok {
+		return t.UTC().Format(time.RFC3339)
+	}
+	return fmt.Sprint(c.Value)
+}
+
+// items returns a listing's items, checking its counts.
+func items(t *testing.T, e *Element, code string) []*Element {
+	t.Helper()
+	if e == nil || e.Code != code {
+		t.Fatalf("got %v, want a %s listing", e, code)
+	}
+	list := e.Child("mlcl").Children()
+	if value(e, "mstt") != "200" || value(e, "mrco") != strconv.Itoa(len(list)) || value(e, "mtco") != strconv.Itoa(len(list)) {
+		t.Errorf("%s: bad listing header: status %s, %s returned of %s", code, value(e, "mstt"), value(e, "mrco"), value(e, "mtco"))
+	}
+	return list
+}
+
+func TestServerInfo(t *testing.T) {
+	f := newFixture(t)
+	_, e := f.get(t, "/server-info", nil)
+	if e == nil || e.Code != "msrv" {
+		t.Fatalf("got %v, want msrv", e)
+	}
+	if value(e, "minm") != "Test Library" || value(e, "mstt") != "200" || value(e, "mpro") != "{2 0 0}" {
+		t.Errorf("got name %s, status %s, version %s", value(e, "minm"), value(e, "mstt"), value(e, "mpro"))
+	}
+	if value(e, "mstm") != "1800" {
+		t.Errorf("got timeout %s, want 1800", value(e, "mstm"))
+	}
+	_, e = f.get(t, "/content-codes", nil)
+	if e == nil || e.Code != "mccr" || len(e.Children()) != len(tagList) + 1 {
+		t.Errorf("content codes don't list every tag")
+	}
+}
+
+func TestSession(t *testing.T) {
+	f := newFixture(t)
+	for _, path := range []string{"/databases", "/databases?session-id=12345", "/databases/1/items/100.mp3?session-id=x"} {
+		w, _ := f.get(t, path, nil)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s: got status %d, want 403", path, w.Code)
+		}
+	}
+	f.login(t)
+	if w, _ := f.get(t, "/databases", nil); w.Code != http.StatusOK {
+		t.Fatalf("got status %d with a session", w.Code)
+	}
+	if _, e := f.get(t, "/logout", nil); e == nil || value(e, "mstt") != "204" {
+		t.Errorf("logout failed: %v", e)
+	}
+	if w, _ := f.get(t, "/databases", nil); w.Code != http.StatusForbidden {
+		t.Errorf("got status %d after logging out, want 403", w.Code)
+	}
+}
+
+func TestDatabases(t *testing.T) {
+	f := newFixture(t)
+	f.login(t)
+	_, e := f.get(t, "/databases", nil)
+	dbs := items(t, e, "avdb")
+	if len(dbs) != 1 {
+		t.Fatalf("got %d databases, want 1", len(dbs))
+	}
+	db := dbs[0]
+	if value(db, "miid") != "1" || value(db, "minm") != "Test Library" || value(db, "mimc") != "2" {
+		t.Errorf("got database %s named %s with %s items", value(db, "miid"), value(db, "minm"), value(db, "mimc"))
+	}
+	if value(db, "mper") != fmt.Sprint(uint64(f.lib.PersistentID)) {
+		t.Errorf("got persistent id %s", value(db, "mper"))
+	}
+	for _, path := range []string{"/databases/2/items", "/databases/1/nope"} {
+		if w, _ := f.get(t, path, nil); w.Code != http.StatusNotFound {
+			t.Errorf("%s: got status %d, want 404", path, w.Code)
+		}
+	}
+}
+
+func TestItems(t *testing.T) {
+	f := newFixture(t)
+	f.login(t)
+	_, e := f.get(t, "/databases/1/items", nil)
+	songs := items(t, e, "adbs")
+	if len(songs) != 2 {
+		t.Fatalf("got %d songs, want the 2 with locations", len(songs))
+	}
+	var nardis *Element
+	for _, s := range songs {
+		if value(s, "minm") == "Nardis" {
+			nardis = s
+		}
+	}
+	if nardis == nil {
+		t.Fatal("Nardis not listed")
+	}
+	want := map[string]string{
+		"mikd": "2",
+		"minm": "Nardis",
+		"asar": "Bill Evans Trio",
+		"asaa": "Bill Evans",
+		"asal": "Explorations",
+		"ascp": "Miles Davis",
+		"asgn": "Jazz",
+		"asfm": "mp3",
+		"astm": "353000",
+		"assz": strconv.Itoa(len(audioData)),
+		"astn": "4",
+		"astc": "9",
+		"asdn": "1",
+		"asdc": "1",
+		"asyr": "1961",
+		"asur": "80",
+		"asco": "0",
+		"asda": "2020-05-01T12:00:00Z",
+		"mper": fmt.Sprint(uint64(f.tracks[0].PersistentID)),
+		// no modification date, so no field
+		"asdm": "-",
+	}
+	for code, v := range want {
+		if got := value(nardis, code); got != v {
+			t.Errorf("%s: got %s, want %s", code, got, v)
+		}
+	}
+
+	// the same track gets the same id every time
+	id := value(nardis, "miid")
+	_, e = f.get(t, "/databases/1/items", nil)
+	for _, s := range items(t, e, "adbs") {
+		if value(s, "minm") == "Nardis" && value(s, "miid") != id {
+			t.Errorf("item id changed from %s to %s", id, value(s, "miid"))
+		}
+	}
+
+	w := httptest.NewRecorder()
+	f.s.ServeHTTP(w, httptest.NewRequest("GET", "/databases/1/items?meta=dmap.itemname,daap.songartist&session-id=" + f.session, nil))
+	elems, err := Decode(w.Body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range items(t, elems[0], "adbs") {
+		codes := []string{}
+		for _, c := range s.Children() {
+			codes = append(codes, c.Code)
+		}
+		if fmt.Sprint(codes) != "[mikd miid minm asar]" {
+			t.Errorf("meta filter: got fields %v", codes)
+		}
+	}
+}
+
+func TestContainers(t *testing.T) {
+	f := newFixture(t)
+	f.login(t)
+	_, e := f.get(t, "/databases/1/containers", nil)
+	pls := items(t, e, "aply")
+	if len(pls) != 3 {
+		t.Fatalf("got %d containers, want the base playlist, the folder and the playlist", len(pls))
+	}
+	base, folder, playlist := pls[0], pls[1], pls[2]
+	if value(base, "miid") != "1" || value(base, "abpl") != "1" || value(base, "mimc") != "2" {
+		t.Errorf("got base playlist %s with %s items", value(base, "miid"), value(base, "mimc"))
+	}
+	if value(folder, "minm") != "Jazz" || value(folder, "mimc") != "-" || value(folder, "mpco") != "-" {
+		t.Errorf("got folder %s with count %s and parent %s", value(folder, "minm"), value(folder, "mimc"), value(folder, "mpco"))
+	}
+	if value(playlist, "minm") != "Evans" || value(playlist, "mpco") != value(folder, "miid") || value(playlist, "mper") != fmt.Sprint(uint64(f.playlist.PersistentID)) {
+		t.Errorf("got playlist %s in %s, want Evans in the folder", value(playlist, "minm"), value(playlist, "mpco"))
+	}
+
+	_, e = f.get(t, "/databases/1/containers/" + value(playlist, "miid") + "/items", nil)
+	songs := items(t, e, "apso")
+	got := []string{}
+	for _, s := range songs {
+		got = append(got, value(s, "minm") + "@" + value(s, "mcti"))
+	}
+	// Peace Piece has no file, but keeps its place in the numbering
+	if fmt.Sprint(got) != "[Israel@1 Nardis@3]" {
+		t.Errorf("got playlist items %v", got)
+	}
+	_, e = f.get(t, "/databases/1/containers/1/items", nil)
+	if n := len(items(t, e, "apso")); n != 2 {
+		t.Errorf("got %d items in the base playlist, want 2", n)
+	}
+	for _, path := range []string{"/databases/1/containers/99/items", "/databases/1/containers/x/items"} {
+		if w, _ := f.get(t, path, nil); w.Code != http.StatusNotFound {
+			t.Errorf("%s: got status %d, want 404", path, w.Code)
+		}
+	}
+}
+
+func TestStream(t *testing.T) {
+	f := newFixture(t)
+	f.login(t)
+	_, e := f.get(t, "/databases/1/items", nil)
+	ids := map[string]string{}
+	for _, s := range items(t, e, "adbs") {
+		ids[value(s, "minm")] = value(s, "miid")
+	}
+
+	w, _ := f.get(t, "/databases/1/items/" + ids["Nardis"] + ".mp3", nil)
+	if w.Code != http.StatusOK || w.Body.String() != audioData {
+		t.Errorf("got status %d and %q", w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "audio/mpeg" {
+		t.Errorf("got content type %q", ct)
+	}
+
+	w, _ = f.get(t, "/databases/1/items/" + ids["Nardis"] + ".mp3", http.Header{"Range": {"bytes=4-9"}})
+	if w.Code != http.StatusPartialContent || w.Body.String() != audioData[4:10] {
+		t.Errorf("range: got status %d and %q", w.Code, w.Body.String())
+	}
+
+	for what, path := range map[string]string{
+		"missing file": "/databases/1/items/" + ids["Israel"] + ".m4a",
+		"unknown item": "/databases/1/items/99999.mp3",
+		"bad item": "/databases/1/items/x.mp3",
+		"other database": "/databases/2/items/" + ids["Nardis"] + ".mp3",
+	} {
+		if w, _ := f.get(t, path, nil); w.Code != http.StatusNotFound {
+			t.Errorf("%s: got status %d, want 404", what, w.Code)
+		}
+	}
+}
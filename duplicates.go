@@ -0,0 +1,313 @@
+package itunes
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rclancey/itunes/media"
+	"github.com/rclancey/itunes/persistentId"
+)
+
+type DuplicateKey int
+
+const (
+	DuplicateArtistName DuplicateKey = 1 << iota
+	DuplicateAlbum
+	DuplicateDuration
+	DuplicateSize
+	DuplicateContent
+)
+
+type DuplicateRank int
+
+const (
+	// RankBitRate prefers the copy with the highest bit rate
+	RankBitRate DuplicateRank = iota
+	// RankPlayHistory prefers copies that have been played or skipped
+	RankPlayHistory
+	// RankPlaylists prefers the copy that is in the most playlists
+	RankPlaylists
+)
+
+type DuplicateOptions struct {
+	// Keys is a combination of the DuplicateKey flags.  Tracks are
+	// duplicates when they match on all of them.
+	Keys DuplicateKey
+	// DurationTolerance is in milliseconds.
+	DurationTolerance uint
+	// Rank lists the strategies used to pick the copy to keep, most
+	// important first.  Remaining ties go to the oldest track.
+	Rank []DuplicateRank
+}
+
+func DefaultDuplicateOptions() *DuplicateOptions {
+	return &DuplicateOptions{
+		Keys: DuplicateArtistName | DuplicateDuration,
+		DurationTolerance: 2000,
+		Rank: []DuplicateRank{RankPlayHistory, RankPlaylists, RankBitRate},
+	}
+}
+
+type DuplicateGroup struct {
+	Keep *Track `json:"keep"`
+	Duplicates []*Track `json:"duplicates"`
+}
+
+type dupCandidate struct {
+	track *Track
+	bitRate uint
+	playlists int
+}
+
+func (c *dupCandidate) hasHistory() bool {
+	return c.track.PlayCount > 0 || c.track.SkipCount > 0 || c.track.PlayDate != nil
+}
+
+// FindDuplicates groups the tracks in tl that match on every key in opts
+// and picks which copy of each group to keep.  Tracks without a name are
+// never considered duplicates by artist and name.
+func (tl *TrackList) FindDuplicates(lib *Library, opts *DuplicateOptions) []*DuplicateGroup {
+	if opts == nil {
+		opts = DefaultDuplicateOptions()
+	}
+	buckets := map[string][]*Track{}
+	keys := []string{}
+	hashes := map[pid.PersistentID]string{}
+	if opts.Keys & DuplicateContent != 0 {
+		// only hash files that could be duplicates on the other keys
+		pre := map[string][]*Track{}
+		for _, tr := range *tl {
+			k, ok := dupKey(tr, opts.Keys &^ DuplicateContent, nil)
+			if ok {
+				pre[k] = append(pre[k], tr)
+			}
+		}
+		for _, trs := range pre {
+			if len(trs) < 2 {
+				continue
+			}
+			for _, tr := range trs {
+				fn := tr.Path()
+				if fn == "" {
+					continue
+				}
+				h, err := media.PayloadHash(fn)
+				if err == nil {
+					hashes[tr.PersistentID] = h
+				}
+			}
+		}
+	}
+	for _, tr := range *tl {
+		k, ok := dupKey(tr, opts.Keys, hashes)
+		if !ok {
+			continue
+		}
+		if _, ok := buckets[k]; !ok {
+			keys = append(keys, k)
+		}
+		buckets[k] = append(buckets[k], tr)
+	}
+	sort.Strings(keys)
+	var counts map[pid.PersistentID]int
+	if lib != nil {
+		counts = playlistCounts(lib)
+	}
+	groups := []*DuplicateGroup{}
+	for _, k := range keys {
+		trs := buckets[k]
+		if len(trs) < 2 {
+			continue
+		}
+		clusters := [][]*Track{trs}
+		if opts.Keys & DuplicateDuration != 0 {
+			clusters = durationClusters(trs, opts.DurationTolerance)
+		}
+		for _, cluster := range clusters {
+			if len(cluster) < 2 {
+				continue
+			}
+			groups = append(groups, rankDuplicates(cluster, opts.Rank, counts))
+		}
+	}
+	return groups
+}
+
+func dupKey(tr *Track, keys DuplicateKey, hashes map[pid.PersistentID]string) (string, bool) {
+	parts := []string{}
+	if keys & DuplicateArtistName != 0 {
+		if tr.Name == "" {
+			return "", false
+		}
+		artist := tr.Artist
+		if artist == "" {
+			artist = tr.AlbumArtist
+		}
+		parts = append(parts, metaKey(artist, tr.Name))
+	}
+	if keys & DuplicateAlbum != 0 {
+		parts = append(parts, MakeKey(tr.Album))
+	}
+	if keys & DuplicateSize != 0 {
+		if tr.Size == 0 {
+			return "", false
+		}
+		parts = append(parts, strconv.FormatUint(tr.Size, 10))
+	}
+	if keys & DuplicateContent != 0 {
+		h, ok := hashes[tr.PersistentID]
+		if !ok {
+			return "", false
+		}
+		parts = append(parts, h)
+	}
+	return strings.Join(parts, "\x00"), true
+}
+
+// durationClusters splits tracks into groups whose durations are all
+// within tolerance of the shortest track in the group, so a run of
+// slightly different durations can't chain into one group.
+func durationClusters(trs []*Track, tolerance uint) [][]*Track {
+	sorted := make([]*Track, len(trs))
+	copy(sorted, trs)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].TotalTime < sorted[j].TotalTime
+	})
+	clusters := [][]*Track{}
+	cur := []*Track{sorted[0]}
+	for _, tr := range sorted[1:] {
+		if durationDiff(tr.TotalTime, cur[0].TotalTime) > tolerance {
+			clusters = append(clusters, cur)
+			cur = []*Track{}
+		}
+		cur = append(cur, tr)
+	}
+	return append(clusters, cur)
+}
+
+func playlistCounts(lib *Library) map[pid.PersistentID]int {
+	counts := map[pid.PersistentID]int{}
+	for _, pl := range lib.Playlists {
+		if pl.Folder || pl.Smart != nil {
+			continue
+		}
+		for _, id := range pl.TrackIDs {
+			counts[id]++
+		}
+	}
+	return counts
+}
+
+func trackBitRate(tr *Track) uint {
+	fn := tr.Path()
+	if fn != "" {
+		info, err := media.ReadFileInfo(fn)
+		if err == nil && info.BitRate > 0 {
+			return info.BitRate
+		}
+	}
+	if tr.TotalTime == 0 {
+		return 0
+	}
+	return uint(tr.Size * 8 / uint64(tr.TotalTime))
+}
+
+func rankDuplicates(trs []*Track, rank []DuplicateRank, counts map[pid.PersistentID]int) *DuplicateGroup {
+	cands := make([]*dupCandidate, len(trs))
+	for i, tr := range trs {
+		cands[i] = &dupCandidate{track: tr, playlists: counts[tr.PersistentID]}
+	}
+	for _, r := range rank {
+		if r == RankBitRate {
+			for _, c := range cands {
+				c.bitRate = trackBitRate(c.track)
+			}
+		}
+	}
+	sort.SliceStable(cands, func(i, j int) bool {
+		a, b := cands[i], cands[j]
+		for _, r := range rank {
+			switch r {
+			case RankBitRate:
+				if a.bitRate != b.bitRate {
+					return a.bitRate > b.bitRate
+				}
+			case RankPlayHistory:
+				if a.hasHistory() != b.hasHistory() {
+					return a.hasHistory()
+				}
+				if a.track.PlayCount != b.track.PlayCount {
+					return a.track.PlayCount > b.track.PlayCount
+				}
+			case RankPlaylists:
+				if a.playlists != b.playlists {
+					return a.playlists > b.playlists
+				}
+			}
+		}
+		ad := a.track.DateAdded
+		bd := b.track.DateAdded
+		if ad != nil && bd != nil && !ad.Equal(bd.Time) {
+			return ad.Before(bd.Time)
+		}
+		if (ad == nil) != (bd == nil) {
+			return ad != nil
+		}
+		return a.track.PersistentID < b.track.PersistentID
+	})
+	group := &DuplicateGroup{Keep: cands[0].track, Duplicates: make([]*Track, len(cands) - 1)}
+	for i, c := range cands[1:] {
+		group.Duplicates[i] = c.track
+	}
+	return group
+}
+
+// MergeDuplicates folds each duplicate's play history, rating and loved
+// flag into the track being kept, points playlists at the kept track and
+// removes the duplicates from the library.  Files are left on disk.
+func (lib *Library) MergeDuplicates(groups []*DuplicateGroup) {
+	lib.Begin()
+	defer lib.Commit()
+	for _, g := range groups {
+		for _, dup := range g.Duplicates {
+			lib.mergeTrack(g.Keep, dup)
+		}
+	}
+}
+
+func (lib *Library) mergeTrack(keep, dup *Track) {
+	// base and cur differ only in the fields keep should take from dup, so
+	// Update adds dup's counts and keeps the later play and skip dates
+	base := &Track{Unplayed: true}
+	cur := &Track{
+		PlayCount: dup.PlayCount,
+		SkipCount: dup.SkipCount,
+		PlayDate: dup.PlayDate,
+		SkipDate: dup.SkipDate,
+		Unplayed: dup.Unplayed,
+	}
+	if dup.Rating > keep.Rating {
+		cur.Rating = dup.Rating
+	}
+	if keep.Loved == nil {
+		cur.Loved = dup.Loved
+	}
+	fields := keep.Update(base, cur)
+	if dup.DateAdded != nil && (keep.DateAdded == nil || dup.DateAdded.Before(keep.DateAdded.Time)) {
+		keep.DateAdded = dup.DateAdded
+		fields = append(fields, "DateAdded")
+	}
+	if len(fields) > 0 {
+		lib.emitTrack(TrackModified, keep.PersistentID, fields)
+	}
+	for _, pl := range lib.Playlists {
+		if pl.Folder || pl.Smart != nil {
+			continue
+		}
+		if pl.ReplaceTrack(dup.PersistentID, keep.PersistentID) {
+			lib.emitPlaylist(PlaylistTracksChanged, pl.PersistentID)
+		}
+	}
+	lib.RemoveTrack(dup.PersistentID)
+}
@@ -0,0 +1,197 @@
+package itunes
+
+import (
+	"sync"
+
+	"github.com/rclancey/itunes/persistentId"
+)
+
+type EventType int
+
+const (
+	TrackAdded EventType = iota
+	TrackRemoved
+	TrackModified
+	PlaylistCreated
+	PlaylistRemoved
+	PlaylistMoved
+	PlaylistRenamed
+	PlaylistTracksChanged
+	PlaylistModified
+)
+
+func (t EventType) String() string {
+	switch t {
+	case TrackAdded:
+		return "track_added"
+	case TrackRemoved:
+		return "track_removed"
+	case TrackModified:
+		return "track_modified"
+	case PlaylistCreated:
+		return "playlist_created"
+	case PlaylistRemoved:
+		return "playlist_removed"
+	case PlaylistMoved:
+		return "playlist_moved"
+	case PlaylistRenamed:
+		return "playlist_renamed"
+	case PlaylistTracksChanged:
+		return "playlist_tracks_changed"
+	case PlaylistModified:
+		return "playlist_modified"
+	}
+	return "unknown"
+}
+
+func (t EventType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+type Event struct {
+	Type        EventType         `json:"type"`
+	TrackID     *pid.PersistentID `json:"track_id,omitempty"`
+	PlaylistID  *pid.PersistentID `json:"playlist_id,omitempty"`
+	Fields      []string          `json:"fields,omitempty"`
+	OldParentID *pid.PersistentID `json:"old_parent_id,omitempty"`
+	NewParentID *pid.PersistentID `json:"new_parent_id,omitempty"`
+	OldName     string            `json:"old_name,omitempty"`
+	NewName     string            `json:"new_name,omitempty"`
+	// Reload is set on events for changes read from the library file by
+	// Reload or ApplyDelta, rather than made through the Library methods.
+	Reload bool `json:"reload,omitempty"`
+}
+
+// EventHandler receives every event emitted by a library.  Outside of a
+// transaction each call carries a single event; inside one, all of the
+// events are delivered together, in order, when the outermost transaction
+// commits.
+type EventHandler func(events []*Event)
+
+type eventBus struct {
+	mutex    sync.Mutex
+	nextID   int
+	handlers map[int]EventHandler
+	depth    int
+	pending  []*Event
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{handlers: map[int]EventHandler{}}
+}
+
+func (bus *eventBus) subscribe(h EventHandler) func() {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	id := bus.nextID
+	bus.nextID += 1
+	bus.handlers[id] = h
+	return func() {
+		bus.mutex.Lock()
+		defer bus.mutex.Unlock()
+		delete(bus.handlers, id)
+	}
+}
+
+func (bus *eventBus) snapshot() []EventHandler {
+	handlers := make([]EventHandler, 0, len(bus.handlers))
+	for i := 0; i < bus.nextID; i++ {
+		h, ok := bus.handlers[i]
+		if ok {
+			handlers = append(handlers, h)
+		}
+	}
+	return handlers
+}
+
+func (bus *eventBus) emit(ev *Event) {
+	bus.mutex.Lock()
+	// queue inside a transaction even with no handlers yet, since one may
+	// subscribe before the commit
+	if bus.depth > 0 {
+		bus.pending = append(bus.pending, ev)
+		bus.mutex.Unlock()
+		return
+	}
+	if len(bus.handlers) == 0 {
+		bus.mutex.Unlock()
+		return
+	}
+	handlers := bus.snapshot()
+	bus.mutex.Unlock()
+	events := []*Event{ev}
+	for _, h := range handlers {
+		h(events)
+	}
+}
+
+func (bus *eventBus) begin() {
+	bus.mutex.Lock()
+	bus.depth += 1
+	bus.mutex.Unlock()
+}
+
+func (bus *eventBus) commit() {
+	bus.mutex.Lock()
+	if bus.depth == 0 {
+		bus.mutex.Unlock()
+		return
+	}
+	bus.depth -= 1
+	if bus.depth > 0 || len(bus.pending) == 0 {
+		bus.mutex.Unlock()
+		return
+	}
+	events := bus.pending
+	bus.pending = nil
+	handlers := bus.snapshot()
+	bus.mutex.Unlock()
+	for _, h := range handlers {
+		h(events)
+	}
+}
+
+func (lib *Library) bus() *eventBus {
+	if lib.events == nil {
+		lib.events = newEventBus()
+	}
+	return lib.events
+}
+
+// Subscribe registers a handler for library change events and returns a
+// function that unregisters it.
+func (lib *Library) Subscribe(h EventHandler) func() {
+	return lib.bus().subscribe(h)
+}
+
+// Begin starts a transaction: events are held until the matching Commit.
+// Transactions may be nested; events are only delivered when the
+// outermost one commits.
+func (lib *Library) Begin() {
+	lib.bus().begin()
+}
+
+func (lib *Library) Commit() {
+	lib.bus().commit()
+}
+
+// Transaction runs f between Begin and Commit.  There is no rollback:
+// events for any changes f made before failing are still delivered.
+func (lib *Library) Transaction(f func() error) error {
+	lib.Begin()
+	defer lib.Commit()
+	return f()
+}
+
+func (lib *Library) emit(ev *Event) {
+	ev.Reload = lib.applying
+	lib.bus().emit(ev)
+}
+
+func (lib *Library) emitTrack(typ EventType, id pid.PersistentID, fields []string) {
+	lib.emit(&Event{Type: typ, TrackID: id.Pointer(), Fields: fields})
+}
+
+func (lib *Library) emitPlaylist(typ EventType, id pid.PersistentID) {
+	lib.emit(&Event{Type: typ, PlaylistID: id.Pointer()})
+}
@@ -0,0 +1,257 @@
+package itunes
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type PlaylistFormat string
+
+const (
+	PlaylistFormatM3U8 = PlaylistFormat("m3u8")
+	PlaylistFormatPLS  = PlaylistFormat("pls")
+	PlaylistFormatXSPF = PlaylistFormat("xspf")
+)
+
+func (f PlaylistFormat) Ext() string {
+	return "." + string(f)
+}
+
+type ExportOptions struct {
+	Format PlaylistFormat
+	// Root is the directory media files live under on the machine that
+	// will read the playlist.  When empty, the first TargetPath of the
+	// global FileFinder is used, and failing that the path returned by
+	// Track.Path() is written as is.
+	Root string
+	// Relative writes paths relative to the directory the playlist is
+	// written to (ExportTree) or to Root (Export).
+	Relative bool
+}
+
+func DefaultExportOptions() *ExportOptions {
+	return &ExportOptions{Format: PlaylistFormatM3U8}
+}
+
+func (opts *ExportOptions) root() string {
+	if opts.Root != "" {
+		return opts.Root
+	}
+	finder := GetGlobalFinder()
+	if finder != nil && len(finder.TargetPath) > 0 {
+		return finder.TargetPath[0]
+	}
+	return ""
+}
+
+func (opts *ExportOptions) trackPath(tr *Track, base string) string {
+	fn := tr.Path()
+	root := opts.root()
+	finder := GetGlobalFinder()
+	if root != "" && finder != nil {
+		rel := finder.Clean(tr.Location)
+		if !filepath.IsAbs(rel) {
+			fn = filepath.Join(root, rel)
+		}
+	}
+	if opts.Relative {
+		if base == "" {
+			base = root
+		}
+		if base != "" && filepath.IsAbs(fn) {
+			rel, err := filepath.Rel(base, fn)
+			if err == nil {
+				fn = rel
+			}
+		}
+	}
+	return filepath.ToSlash(fn)
+}
+
+func exportTitle(tr *Track) string {
+	if tr.Artist != "" {
+		return tr.Artist + " - " + tr.Name
+	}
+	return tr.Name
+}
+
+func exportSeconds(tr *Track) int {
+	if tr.TotalTime == 0 {
+		return -1
+	}
+	return int((tr.TotalTime + 500) / 1000)
+}
+
+// Export writes the playlist to w.  Smart playlists are evaluated against
+// lib at the time of export.
+func (p *Playlist) Export(lib *Library, w io.Writer, opts *ExportOptions) error {
+	if opts == nil {
+		opts = DefaultExportOptions()
+	}
+	return p.export(lib, w, opts, "")
+}
+
+func (p *Playlist) export(lib *Library, w io.Writer, opts *ExportOptions, base string) error {
+	if p.Folder {
+		return fmt.Errorf("can't export folder %s as a playlist", p.Name)
+	}
+	tracks := []*Track{}
+	for _, tr := range p.Populate(lib).PlaylistItems {
+		if tr != nil {
+			tracks = append(tracks, tr)
+		}
+	}
+	switch opts.Format {
+	case PlaylistFormatM3U8:
+		return exportM3U8(w, p.Name, tracks, opts, base)
+	case PlaylistFormatPLS:
+		return exportPLS(w, tracks, opts, base)
+	case PlaylistFormatXSPF:
+		return exportXSPF(w, p.Name, tracks, opts, base)
+	}
+	return fmt.Errorf("unknown playlist format %s", opts.Format)
+}
+
+func exportM3U8(w io.Writer, name string, tracks []*Track, opts *ExportOptions, base string) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "#EXTM3U")
+	fmt.Fprintf(bw, "#PLAYLIST:%s\n", name)
+	for _, tr := range tracks {
+		fmt.Fprintf(bw, "#EXTINF:%d,%s\n", exportSeconds(tr), exportTitle(tr))
+		if tr.Album != "" {
+			fmt.Fprintf(bw, "#EXTALB:%s\n", tr.Album)
+		}
+		fmt.Fprintln(bw, opts.trackPath(tr, base))
+	}
+	return bw.Flush()
+}
+
+func exportPLS(w io.Writer, tracks []*Track, opts *ExportOptions, base string) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "[playlist]")
+	for i, tr := range tracks {
+		fmt.Fprintf(bw, "File%d=%s\n", i+1, opts.trackPath(tr, base))
+		fmt.Fprintf(bw, "Title%d=%s\n", i+1, exportTitle(tr))
+		fmt.Fprintf(bw, "Length%d=%d\n", i+1, exportSeconds(tr))
+	}
+	fmt.Fprintf(bw, "NumberOfEntries=%d\n", len(tracks))
+	fmt.Fprintln(bw, "Version=2")
+	return bw.Flush()
+}
+
+type xspfTrack struct {
+	Location string `xml:"location"`
+	Title    string `xml:"title,omitempty"`
+	Creator  string `xml:"creator,omitempty"`
+	Album    string `xml:"album,omitempty"`
+	TrackNum uint8  `xml:"trackNum,omitempty"`
+	Duration uint   `xml:"duration,omitempty"`
+}
+
+type xspfPlaylist struct {
+	XMLName xml.Name    `xml:"http://xspf.org/ns/0/ playlist"`
+	Version int         `xml:"version,attr"`
+	Title   string      `xml:"title,omitempty"`
+	Tracks  []xspfTrack `xml:"trackList>track"`
+}
+
+func xspfLocation(fn string) string {
+	if strings.HasPrefix(fn, "/") {
+		u := &url.URL{Scheme: "file", Path: fn}
+		return u.String()
+	}
+	u := &url.URL{Path: fn}
+	return u.String()
+}
+
+func exportXSPF(w io.Writer, name string, tracks []*Track, opts *ExportOptions, base string) error {
+	doc := &xspfPlaylist{Version: 1, Title: name, Tracks: make([]xspfTrack, len(tracks))}
+	for i, tr := range tracks {
+		doc.Tracks[i] = xspfTrack{
+			Location: xspfLocation(opts.trackPath(tr, base)),
+			Title:    tr.Name,
+			Creator:  tr.Artist,
+			Album:    tr.Album,
+			TrackNum: tr.TrackNumber,
+			Duration: tr.TotalTime,
+		}
+	}
+	_, err := io.WriteString(w, xml.Header)
+	if err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	err = enc.Encode(doc)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "\n")
+	return err
+}
+
+// ExportTree writes p under dir.  Folders become directories and every
+// playlist inside them is exported recursively.
+func (p *Playlist) ExportTree(lib *Library, dir string, opts *ExportOptions) error {
+	return exportPlaylists(lib, []*Playlist{p}, dir, opts)
+}
+
+// ExportPlaylists writes the whole playlist tree under dir.
+func (lib *Library) ExportPlaylists(dir string, opts *ExportOptions) error {
+	return exportPlaylists(lib, lib.PlaylistTree, dir, opts)
+}
+
+func exportPlaylists(lib *Library, playlists []*Playlist, dir string, opts *ExportOptions) error {
+	if opts == nil {
+		opts = DefaultExportOptions()
+	}
+	used := map[string]bool{}
+	for _, p := range playlists {
+		ext := opts.Format.Ext()
+		if p.Folder {
+			ext = ""
+		}
+		name := SafeFileName(p.Name)
+		fn := name + ext
+		for i := 2; used[strings.ToLower(fn)]; i++ {
+			fn = fmt.Sprintf("%s (%d)%s", name, i, ext)
+		}
+		used[strings.ToLower(fn)] = true
+		fn = filepath.Join(dir, fn)
+		if p.Folder {
+			// create the directory even for an empty folder
+			err := os.MkdirAll(fn, os.FileMode(0755))
+			if err != nil {
+				return err
+			}
+			err = exportPlaylists(lib, p.Children, fn, opts)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		err := EnsureDir(fn)
+		if err != nil {
+			return err
+		}
+		f, err := os.Create(fn)
+		if err != nil {
+			return err
+		}
+		err = p.export(lib, f, opts, dir)
+		cerr := f.Close()
+		if err != nil {
+			return err
+		}
+		if cerr != nil {
+			return cerr
+		}
+	}
+	return nil
+}
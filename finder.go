@@ -2,6 +2,8 @@ package itunes
 
 import (
 	"fmt"
+	"io/ioutil"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
@@ -13,6 +15,104 @@ type FileFinder struct {
 	MediaFolder []string
 	SourcePath []string
 	TargetPath []string
+	Rules []*PathRule
+	CaseInsensitive bool
+}
+
+// PathRule rewrites locations that start with From so that they start
+// with To instead.  Both are compared with forward slashes, so a rule
+// written for a Windows library matches either separator.
+type PathRule struct {
+	From string
+	To string
+	CaseInsensitive bool
+}
+
+// ParsePathRule parses a rule of the form "from=to".  Rules whose source
+// is a Windows path are case insensitive.
+func ParsePathRule(s string) (*PathRule, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return nil, fmt.Errorf("invalid path rule %s", s)
+	}
+	return &PathRule{
+		From: parts[0],
+		To: parts[1],
+		CaseInsensitive: isWindowsPath(parts[0]) || strings.HasPrefix(parts[0], "\\\\"),
+	}, nil
+}
+
+func (r *PathRule) Apply(fn string) (string, bool) {
+	from := strings.TrimSuffix(toSlash(r.From), "/")
+	prefix := fn
+	if len(prefix) < len(from) {
+		return fn, false
+	}
+	prefix = prefix[:len(from)]
+	if r.CaseInsensitive {
+		if !strings.EqualFold(prefix, from) {
+			return fn, false
+		}
+	} else if prefix != from {
+		return fn, false
+	}
+	rest := fn[len(from):]
+	if rest != "" && rest[0] != '/' {
+		return fn, false
+	}
+	return strings.TrimSuffix(toSlash(r.To), "/") + rest, true
+}
+
+func (ff *FileFinder) AddRule(from, to string, caseInsensitive bool) {
+	ff.Rules = append(ff.Rules, &PathRule{from, to, caseInsensitive})
+}
+
+func isWindowsPath(fn string) bool {
+	return len(fn) >= 3 && fn[1] == ':' && (fn[2] == '\\' || fn[2] == '/')
+}
+
+func mapLocation(loc string) string {
+	ff := GetGlobalFinder()
+	if ff == nil {
+		ff = &FileFinder{}
+	}
+	return ff.MapPath(loc)
+}
+
+func toSlash(fn string) string {
+	return strings.Replace(fn, "\\", "/", -1)
+}
+
+// MapPath turns a location as stored in a library, which may be a
+// file:// URL or a path from another operating system, into a local path.
+// URLs are decoded, Windows separators are converted and the first
+// matching rule is applied.
+func (ff *FileFinder) MapPath(loc string) string {
+	fn := loc
+	if strings.HasPrefix(fn, "file:") {
+		u, err := url.Parse(fn)
+		if err == nil {
+			fn = u.Path
+			if u.Host != "" && u.Host != "localhost" {
+				// UNC path
+				fn = "//" + u.Host + fn
+			}
+			if len(fn) >= 3 && fn[0] == '/' && isWindowsPath(fn[1:]) {
+				fn = fn[1:]
+			}
+		}
+	}
+	if isWindowsPath(fn) || strings.HasPrefix(fn, "\\\\") {
+		fn = toSlash(fn)
+	}
+	for _, rule := range ff.Rules {
+		xfn, ok := rule.Apply(fn)
+		if ok {
+			fn = xfn
+			break
+		}
+	}
+	return filepath.FromSlash(fn)
 }
 
 var globalFinder *FileFinder
@@ -124,7 +224,15 @@ func NewFileFinder(mediaFolder string, sourcePath, targetPath []string) *FileFin
 	return ff
 }
 
+// Clean maps fn to a local path and removes the source path and media
+// folder prefix from it.
 func (ff *FileFinder) Clean(fn string) string {
+	return ff.trimSource(ff.MapPath(fn))
+}
+
+// trimSource removes the source path and media folder prefix from an
+// already mapped path.
+func (ff *FileFinder) trimSource(fn string) string {
 	var dn, after string
 	for _, mp := range ff.SourcePath {
 		for _, f := range ff.MediaFolder {
@@ -138,25 +246,86 @@ func (ff *FileFinder) Clean(fn string) string {
 	return fn
 }
 
+func (ff *FileFinder) exists(fn string) (string, bool) {
+	xfn, ex := fileExists(fn)
+	if ex || !ff.CaseInsensitive {
+		return xfn, ex
+	}
+	return findCaseInsensitive(fn)
+}
+
+// findCaseInsensitive resolves fn one component at a time, falling back to
+// a case and normalization insensitive match against the directory
+// listing when a component doesn't exist as spelled.
+func findCaseInsensitive(fn string) (string, bool) {
+	fn = filepath.Clean(fn)
+	vol := filepath.VolumeName(fn)
+	rest := strings.TrimPrefix(fn[len(vol):], sep)
+	cur := vol + sep
+	if !filepath.IsAbs(fn) {
+		cur = "."
+		rest = fn
+	}
+	for _, part := range strings.Split(rest, sep) {
+		next := filepath.Join(cur, part)
+		if _, err := os.Stat(next); err == nil {
+			cur = next
+			continue
+		}
+		entries, err := ioutil.ReadDir(cur)
+		if err != nil {
+			return fn, false
+		}
+		key := norm.NFC.String(part)
+		found := false
+		for _, ent := range entries {
+			if strings.EqualFold(norm.NFC.String(ent.Name()), key) {
+				cur = filepath.Join(cur, ent.Name())
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fn, false
+		}
+	}
+	return cur, true
+}
+
+// FindFile maps fn to a local path and looks for it, first as is, then
+// under each source path and media folder, and finally, with the source
+// prefix removed, under each target path.
 func (ff *FileFinder) FindFile(fn string) (string, error) {
 	var xfn string
 	var ex bool
+	fn = ff.MapPath(fn)
 	if filepath.IsAbs(fn) {
-		xfn, ex = fileExists(fn)
+		xfn, ex = ff.exists(fn)
 		if ex {
 			return xfn, nil
 		}
-		return fn, fmt.Errorf("absolute path %s doesn't exist", fn)
+		after := ff.trimSource(fn)
+		if after == fn {
+			return fn, fmt.Errorf("absolute path %s doesn't exist", fn)
+		}
+		fn = after
 	}
 	for _, mp := range ff.SourcePath {
 		for _, f := range ff.MediaFolder {
 			xfn = filepath.Join(mp, f, fn)
-			xfn, ex = fileExists(xfn)
+			xfn, ex = ff.exists(xfn)
 			if ex {
 				return xfn, nil
 			}
 		}
 	}
+	for _, mp := range ff.TargetPath {
+		xfn = filepath.Join(mp, fn)
+		xfn, ex = ff.exists(xfn)
+		if ex {
+			return xfn, nil
+		}
+	}
 	return fn, fmt.Errorf("can't find %s in a media folder", fn)
 }
 
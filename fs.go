@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 var serializationRoot string
@@ -37,6 +38,35 @@ func EnsureDir(fn string) error {
 	return nil
 }
 
+var unsafeFileChars = strings.NewReplacer(
+	"/", "_",
+	"\\", "_",
+	":", "_",
+	"*", "_",
+	"?", "_",
+	"\"", "_",
+	"<", "_",
+	">", "_",
+	"|", "_",
+)
+
+// SafeFileName makes name usable as a single path component on all of the
+// filesystems a library is likely to be copied to.
+func SafeFileName(name string) string {
+	s := strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, name)
+	s = unsafeFileChars.Replace(s)
+	s = strings.Trim(s, " .")
+	if s == "" {
+		return "_"
+	}
+	return s
+}
+
 func Serialize(obj Serializable) error {
 	data, err := obj.Serialize(2)
 	if err != nil {
@@ -4,6 +4,7 @@ go 1.13
 
 require (
 	github.com/dhowden/tag v0.0.0-20201120070457-d52dcb253c63
+	github.com/graphql-go/graphql v0.8.1
 	github.com/jmoiron/sqlx v1.3.4
 	github.com/mattn/go-sqlite3 v1.14.8
 	github.com/pkg/errors v0.9.1
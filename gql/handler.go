@@ -0,0 +1,49 @@
+package gql
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+type request struct {
+	Query string `json:"query"`
+	OperationName string `json:"operationName"`
+	Variables map[string]interface{} `json:"variables"`
+}
+
+// ServeHTTP accepts queries as a JSON body posted with query,
+// operationName and variables, or in the URL parameters of the same names
+// for GET.  Query errors are reported in the result with a 200 status.
+func (s *Schema) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	req := &request{}
+	switch r.Method {
+	case http.MethodGet:
+		q := r.URL.Query()
+		req.Query = q.Get("query")
+		req.OperationName = q.Get("operationName")
+		if v := q.Get("variables"); v != "" {
+			err := json.Unmarshal([]byte(v), &req.Variables)
+			if err != nil {
+				http.Error(w, "invalid variables: " + err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+	case http.MethodPost:
+		err := json.NewDecoder(r.Body).Decode(req)
+		if err != nil {
+			http.Error(w, "invalid request: " + err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if req.Query == "" {
+		http.Error(w, "query is required", http.StatusBadRequest)
+		return
+	}
+	result := s.Do(r.Context(), req.Query, req.OperationName, req.Variables)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
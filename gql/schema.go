@@ -0,0 +1,546 @@
+// Package gql exposes an itunes.Library through a read-only GraphQL
+// schema, so that nested data such as folders, their playlists and the
+// tracks and artwork of those can be fetched in a single request.
+package gql
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/graphql-go/graphql"
+	"github.com/rclancey/itunes"
+	"github.com/rclancey/itunes/persistentId"
+)
+
+// Schema resolves queries against a library.  Queries run with the
+// library read-locked.
+type Schema struct {
+	lib *itunes.Library
+	schema graphql.Schema
+	// ArtworkPrefix is where an artwork.Server is mounted; artworkUrl
+	// fields are ArtworkPrefix + persistent ID.
+	ArtworkPrefix string
+	// MaxLimit caps the page size of track lists.
+	MaxLimit int
+}
+
+type trackPage struct {
+	total int
+	offset int
+	limit int
+	tracks []*itunes.Track
+}
+
+type album struct {
+	name string
+	artist string
+	key string
+	tracks *itunes.TrackList
+}
+
+type indexEntry struct {
+	name string
+	key string
+}
+
+func timeValue(t *itunes.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return t.Time
+}
+
+type trackField struct {
+	name string
+	typ graphql.Output
+	get func(tr *itunes.Track) interface{}
+}
+
+var trackFields = []trackField{
+	{"name", graphql.String, func(tr *itunes.Track) interface{} { return tr.Name }},
+	{"artist", graphql.String, func(tr *itunes.Track) interface{} { return tr.Artist }},
+	{"albumArtist", graphql.String, func(tr *itunes.Track) interface{} { return tr.AlbumArtist }},
+	{"album", graphql.String, func(tr *itunes.Track) interface{} { return tr.Album }},
+	{"composer", graphql.String, func(tr *itunes.Track) interface{} { return tr.Composer }},
+	{"genre", graphql.String, func(tr *itunes.Track) interface{} { return tr.Genre }},
+	{"grouping", graphql.String, func(tr *itunes.Track) interface{} { return tr.Grouping }},
+	{"work", graphql.String, func(tr *itunes.Track) interface{} { return tr.Work }},
+	{"comments", graphql.String, func(tr *itunes.Track) interface{} { return tr.Comments }},
+	{"kind", graphql.String, func(tr *itunes.Track) interface{} { return tr.Kind }},
+	{"location", graphql.String, func(tr *itunes.Track) interface{} { return tr.Location }},
+	{"sortName", graphql.String, func(tr *itunes.Track) interface{} { return tr.SortName }},
+	{"sortArtist", graphql.String, func(tr *itunes.Track) interface{} { return tr.SortArtist }},
+	{"sortAlbumArtist", graphql.String, func(tr *itunes.Track) interface{} { return tr.SortAlbumArtist }},
+	{"sortAlbum", graphql.String, func(tr *itunes.Track) interface{} { return tr.SortAlbum }},
+	{"sortComposer", graphql.String, func(tr *itunes.Track) interface{} { return tr.SortComposer }},
+	{"trackNumber", graphql.Int, func(tr *itunes.Track) interface{} { return int(tr.TrackNumber) }},
+	{"trackCount", graphql.Int, func(tr *itunes.Track) interface{} { return int(tr.TrackCount) }},
+	{"discNumber", graphql.Int, func(tr *itunes.Track) interface{} { return int(tr.DiscNumber) }},
+	{"discCount", graphql.Int, func(tr *itunes.Track) interface{} { return int(tr.DiscCount) }},
+	{"year", graphql.Int, func(tr *itunes.Track) interface{} {
+		if tr.ReleaseDate == nil {
+			return nil
+		}
+		return tr.ReleaseDate.Year()
+	}},
+	{"totalTime", graphql.Int, func(tr *itunes.Track) interface{} { return int(tr.TotalTime) }},
+	{"size", graphql.Float, func(tr *itunes.Track) interface{} { return float64(tr.Size) }},
+	{"rating", graphql.Int, func(tr *itunes.Track) interface{} { return int(tr.Rating) }},
+	{"albumRating", graphql.Int, func(tr *itunes.Track) interface{} { return int(tr.AlbumRating) }},
+	{"loved", graphql.Boolean, func(tr *itunes.Track) interface{} {
+		if tr.Loved == nil {
+			return nil
+		}
+		return *tr.Loved
+	}},
+	{"compilation", graphql.Boolean, func(tr *itunes.Track) interface{} { return tr.Compilation }},
+	{"playCount", graphql.Int, func(tr *itunes.Track) interface{} { return int(tr.PlayCount) }},
+	{"skipCount", graphql.Int, func(tr *itunes.Track) interface{} { return int(tr.SkipCount) }},
+	{"playDate", graphql.DateTime, func(tr *itunes.Track) interface{} { return timeValue(tr.PlayDate) }},
+	{"skipDate", graphql.DateTime, func(tr *itunes.Track) interface{} { return timeValue(tr.SkipDate) }},
+	{"dateAdded", graphql.DateTime, func(tr *itunes.Track) interface{} { return timeValue(tr.DateAdded) }},
+	{"dateModified", graphql.DateTime, func(tr *itunes.Track) interface{} { return timeValue(tr.DateModified) }},
+	{"releaseDate", graphql.DateTime, func(tr *itunes.Track) interface{} { return timeValue(tr.ReleaseDate) }},
+	{"purchaseDate", graphql.DateTime, func(tr *itunes.Track) interface{} { return timeValue(tr.PurchaseDate) }},
+	{"albumKey", graphql.String, func(tr *itunes.Track) interface{} { return tr.AlbumKey() }},
+}
+
+var trackListArgs = graphql.FieldConfigArgument{
+	"genre": &graphql.ArgumentConfig{Type: graphql.String},
+	"artist": &graphql.ArgumentConfig{Type: graphql.String},
+	"album": &graphql.ArgumentConfig{Type: graphql.String},
+	"sort": &graphql.ArgumentConfig{Type: graphql.String, Description: "a Track field or method name, as for TrackList.SortBy"},
+	"desc": &graphql.ArgumentConfig{Type: graphql.Boolean},
+	"offset": &graphql.ArgumentConfig{Type: graphql.Int},
+	"limit": &graphql.ArgumentConfig{Type: graphql.Int},
+}
+
+func stringArg(args map[string]interface{}, key string) string {
+	s, _ := args[key].(string)
+	return s
+}
+
+func intArg(args map[string]interface{}, key string) int {
+	n, _ := args[key].(int)
+	return n
+}
+
+func idArg(args map[string]interface{}, key string) (pid.PersistentID, error) {
+	var id pid.PersistentID
+	err := (&id).Decode(stringArg(args, key))
+	if err != nil {
+		return id, fmt.Errorf("invalid persistent id %q", stringArg(args, key))
+	}
+	return id, nil
+}
+
+// page filters, sorts and slices tracks according to trackListArgs.
+// Tracks keep their order unless a sort is given.
+func (s *Schema) page(tl *itunes.TrackList, args map[string]interface{}) (*trackPage, error) {
+	tl = tl.Filter(stringArg(args, "genre"), stringArg(args, "artist"), stringArg(args, "album")).Clone()
+	if key := stringArg(args, "sort"); key != "" {
+		desc, _ := args["desc"].(bool)
+		err := tl.SortBy(key, desc)
+		if err != nil {
+			return nil, err
+		}
+	}
+	offset := intArg(args, "offset")
+	limit := intArg(args, "limit")
+	if offset < 0 || limit < 0 {
+		return nil, errors.New("offset and limit must not be negative")
+	}
+	if s.MaxLimit > 0 && (limit == 0 || limit > s.MaxLimit) {
+		limit = s.MaxLimit
+	}
+	page := &trackPage{total: len(*tl), offset: offset, limit: limit}
+	if offset > len(*tl) {
+		offset = len(*tl)
+	}
+	end := len(*tl)
+	if limit > 0 && offset + limit < end {
+		end = offset + limit
+	}
+	page.tracks = []*itunes.Track((*tl)[offset:end])
+	return page, nil
+}
+
+func (s *Schema) artworkURL(id pid.PersistentID, args map[string]interface{}) string {
+	u := s.ArtworkPrefix + id.String()
+	if size := intArg(args, "size"); size > 0 {
+		u += fmt.Sprintf("?size=%d", size)
+	}
+	return u
+}
+
+// albumTracks groups the library's tracks by album key in a single pass,
+// so that resolving the tracks of every album in a query stays linear.
+func (s *Schema) albumTracks() map[string]*itunes.TrackList {
+	albums := map[string]*itunes.TrackList{}
+	for _, tr := range s.lib.Tracks {
+		key := tr.AlbumKey()
+		if key == "" {
+			continue
+		}
+		tl, ok := albums[key]
+		if !ok {
+			tl = &itunes.TrackList{}
+			albums[key] = tl
+		}
+		tl.Add(tr)
+	}
+	for _, tl := range albums {
+		tl.DefaultSort()
+	}
+	return albums
+}
+
+func (s *Schema) playlistTracks(p *itunes.Playlist) *itunes.TrackList {
+	tl := itunes.TrackList{}
+	for _, tr := range p.Populate(s.lib).PlaylistItems {
+		if tr != nil {
+			tl = append(tl, tr)
+		}
+	}
+	return &tl
+}
+
+func sortedPlaylists(pls []*itunes.Playlist) []*itunes.Playlist {
+	out := make([]*itunes.Playlist, len(pls))
+	copy(out, pls)
+	sort.Sort(itunes.SortablePlaylistList(out))
+	return out
+}
+
+func NewSchema(lib *itunes.Library) (*Schema, error) {
+	s := &Schema{lib: lib, ArtworkPrefix: "/artwork/", MaxLimit: 1000}
+	artworkArgs := graphql.FieldConfigArgument{
+		"size": &graphql.ArgumentConfig{Type: graphql.Int},
+	}
+
+	trackType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Track",
+		Fields: graphql.FieldsThunk(func() graphql.Fields {
+			fields := graphql.Fields{
+				"id": &graphql.Field{
+					Type: graphql.NewNonNull(graphql.ID),
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return p.Source.(*itunes.Track).PersistentID.String(), nil
+					},
+				},
+				"artworkUrl": &graphql.Field{
+					Type: graphql.String,
+					Args: artworkArgs,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return s.artworkURL(p.Source.(*itunes.Track).PersistentID, p.Args), nil
+					},
+				},
+			}
+			for _, f := range trackFields {
+				get := f.get
+				fields[f.name] = &graphql.Field{
+					Type: f.typ,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return get(p.Source.(*itunes.Track)), nil
+					},
+				}
+			}
+			return fields
+		}),
+	})
+
+	pageType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "TrackPage",
+		Fields: graphql.Fields{
+			"total": &graphql.Field{Type: graphql.Int, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(*trackPage).total, nil
+			}},
+			"offset": &graphql.Field{Type: graphql.Int, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(*trackPage).offset, nil
+			}},
+			"limit": &graphql.Field{Type: graphql.Int, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(*trackPage).limit, nil
+			}},
+			"items": &graphql.Field{Type: graphql.NewList(trackType), Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(*trackPage).tracks, nil
+			}},
+		},
+	})
+
+	smartType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "SmartPlaylist",
+		Fields: graphql.Fields{
+			"liveUpdating": &graphql.Field{Type: graphql.Boolean, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(*itunes.SmartPlaylist).Info.LiveUpdating, nil
+			}},
+			"checkedOnly": &graphql.Field{Type: graphql.Boolean, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(*itunes.SmartPlaylist).Info.CheckedOnly, nil
+			}},
+			"hasLimit": &graphql.Field{Type: graphql.Boolean, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(*itunes.SmartPlaylist).Info.HasLimit, nil
+			}},
+			"limitSize": &graphql.Field{Type: graphql.Int, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				info := p.Source.(*itunes.SmartPlaylist).Info
+				if info.LimitSize == nil {
+					return nil, nil
+				}
+				return *info.LimitSize, nil
+			}},
+			"limitUnit": &graphql.Field{Type: graphql.String, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				info := p.Source.(*itunes.SmartPlaylist).Info
+				if info.LimitUnit == nil {
+					return nil, nil
+				}
+				return info.LimitUnit.String(), nil
+			}},
+			"sortField": &graphql.Field{Type: graphql.String, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				info := p.Source.(*itunes.SmartPlaylist).Info
+				if info.SortField == nil {
+					return nil, nil
+				}
+				return info.SortField.String(), nil
+			}},
+			"descending": &graphql.Field{Type: graphql.Boolean, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(*itunes.SmartPlaylist).Info.Descending, nil
+			}},
+			"conjunction": &graphql.Field{Type: graphql.String, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(*itunes.SmartPlaylist).Criteria.Conjunction.String(), nil
+			}},
+			"criteria": &graphql.Field{
+				Type: graphql.String,
+				Description: "the rules as JSON",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					data, err := json.Marshal(p.Source.(*itunes.SmartPlaylist).Criteria)
+					return string(data), err
+				},
+			},
+		},
+	})
+
+	var playlistType *graphql.Object
+	playlistType = graphql.NewObject(graphql.ObjectConfig{
+		Name: "Playlist",
+		Fields: graphql.FieldsThunk(func() graphql.Fields {
+			return graphql.Fields{
+				"id": &graphql.Field{Type: graphql.NewNonNull(graphql.ID), Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(*itunes.Playlist).PersistentID.String(), nil
+				}},
+				"name": &graphql.Field{Type: graphql.String, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(*itunes.Playlist).Name, nil
+				}},
+				"kind": &graphql.Field{Type: graphql.String, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(*itunes.Playlist).Kind(), nil
+				}},
+				"folder": &graphql.Field{Type: graphql.Boolean, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(*itunes.Playlist).Folder, nil
+				}},
+				"smart": &graphql.Field{Type: smartType, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					sp := p.Source.(*itunes.Playlist).Smart
+					if sp == nil {
+						return nil, nil
+					}
+					return sp, nil
+				}},
+				"parent": &graphql.Field{Type: playlistType, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					id := p.Source.(*itunes.Playlist).ParentPersistentID
+					if id == nil {
+						return nil, nil
+					}
+					parent, ok := s.lib.Playlists[*id]
+					if !ok {
+						return nil, nil
+					}
+					return parent, nil
+				}},
+				"children": &graphql.Field{Type: graphql.NewList(playlistType), Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return sortedPlaylists(p.Source.(*itunes.Playlist).Children), nil
+				}},
+				"tracks": &graphql.Field{
+					Type: pageType,
+					Args: trackListArgs,
+					Description: "the tracks of a playlist; smart playlists are evaluated",
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						pl := p.Source.(*itunes.Playlist)
+						if pl.Folder {
+							return nil, nil
+						}
+						return s.page(s.playlistTracks(pl), p.Args)
+					},
+				},
+			}
+		}),
+	})
+
+	albumType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Album",
+		Fields: graphql.Fields{
+			"key": &graphql.Field{Type: graphql.String, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(*album).key, nil
+			}},
+			"name": &graphql.Field{Type: graphql.String, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(*album).name, nil
+			}},
+			"artist": &graphql.Field{Type: graphql.String, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(*album).artist, nil
+			}},
+			"artworkUrl": &graphql.Field{Type: graphql.String, Args: artworkArgs, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				tl := p.Source.(*album).tracks
+				if len(*tl) == 0 {
+					return nil, nil
+				}
+				return s.artworkURL((*tl)[0].PersistentID, p.Args), nil
+			}},
+			"tracks": &graphql.Field{Type: pageType, Args: trackListArgs, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return s.page(p.Source.(*album).tracks, p.Args)
+			}},
+		},
+	})
+
+	indexType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "IndexEntry",
+		Fields: graphql.Fields{
+			"name": &graphql.Field{Type: graphql.String, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(*indexEntry).name, nil
+			}},
+			"key": &graphql.Field{Type: graphql.String, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(*indexEntry).key, nil
+			}},
+		},
+	})
+
+	filterArgs := graphql.FieldConfigArgument{
+		"genre": &graphql.ArgumentConfig{Type: graphql.String},
+		"artist": &graphql.ArgumentConfig{Type: graphql.String},
+	}
+	filtered := func(args map[string]interface{}) *itunes.TrackList {
+		return s.lib.TrackList().Filter(stringArg(args, "genre"), stringArg(args, "artist"), "")
+	}
+	index := func(vals [][2]string) []*indexEntry {
+		entries := make([]*indexEntry, len(vals))
+		for i, v := range vals {
+			entries[i] = &indexEntry{v[0], v[1]}
+		}
+		return entries
+	}
+
+	queryType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"persistentId": &graphql.Field{Type: graphql.ID, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return s.lib.PersistentID.String(), nil
+			}},
+			"tracks": &graphql.Field{Type: pageType, Args: trackListArgs, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return s.page(s.lib.TrackList(), p.Args)
+			}},
+			"track": &graphql.Field{
+				Type: trackType,
+				Args: graphql.FieldConfigArgument{"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)}},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					id, err := idArg(p.Args, "id")
+					if err != nil {
+						return nil, err
+					}
+					tr := s.lib.GetTrack(id)
+					if tr == nil {
+						return nil, nil
+					}
+					return tr, nil
+				},
+			},
+			"playlists": &graphql.Field{
+				Type: graphql.NewList(playlistType),
+				Description: "the top level of the playlist tree",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return sortedPlaylists(s.lib.PlaylistTree), nil
+				},
+			},
+			"playlist": &graphql.Field{
+				Type: playlistType,
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{Type: graphql.ID},
+					"path": &graphql.ArgumentConfig{Type: graphql.String, Description: "folder path separated by slashes"},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if path := stringArg(p.Args, "path"); path != "" {
+						pl := s.lib.GetPlaylistByPath(path)
+						if pl == nil {
+							return nil, nil
+						}
+						return pl, nil
+					}
+					id, err := idArg(p.Args, "id")
+					if err != nil {
+						return nil, err
+					}
+					pl, ok := s.lib.Playlists[id]
+					if !ok {
+						return nil, nil
+					}
+					return pl, nil
+				},
+			},
+			"genres": &graphql.Field{Type: graphql.NewList(indexType), Args: filterArgs, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return index(filtered(p.Args).Genres()), nil
+			}},
+			"artists": &graphql.Field{Type: graphql.NewList(indexType), Args: filterArgs, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return index(filtered(p.Args).Artists()), nil
+			}},
+			"albums": &graphql.Field{Type: graphql.NewList(albumType), Args: filterArgs, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				vals := filtered(p.Args).Albums()
+				tracks := s.albumTracks()
+				albums := make([]*album, len(vals))
+				for i, v := range vals {
+					albums[i] = &album{artist: v[0], name: v[1], key: v[2], tracks: tracks[v[2]]}
+					if albums[i].tracks == nil {
+						albums[i].tracks = &itunes.TrackList{}
+					}
+				}
+				return albums, nil
+			}},
+			"smartTracks": &graphql.Field{
+				Type: pageType,
+				Description: "evaluates smart playlist rules given as base64 info and criteria, as in the library XML",
+				Args: graphql.FieldConfigArgument{
+					"info": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"criteria": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"offset": &graphql.ArgumentConfig{Type: graphql.Int},
+					"limit": &graphql.ArgumentConfig{Type: graphql.Int},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					sp, err := itunes.ParseSmartPlaylist([]byte(stringArg(p.Args, "info")), []byte(stringArg(p.Args, "criteria")))
+					if err != nil {
+						return nil, err
+					}
+					tl, err := s.lib.TrackList().SmartFilter(sp, s.lib)
+					if err != nil {
+						return nil, err
+					}
+					return s.page(tl, p.Args)
+				},
+			},
+		},
+	})
+
+	var err error
+	s.schema, err = graphql.NewSchema(graphql.SchemaConfig{Query: queryType})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Do runs a query with the library read-locked.
+func (s *Schema) Do(ctx context.Context, query, operation string, vars map[string]interface{}) *graphql.Result {
+	s.lib.RLock()
+	defer s.lib.RUnlock()
+	return graphql.Do(graphql.Params{
+		Schema: s.schema,
+		RequestString: query,
+		OperationName: operation,
+		VariableValues: vars,
+		Context: ctx,
+	})
+}
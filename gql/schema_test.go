@@ -0,0 +1,229 @@
+package gql
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/rclancey/itunes"
+	"github.com/rclancey/itunes/persistentId"
+)
+
+// newTestSchema has Abbey Road, whose tracks were added out of album
+// order, and Kind of Blue; a Decades folder holding a 60s folder holding
+// the playlist 1969 (Something, Blue in Green); and a top level playlist
+// Mornings.
+func newTestSchema(t *testing.T) (*Schema, []*itunes.Track) {
+	lib := itunes.NewLibrary()
+	tracks := []*itunes.Track{}
+	for i, tr := range []*itunes.Track{
+		{Name: "Here Comes the Sun", Artist: "The Beatles", Album: "Abbey Road", Genre: "Rock", TrackNumber: 7},
+		{Name: "Come Together", Artist: "The Beatles", Album: "Abbey Road", Genre: "Rock", TrackNumber: 1},
+		{Name: "Something", Artist: "The Beatles", Album: "Abbey Road", Genre: "Rock", TrackNumber: 2},
+		{Name: "Blue in Green", Artist: "Miles Davis", Album: "Kind of Blue", Genre: "Jazz", TrackNumber: 3},
+	} {
+		tr.PersistentID = pid.PersistentID(i + 1)
+		lib.AddTrack(tr)
+		tracks = append(tracks, tr)
+	}
+	decades := lib.CreateFolder("Decades", nil)
+	sixties := lib.CreateFolder("60s", &decades.PersistentID)
+	p := lib.CreatePlaylist("1969", &sixties.PersistentID)
+	lib.AddToPlaylist(p, tracks[2], tracks[3])
+	p = lib.CreatePlaylist("Mornings", nil)
+	lib.AddToPlaylist(p, tracks[0])
+	s, err := NewSchema(lib)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, tracks
+}
+
+// query runs a query that should succeed, decoding its data into out.
+func query(t *testing.T, s *Schema, q string, vars map[string]interface{}, out interface{}) {
+	t.Helper()
+	res := s.Do(context.Background(), q, "", vars)
+	if res.HasErrors() {
+		t.Fatalf("%s: %v", q, res.Errors)
+	}
+	data, err := json.Marshal(res.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.Unmarshal(data, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+type testTrack struct {
+	ID string `json:"id"`
+	Name string `json:"name"`
+	ArtworkURL string `json:"artworkUrl"`
+}
+
+type testPage struct {
+	Total int `json:"total"`
+	Offset int `json:"offset"`
+	Limit int `json:"limit"`
+	Items []testTrack `json:"items"`
+}
+
+func (p *testPage) names() []string {
+	names := []string{}
+	for _, tr := range p.Items {
+		names = append(names, tr.Name)
+	}
+	return names
+}
+
+type testPlaylist struct {
+	Name string `json:"name"`
+	Folder bool `json:"folder"`
+	Parent *testPlaylist `json:"parent"`
+	Children []*testPlaylist `json:"children"`
+	Tracks *testPage `json:"tracks"`
+}
+
+func TestNestedPlaylists(t *testing.T) {
+	s, tracks := newTestSchema(t)
+	var res struct {
+		Playlists []*testPlaylist `json:"playlists"`
+	}
+	query(t, s, `{
+		playlists {
+			name
+			folder
+			tracks { total }
+			children {
+				name
+				children {
+					name
+					tracks { total items { id name artworkUrl(size: 100) } }
+				}
+			}
+		}
+	}`, nil, &res)
+	if len(res.Playlists) != 2 {
+		t.Fatalf("got %d top level playlists, want 2", len(res.Playlists))
+	}
+	var decades *testPlaylist
+	for _, p := range res.Playlists {
+		if p.Name == "Decades" {
+			decades = p
+		}
+	}
+	if decades == nil || !decades.Folder || decades.Tracks != nil {
+		t.Fatalf("expected a Decades folder without tracks, got %#v", decades)
+	}
+	if len(decades.Children) != 1 || len(decades.Children[0].Children) != 1 {
+		t.Fatalf("expected 60s/1969 in Decades, got %#v", decades.Children)
+	}
+	pl := decades.Children[0].Children[0]
+	if pl.Name != "1969" || pl.Tracks.Total != 2 || !reflect.DeepEqual(pl.Tracks.names(), []string{"Something", "Blue in Green"}) {
+		t.Errorf("got %s with tracks %v, want 1969 with Something and Blue in Green", pl.Name, pl.Tracks.names())
+	}
+	id := tracks[2].PersistentID.String()
+	if pl.Tracks.Items[0].ID != id || pl.Tracks.Items[0].ArtworkURL != "/artwork/" + id + "?size=100" {
+		t.Errorf("got id %q, artwork %q for Something", pl.Tracks.Items[0].ID, pl.Tracks.Items[0].ArtworkURL)
+	}
+
+	var byPath struct {
+		Playlist *testPlaylist `json:"playlist"`
+	}
+	query(t, s, `query ($path: String) { playlist(path: $path) { name parent { name parent { name } } } }`, map[string]interface{}{"path": "Decades/60s/1969"}, &byPath)
+	if p := byPath.Playlist; p == nil || p.Parent == nil || p.Parent.Name != "60s" || p.Parent.Parent == nil || p.Parent.Parent.Name != "Decades" {
+		t.Errorf("got %#v for Decades/60s/1969", byPath.Playlist)
+	}
+	query(t, s, `{ playlist(path: "Decades/70s") { name } }`, nil, &byPath)
+	if byPath.Playlist != nil {
+		t.Errorf("got %#v for a missing playlist", byPath.Playlist)
+	}
+}
+
+func TestTrackPages(t *testing.T) {
+	s, _ := newTestSchema(t)
+	tests := []struct {
+		args string
+		total int
+		want []string
+	}{
+		{`sort: "Name"`, 4, []string{"Blue in Green", "Come Together", "Here Comes the Sun", "Something"}},
+		{`sort: "Name", desc: true`, 4, []string{"Something", "Here Comes the Sun", "Come Together", "Blue in Green"}},
+		{`genre: "Rock", sort: "Name", desc: true`, 3, []string{"Something", "Here Comes the Sun", "Come Together"}},
+		{`artist: "Miles Davis"`, 1, []string{"Blue in Green"}},
+		{`album: "Nope"`, 0, []string{}},
+		{`sort: "Name", offset: 1, limit: 2`, 4, []string{"Come Together", "Here Comes the Sun"}},
+		{`sort: "Name", offset: 3, limit: 5`, 4, []string{"Something"}},
+		{`offset: 10`, 4, []string{}},
+	}
+	for _, test := range tests {
+		var res struct {
+			Tracks *testPage `json:"tracks"`
+		}
+		query(t, s, `{ tracks(` + test.args + `) { total items { name } } }`, nil, &res)
+		if res.Tracks.Total != test.total || !reflect.DeepEqual(res.Tracks.names(), test.want) {
+			t.Errorf("%s: got %v of %d, want %v of %d", test.args, res.Tracks.names(), res.Tracks.Total, test.want, test.total)
+		}
+	}
+
+	s.MaxLimit = 2
+	var res struct {
+		Tracks *testPage `json:"tracks"`
+	}
+	query(t, s, `{ tracks(limit: 10) { total limit items { name } } }`, nil, &res)
+	if res.Tracks.Limit != 2 || len(res.Tracks.Items) != 2 || res.Tracks.Total != 4 {
+		t.Errorf("got limit %d and %d items, want both capped at 2", res.Tracks.Limit, len(res.Tracks.Items))
+	}
+
+	for _, q := range []string{
+		`{ tracks(offset: -1) { total } }`,
+		`{ tracks(sort: "NoSuchField") { total } }`,
+		`{ track(id: "xyz") { name } }`,
+	} {
+		if res := s.Do(context.Background(), q, "", nil); !res.HasErrors() {
+			t.Errorf("%s: no error", q)
+		}
+	}
+}
+
+type testAlbum struct {
+	Name string `json:"name"`
+	Artist string `json:"artist"`
+	ArtworkURL string `json:"artworkUrl"`
+	Tracks *testPage `json:"tracks"`
+}
+
+func TestAlbums(t *testing.T) {
+	s, tracks := newTestSchema(t)
+	var res struct {
+		Albums []*testAlbum `json:"albums"`
+	}
+	query(t, s, `{ albums { name artist artworkUrl tracks { total items { name } } } }`, nil, &res)
+	if len(res.Albums) != 2 {
+		t.Fatalf("got %d albums, want 2", len(res.Albums))
+	}
+	// album tracks are in album order, and the artwork is the first's
+	abbey := res.Albums[0]
+	if abbey.Name != "Abbey Road" || abbey.Artist != "The Beatles" || abbey.ArtworkURL != "/artwork/" + tracks[1].PersistentID.String() {
+		t.Errorf("got album %#v", abbey)
+	}
+	if !reflect.DeepEqual(abbey.Tracks.names(), []string{"Come Together", "Something", "Here Comes the Sun"}) {
+		t.Errorf("got tracks %v for Abbey Road", abbey.Tracks.names())
+	}
+	if kob := res.Albums[1]; kob.Name != "Kind of Blue" || !reflect.DeepEqual(kob.Tracks.names(), []string{"Blue in Green"}) {
+		t.Errorf("got album %#v with tracks %v", kob, kob.Tracks.names())
+	}
+
+	var filtered struct {
+		Albums []*testAlbum `json:"albums"`
+	}
+	query(t, s, `{ albums(genre: "Rock") { name tracks(offset: 1, limit: 1) { total items { name } } } }`, nil, &filtered)
+	if len(filtered.Albums) != 1 || filtered.Albums[0].Name != "Abbey Road" {
+		t.Fatalf("got %#v filtering albums by genre", filtered.Albums)
+	}
+	if page := filtered.Albums[0].Tracks; page.Total != 3 || !reflect.DeepEqual(page.names(), []string{"Something"}) {
+		t.Errorf("got %v of %d paging album tracks", page.names(), page.Total)
+	}
+}
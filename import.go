@@ -0,0 +1,398 @@
+package itunes
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+
+	"github.com/rclancey/itunes/persistentId"
+)
+
+type PlaylistEntry struct {
+	Path     string `json:"path,omitempty"`
+	Title    string `json:"title,omitempty"`
+	Artist   string `json:"artist,omitempty"`
+	Album    string `json:"album,omitempty"`
+	Duration uint   `json:"duration,omitempty"`
+}
+
+func (e *PlaylistEntry) String() string {
+	if e.Path != "" {
+		return e.Path
+	}
+	if e.Artist != "" {
+		return e.Artist + " - " + e.Title
+	}
+	return e.Title
+}
+
+func PlaylistFormatFromFileName(fn string) (PlaylistFormat, error) {
+	switch strings.ToLower(filepath.Ext(fn)) {
+	case ".m3u", ".m3u8":
+		return PlaylistFormatM3U8, nil
+	case ".pls":
+		return PlaylistFormatPLS, nil
+	case ".xspf":
+		return PlaylistFormatXSPF, nil
+	}
+	return "", fmt.Errorf("unknown playlist format for %s", fn)
+}
+
+// ReadPlaylistFile parses a playlist file.  Relative entry paths are
+// resolved against the directory containing the file.  The returned name
+// is the playlist's title, or the file name if it has none.
+func ReadPlaylistFile(fn string) (string, []*PlaylistEntry, error) {
+	format, err := PlaylistFormatFromFileName(fn)
+	if err != nil {
+		return "", nil, err
+	}
+	f, err := os.Open(fn)
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+	name, entries, err := ReadPlaylist(f, format)
+	if err != nil {
+		return "", nil, err
+	}
+	if name == "" {
+		name = strings.TrimSuffix(filepath.Base(fn), filepath.Ext(fn))
+	}
+	dir := filepath.Dir(fn)
+	for _, e := range entries {
+		if e.Path != "" && !filepath.IsAbs(e.Path) && !isWindowsPath(e.Path) {
+			e.Path = filepath.Join(dir, e.Path)
+		}
+	}
+	return name, entries, nil
+}
+
+func ReadPlaylist(r io.Reader, format PlaylistFormat) (string, []*PlaylistEntry, error) {
+	switch format {
+	case PlaylistFormatM3U8:
+		return readM3U(r)
+	case PlaylistFormatPLS:
+		return readPLS(r)
+	case PlaylistFormatXSPF:
+		return readXSPF(r)
+	}
+	return "", nil, fmt.Errorf("unknown playlist format %s", format)
+}
+
+func entryPath(loc string) string {
+	if strings.HasPrefix(loc, "file:") {
+		u, err := url.Parse(loc)
+		if err == nil {
+			return u.Path
+		}
+	}
+	return loc
+}
+
+func splitTitle(e *PlaylistEntry, s string) {
+	parts := strings.SplitN(s, " - ", 2)
+	if len(parts) == 2 {
+		e.Artist = strings.TrimSpace(parts[0])
+		e.Title = strings.TrimSpace(parts[1])
+	} else {
+		e.Title = strings.TrimSpace(s)
+	}
+}
+
+func readM3U(r io.Reader) (string, []*PlaylistEntry, error) {
+	name := ""
+	entries := []*PlaylistEntry{}
+	cur := &PlaylistEntry{}
+	scanner := bufio.NewScanner(r)
+	first := true
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if first {
+			line = strings.TrimPrefix(line, "\ufeff")
+			first = false
+		}
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#PLAYLIST:") {
+			name = strings.TrimPrefix(line, "#PLAYLIST:")
+		} else if strings.HasPrefix(line, "#EXTINF:") {
+			parts := strings.SplitN(strings.TrimPrefix(line, "#EXTINF:"), ",", 2)
+			secs, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+			if err == nil && secs > 0 {
+				cur.Duration = uint(secs) * 1000
+			}
+			if len(parts) == 2 {
+				splitTitle(cur, parts[1])
+			}
+		} else if strings.HasPrefix(line, "#EXTALB:") {
+			cur.Album = strings.TrimPrefix(line, "#EXTALB:")
+		} else if strings.HasPrefix(line, "#EXTART:") {
+			cur.Artist = strings.TrimPrefix(line, "#EXTART:")
+		} else if strings.HasPrefix(line, "#") {
+			continue
+		} else {
+			cur.Path = entryPath(line)
+			entries = append(entries, cur)
+			cur = &PlaylistEntry{}
+		}
+	}
+	return name, entries, scanner.Err()
+}
+
+func readPLS(r io.Reader) (string, []*PlaylistEntry, error) {
+	byIndex := map[int]*PlaylistEntry{}
+	max := 0
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key := strings.ToLower(parts[0])
+		var field string
+		for _, prefix := range []string{"file", "title", "length"} {
+			if strings.HasPrefix(key, prefix) {
+				field = prefix
+				break
+			}
+		}
+		if field == "" {
+			continue
+		}
+		idx, err := strconv.Atoi(key[len(field):])
+		if err != nil || idx <= 0 {
+			continue
+		}
+		e, ok := byIndex[idx]
+		if !ok {
+			e = &PlaylistEntry{}
+			byIndex[idx] = e
+		}
+		if idx > max {
+			max = idx
+		}
+		switch field {
+		case "file":
+			e.Path = entryPath(parts[1])
+		case "title":
+			splitTitle(e, parts[1])
+		case "length":
+			secs, err := strconv.Atoi(parts[1])
+			if err == nil && secs > 0 {
+				e.Duration = uint(secs) * 1000
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", nil, err
+	}
+	entries := []*PlaylistEntry{}
+	for i := 1; i <= max; i++ {
+		e, ok := byIndex[i]
+		if ok && e.Path != "" {
+			entries = append(entries, e)
+		}
+	}
+	return "", entries, nil
+}
+
+func readXSPF(r io.Reader) (string, []*PlaylistEntry, error) {
+	doc := &xspfPlaylist{}
+	err := xml.NewDecoder(r).Decode(doc)
+	if err != nil {
+		return "", nil, err
+	}
+	entries := make([]*PlaylistEntry, len(doc.Tracks))
+	for i, tr := range doc.Tracks {
+		loc := tr.Location
+		u, err := url.Parse(loc)
+		if err == nil && (u.Scheme == "" || u.Scheme == "file") {
+			loc = u.Path
+		}
+		entries[i] = &PlaylistEntry{
+			Path:     loc,
+			Title:    tr.Title,
+			Artist:   tr.Creator,
+			Album:    tr.Album,
+			Duration: tr.Duration,
+		}
+	}
+	return doc.Title, entries, nil
+}
+
+type AmbiguousEntry struct {
+	Entry      *PlaylistEntry `json:"entry"`
+	Candidates []*Track       `json:"candidates"`
+}
+
+type ImportReport struct {
+	Playlist  *Playlist         `json:"playlist"`
+	Matched   int               `json:"matched"`
+	Unmatched []*PlaylistEntry  `json:"unmatched"`
+	Ambiguous []*AmbiguousEntry `json:"ambiguous"`
+}
+
+type ImportOptions struct {
+	Name     string
+	ParentID *pid.PersistentID
+	// DurationTolerance is the largest difference, in milliseconds,
+	// between an entry's duration and a track's for them to match.  Zero
+	// requires the durations to be equal; DefaultImportOptions allows two
+	// seconds.
+	DurationTolerance uint
+	// PickFirst adds the closest candidate for ambiguous entries instead
+	// of leaving them out of the playlist.
+	PickFirst bool
+}
+
+func DefaultImportOptions() *ImportOptions {
+	return &ImportOptions{DurationTolerance: 2000}
+}
+
+type trackMatcher struct {
+	finder *FileFinder
+	byPath map[string]*Track
+	byMeta map[string][]*Track
+}
+
+func normalizePath(finder *FileFinder, fn string) string {
+	if finder != nil {
+		fn = finder.Clean(fn)
+	}
+	fn = strings.Replace(fn, "\\", "/", -1)
+	return strings.ToLower(norm.NFC.String(fn))
+}
+
+func metaKey(artist, name string) string {
+	return MakeKey(artist) + "|" + MakeKey(name)
+}
+
+func newTrackMatcher(lib *Library) *trackMatcher {
+	m := &trackMatcher{
+		finder: GetGlobalFinder(),
+		byPath: map[string]*Track{},
+		byMeta: map[string][]*Track{},
+	}
+	for _, tr := range lib.Tracks {
+		if tr.Location != "" {
+			m.byPath[normalizePath(m.finder, tr.Location)] = tr
+		}
+		if tr.Name != "" {
+			k := metaKey(tr.Artist, tr.Name)
+			m.byMeta[k] = append(m.byMeta[k], tr)
+			if tr.AlbumArtist != "" && MakeKey(tr.AlbumArtist) != MakeKey(tr.Artist) {
+				k = metaKey(tr.AlbumArtist, tr.Name)
+				m.byMeta[k] = append(m.byMeta[k], tr)
+			}
+		}
+	}
+	return m
+}
+
+func durationDiff(a, b uint) uint {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+func (m *trackMatcher) match(e *PlaylistEntry, tolerance uint) []*Track {
+	if e.Path != "" {
+		tr, ok := m.byPath[normalizePath(m.finder, e.Path)]
+		if ok {
+			return []*Track{tr}
+		}
+	}
+	if e.Title == "" {
+		return nil
+	}
+	candidates := m.byMeta[metaKey(e.Artist, e.Title)]
+	if len(candidates) > 1 && e.Album != "" {
+		key := MakeKey(e.Album)
+		filtered := []*Track{}
+		for _, tr := range candidates {
+			if MakeKey(tr.Album) == key {
+				filtered = append(filtered, tr)
+			}
+		}
+		if len(filtered) > 0 {
+			candidates = filtered
+		}
+	}
+	if e.Duration > 0 {
+		filtered := []*Track{}
+		for _, tr := range candidates {
+			if tr.TotalTime == 0 || durationDiff(tr.TotalTime, e.Duration) <= tolerance {
+				filtered = append(filtered, tr)
+			}
+		}
+		candidates = filtered
+		sorted := TrackList(candidates)
+		stl := &SortableTrackList{tl: sorted, less: func(a, b *Track) bool {
+			return durationDiff(a.TotalTime, e.Duration) < durationDiff(b.TotalTime, e.Duration)
+		}}
+		sort.Stable(stl)
+	}
+	return candidates
+}
+
+// ImportPlaylist creates a regular playlist from entries, matching each
+// one to a library track by path first and then by artist, title, album
+// and duration.
+func (lib *Library) ImportPlaylist(entries []*PlaylistEntry, opts *ImportOptions) *ImportReport {
+	if opts == nil {
+		opts = DefaultImportOptions()
+	}
+	m := newTrackMatcher(lib)
+	report := &ImportReport{
+		Unmatched: []*PlaylistEntry{},
+		Ambiguous: []*AmbiguousEntry{},
+	}
+	tracks := []*Track{}
+	for _, e := range entries {
+		candidates := m.match(e, opts.DurationTolerance)
+		switch len(candidates) {
+		case 0:
+			report.Unmatched = append(report.Unmatched, e)
+		case 1:
+			tracks = append(tracks, candidates[0])
+			report.Matched += 1
+		default:
+			report.Ambiguous = append(report.Ambiguous, &AmbiguousEntry{e, candidates})
+			if opts.PickFirst {
+				tracks = append(tracks, candidates[0])
+			}
+		}
+	}
+	lib.Begin()
+	defer lib.Commit()
+	report.Playlist = lib.CreatePlaylist(opts.Name, opts.ParentID)
+	lib.AddToPlaylist(report.Playlist, tracks...)
+	return report
+}
+
+func (lib *Library) ImportPlaylistFile(fn string, opts *ImportOptions) (*ImportReport, error) {
+	name, entries, err := ReadPlaylistFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	if opts == nil {
+		opts = DefaultImportOptions()
+	}
+	xopts := *opts
+	if xopts.Name == "" {
+		xopts.Name = name
+	}
+	return lib.ImportPlaylist(entries, &xopts), nil
+}
@@ -0,0 +1,215 @@
+package itunes
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dhowden/tag"
+
+	"github.com/rclancey/itunes/media"
+	"github.com/rclancey/itunes/persistentId"
+)
+
+var extKind = map[string]string{
+	".aac": "AAC audio file",
+	".aif": "AIFF audio file",
+	".aiff": "AIFF audio file",
+	".flac": "FLAC audio file",
+	".m4a": "AAC audio file",
+	".m4p": "Protected AAC audio file",
+	".mp3": "MPEG audio file",
+	".ogg": "Ogg Vorbis audio file",
+	".opus": "Opus audio file",
+	".wav": "WAV audio file",
+}
+
+// pathOnly lists the formats neither the media package nor the tag reader
+// understands, which get their metadata from their path alone.
+var pathOnly = map[string]bool{
+	".aac": true,
+	".aif": true,
+	".aiff": true,
+}
+
+type FileError struct {
+	Path string `json:"path"`
+	Err error `json:"-"`
+}
+
+func (e *FileError) Error() string {
+	return e.Path + ": " + e.Err.Error()
+}
+
+func (e *FileError) Unwrap() error {
+	return e.Err
+}
+
+func (e *FileError) MarshalText() ([]byte, error) {
+	return []byte(e.Error()), nil
+}
+
+type DirectoryImportReport struct {
+	Added []*Track `json:"added"`
+	Skipped []string `json:"skipped"`
+	// Errors lists files that could not be imported, or were imported
+	// without some of their metadata.
+	Errors []*FileError `json:"errors"`
+}
+
+// ImportDirectory walks root and adds every audio file that isn't already
+// in the library, reading its metadata from its tags.  Files without
+// usable tags fall back to the artist/album/track layout of their path.
+func (lib *Library) ImportDirectory(root string) (*DirectoryImportReport, error) {
+	report := &DirectoryImportReport{
+		Added: []*Track{},
+		Skipped: []string{},
+		Errors: []*FileError{},
+	}
+	existing := map[string]bool{}
+	for _, tr := range lib.Tracks {
+		if tr.Location != "" {
+			existing[fileKey(tr.Path())] = true
+		}
+	}
+	lib.Begin()
+	defer lib.Commit()
+	err := filepath.Walk(root, func(fn string, info os.FileInfo, err error) error {
+		if err != nil {
+			report.Errors = append(report.Errors, &FileError{fn, err})
+			if info != nil && info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			if strings.HasPrefix(info.Name(), ".") && fn != root {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if _, ok := extKind[strings.ToLower(filepath.Ext(fn))]; !ok {
+			return nil
+		}
+		fn, err = filepath.Abs(fn)
+		if err != nil {
+			report.Errors = append(report.Errors, &FileError{fn, err})
+			return nil
+		}
+		if existing[fileKey(fn)] {
+			report.Skipped = append(report.Skipped, fn)
+			return nil
+		}
+		tr, errs := NewTrackFromFile(fn, info)
+		for _, err := range errs {
+			report.Errors = append(report.Errors, &FileError{fn, err})
+		}
+		if tr == nil {
+			return nil
+		}
+		lib.AddTrack(tr)
+		existing[fileKey(fn)] = true
+		report.Added = append(report.Added, tr)
+		return nil
+	})
+	return report, err
+}
+
+// NewTrackFromFile builds a track with a new persistent ID from a media
+// file.  Problems reading tags or the stream duration are returned
+// alongside the track rather than preventing it from being created.
+// Missing names, artists and albums come from GetName, GetArtist and
+// GetAlbum.
+func NewTrackFromFile(fn string, info os.FileInfo) (*Track, []error) {
+	errs := []error{}
+	ext := strings.ToLower(filepath.Ext(fn))
+	now := time.Now().In(time.UTC)
+	tr := &Track{
+		PersistentID: pid.NewPersistentID(),
+		Kind: extKind[ext],
+		Location: fn,
+		Size: uint64(info.Size()),
+		DateAdded: &Time{now},
+		DateModified: &Time{info.ModTime().In(time.UTC)},
+		Unplayed: true,
+	}
+	if !pathOnly[ext] {
+		errs = readFileMetadata(tr, fn)
+	}
+	tr.GetName()
+	if tr.Artist == "" && tr.AlbumArtist == "" {
+		tr.GetArtist()
+	}
+	tr.GetAlbum()
+	return tr, errs
+}
+
+func readFileMetadata(tr *Track, fn string) []error {
+	errs := []error{}
+	minfo, err := media.ReadFileInfo(fn)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("can't read duration: %s", err))
+	} else {
+		tr.TotalTime = minfo.Duration
+	}
+	f, err := os.Open(fn)
+	if err != nil {
+		return append(errs, err)
+	}
+	defer f.Close()
+	m, err := tag.ReadFrom(f)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("can't read tags: %s", err))
+	} else {
+		tr.Name = strings.TrimSpace(m.Title())
+		tr.Artist = strings.TrimSpace(m.Artist())
+		tr.AlbumArtist = strings.TrimSpace(m.AlbumArtist())
+		tr.Album = strings.TrimSpace(m.Album())
+		tr.Genre = strings.TrimSpace(m.Genre())
+		tr.Composer = strings.TrimSpace(m.Composer())
+		tr.Comments = strings.TrimSpace(m.Comment())
+		n, count := m.Track()
+		tr.TrackNumber = clampUint8(n)
+		tr.TrackCount = clampUint8(count)
+		n, count = m.Disc()
+		tr.DiscNumber = clampUint8(n)
+		tr.DiscCount = clampUint8(count)
+		if year := m.Year(); year > 0 {
+			tr.ReleaseDate = &Time{time.Date(year, time.January, 1, 0, 0, 0, 0, time.UTC)}
+		}
+		tr.Compilation = tagCompilation(m)
+	}
+	return errs
+}
+
+func clampUint8(n int) uint8 {
+	if n < 0 {
+		return 0
+	}
+	if n > 255 {
+		return 255
+	}
+	return uint8(n)
+}
+
+func tagCompilation(m tag.Metadata) bool {
+	raw := m.Raw()
+	for _, k := range []string{"cpil", "TCMP", "TCP", "compilation"} {
+		v, ok := raw[k]
+		if !ok {
+			continue
+		}
+		switch xv := v.(type) {
+		case int:
+			return xv != 0
+		case bool:
+			return xv
+		case string:
+			xs := strings.TrimSpace(strings.ToLower(xv))
+			return xs == "1" || xs == "true" || xs == "yes"
+		}
+	}
+	return false
+}
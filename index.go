@@ -553,21 +553,8 @@ func (tl *TrackList) Albums() [][3]string {
 		if tr.Album == "" {
 			continue
 		}
-		if tr.SortAlbum != "" {
-			key = tr.SortAlbum
-		} else {
-			key = tr.Album
-		}
+		key = albumKeySource(tr)
 		val = tr.Album
-		if tr.SortAlbumArtist != "" {
-			key += " " + tr.SortAlbumArtist
-		} else if tr.AlbumArtist != "" {
-			key += " " + tr.AlbumArtist
-		} else if tr.SortArtist != "" {
-			key += " " + tr.SortArtist
-		} else if tr.Artist != "" {
-			key += " " + tr.Artist
-		}
 		if tr.AlbumArtist != "" {
 			val += "|@@@|" + tr.AlbumArtist
 		} else if tr.Artist != "" {
@@ -586,6 +573,35 @@ func (tl *TrackList) Albums() [][3]string {
 	return xvals
 }
 
+func albumKeySource(tr *Track) string {
+	var key string
+	if tr.SortAlbum != "" {
+		key = tr.SortAlbum
+	} else {
+		key = tr.Album
+	}
+	if tr.SortAlbumArtist != "" {
+		key += " " + tr.SortAlbumArtist
+	} else if tr.AlbumArtist != "" {
+		key += " " + tr.AlbumArtist
+	} else if tr.SortArtist != "" {
+		key += " " + tr.SortArtist
+	} else if tr.Artist != "" {
+		key += " " + tr.Artist
+	}
+	return key
+}
+
+// AlbumKey identifies the album a track belongs to, as returned in the
+// third column of TrackList.Albums.  It is empty for tracks without an
+// album.
+func (t *Track) AlbumKey() string {
+	if t.Album == "" {
+		return ""
+	}
+	return MakeKey(albumKeySource(t))
+}
+
 var aAnThe = regexp.MustCompile(`^(a|an|the) `)
 var nonAlpha = regexp.MustCompile(`[^a-z0-9]+`)
 var spaces = regexp.MustCompile(`\s+`)
@@ -1,10 +1,13 @@
 package itunes
 
 import (
+	"errors"
 	"math/rand"
+	"os"
 	"path"
 	"sort"
 	"strings"
+	"sync"
 
 	"github.com/rclancey/itunes/loader"
 	"github.com/rclancey/itunes/persistentId"
@@ -23,6 +26,9 @@ type Library struct {
 	Tracks []*Track
 	Playlists map[pid.PersistentID]*Playlist
 	PlaylistTree []*Playlist
+	events *eventBus
+	mutex sync.RWMutex
+	applying bool
 }
 
 func NewLibrary() *Library {
@@ -30,12 +36,15 @@ func NewLibrary() *Library {
 	lib.Tracks = make([]*Track, 0)
 	lib.Playlists = map[pid.PersistentID]*Playlist{}
 	lib.PlaylistTree = []*Playlist{}
+	lib.events = newEventBus()
 	return lib
 }
 
 func (lib *Library) Load(fn string) error {
 	l := NewLoader(fn)
 	go l.LoadFile(fn)
+	lib.Begin()
+	defer lib.Commit()
 	for {
 		ch := l.GetChan()
 		update, ok := <-ch
@@ -213,7 +222,113 @@ func (lib *Library) CreatePlaylist(name string, parentId *pid.PersistentID) *Pla
 	}
 	lib.Playlists[p.PersistentID] = p
 	p.Nest(lib)
-	return nil
+	lib.emitPlaylist(PlaylistCreated, p.PersistentID)
+	return p
+}
+
+// CreateFolder adds an empty playlist folder.
+func (lib *Library) CreateFolder(name string, parentId *pid.PersistentID) *Playlist {
+	p := &Playlist{
+		PersistentID: pid.PersistentID(rand.Uint64()),
+		ParentPersistentID: parentId,
+		Name: name,
+		Folder: true,
+		Children: []*Playlist{},
+	}
+	lib.Playlists[p.PersistentID] = p
+	p.Nest(lib)
+	lib.emitPlaylist(PlaylistCreated, p.PersistentID)
+	return p
+}
+
+// DeletePlaylist removes a playlist.  Deleting a folder deletes everything
+// in it too.
+func (lib *Library) DeletePlaylist(p *Playlist) {
+	if _, ok := lib.Playlists[p.PersistentID]; !ok {
+		return
+	}
+	lib.Begin()
+	defer lib.Commit()
+	if p.Folder {
+		children := []*Playlist{}
+		for _, child := range lib.Playlists {
+			if child.ParentPersistentID != nil && *child.ParentPersistentID == p.PersistentID {
+				children = append(children, child)
+			}
+		}
+		for _, child := range children {
+			lib.DeletePlaylist(child)
+		}
+	}
+	p.Unnest(lib)
+	delete(lib.Playlists, p.PersistentID)
+	lib.emitPlaylist(PlaylistRemoved, p.PersistentID)
+}
+
+func (lib *Library) RenamePlaylist(p *Playlist, name string) {
+	if p.Name == name {
+		return
+	}
+	old := p.Name
+	p.Name = name
+	lib.emit(&Event{
+		Type: PlaylistRenamed,
+		PlaylistID: p.PersistentID.Pointer(),
+		OldName: old,
+		NewName: name,
+	})
+}
+
+func (lib *Library) AddToPlaylist(p *Playlist, tracks ...*Track) {
+	if len(tracks) == 0 {
+		return
+	}
+	for _, tr := range tracks {
+		p.AddTrack(tr)
+	}
+	lib.emitPlaylist(PlaylistTracksChanged, p.PersistentID)
+}
+
+func (lib *Library) RemoveFromPlaylist(p *Playlist, ids ...pid.PersistentID) {
+	if p.RemoveTracks(ids...) > 0 {
+		lib.emitPlaylist(PlaylistTracksChanged, p.PersistentID)
+	}
+}
+
+func (lib *Library) UpdatePlaylist(p, orig, cur *Playlist) {
+	oldName := p.Name
+	oldIDs := p.TrackIDs
+	oldSmart := p.Smart
+	parentId, moved := p.Update(orig, cur)
+	if p.Name != oldName {
+		lib.emit(&Event{
+			Type: PlaylistRenamed,
+			PlaylistID: p.PersistentID.Pointer(),
+			OldName: oldName,
+			NewName: p.Name,
+		})
+	}
+	if !pidsEqual(oldIDs, p.TrackIDs) {
+		lib.emitPlaylist(PlaylistTracksChanged, p.PersistentID)
+	}
+	if p.Smart != oldSmart {
+		lib.emit(&Event{Type: PlaylistModified, PlaylistID: p.PersistentID.Pointer(), Fields: []string{"Smart"}})
+	}
+	if moved {
+		lib.MovePlaylist(p, parentId)
+	}
+}
+
+func pidsEqual(a, b []pid.PersistentID) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i, id := range a {
+		if b[i] != id {
+			return false
+		}
+	}
+	return true
 }
 
 func (lib *Library) TrackList() *TrackList {
@@ -257,6 +372,15 @@ func (lib *Library) AddTrack(tr *Track) {
 		runtime.GC()
 	}
 	*/
+	lib.emitTrack(TrackAdded, id, nil)
+}
+
+func (lib *Library) UpdateTrack(tr, orig, cur *Track) []string {
+	fields := tr.Update(orig, cur)
+	if len(fields) > 0 {
+		lib.emitTrack(TrackModified, tr.PersistentID, fields)
+	}
+	return fields
 }
 
 func (lib *Library) RemoveTrack(id pid.PersistentID) {
@@ -270,26 +394,15 @@ func (lib *Library) RemoveTrack(id pid.PersistentID) {
 	}
 	tracks := append(lib.Tracks[:idx], lib.Tracks[idx+1:]...)
 	lib.Tracks = tracks
+	lib.Begin()
+	defer lib.Commit()
+	lib.emitTrack(TrackRemoved, id, nil)
 	for _, pl := range lib.Playlists {
 		if pl.Folder || pl.Smart != nil {
 			continue
 		}
-		found := 0
-		for _, tid := range pl.TrackIDs {
-			if tid == id {
-				found += 1
-			}
-		}
-		if found > 0 {
-			ids := make([]pid.PersistentID, len(pl.TrackIDs) - found)
-			i := 0
-			for _, tid := range pl.TrackIDs {
-				if tid != id {
-					ids[i] = tid
-					i += 1
-				}
-			}
-			pl.TrackIDs = ids
+		if pl.RemoveTracks(id) > 0 {
+			lib.emitPlaylist(PlaylistTracksChanged, pl.PersistentID)
 		}
 	}
 }
@@ -309,6 +422,20 @@ func (lib *Library) GetTrack(id pid.PersistentID) *Track {
 	return nil
 }
 
+// TrackPath returns the media file of a track.  It can be used as an
+// artwork.PathResolver.
+func (lib *Library) TrackPath(id pid.PersistentID) (string, error) {
+	tr := lib.GetTrack(id)
+	if tr == nil {
+		return "", os.ErrNotExist
+	}
+	fn := tr.Path()
+	if fn == "" {
+		return "", os.ErrNotExist
+	}
+	return fn, nil
+}
+
 type spls []*Playlist
 func (s spls) Len() int { return len(s) }
 func (s spls) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
@@ -353,6 +480,11 @@ func (l *Library) RenestPlaylists() {
 	sort.Sort(spls(l.PlaylistTree))
 }
 
+var ErrPlaylistCycle = errors.New("can't move a folder into itself or one of its subfolders")
+
+// MovePlaylist moves p into the folder parentId, or to the top level when
+// parentId is nil.  Moving a folder into itself or anything inside it
+// fails with ErrPlaylistCycle.
 func (l *Library) MovePlaylist(p *Playlist, parentId *pid.PersistentID) error {
 	if p.ParentPersistentID == nil && parentId == nil {
 		return nil
@@ -360,8 +492,27 @@ func (l *Library) MovePlaylist(p *Playlist, parentId *pid.PersistentID) error {
 	if p.ParentPersistentID != nil && parentId != nil && *p.ParentPersistentID == *parentId {
 		return nil
 	}
+	seen := map[pid.PersistentID]bool{}
+	for id := parentId; id != nil && !seen[*id]; {
+		if *id == p.PersistentID {
+			return ErrPlaylistCycle
+		}
+		seen[*id] = true
+		parent, ok := l.Playlists[*id]
+		if !ok {
+			break
+		}
+		id = parent.ParentPersistentID
+	}
+	oldParentId := p.ParentPersistentID
 	p.Unnest(l)
 	p.ParentPersistentID = parentId
 	p.Nest(l)
+	l.emit(&Event{
+		Type: PlaylistMoved,
+		PlaylistID: p.PersistentID.Pointer(),
+		OldParentID: oldParentId,
+		NewParentID: parentId,
+	})
 	return nil
 }
@@ -0,0 +1,54 @@
+package media
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"os"
+)
+
+// PayloadHash returns a hash of the audio data in fn, leaving out ID3 tags
+// and MP4 metadata so that copies of a track with different tags hash the
+// same.  Other formats are hashed whole.
+func PayloadHash(fn string) (string, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	start := int64(0)
+	end := st.Size()
+	head := make([]byte, 8)
+	n, _ := io.ReadFull(f, head)
+	if n == 8 && string(head[4:8]) == "ftyp" {
+		a, err := findAtom(f, 0, end, "mdat")
+		if err != nil {
+			return "", err
+		}
+		start = a.dataStart
+		end = a.end
+	} else if n >= 4 && isMP3(fn, head) {
+		_, size, err := readID3(f)
+		if err != nil {
+			return "", err
+		}
+		start = size
+		if end - start >= 128 {
+			tail := make([]byte, 3)
+			_, err = f.ReadAt(tail, end - 128)
+			if err == nil && string(tail) == "TAG" {
+				end -= 128
+			}
+		}
+	}
+	h := sha1.New()
+	_, err = io.Copy(h, io.NewSectionReader(f, start, end - start))
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,557 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+type id3Frame struct {
+	id string
+	flags [2]byte
+	data []byte
+}
+
+type id3Tag struct {
+	version byte
+	frames []*id3Frame
+}
+
+var id3v22Frames = map[string]string{
+	"TT1": "TIT1",
+	"TT2": "TIT2",
+	"TP1": "TPE1",
+	"TP2": "TPE2",
+	"TAL": "TALB",
+	"TCM": "TCOM",
+	"TCO": "TCON",
+	"TRK": "TRCK",
+	"TPA": "TPOS",
+	"TYE": "TYER",
+	"COM": "COMM",
+	"TCP": "TCMP",
+	"TST": "TSOT",
+	"TSP": "TSOP",
+	"TS2": "TSO2",
+	"TSA": "TSOA",
+	"TSC": "TSOC",
+	"POP": "POPM",
+	"PIC": "APIC",
+	"ULT": "USLT",
+}
+
+func syncsafe(b []byte) int {
+	return int(b[0]) << 21 | int(b[1]) << 14 | int(b[2]) << 7 | int(b[3])
+}
+
+func putSyncsafe(b []byte, n int) {
+	b[0] = byte(n >> 21) & 0x7f
+	b[1] = byte(n >> 14) & 0x7f
+	b[2] = byte(n >> 7) & 0x7f
+	b[3] = byte(n) & 0x7f
+}
+
+func removeUnsync(data []byte) []byte {
+	return bytes.Replace(data, []byte{0xff, 0x00}, []byte{0xff}, -1)
+}
+
+// readID3 reads the ID3v2 tag at the start of r, returning the total
+// number of bytes it occupies (header, frames, padding and footer).
+func readID3(r io.ReadSeeker) (*id3Tag, int64, error) {
+	_, err := r.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, 0, err
+	}
+	hdr := make([]byte, 10)
+	_, err = io.ReadFull(r, hdr)
+	if err != nil || string(hdr[:3]) != "ID3" {
+		return nil, 0, nil
+	}
+	version := hdr[3]
+	flags := hdr[5]
+	size := syncsafe(hdr[6:])
+	total := int64(size) + 10
+	if flags & 0x10 != 0 {
+		total += 10
+	}
+	// don't trust the header's size before allocating for it
+	end, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, 0, err
+	}
+	if int64(size) > end - 10 {
+		return nil, 0, errors.New("id3 tag overruns the file")
+	}
+	_, err = r.Seek(10, io.SeekStart)
+	if err != nil {
+		return nil, 0, err
+	}
+	body := make([]byte, size)
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		return nil, 0, err
+	}
+	if flags & 0x80 != 0 && version < 4 {
+		body = removeUnsync(body)
+	}
+	if flags & 0x40 != 0 {
+		switch version {
+		case 3:
+			if len(body) >= 4 {
+				n := int(binary.BigEndian.Uint32(body)) + 4
+				if n <= len(body) {
+					body = body[n:]
+				}
+			}
+		case 4:
+			if len(body) >= 4 {
+				n := syncsafe(body)
+				if n <= len(body) {
+					body = body[n:]
+				}
+			}
+		}
+	}
+	tag := &id3Tag{version: version, frames: []*id3Frame{}}
+	switch version {
+	case 2:
+		for len(body) >= 6 && body[0] != 0 {
+			id := string(body[:3])
+			n := int(body[3]) << 16 | int(body[4]) << 8 | int(body[5])
+			if 6 + n > len(body) {
+				break
+			}
+			data := body[6:6+n]
+			body = body[6+n:]
+			xid, ok := id3v22Frames[id]
+			if !ok {
+				continue
+			}
+			if xid == "APIC" {
+				data = convertPIC(data)
+				if data == nil {
+					continue
+				}
+			}
+			tag.frames = append(tag.frames, &id3Frame{id: xid, data: data})
+		}
+	case 3, 4:
+		for len(body) >= 10 && body[0] != 0 {
+			id := string(body[:4])
+			var n int
+			if version == 4 {
+				n = syncsafe(body[4:])
+			} else {
+				n = int(binary.BigEndian.Uint32(body[4:]))
+			}
+			if 10 + n > len(body) {
+				break
+			}
+			frame := &id3Frame{id: id, data: body[10:10+n]}
+			copy(frame.flags[:], body[8:10])
+			tag.frames = append(tag.frames, frame)
+			body = body[10+n:]
+		}
+	default:
+		return nil, 0, errors.New("unsupported id3 version " + strconv.Itoa(int(version)))
+	}
+	return tag, total, nil
+}
+
+func convertPIC(data []byte) []byte {
+	if len(data) < 5 {
+		return nil
+	}
+	mime := "image/jpeg"
+	if strings.ToUpper(string(data[1:4])) == "PNG" {
+		mime = "image/png"
+	}
+	out := []byte{data[0]}
+	out = append(out, []byte(mime)...)
+	out = append(out, 0)
+	return append(out, data[4:]...)
+}
+
+func (frame *id3Frame) plain() []byte {
+	data := frame.data
+	// v2.4 frame level flags: unsynchronised and data length indicator
+	if frame.flags[1] & 0x01 != 0 && len(data) >= 4 {
+		data = data[4:]
+	}
+	if frame.flags[1] & 0x02 != 0 {
+		data = removeUnsync(data)
+	}
+	return data
+}
+
+func decodeLatin1(b []byte) string {
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+	return string(runes)
+}
+
+func decodeUTF16(b []byte, bigEndian bool) string {
+	if len(b) >= 2 {
+		if b[0] == 0xff && b[1] == 0xfe {
+			bigEndian = false
+			b = b[2:]
+		} else if b[0] == 0xfe && b[1] == 0xff {
+			bigEndian = true
+			b = b[2:]
+		}
+	}
+	u := make([]uint16, len(b) / 2)
+	for i := range u {
+		if bigEndian {
+			u[i] = binary.BigEndian.Uint16(b[i*2:])
+		} else {
+			u[i] = binary.LittleEndian.Uint16(b[i*2:])
+		}
+	}
+	return string(utf16.Decode(u))
+}
+
+func decodeText(enc byte, b []byte) string {
+	switch enc {
+	case 1:
+		return decodeUTF16(b, false)
+	case 2:
+		return decodeUTF16(b, true)
+	case 3:
+		return string(b)
+	}
+	return decodeLatin1(b)
+}
+
+// splitTerminated splits b at the first string terminator for enc.
+func splitTerminated(enc byte, b []byte) ([]byte, []byte) {
+	if enc == 1 || enc == 2 {
+		for i := 0; i + 1 < len(b); i += 2 {
+			if b[i] == 0 && b[i+1] == 0 {
+				return b[:i], b[i+2:]
+			}
+		}
+		return b, nil
+	}
+	idx := bytes.IndexByte(b, 0)
+	if idx < 0 {
+		return b, nil
+	}
+	return b[:idx], b[idx+1:]
+}
+
+func (frame *id3Frame) text() string {
+	data := frame.plain()
+	if len(data) < 1 {
+		return ""
+	}
+	enc := data[0]
+	// only the first of multiple values is used
+	s, _ := splitTerminated(enc, data[1:])
+	return decodeText(enc, s)
+}
+
+func (frame *id3Frame) comment() (string, string) {
+	data := frame.plain()
+	if len(data) < 4 {
+		return "", ""
+	}
+	enc := data[0]
+	desc, text := splitTerminated(enc, data[4:])
+	return decodeText(enc, desc), strings.TrimRight(decodeText(enc, text), "\x00")
+}
+
+const popmEmail = "no@email"
+
+func (frame *id3Frame) popm() (string, int) {
+	data := frame.plain()
+	idx := bytes.IndexByte(data, 0)
+	if idx < 0 || idx + 1 >= len(data) {
+		return "", 0
+	}
+	return string(data[:idx]), int(data[idx+1])
+}
+
+func (tag *id3Tag) find(id string) *id3Frame {
+	for _, frame := range tag.frames {
+		if frame.id == id {
+			return frame
+		}
+	}
+	return nil
+}
+
+func (tag *id3Tag) text(ids ...string) string {
+	for _, id := range ids {
+		frame := tag.find(id)
+		if frame != nil {
+			return frame.text()
+		}
+	}
+	return ""
+}
+
+func (tag *id3Tag) tags() *Tags {
+	t := &Tags{}
+	switch tag.version {
+	case 2:
+		t.Format = TagFormatID3v22
+	case 3:
+		t.Format = TagFormatID3v23
+	default:
+		t.Format = TagFormatID3v24
+	}
+	t.Title = tag.text("TIT2")
+	t.Artist = tag.text("TPE1")
+	t.AlbumArtist = tag.text("TPE2")
+	t.Album = tag.text("TALB")
+	t.Composer = tag.text("TCOM")
+	t.Genre = genreName(tag.text("TCON"))
+	t.Grouping = tag.text("GRP1")
+	t.Work = tag.text("TIT1")
+	t.SortTitle = tag.text("TSOT")
+	t.SortArtist = tag.text("TSOP")
+	t.SortAlbumArtist = tag.text("TSO2")
+	t.SortAlbum = tag.text("TSOA")
+	t.SortComposer = tag.text("TSOC")
+	t.TrackNumber, t.TrackCount = parseNumberPair(tag.text("TRCK"))
+	t.DiscNumber, t.DiscCount = parseNumberPair(tag.text("TPOS"))
+	t.Year = parseYear(tag.text("TDRC", "TYER"))
+	t.Compilation = tag.text("TCMP") == "1"
+	for _, frame := range tag.frames {
+		switch frame.id {
+		case "COMM":
+			if t.Comment == "" {
+				desc, text := frame.comment()
+				if desc == "" {
+					t.Comment = text
+				}
+			}
+		case "POPM":
+			email, rating := frame.popm()
+			if email == popmEmail || t.Rating == 0 {
+				t.Rating = popmToRating(rating)
+			}
+		}
+	}
+	return t
+}
+
+// POPM ratings run from 1 to 255; these are the values Windows Media
+// Player uses for one to five stars.
+var popmStars = []int{0, 1, 64, 128, 196, 255}
+
+func popmToRating(v int) int {
+	if v == 0 {
+		return 0
+	}
+	for stars := 1; stars < len(popmStars); stars++ {
+		if v <= popmStars[stars] {
+			return stars * 20
+		}
+	}
+	return 100
+}
+
+func ratingToPOPM(r int) int {
+	stars := (r + 10) / 20
+	if stars < 0 {
+		stars = 0
+	}
+	if stars > 5 {
+		stars = 5
+	}
+	return popmStars[stars]
+}
+
+func isLatin1(s string) bool {
+	for _, r := range s {
+		if r > 0xff {
+			return false
+		}
+	}
+	return true
+}
+
+func encodeText(version byte, s string) (byte, []byte) {
+	if version >= 4 {
+		return 3, []byte(s)
+	}
+	if isLatin1(s) {
+		b := make([]byte, 0, len(s))
+		for _, r := range s {
+			b = append(b, byte(r))
+		}
+		return 0, b
+	}
+	u := utf16.Encode([]rune(s))
+	b := make([]byte, 2 + len(u) * 2)
+	b[0] = 0xff
+	b[1] = 0xfe
+	for i, c := range u {
+		binary.LittleEndian.PutUint16(b[2+i*2:], c)
+	}
+	return 1, b
+}
+
+func terminator(enc byte) []byte {
+	if enc == 1 || enc == 2 {
+		return []byte{0, 0}
+	}
+	return []byte{0}
+}
+
+func textFrame(version byte, id, s string) *id3Frame {
+	enc, b := encodeText(version, s)
+	return &id3Frame{id: id, data: append([]byte{enc}, b...)}
+}
+
+func commentFrame(version byte, s string) *id3Frame {
+	enc, b := encodeText(version, s)
+	data := append([]byte{enc}, []byte("eng")...)
+	data = append(data, terminator(enc)...)
+	return &id3Frame{id: "COMM", data: append(data, b...)}
+}
+
+func popmFrame(rating int) *id3Frame {
+	data := append([]byte(popmEmail), 0, byte(ratingToPOPM(rating)))
+	return &id3Frame{id: "POPM", data: data}
+}
+
+type id3Text struct {
+	id string
+	value string
+}
+
+// update replaces the frames that correspond to fields in t.
+func (tag *id3Tag) update(t *Tags) {
+	v := tag.version
+	texts := []id3Text{
+		{"TIT2", t.Title},
+		{"TPE1", t.Artist},
+		{"TPE2", t.AlbumArtist},
+		{"TALB", t.Album},
+		{"TCOM", t.Composer},
+		{"TCON", t.Genre},
+		{"GRP1", t.Grouping},
+		{"TIT1", t.Work},
+		{"TSOT", t.SortTitle},
+		{"TSOP", t.SortArtist},
+		{"TSO2", t.SortAlbumArtist},
+		{"TSOA", t.SortAlbum},
+		{"TSOC", t.SortComposer},
+		{"TRCK", formatNumberPair(t.TrackNumber, t.TrackCount)},
+		{"TPOS", formatNumberPair(t.DiscNumber, t.DiscCount)},
+	}
+	year := ""
+	if t.Year > 0 {
+		year = strconv.Itoa(t.Year)
+	}
+	if v >= 4 {
+		texts = append(texts, id3Text{"TDRC", year})
+	} else {
+		texts = append(texts, id3Text{"TYER", year})
+	}
+	compilation := ""
+	if t.Compilation {
+		compilation = "1"
+	}
+	texts = append(texts, id3Text{"TCMP", compilation})
+	managed := map[string]bool{"TDRC": true, "TYER": true, "TDAT": true}
+	for _, x := range texts {
+		managed[x.id] = true
+	}
+	frames := []*id3Frame{}
+	for _, x := range texts {
+		if x.value != "" {
+			frames = append(frames, textFrame(v, x.id, x.value))
+		}
+	}
+	if t.Comment != "" {
+		frames = append(frames, commentFrame(v, t.Comment))
+	}
+	if t.Rating > 0 {
+		frames = append(frames, popmFrame(t.Rating))
+	}
+	for _, frame := range tag.frames {
+		if managed[frame.id] {
+			continue
+		}
+		if frame.id == "COMM" {
+			desc, _ := frame.comment()
+			if desc == "" {
+				continue
+			}
+		}
+		if frame.id == "POPM" {
+			email, _ := frame.popm()
+			if email == popmEmail {
+				continue
+			}
+		}
+		frames = append(frames, frame)
+	}
+	tag.frames = frames
+}
+
+func (tag *id3Tag) encodeFrames() []byte {
+	buf := &bytes.Buffer{}
+	for _, frame := range tag.frames {
+		hdr := make([]byte, 10)
+		copy(hdr, frame.id)
+		if tag.version >= 4 {
+			putSyncsafe(hdr[4:], len(frame.data))
+		} else {
+			binary.BigEndian.PutUint32(hdr[4:], uint32(len(frame.data)))
+		}
+		copy(hdr[8:], frame.flags[:])
+		buf.Write(hdr)
+		buf.Write(frame.data)
+	}
+	return buf.Bytes()
+}
+
+func (tag *id3Tag) encode(size int) []byte {
+	frames := tag.encodeFrames()
+	if size < len(frames) + 10 {
+		size = len(frames) + 10
+	}
+	out := make([]byte, size)
+	copy(out, "ID3")
+	out[3] = tag.version
+	putSyncsafe(out[6:], size - 10)
+	copy(out[10:], frames)
+	return out
+}
+
+const id3Padding = 2048
+
+func writeID3Tags(f *os.File, fn string, t *Tags) error {
+	tag, oldSize, err := readID3(f)
+	if err != nil {
+		return err
+	}
+	if tag == nil || tag.version == 2 {
+		// v2.2 tags are upgraded; frames without a v2.3 equivalent
+		// are dropped
+		frames := []*id3Frame{}
+		if tag != nil {
+			frames = tag.frames
+		}
+		tag = &id3Tag{version: 3, frames: frames}
+	}
+	tag.update(t)
+	needed := int64(len(tag.encodeFrames()) + 10)
+	if oldSize > 0 && needed <= oldSize {
+		_, err = f.WriteAt(tag.encode(int(oldSize)), 0)
+		return err
+	}
+	return replaceFile(f, fn, tag.encode(int(needed) + id3Padding), oldSize)
+}
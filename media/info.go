@@ -0,0 +1,428 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var ErrUnknownFormat = errors.New("unknown media format")
+
+type Info struct {
+	// Duration in milliseconds
+	Duration uint
+	// BitRate in kbps
+	BitRate uint
+	SampleRate uint
+	Size int64
+}
+
+func ReadFileInfo(fn string) (*Info, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadInfo(f, filepath.Ext(fn))
+}
+
+// ReadInfo works out the duration and bit rate of an audio stream without
+// decoding it.  The extension is used as a hint; the content is sniffed
+// when it is empty or unrecognized.
+func ReadInfo(r io.ReadSeeker, ext string) (*Info, error) {
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	_, err = r.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	head := make([]byte, 12)
+	n, err := io.ReadFull(r, head)
+	if err != nil && n == 0 {
+		return nil, err
+	}
+	head = head[:n]
+	_, err = r.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	var info *Info
+	switch {
+	case bytes.HasPrefix(head, []byte("fLaC")):
+		info, err = readFLAC(r)
+	case bytes.HasPrefix(head, []byte("OggS")):
+		info, err = readOgg(r, size)
+	case bytes.HasPrefix(head, []byte("RIFF")) && len(head) >= 12 && string(head[8:12]) == "WAVE":
+		info, err = readWAV(r)
+	case len(head) >= 8 && string(head[4:8]) == "ftyp":
+		info, err = readMP4(r, size)
+	case bytes.HasPrefix(head, []byte("ID3")):
+		info, err = readMP3(r, size)
+	default:
+		switch strings.ToLower(ext) {
+		case ".mp3", ".mp2":
+			info, err = readMP3(r, size)
+		case ".m4a", ".m4p", ".m4b", ".mp4", ".m4v", ".mov":
+			info, err = readMP4(r, size)
+		default:
+			if len(head) >= 2 && head[0] == 0xff && head[1] & 0xe0 == 0xe0 {
+				info, err = readMP3(r, size)
+			} else {
+				return nil, ErrUnknownFormat
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	info.Size = size
+	if info.BitRate == 0 && info.Duration > 0 {
+		info.BitRate = uint(size * 8 / int64(info.Duration))
+	}
+	return info, nil
+}
+
+var mp3BitRates = [2][3][16]uint{
+	// MPEG 1: layer I, II, III
+	{
+		{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448, 0},
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384, 0},
+		{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0},
+	},
+	// MPEG 2 and 2.5: layer I, II, III
+	{
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256, 0},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},
+	},
+}
+
+var mp3SampleRates = map[byte][3]uint{
+	3: {44100, 48000, 32000},
+	2: {22050, 24000, 16000},
+	0: {11025, 12000, 8000},
+}
+
+type mp3Frame struct {
+	version byte
+	layer int
+	bitRate uint
+	sampleRate uint
+	samples uint
+	mono bool
+}
+
+func parseMP3Frame(h []byte) *mp3Frame {
+	if h[0] != 0xff || h[1] & 0xe0 != 0xe0 {
+		return nil
+	}
+	version := (h[1] >> 3) & 3
+	layerBits := (h[1] >> 1) & 3
+	if version == 1 || layerBits == 0 {
+		return nil
+	}
+	layer := 4 - int(layerBits)
+	brIdx := h[2] >> 4
+	srIdx := (h[2] >> 2) & 3
+	if brIdx == 0 || brIdx == 15 || srIdx == 3 {
+		return nil
+	}
+	f := &mp3Frame{version: version, layer: layer}
+	vIdx := 0
+	if version != 3 {
+		vIdx = 1
+	}
+	f.bitRate = mp3BitRates[vIdx][layer-1][brIdx]
+	f.sampleRate = mp3SampleRates[version][srIdx]
+	switch {
+	case layer == 1:
+		f.samples = 384
+	case layer == 3 && version != 3:
+		f.samples = 576
+	default:
+		f.samples = 1152
+	}
+	f.mono = h[3] >> 6 == 3
+	return f
+}
+
+func readMP3(r io.ReadSeeker, size int64) (*Info, error) {
+	var start int64
+	hdr := make([]byte, 10)
+	_, err := io.ReadFull(r, hdr)
+	if err != nil {
+		return nil, err
+	}
+	if string(hdr[:3]) == "ID3" {
+		start = int64(hdr[6]) << 21 | int64(hdr[7]) << 14 | int64(hdr[8]) << 7 | int64(hdr[9])
+		start += 10
+		if hdr[5] & 0x10 != 0 {
+			start += 10
+		}
+	}
+	_, err = r.Seek(start, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 64 * 1024)
+	n, err := io.ReadFull(r, buf)
+	if err != nil && n == 0 {
+		return nil, err
+	}
+	buf = buf[:n]
+	for i := 0; i + 4 <= len(buf); i++ {
+		frame := parseMP3Frame(buf[i:i+4])
+		if frame == nil {
+			continue
+		}
+		audioStart := start + int64(i)
+		info := &Info{SampleRate: frame.sampleRate}
+		frames := mp3VBRFrames(buf[i:], frame)
+		if frames > 0 {
+			info.Duration = uint(uint64(frames) * uint64(frame.samples) * 1000 / uint64(frame.sampleRate))
+			return info, nil
+		}
+		audioSize := size - audioStart
+		if audioSize > 128 {
+			// probably an ID3v1 tag at the end
+			audioSize -= 128
+		}
+		info.BitRate = frame.bitRate
+		info.Duration = uint(audioSize * 8 / int64(frame.bitRate))
+		return info, nil
+	}
+	return nil, errors.New("no mpeg audio frame found")
+}
+
+func mp3VBRFrames(buf []byte, frame *mp3Frame) uint32 {
+	var off int
+	if frame.version == 3 {
+		if frame.mono {
+			off = 4 + 17
+		} else {
+			off = 4 + 32
+		}
+	} else {
+		if frame.mono {
+			off = 4 + 9
+		} else {
+			off = 4 + 17
+		}
+	}
+	if len(buf) >= off + 12 {
+		tag := string(buf[off:off+4])
+		if tag == "Xing" || tag == "Info" {
+			flags := binary.BigEndian.Uint32(buf[off+4:])
+			if flags & 1 != 0 {
+				return binary.BigEndian.Uint32(buf[off+8:])
+			}
+		}
+	}
+	off = 4 + 32
+	if len(buf) >= off + 18 && string(buf[off:off+4]) == "VBRI" {
+		return binary.BigEndian.Uint32(buf[off+14:])
+	}
+	return 0
+}
+
+func readMP4(r io.ReadSeeker, size int64) (*Info, error) {
+	moov, err := findAtom(r, 0, size, "moov")
+	if err != nil {
+		return nil, err
+	}
+	mvhd, err := findAtom(r, moov.dataStart, moov.end, "mvhd")
+	if err != nil {
+		return nil, err
+	}
+	_, err = r.Seek(mvhd.dataStart, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, 32)
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return nil, err
+	}
+	var timescale, duration uint64
+	if data[0] == 1 {
+		timescale = uint64(binary.BigEndian.Uint32(data[20:]))
+		duration = binary.BigEndian.Uint64(data[24:])
+	} else {
+		timescale = uint64(binary.BigEndian.Uint32(data[12:]))
+		duration = uint64(binary.BigEndian.Uint32(data[16:]))
+	}
+	if timescale == 0 {
+		return nil, errors.New("invalid mp4 timescale")
+	}
+	return &Info{Duration: uint(duration * 1000 / timescale)}, nil
+}
+
+type atom struct {
+	kind string
+	start int64
+	dataStart int64
+	end int64
+}
+
+func readAtomHeader(r io.ReadSeeker, pos, limit int64) (*atom, error) {
+	_, err := r.Seek(pos, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	hdr := make([]byte, 8)
+	_, err = io.ReadFull(r, hdr)
+	if err != nil {
+		return nil, err
+	}
+	a := &atom{kind: string(hdr[4:]), start: pos, dataStart: pos + 8}
+	size := int64(binary.BigEndian.Uint32(hdr))
+	switch size {
+	case 0:
+		a.end = limit
+	case 1:
+		ext := make([]byte, 8)
+		_, err = io.ReadFull(r, ext)
+		if err != nil {
+			return nil, err
+		}
+		a.dataStart += 8
+		a.end = pos + int64(binary.BigEndian.Uint64(ext))
+	default:
+		a.end = pos + size
+	}
+	if a.end < a.dataStart || a.end > limit {
+		return nil, errors.New("invalid mp4 atom size")
+	}
+	return a, nil
+}
+
+func findAtom(r io.ReadSeeker, pos, limit int64, kind string) (*atom, error) {
+	for pos + 8 <= limit {
+		a, err := readAtomHeader(r, pos, limit)
+		if err != nil {
+			return nil, err
+		}
+		if a.kind == kind {
+			return a, nil
+		}
+		pos = a.end
+	}
+	return nil, errors.New("mp4 atom " + kind + " not found")
+}
+
+func readFLAC(r io.ReadSeeker) (*Info, error) {
+	data := make([]byte, 4 + 4 + 34)
+	_, err := io.ReadFull(r, data)
+	if err != nil {
+		return nil, err
+	}
+	if data[4] & 0x7f != 0 {
+		return nil, errors.New("flac streaminfo block missing")
+	}
+	si := data[8:]
+	sampleRate := uint64(si[10]) << 12 | uint64(si[11]) << 4 | uint64(si[12]) >> 4
+	samples := uint64(si[13] & 0x0f) << 32 | uint64(binary.BigEndian.Uint32(si[14:]))
+	if sampleRate == 0 {
+		return nil, errors.New("invalid flac sample rate")
+	}
+	return &Info{
+		Duration: uint(samples * 1000 / sampleRate),
+		SampleRate: uint(sampleRate),
+	}, nil
+}
+
+func readWAV(r io.ReadSeeker) (*Info, error) {
+	_, err := r.Seek(12, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	var byteRate, sampleRate uint32
+	hdr := make([]byte, 8)
+	for {
+		_, err = io.ReadFull(r, hdr)
+		if err != nil {
+			return nil, err
+		}
+		size := int64(binary.LittleEndian.Uint32(hdr[4:]))
+		switch string(hdr[:4]) {
+		case "fmt ":
+			if size < 12 {
+				return nil, errors.New("invalid wav fmt chunk")
+			}
+			// only the sample and byte rates are needed; skip the
+			// rest, however large the chunk claims to be
+			fmtData := make([]byte, 12)
+			_, err = io.ReadFull(r, fmtData)
+			if err != nil {
+				return nil, err
+			}
+			sampleRate = binary.LittleEndian.Uint32(fmtData[4:])
+			byteRate = binary.LittleEndian.Uint32(fmtData[8:])
+			_, err = r.Seek(size - 12 + size % 2, io.SeekCurrent)
+			if err != nil {
+				return nil, err
+			}
+		case "data":
+			if byteRate == 0 {
+				return nil, errors.New("wav data before fmt chunk")
+			}
+			return &Info{
+				Duration: uint(size * 1000 / int64(byteRate)),
+				BitRate: uint(uint64(byteRate) * 8 / 1000),
+				SampleRate: uint(sampleRate),
+			}, nil
+		default:
+			_, err = r.Seek(size + size % 2, io.SeekCurrent)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+func readOgg(r io.ReadSeeker, size int64) (*Info, error) {
+	head := make([]byte, 128)
+	n, err := io.ReadFull(r, head)
+	if err != nil && n == 0 {
+		return nil, err
+	}
+	head = head[:n]
+	var sampleRate uint64
+	if idx := bytes.Index(head, []byte("\x01vorbis")); idx >= 0 && len(head) >= idx + 16 {
+		sampleRate = uint64(binary.LittleEndian.Uint32(head[idx+12:]))
+	} else if bytes.Contains(head, []byte("OpusHead")) {
+		// opus granule positions are always in 48kHz samples
+		sampleRate = 48000
+	}
+	if sampleRate == 0 {
+		return nil, errors.New("unknown ogg codec")
+	}
+	start := size - 64 * 1024
+	if start < 0 {
+		start = 0
+	}
+	_, err = r.Seek(start, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	tail := make([]byte, size - start)
+	_, err = io.ReadFull(r, tail)
+	if err != nil {
+		return nil, err
+	}
+	idx := bytes.LastIndex(tail, []byte("OggS"))
+	if idx < 0 || len(tail) < idx + 14 {
+		return nil, errors.New("no ogg page found")
+	}
+	granule := binary.LittleEndian.Uint64(tail[idx+6:])
+	return &Info{
+		Duration: uint(granule * 1000 / sampleRate),
+		SampleRate: uint(sampleRate),
+	}, nil
+}
@@ -0,0 +1,408 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+)
+
+type mp4Box struct {
+	kind string
+	// prefix holds the version and flags of full boxes that also have
+	// children (meta)
+	prefix []byte
+	data []byte
+	children []*mp4Box
+}
+
+var mp4Containers = map[string]bool{
+	"moov": true,
+	"trak": true,
+	"mdia": true,
+	"minf": true,
+	"stbl": true,
+	"udta": true,
+	"meta": true,
+	"ilst": true,
+}
+
+func parseBoxes(data []byte, parent string) ([]*mp4Box, error) {
+	boxes := []*mp4Box{}
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, errors.New("truncated mp4 atom")
+		}
+		size := uint64(binary.BigEndian.Uint32(data))
+		kind := string(data[4:8])
+		hdr := uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return nil, errors.New("truncated mp4 atom")
+			}
+			size = binary.BigEndian.Uint64(data[8:])
+			hdr = 16
+		}
+		if size < hdr || size > uint64(len(data)) {
+			return nil, errors.New("invalid mp4 atom size")
+		}
+		box := &mp4Box{kind: kind}
+		payload := data[hdr:size]
+		// items inside ilst are kept whole
+		if mp4Containers[kind] && parent != "ilst" {
+			if kind == "meta" && len(payload) >= 4 && binary.BigEndian.Uint32(payload) == 0 {
+				box.prefix = payload[:4]
+				payload = payload[4:]
+			}
+			children, err := parseBoxes(payload, kind)
+			if err != nil {
+				return nil, err
+			}
+			box.children = children
+		} else {
+			box.data = payload
+		}
+		boxes = append(boxes, box)
+		data = data[size:]
+	}
+	return boxes, nil
+}
+
+func (box *mp4Box) encode(buf *bytes.Buffer) {
+	start := buf.Len()
+	buf.Write([]byte{0, 0, 0, 0})
+	buf.WriteString(box.kind)
+	if box.children != nil {
+		buf.Write(box.prefix)
+		for _, child := range box.children {
+			child.encode(buf)
+		}
+	} else {
+		buf.Write(box.data)
+	}
+	binary.BigEndian.PutUint32(buf.Bytes()[start:], uint32(buf.Len() - start))
+}
+
+func (box *mp4Box) size() int {
+	buf := &bytes.Buffer{}
+	box.encode(buf)
+	return buf.Len()
+}
+
+func (box *mp4Box) child(kind string) *mp4Box {
+	for _, c := range box.children {
+		if c.kind == kind {
+			return c
+		}
+	}
+	return nil
+}
+
+func (box *mp4Box) path(kinds ...string) *mp4Box {
+	cur := box
+	for _, kind := range kinds {
+		cur = cur.child(kind)
+		if cur == nil {
+			return nil
+		}
+	}
+	return cur
+}
+
+func (box *mp4Box) walk(f func(*mp4Box)) {
+	f(box)
+	for _, c := range box.children {
+		c.walk(f)
+	}
+}
+
+// itemData returns the type and payload of the first data atom of an ilst
+// item.
+func itemData(item *mp4Box) (uint32, []byte) {
+	boxes, err := parseBoxes(item.data, "item")
+	if err != nil {
+		return 0, nil
+	}
+	for _, b := range boxes {
+		if b.kind == "data" && len(b.data) >= 8 {
+			return binary.BigEndian.Uint32(b.data) & 0xffffff, b.data[8:]
+		}
+	}
+	return 0, nil
+}
+
+func newItem(kind string, typ uint32, value []byte) *mp4Box {
+	data := make([]byte, 8, 8 + len(value))
+	binary.BigEndian.PutUint32(data, typ)
+	data = append(data, value...)
+	buf := &bytes.Buffer{}
+	(&mp4Box{kind: "data", data: data}).encode(buf)
+	return &mp4Box{kind: kind, data: buf.Bytes()}
+}
+
+const (
+	mp4TypeImplicit = 0
+	mp4TypeUTF8 = 1
+	mp4TypeInt = 21
+)
+
+var mp4TextItems = []struct{
+	kind string
+	field func(*Tags) *string
+}{
+	{"\xa9nam", func(t *Tags) *string { return &t.Title }},
+	{"\xa9ART", func(t *Tags) *string { return &t.Artist }},
+	{"aART", func(t *Tags) *string { return &t.AlbumArtist }},
+	{"\xa9alb", func(t *Tags) *string { return &t.Album }},
+	{"\xa9wrt", func(t *Tags) *string { return &t.Composer }},
+	{"\xa9gen", func(t *Tags) *string { return &t.Genre }},
+	{"\xa9grp", func(t *Tags) *string { return &t.Grouping }},
+	{"\xa9wrk", func(t *Tags) *string { return &t.Work }},
+	{"\xa9cmt", func(t *Tags) *string { return &t.Comment }},
+	{"sonm", func(t *Tags) *string { return &t.SortTitle }},
+	{"soar", func(t *Tags) *string { return &t.SortArtist }},
+	{"soaa", func(t *Tags) *string { return &t.SortAlbumArtist }},
+	{"soal", func(t *Tags) *string { return &t.SortAlbum }},
+	{"soco", func(t *Tags) *string { return &t.SortComposer }},
+}
+
+type mp4File struct {
+	size int64
+	moovStart int64
+	moovEnd int64
+	moov *mp4Box
+}
+
+func readMP4File(f *os.File) (*mp4File, error) {
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	a, err := findAtom(f, 0, st.Size(), "moov")
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, a.end - a.start)
+	_, err = f.ReadAt(data, a.start)
+	if err != nil {
+		return nil, err
+	}
+	boxes, err := parseBoxes(data, "")
+	if err != nil {
+		return nil, err
+	}
+	return &mp4File{st.Size(), a.start, a.end, boxes[0]}, nil
+}
+
+func readMP4Tags(f *os.File) (*Tags, error) {
+	mf, err := readMP4File(f)
+	if err != nil {
+		return nil, err
+	}
+	t := &Tags{Format: TagFormatMP4}
+	ilst := mf.moov.path("udta", "meta", "ilst")
+	if ilst == nil {
+		return t, nil
+	}
+	items := map[string]*mp4Box{}
+	for _, item := range ilst.children {
+		if _, ok := items[item.kind]; !ok {
+			items[item.kind] = item
+		}
+	}
+	for _, ti := range mp4TextItems {
+		item, ok := items[ti.kind]
+		if ok {
+			_, value := itemData(item)
+			*ti.field(t) = string(value)
+		}
+	}
+	if t.Genre == "" {
+		if item, ok := items["gnre"]; ok {
+			_, value := itemData(item)
+			if len(value) >= 2 {
+				idx := int(binary.BigEndian.Uint16(value)) - 1
+				t.Genre = genreName(strconv.Itoa(idx))
+			}
+		}
+	}
+	if item, ok := items["\xa9day"]; ok {
+		_, value := itemData(item)
+		t.Year = parseYear(string(value))
+	}
+	if item, ok := items["trkn"]; ok {
+		_, value := itemData(item)
+		if len(value) >= 6 {
+			t.TrackNumber = int(binary.BigEndian.Uint16(value[2:]))
+			t.TrackCount = int(binary.BigEndian.Uint16(value[4:]))
+		}
+	}
+	if item, ok := items["disk"]; ok {
+		_, value := itemData(item)
+		if len(value) >= 6 {
+			t.DiscNumber = int(binary.BigEndian.Uint16(value[2:]))
+			t.DiscCount = int(binary.BigEndian.Uint16(value[4:]))
+		}
+	}
+	if item, ok := items["cpil"]; ok {
+		_, value := itemData(item)
+		t.Compilation = len(value) > 0 && value[len(value)-1] != 0
+	}
+	return t, nil
+}
+
+func numberPairItem(kind string, n, c int) *mp4Box {
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint16(value[2:], uint16(n))
+	binary.BigEndian.PutUint16(value[4:], uint16(c))
+	if kind == "disk" {
+		value = value[:6]
+	}
+	return newItem(kind, mp4TypeImplicit, value)
+}
+
+func metaHandler() *mp4Box {
+	data := make([]byte, 4 + 4 + 4 + 12 + 1)
+	copy(data[8:], "mdir")
+	copy(data[12:], "appl")
+	return &mp4Box{kind: "hdlr", data: data}
+}
+
+func ensureChild(box *mp4Box, kind string) *mp4Box {
+	c := box.child(kind)
+	if c == nil {
+		c = &mp4Box{kind: kind, children: []*mp4Box{}}
+		if kind == "meta" {
+			c.prefix = []byte{0, 0, 0, 0}
+			c.children = append(c.children, metaHandler())
+		}
+		box.children = append(box.children, c)
+	}
+	return c
+}
+
+func updateIlst(ilst *mp4Box, t *Tags) {
+	managed := map[string]bool{"gnre": true, "\xa9day": true, "trkn": true, "disk": true, "cpil": true}
+	items := []*mp4Box{}
+	for _, ti := range mp4TextItems {
+		managed[ti.kind] = true
+		value := *ti.field(t)
+		if value != "" {
+			items = append(items, newItem(ti.kind, mp4TypeUTF8, []byte(value)))
+		}
+	}
+	if t.Year > 0 {
+		items = append(items, newItem("\xa9day", mp4TypeUTF8, []byte(strconv.Itoa(t.Year))))
+	}
+	if t.TrackNumber > 0 || t.TrackCount > 0 {
+		items = append(items, numberPairItem("trkn", t.TrackNumber, t.TrackCount))
+	}
+	if t.DiscNumber > 0 || t.DiscCount > 0 {
+		items = append(items, numberPairItem("disk", t.DiscNumber, t.DiscCount))
+	}
+	if t.Compilation {
+		items = append(items, newItem("cpil", mp4TypeInt, []byte{1}))
+	}
+	for _, item := range ilst.children {
+		if !managed[item.kind] {
+			items = append(items, item)
+		}
+	}
+	ilst.children = items
+}
+
+// absorbDelta grows or shrinks a free atom inside udta/meta so that the
+// size of moov doesn't change, which avoids rewriting the whole file.
+func absorbDelta(meta *mp4Box, delta int) bool {
+	for _, c := range meta.children {
+		if c.kind != "free" && c.kind != "skip" {
+			continue
+		}
+		n := len(c.data) - delta
+		if n >= 0 {
+			c.data = make([]byte, n)
+			return true
+		}
+	}
+	return false
+}
+
+// shiftChunkOffsets adds delta to every chunk offset that points past
+// moov, for when moov changes size ahead of the media data.
+func shiftChunkOffsets(moov *mp4Box, after int64, delta int64) error {
+	var err error
+	moov.walk(func(box *mp4Box) {
+		if err != nil || (box.kind != "stco" && box.kind != "co64") || len(box.data) < 8 {
+			return
+		}
+		n := int(binary.BigEndian.Uint32(box.data[4:]))
+		entries := box.data[8:]
+		if box.kind == "stco" {
+			if len(entries) < n * 4 {
+				err = errors.New("truncated stco atom")
+				return
+			}
+			for i := 0; i < n; i++ {
+				off := int64(binary.BigEndian.Uint32(entries[i*4:]))
+				if off >= after {
+					off += delta
+					if off > 0xffffffff {
+						err = errors.New("chunk offset overflow")
+						return
+					}
+					binary.BigEndian.PutUint32(entries[i*4:], uint32(off))
+				}
+			}
+		} else {
+			if len(entries) < n * 8 {
+				err = errors.New("truncated co64 atom")
+				return
+			}
+			for i := 0; i < n; i++ {
+				off := int64(binary.BigEndian.Uint64(entries[i*8:]))
+				if off >= after {
+					binary.BigEndian.PutUint64(entries[i*8:], uint64(off + delta))
+				}
+			}
+		}
+	})
+	return err
+}
+
+func writeMP4Tags(f *os.File, fn string, t *Tags) error {
+	mf, err := readMP4File(f)
+	if err != nil {
+		return err
+	}
+	oldSize := int(mf.moovEnd - mf.moovStart)
+	meta := ensureChild(ensureChild(mf.moov, "udta"), "meta")
+	ilst := ensureChild(meta, "ilst")
+	updateIlst(ilst, t)
+	delta := mf.moov.size() - oldSize
+	if delta != 0 && absorbDelta(meta, delta) {
+		delta = mf.moov.size() - oldSize
+	}
+	if delta != 0 {
+		err = shiftChunkOffsets(mf.moov, mf.moovEnd, int64(delta))
+		if err != nil {
+			return err
+		}
+	}
+	buf := &bytes.Buffer{}
+	mf.moov.encode(buf)
+	if delta == 0 {
+		_, err = f.WriteAt(buf.Bytes(), mf.moovStart)
+		return err
+	}
+	prefix := make([]byte, mf.moovStart)
+	_, err = f.ReadAt(prefix, 0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	return replaceFile(f, fn, append(prefix, buf.Bytes()...), mf.moovEnd)
+}
@@ -0,0 +1,251 @@
+package media
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+)
+
+var ErrUnsupportedTags = errors.New("tag writing not supported for this file type")
+
+const (
+	TagFormatID3v22 = "id3v2.2"
+	TagFormatID3v23 = "id3v2.3"
+	TagFormatID3v24 = "id3v2.4"
+	TagFormatMP4 = "mp4"
+)
+
+// Tags holds the metadata that can be synchronized between a library and
+// its media files.  Zero values mean the tag is absent.
+type Tags struct {
+	Format string `tag:"-"`
+	Title string
+	Artist string
+	AlbumArtist string
+	Album string
+	Composer string
+	Genre string
+	Grouping string
+	Work string
+	Comment string
+	SortTitle string
+	SortArtist string
+	SortAlbumArtist string
+	SortAlbum string
+	SortComposer string
+	TrackNumber int
+	TrackCount int
+	DiscNumber int
+	DiscCount int
+	Year int
+	Compilation bool
+	// Rating is 0-100, as in iTunes.  MP4 files have no standard place
+	// to store it.
+	Rating int
+}
+
+type TagDiff struct {
+	Field string `json:"field"`
+	Library string `json:"library"`
+	File string `json:"file"`
+}
+
+// Diff lists the fields where want differs from the tags in the file.
+// Fields the file's format can't store are ignored.
+func (file *Tags) Diff(want *Tags) []TagDiff {
+	diffs := []TagDiff{}
+	fv := reflect.ValueOf(file).Elem()
+	wv := reflect.ValueOf(want).Elem()
+	rt := fv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		f := rt.Field(i)
+		if f.Tag.Get("tag") == "-" {
+			continue
+		}
+		if f.Name == "Rating" && file.Format == TagFormatMP4 {
+			continue
+		}
+		a := fv.Field(i).Interface()
+		b := wv.Field(i).Interface()
+		if a != b {
+			diffs = append(diffs, TagDiff{f.Name, fmt.Sprint(b), fmt.Sprint(a)})
+		}
+	}
+	return diffs
+}
+
+func ReadTags(fn string) (*Tags, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	head := make([]byte, 8)
+	n, err := io.ReadFull(f, head)
+	if err != nil && n < 4 {
+		return nil, err
+	}
+	if n == 8 && string(head[4:8]) == "ftyp" {
+		return readMP4Tags(f)
+	}
+	if isMP3(fn, head) {
+		tag, _, err := readID3(f)
+		if err != nil {
+			return nil, err
+		}
+		if tag == nil {
+			return &Tags{Format: TagFormatID3v23}, nil
+		}
+		return tag.tags(), nil
+	}
+	return nil, ErrUnsupportedTags
+}
+
+// WriteTags replaces the synchronized tags in fn with tags, leaving
+// everything else (artwork, other frames and atoms) alone.  When the new
+// tags don't fit in the space the old ones occupied the file is rewritten
+// through a temporary file in the same directory.
+func WriteTags(fn string, tags *Tags) error {
+	f, err := os.OpenFile(fn, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	head := make([]byte, 8)
+	n, err := io.ReadFull(f, head)
+	if err != nil && n < 4 {
+		return err
+	}
+	if n == 8 && string(head[4:8]) == "ftyp" {
+		return writeMP4Tags(f, fn, tags)
+	}
+	if isMP3(fn, head) {
+		return writeID3Tags(f, fn, tags)
+	}
+	return ErrUnsupportedTags
+}
+
+func isMP3(fn string, head []byte) bool {
+	if string(head[:3]) == "ID3" {
+		return true
+	}
+	ext := filepath.Ext(fn)
+	if ext == ".mp3" || ext == ".MP3" {
+		return true
+	}
+	return head[0] == 0xff && head[1] & 0xe0 == 0xe0
+}
+
+// replaceFile writes prefix followed by the contents of f from offset
+// onwards to a temporary file and moves it over fn.
+func replaceFile(f *os.File, fn string, prefix []byte, offset int64) error {
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(fn), "." + filepath.Base(fn) + ".")
+	if err != nil {
+		return err
+	}
+	tmpfn := tmp.Name()
+	fail := func(err error) error {
+		tmp.Close()
+		os.Remove(tmpfn)
+		return err
+	}
+	_, err = tmp.Write(prefix)
+	if err != nil {
+		return fail(err)
+	}
+	_, err = f.Seek(offset, io.SeekStart)
+	if err != nil {
+		return fail(err)
+	}
+	_, err = io.Copy(tmp, f)
+	if err != nil {
+		return fail(err)
+	}
+	err = tmp.Chmod(st.Mode())
+	if err != nil {
+		return fail(err)
+	}
+	err = tmp.Close()
+	if err != nil {
+		os.Remove(tmpfn)
+		return err
+	}
+	return os.Rename(tmpfn, fn)
+}
+
+var numberPair = regexp.MustCompile(`^\s*(\d*)\s*(?:/\s*(\d*))?`)
+
+func parseNumberPair(s string) (int, int) {
+	m := numberPair.FindStringSubmatch(s)
+	if m == nil {
+		return 0, 0
+	}
+	n, _ := strconv.Atoi(m[1])
+	c, _ := strconv.Atoi(m[2])
+	return n, c
+}
+
+func formatNumberPair(n, c int) string {
+	if n == 0 && c == 0 {
+		return ""
+	}
+	if c == 0 {
+		return strconv.Itoa(n)
+	}
+	return strconv.Itoa(n) + "/" + strconv.Itoa(c)
+}
+
+var yearPrefix = regexp.MustCompile(`^\s*(\d{4})`)
+
+func parseYear(s string) int {
+	m := yearPrefix.FindStringSubmatch(s)
+	if m == nil {
+		return 0
+	}
+	y, _ := strconv.Atoi(m[1])
+	return y
+}
+
+var id3v1Genres = []string{
+	"Blues", "Classic Rock", "Country", "Dance", "Disco", "Funk", "Grunge",
+	"Hip-Hop", "Jazz", "Metal", "New Age", "Oldies", "Other", "Pop", "R&B",
+	"Rap", "Reggae", "Rock", "Techno", "Industrial", "Alternative", "Ska",
+	"Death Metal", "Pranks", "Soundtrack", "Euro-Techno", "Ambient",
+	"Trip-Hop", "Vocal", "Jazz+Funk", "Fusion", "Trance", "Classical",
+	"Instrumental", "Acid", "House", "Game", "Sound Clip", "Gospel",
+	"Noise", "AlternRock", "Bass", "Soul", "Punk", "Space", "Meditative",
+	"Instrumental Pop", "Instrumental Rock", "Ethnic", "Gothic",
+	"Darkwave", "Techno-Industrial", "Electronic", "Pop-Folk",
+	"Eurodance", "Dream", "Southern Rock", "Comedy", "Cult", "Gangsta",
+	"Top 40", "Christian Rap", "Pop/Funk", "Jungle", "Native American",
+	"Cabaret", "New Wave", "Psychedelic", "Rave", "Showtunes", "Trailer",
+	"Lo-Fi", "Tribal", "Acid Punk", "Acid Jazz", "Polka", "Retro",
+	"Musical", "Rock & Roll", "Hard Rock",
+}
+
+var numericGenre = regexp.MustCompile(`^\((\d+)\)(.*)$`)
+
+func genreName(s string) string {
+	m := numericGenre.FindStringSubmatch(s)
+	if m != nil {
+		if m[2] != "" {
+			return m[2]
+		}
+		s = m[1]
+	}
+	idx, err := strconv.Atoi(s)
+	if err == nil && idx >= 0 && idx < len(id3v1Genres) {
+		return id3v1Genres[idx]
+	}
+	return s
+}
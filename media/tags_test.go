@@ -0,0 +1,196 @@
+package media
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// a few bytes that look like the start of an MPEG audio frame
+var audio = append([]byte{0xff, 0xfb, 0x90, 0x64}, bytes.Repeat([]byte("audio"), 100)...)
+
+func writeTestFile(t *testing.T, data ...[]byte) string {
+	dir, err := ioutil.TempDir("", "tags")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	fn := filepath.Join(dir, "song.mp3")
+	err = ioutil.WriteFile(fn, bytes.Join(data, nil), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fn
+}
+
+func fullTags() *Tags {
+	return &Tags{
+		Title: "Jóga ♫",
+		Artist: "Björk",
+		AlbumArtist: "Björk",
+		Album: "Homogenic",
+		Composer: "Björk, Sjón",
+		Genre: "Electronic",
+		Grouping: "Singles",
+		Work: "Homogenic",
+		Comment: "remastered",
+		SortTitle: "Joga",
+		SortArtist: "Bjork",
+		SortAlbumArtist: "Bjork",
+		SortAlbum: "Homogenic",
+		SortComposer: "Bjork",
+		TrackNumber: 2,
+		TrackCount: 10,
+		DiscNumber: 1,
+		DiscCount: 1,
+		Year: 1997,
+		Compilation: true,
+		Rating: 80,
+	}
+}
+
+// readBack reads the tags of fn and checks the audio after them is intact.
+func readBack(t *testing.T, fn string) *Tags {
+	t.Helper()
+	tags, err := ReadTags(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasSuffix(data, audio) {
+		t.Errorf("audio data damaged")
+	}
+	return tags
+}
+
+func TestWriteID3RoundTrip(t *testing.T) {
+	fn := writeTestFile(t, audio)
+	want := fullTags()
+	err := WriteTags(fn, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := readBack(t, fn)
+	if got.Format != TagFormatID3v23 {
+		t.Errorf("got format %s, want %s", got.Format, TagFormatID3v23)
+	}
+	if diffs := got.Diff(want); len(diffs) > 0 {
+		t.Errorf("tags changed in the round trip: %+v", diffs)
+	}
+
+	// smaller tags are written in place, and cleared fields go away
+	st, _ := os.Stat(fn)
+	want = &Tags{Title: "Hunter", Artist: "Björk", TrackNumber: 1}
+	err = WriteTags(fn, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st2, _ := os.Stat(fn); st2.Size() != st.Size() {
+		t.Errorf("file size changed from %d to %d rewriting in place", st.Size(), st2.Size())
+	}
+	got = readBack(t, fn)
+	if diffs := got.Diff(want); len(diffs) > 0 {
+		t.Errorf("tags changed in the round trip: %+v", diffs)
+	}
+}
+
+func TestWriteID3KeepsOtherFrames(t *testing.T) {
+	old := &id3Tag{version: 3, frames: []*id3Frame{
+		textFrame(3, "TIT2", "Old Title"),
+		{id: "APIC", data: []byte("\x00image/jpeg\x00\x03\x00picture")},
+		{id: "COMM", data: []byte("\x00engiTunNORM\x00 0000")},
+		{id: "POPM", data: []byte("someone@else\x00\x40")},
+	}}
+	fn := writeTestFile(t, old.encode(200), audio)
+	err := WriteTags(fn, &Tags{Title: "New Title", Rating: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tag, size, err := readID3(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 200 {
+		t.Errorf("got tag size %d, want the original 200", size)
+	}
+	ids := []string{}
+	for _, frame := range tag.frames {
+		ids = append(ids, frame.id)
+	}
+	want := []string{"TIT2", "POPM", "APIC", "COMM", "POPM"}
+	if !reflect.DeepEqual(ids, want) {
+		t.Errorf("got frames %v, want %v", ids, want)
+	}
+	got := tag.tags()
+	if got.Title != "New Title" || got.Rating != 100 || got.Comment != "" {
+		t.Errorf("got title %q, rating %d, comment %q", got.Title, got.Rating, got.Comment)
+	}
+}
+
+func TestWriteID3Versions(t *testing.T) {
+	v24 := &id3Tag{version: 4, frames: []*id3Frame{textFrame(4, "TIT2", "Jóga"), textFrame(4, "TDRC", "1997-09-22")}}
+	fn := writeTestFile(t, v24.encode(100), audio)
+	got := readBack(t, fn)
+	if got.Format != TagFormatID3v24 || got.Title != "Jóga" || got.Year != 1997 {
+		t.Errorf("read v2.4 tag as %+v", got)
+	}
+	want := fullTags()
+	err := WriteTags(fn, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = readBack(t, fn)
+	if got.Format != TagFormatID3v24 {
+		t.Errorf("v2.4 tag rewritten as %s", got.Format)
+	}
+	if diffs := got.Diff(want); len(diffs) > 0 {
+		t.Errorf("tags changed in the round trip: %+v", diffs)
+	}
+
+	// v2.2 has three letter frame ids and is upgraded when written
+	frame := []byte("TT2\x00\x00\x06\x00Hello")
+	hdr := []byte{'I', 'D', '3', 2, 0, 0, 0, 0, 0, 0}
+	putSyncsafe(hdr[6:], len(frame))
+	fn = writeTestFile(t, hdr, frame, audio)
+	got = readBack(t, fn)
+	if got.Format != TagFormatID3v22 || got.Title != "Hello" {
+		t.Errorf("read v2.2 tag as %+v", got)
+	}
+	err = WriteTags(fn, &Tags{Title: "Hello", Artist: "Björk"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = readBack(t, fn)
+	if got.Format != TagFormatID3v23 || got.Title != "Hello" || got.Artist != "Björk" {
+		t.Errorf("upgraded v2.2 tag read as %+v", got)
+	}
+}
+
+func TestReadID3Overrun(t *testing.T) {
+	// the header claims a 256MB tag in a tiny file
+	hdr := []byte{'I', 'D', '3', 3, 0, 0, 0x7f, 0x7f, 0x7f, 0x7f}
+	fn := writeTestFile(t, hdr, audio)
+	_, err := ReadTags(fn)
+	if err == nil {
+		t.Errorf("no error for a tag larger than the file")
+	}
+	err = WriteTags(fn, &Tags{Title: "x"})
+	if err == nil {
+		t.Errorf("wrote tags over a tag larger than the file")
+	}
+	data, _ := ioutil.ReadFile(fn)
+	if !bytes.Equal(data, append(hdr, audio...)) {
+		t.Errorf("failed write changed the file")
+	}
+}
@@ -0,0 +1,227 @@
+package itunes
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dhowden/tag"
+	"golang.org/x/text/unicode/norm"
+
+	"github.com/rclancey/itunes/media"
+)
+
+type RelocationCandidate struct {
+	Path          string `json:"path"`
+	Score         int    `json:"score"`
+	NameMatch     bool   `json:"name_match"`
+	SizeMatch     bool   `json:"size_match"`
+	DurationMatch bool   `json:"duration_match"`
+	TagMatch      bool   `json:"tag_match"`
+}
+
+type MissingTrack struct {
+	Track      *Track                 `json:"track"`
+	Path       string                 `json:"path"`
+	Candidates []*RelocationCandidate `json:"candidates"`
+}
+
+// Best returns the highest scoring candidate if it is a clear winner:
+// it must match on more than just its file name and must score higher
+// than the runner up.
+func (m *MissingTrack) Best() *RelocationCandidate {
+	if len(m.Candidates) == 0 {
+		return nil
+	}
+	best := m.Candidates[0]
+	if best.Score < scoreName + scoreSize {
+		return nil
+	}
+	if len(m.Candidates) > 1 && m.Candidates[1].Score == best.Score {
+		return nil
+	}
+	return best
+}
+
+const (
+	scoreName = 1
+	scoreSize = 2
+	scoreDuration = 2
+	scoreTag = 3
+)
+
+type MissingScanner struct {
+	// Roots are searched for files that might be the missing ones.
+	Roots []string
+	// DurationTolerance is in milliseconds.
+	DurationTolerance uint
+	byName map[string][]string
+	bySize map[int64][]string
+}
+
+func NewMissingScanner(roots ...string) *MissingScanner {
+	return &MissingScanner{
+		Roots: roots,
+		DurationTolerance: 2000,
+	}
+}
+
+func fileKey(fn string) string {
+	return strings.ToLower(norm.NFC.String(fn))
+}
+
+func (s *MissingScanner) index() error {
+	s.byName = map[string][]string{}
+	s.bySize = map[int64][]string{}
+	for _, root := range s.Roots {
+		err := filepath.Walk(root, func(fn string, info os.FileInfo, err error) error {
+			if err != nil {
+				if info != nil && info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			k := fileKey(info.Name())
+			s.byName[k] = append(s.byName[k], fn)
+			s.bySize[info.Size()] = append(s.bySize[info.Size()], fn)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Scan checks every track's file and, for those that are missing,
+// searches the roots for candidates with the same file name or size.
+func (s *MissingScanner) Scan(lib *Library) ([]*MissingTrack, error) {
+	missing := []*MissingTrack{}
+	for _, tr := range lib.Tracks {
+		if tr.Location == "" {
+			continue
+		}
+		fn := tr.Path()
+		if _, err := os.Stat(fn); err == nil {
+			continue
+		}
+		missing = append(missing, &MissingTrack{Track: tr, Path: fn, Candidates: []*RelocationCandidate{}})
+	}
+	if len(missing) == 0 || len(s.Roots) == 0 {
+		return missing, nil
+	}
+	err := s.index()
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range missing {
+		m.Candidates = s.candidates(m.Track)
+	}
+	return missing, nil
+}
+
+func (s *MissingScanner) candidates(tr *Track) []*RelocationCandidate {
+	name := fileKey(filepath.Base(mapLocation(tr.Location)))
+	ext := strings.ToLower(filepath.Ext(name))
+	found := map[string]*RelocationCandidate{}
+	for _, fn := range s.byName[name] {
+		found[fn] = &RelocationCandidate{Path: fn, NameMatch: true, Score: scoreName}
+	}
+	if tr.Size > 0 {
+		for _, fn := range s.bySize[int64(tr.Size)] {
+			if strings.ToLower(filepath.Ext(fn)) != ext {
+				continue
+			}
+			c, ok := found[fn]
+			if !ok {
+				c = &RelocationCandidate{Path: fn}
+				found[fn] = c
+			}
+			c.SizeMatch = true
+			c.Score += scoreSize
+		}
+	}
+	candidates := make([]*RelocationCandidate, 0, len(found))
+	for _, c := range found {
+		s.checkContent(tr, c)
+		candidates = append(candidates, c)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].Score != candidates[j].Score {
+			return candidates[i].Score > candidates[j].Score
+		}
+		return candidates[i].Path < candidates[j].Path
+	})
+	return candidates
+}
+
+func (s *MissingScanner) checkContent(tr *Track, c *RelocationCandidate) {
+	if tr.TotalTime > 0 {
+		info, err := media.ReadFileInfo(c.Path)
+		if err == nil && durationDiff(info.Duration, tr.TotalTime) <= s.DurationTolerance {
+			c.DurationMatch = true
+			c.Score += scoreDuration
+		}
+	}
+	if tr.Name == "" {
+		return
+	}
+	f, err := os.Open(c.Path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	m, err := tag.ReadFrom(f)
+	if err != nil {
+		return
+	}
+	if MakeKey(m.Title()) != MakeKey(tr.Name) {
+		return
+	}
+	if tr.Artist != "" && MakeKey(m.Artist()) != MakeKey(tr.Artist) {
+		return
+	}
+	c.TagMatch = true
+	c.Score += scoreTag
+}
+
+type Relocation struct {
+	Track       *Track `json:"track"`
+	OldLocation string `json:"old_location"`
+	NewLocation string `json:"new_location"`
+}
+
+// Relocate proposes a new Location for each missing track with a clear
+// best candidate.  When apply is true the tracks are updated as well.
+func (lib *Library) Relocate(missing []*MissingTrack, apply bool) []*Relocation {
+	relocs := []*Relocation{}
+	lib.Begin()
+	defer lib.Commit()
+	for _, m := range missing {
+		best := m.Best()
+		if best == nil {
+			continue
+		}
+		relocs = append(relocs, &Relocation{
+			Track: m.Track,
+			OldLocation: m.Track.Location,
+			NewLocation: best.Path,
+		})
+		if apply {
+			lib.SetLocation(m.Track, best.Path)
+		}
+	}
+	return relocs
+}
+
+func (lib *Library) SetLocation(tr *Track, loc string) {
+	if tr.Location == loc {
+		return
+	}
+	tr.Location = loc
+	lib.emitTrack(TrackModified, tr.PersistentID, []string{"Location"})
+}
@@ -0,0 +1,530 @@
+package mpd
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type command func(c *conn, out *bytes.Buffer, args []string) error
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"ping": ping,
+		"commands": listCommands,
+		"notcommands": notCommands,
+		"tagtypes": tagTypes,
+		"status": status,
+		"stats": stats,
+		"currentsong": empty,
+		"outputs": empty,
+		"decoders": empty,
+		"urlhandlers": empty,
+		"update": update,
+		"rescan": update,
+		"lsinfo": lsinfo,
+		"listall": listAll,
+		"listallinfo": listAllInfo,
+		"list": list,
+		"find": find,
+		"search": search,
+		"count": count,
+		"listplaylists": listPlaylists,
+		"listplaylist": listPlaylist,
+		"listplaylistinfo": listPlaylistInfo,
+	}
+}
+
+func ping(c *conn, out *bytes.Buffer, args []string) error {
+	return nil
+}
+
+func empty(c *conn, out *bytes.Buffer, args []string) error {
+	return nil
+}
+
+func listCommands(c *conn, out *bytes.Buffer, args []string) error {
+	names := []string{"close", "idle", "noidle", "command_list_begin", "command_list_ok_begin", "command_list_end"}
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(out, "command: %s\n", name)
+	}
+	return nil
+}
+
+func notCommands(c *conn, out *bytes.Buffer, args []string) error {
+	return nil
+}
+
+func tagTypes(c *conn, out *bytes.Buffer, args []string) error {
+	if len(args) == 0 {
+		for _, name := range tagNames {
+			if c.tags[name] {
+				fmt.Fprintf(out, "tagtype: %s\n", name)
+			}
+		}
+		return nil
+	}
+	switch strings.ToLower(args[0]) {
+	case "all", "clear":
+		on := strings.ToLower(args[0]) == "all"
+		for _, name := range tagNames {
+			c.tags[name] = on
+		}
+	case "enable", "disable":
+		on := strings.ToLower(args[0]) == "enable"
+		for _, a := range args[1:] {
+			name := canonicalTag(a)
+			if name == "" {
+				return ack(AckArg, "Unknown tag type: %s", a)
+			}
+			c.tags[name] = on
+		}
+	default:
+		return ack(AckArg, "Unknown sub command")
+	}
+	return nil
+}
+
+func status(c *conn, out *bytes.Buffer, args []string) error {
+	out.WriteString("volume: -1\nrepeat: 0\nrandom: 0\nsingle: 0\nconsume: 0\n")
+	out.WriteString("playlist: 0\nplaylistlength: 0\nmixrampdb: 0.000000\nstate: stop\n")
+	return nil
+}
+
+func stats(c *conn, out *bytes.Buffer, args []string) error {
+	c.s.lib.RLock()
+	defer c.s.lib.RUnlock()
+	db := c.s.database()
+	artists := map[string]bool{}
+	albums := map[string]bool{}
+	var playtime uint
+	for _, s := range db.songs {
+		artists[s.track.Artist] = true
+		albums[s.track.Album] = true
+		playtime += s.track.TotalTime / 1000
+	}
+	delete(artists, "")
+	delete(albums, "")
+	fmt.Fprintf(out, "artists: %d\nalbums: %d\nsongs: %d\n", len(artists), len(albums), len(db.songs))
+	fmt.Fprintf(out, "uptime: %d\nplaytime: 0\n", int(time.Since(c.s.started).Seconds()))
+	var updated int64
+	if !c.s.lib.Date.IsZero() {
+		updated = c.s.lib.Date.Unix()
+	}
+	fmt.Fprintf(out, "db_playtime: %d\ndb_update: %d\n", playtime, updated)
+	return nil
+}
+
+func update(c *conn, out *bytes.Buffer, args []string) error {
+	// the library is live, so there is never anything to rescan
+	out.WriteString("updating_db: 1\n")
+	return nil
+}
+
+func (c *conn) writeSong(out *bytes.Buffer, s *song) {
+	fmt.Fprintf(out, "file: %s\n", s.uri)
+	if t := lastModified(s.track); t != nil {
+		fmt.Fprintf(out, "Last-Modified: %s\n", t.UTC().Format(time.RFC3339))
+	}
+	for _, name := range tagNames {
+		if !c.tags[name] {
+			continue
+		}
+		if v := tagValue(s.track, name); v != "" {
+			fmt.Fprintf(out, "%s: %s\n", name, v)
+		}
+	}
+	if s.track.TotalTime > 0 {
+		fmt.Fprintf(out, "Time: %d\n", (s.track.TotalTime + 500) / 1000)
+		fmt.Fprintf(out, "duration: %.3f\n", float64(s.track.TotalTime) / 1000)
+	}
+}
+
+func (c *conn) writePlaylist(out *bytes.Buffer, sp *storedPlaylist) {
+	fmt.Fprintf(out, "playlist: %s\n", sp.name)
+	if !c.s.lib.Date.IsZero() {
+		fmt.Fprintf(out, "Last-Modified: %s\n", c.s.lib.Date.UTC().Format(time.RFC3339))
+	}
+}
+
+func optionalURI(args []string) (string, error) {
+	switch len(args) {
+	case 0:
+		return "", nil
+	case 1:
+		return strings.Trim(args[0], "/"), nil
+	}
+	return "", ack(AckArg, "too many arguments")
+}
+
+func lsinfo(c *conn, out *bytes.Buffer, args []string) error {
+	uri, err := optionalURI(args)
+	if err != nil {
+		return err
+	}
+	c.s.lib.RLock()
+	defer c.s.lib.RUnlock()
+	db := c.s.database()
+	if s, ok := db.byURI[uri]; ok {
+		c.writeSong(out, s)
+		return nil
+	}
+	d, ok := db.dirs[uri]
+	if !ok {
+		return ack(AckNoExist, "No such directory")
+	}
+	for _, sub := range d.dirs {
+		fmt.Fprintf(out, "directory: %s\n", sub.path)
+	}
+	for _, s := range d.songs {
+		c.writeSong(out, s)
+	}
+	if uri == "" {
+		for _, sp := range db.playlists {
+			c.writePlaylist(out, sp)
+		}
+	}
+	return nil
+}
+
+func (c *conn) listAll(out *bytes.Buffer, args []string, info bool) error {
+	uri, err := optionalURI(args)
+	if err != nil {
+		return err
+	}
+	c.s.lib.RLock()
+	defer c.s.lib.RUnlock()
+	db := c.s.database()
+	if s, ok := db.byURI[uri]; ok {
+		if info {
+			c.writeSong(out, s)
+		} else {
+			fmt.Fprintf(out, "file: %s\n", s.uri)
+		}
+		return nil
+	}
+	d, ok := db.dirs[uri]
+	if !ok {
+		return ack(AckNoExist, "No such directory")
+	}
+	var rec func(d *directory)
+	rec = func(d *directory) {
+		if d.path != "" {
+			fmt.Fprintf(out, "directory: %s\n", d.path)
+		}
+		for _, s := range d.songs {
+			if info {
+				c.writeSong(out, s)
+			} else {
+				fmt.Fprintf(out, "file: %s\n", s.uri)
+			}
+		}
+		for _, sub := range d.dirs {
+			rec(sub)
+		}
+	}
+	rec(d)
+	return nil
+}
+
+func listAll(c *conn, out *bytes.Buffer, args []string) error {
+	return c.listAll(out, args, false)
+}
+
+func listAllInfo(c *conn, out *bytes.Buffer, args []string) error {
+	return c.listAll(out, args, true)
+}
+
+// splitOptions removes trailing "group", "sort" and "window" options from
+// the arguments of a filter command.
+func splitOptions(args []string) ([]string, map[string][]string, error) {
+	opts := map[string][]string{}
+	i := 0
+	for i < len(args) {
+		key := strings.ToLower(args[i])
+		if (key == "group" || key == "sort" || key == "window") && !strings.HasPrefix(args[i], "(") {
+			if i + 1 >= len(args) {
+				return nil, nil, ack(AckArg, "missing argument for %s", key)
+			}
+			opts[key] = append(opts[key], args[i + 1])
+			args = append(args[:i:i], args[i + 2:]...)
+			continue
+		}
+		i++
+	}
+	return args, opts, nil
+}
+
+func (c *conn) matching(args []string, fold bool) ([]*song, map[string][]string, error) {
+	args, opts, err := splitOptions(args)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := parseFilter(args, fold)
+	if err != nil {
+		return nil, nil, ack(AckArg, "%s", err.Error())
+	}
+	songs := []*song{}
+	for _, s := range c.s.database().songs {
+		if f(s) {
+			songs = append(songs, s)
+		}
+	}
+	return songs, opts, nil
+}
+
+func (c *conn) find(out *bytes.Buffer, args []string, fold bool) error {
+	if len(args) == 0 {
+		return ack(AckArg, "too few arguments")
+	}
+	c.s.lib.RLock()
+	defer c.s.lib.RUnlock()
+	songs, opts, err := c.matching(args, fold)
+	if err != nil {
+		return err
+	}
+	if keys := opts["sort"]; len(keys) > 0 {
+		key := keys[0]
+		desc := strings.HasPrefix(key, "-")
+		tag := canonicalTag(strings.TrimPrefix(key, "-"))
+		if tag == "" {
+			return ack(AckArg, "invalid sort tag")
+		}
+		sort.SliceStable(songs, func(i, j int) bool {
+			a, b := tagValue(songs[i].track, tag), tagValue(songs[j].track, tag)
+			if desc {
+				return a > b
+			}
+			return a < b
+		})
+	}
+	if w := opts["window"]; len(w) > 0 {
+		start, end, err := parseRange(w[0], len(songs))
+		if err != nil {
+			return err
+		}
+		songs = songs[start:end]
+	}
+	for _, s := range songs {
+		c.writeSong(out, s)
+	}
+	return nil
+}
+
+func parseRange(s string, n int) (int, int, error) {
+	parts := strings.SplitN(s, ":", 2)
+	start, err := strconv.Atoi(parts[0])
+	if err != nil || start < 0 {
+		return 0, 0, ack(AckArg, "Integer expected: %s", s)
+	}
+	end := n
+	if len(parts) == 2 && parts[1] != "" {
+		end, err = strconv.Atoi(parts[1])
+		if err != nil || end < start {
+			return 0, 0, ack(AckArg, "Integer expected: %s", s)
+		}
+	}
+	if start > n {
+		start = n
+	}
+	if end > n {
+		end = n
+	}
+	return start, end, nil
+}
+
+func find(c *conn, out *bytes.Buffer, args []string) error {
+	return c.find(out, args, false)
+}
+
+func search(c *conn, out *bytes.Buffer, args []string) error {
+	return c.find(out, args, true)
+}
+
+// groupTags resolves the tags of "group" options.
+func groupTags(opts map[string][]string) ([]string, error) {
+	tags := []string{}
+	for _, g := range opts["group"] {
+		tag := canonicalTag(g)
+		if tag == "" {
+			return nil, ack(AckArg, "Unknown tag type: %s", g)
+		}
+		tags = append(tags, tag)
+	}
+	return tags, nil
+}
+
+// groupKey joins the values of the group tags of a song.
+func groupKey(s *song, tags []string) []string {
+	vals := make([]string, len(tags))
+	for i, tag := range tags {
+		vals[i] = tagValue(s.track, tag)
+	}
+	return vals
+}
+
+// list prints the distinct values of a tag among matching songs.  As in
+// older clients, "list album ARTIST" filters by artist.
+func list(c *conn, out *bytes.Buffer, args []string) error {
+	if len(args) == 0 {
+		return ack(AckArg, "too few arguments")
+	}
+	typ := strings.ToLower(args[0])
+	tag := "file"
+	if typ != "file" {
+		tag = canonicalTag(typ)
+		if tag == "" {
+			return ack(AckArg, "Unknown tag type: %s", args[0])
+		}
+	}
+	args = args[1:]
+	if tag == "Album" && len(args) == 1 && !strings.HasPrefix(args[0], "(") {
+		args = []string{"artist", args[0]}
+	}
+	c.s.lib.RLock()
+	defer c.s.lib.RUnlock()
+	songs, opts, err := c.matching(args, false)
+	if err != nil {
+		return err
+	}
+	groups, err := groupTags(opts)
+	if err != nil {
+		return err
+	}
+	type row struct {
+		group []string
+		value string
+	}
+	seen := map[string]bool{}
+	rows := []row{}
+	for _, s := range songs {
+		r := row{groupKey(s, groups), values(s, tag)[0]}
+		k := strings.Join(r.group, "\x00") + "\x00" + r.value
+		if !seen[k] && (r.value != "" || len(groups) > 0) {
+			seen[k] = true
+			rows = append(rows, r)
+		}
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		for k := range groups {
+			if rows[i].group[k] != rows[j].group[k] {
+				return rows[i].group[k] < rows[j].group[k]
+			}
+		}
+		return rows[i].value < rows[j].value
+	})
+	var last []string
+	for _, r := range rows {
+		for k, g := range groups {
+			if last == nil || last[k] != r.group[k] {
+				fmt.Fprintf(out, "%s: %s\n", g, r.group[k])
+				last = nil
+			}
+		}
+		last = r.group
+		if r.value != "" {
+			fmt.Fprintf(out, "%s: %s\n", tag, r.value)
+		}
+	}
+	return nil
+}
+
+func count(c *conn, out *bytes.Buffer, args []string) error {
+	c.s.lib.RLock()
+	defer c.s.lib.RUnlock()
+	songs, opts, err := c.matching(args, false)
+	if err != nil {
+		return err
+	}
+	groups, err := groupTags(opts)
+	if err != nil {
+		return err
+	}
+	if len(groups) == 0 {
+		var playtime uint
+		for _, s := range songs {
+			playtime += s.track.TotalTime / 1000
+		}
+		fmt.Fprintf(out, "songs: %d\nplaytime: %d\n", len(songs), playtime)
+		return nil
+	}
+	// only the first group tag is used, as in MPD
+	type total struct {
+		songs int
+		playtime uint
+	}
+	totals := map[string]*total{}
+	keys := []string{}
+	for _, s := range songs {
+		k := tagValue(s.track, groups[0])
+		t, ok := totals[k]
+		if !ok {
+			t = &total{}
+			totals[k] = t
+			keys = append(keys, k)
+		}
+		t.songs++
+		t.playtime += s.track.TotalTime / 1000
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(out, "%s: %s\nsongs: %d\nplaytime: %d\n", groups[0], k, totals[k].songs, totals[k].playtime)
+	}
+	return nil
+}
+
+func listPlaylists(c *conn, out *bytes.Buffer, args []string) error {
+	c.s.lib.RLock()
+	defer c.s.lib.RUnlock()
+	for _, sp := range c.s.database().playlists {
+		c.writePlaylist(out, sp)
+	}
+	return nil
+}
+
+func (c *conn) playlistSongs(args []string) ([]*song, error) {
+	if len(args) != 1 {
+		return nil, ack(AckArg, "wrong number of arguments")
+	}
+	db := c.s.database()
+	sp, ok := db.playlistsByName[args[0]]
+	if !ok {
+		return nil, ack(AckNoExist, "No such playlist")
+	}
+	return db.playlistSongs(c.s.lib, sp), nil
+}
+
+func listPlaylist(c *conn, out *bytes.Buffer, args []string) error {
+	c.s.lib.RLock()
+	defer c.s.lib.RUnlock()
+	songs, err := c.playlistSongs(args)
+	if err != nil {
+		return err
+	}
+	for _, s := range songs {
+		fmt.Fprintf(out, "file: %s\n", s.uri)
+	}
+	return nil
+}
+
+func listPlaylistInfo(c *conn, out *bytes.Buffer, args []string) error {
+	c.s.lib.RLock()
+	defer c.s.lib.RUnlock()
+	songs, err := c.playlistSongs(args)
+	if err != nil {
+		return err
+	}
+	for _, s := range songs {
+		c.writeSong(out, s)
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package mpd
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/rclancey/itunes"
+	"github.com/rclancey/itunes/persistentId"
+)
+
+type song struct {
+	uri string
+	track *itunes.Track
+}
+
+type directory struct {
+	path string
+	dirs []*directory
+	songs []*song
+}
+
+type storedPlaylist struct {
+	name string
+	playlist *itunes.Playlist
+}
+
+// database is a snapshot of the library laid out as MPD sees it: a
+// directory per album artist holding a directory per album, and stored
+// playlists named by their folder path.  Song URIs stay the same for as
+// long as their tags do.
+type database struct {
+	root *directory
+	dirs map[string]*directory
+	songs []*song
+	byURI map[string]*song
+	byID map[pid.PersistentID]*song
+	playlists []*storedPlaylist
+	playlistsByName map[string]*storedPlaylist
+}
+
+func artistDirName(tr *itunes.Track) string {
+	name := tr.AlbumArtist
+	if name == "" {
+		name = tr.Artist
+	}
+	if name == "" {
+		return "Unknown Artist"
+	}
+	return name
+}
+
+func songFileName(tr *itunes.Track) string {
+	name := tr.Name
+	if name == "" {
+		name = "Untitled"
+	}
+	if tr.TrackNumber > 0 {
+		if tr.DiscCount > 1 {
+			name = fmt.Sprintf("%d-%02d %s", tr.DiscNumber, tr.TrackNumber, name)
+		} else {
+			name = fmt.Sprintf("%02d %s", tr.TrackNumber, name)
+		}
+	}
+	return itunes.SafeFileName(name) + strings.ToLower(tr.GetExt())
+}
+
+func newDatabase(lib *itunes.Library) *database {
+	db := &database{
+		root: &directory{},
+		dirs: map[string]*directory{},
+		byURI: map[string]*song{},
+		byID: map[pid.PersistentID]*song{},
+		playlistsByName: map[string]*storedPlaylist{},
+	}
+	db.dirs[""] = db.root
+	// directory names are chosen per MakeKey, so that spelling variants
+	// of an artist or album end up together
+	names := map[string]string{}
+	dirName := func(parent, name string) string {
+		key := itunes.MakeKey(name)
+		if key == "" {
+			key = strings.ToLower(name)
+		}
+		key = parent + "/" + key
+		if n, ok := names[key]; ok {
+			return n
+		}
+		n := path.Join(parent, itunes.SafeFileName(name))
+		names[key] = n
+		return n
+	}
+	tracks := itunes.TrackList{}
+	for _, tr := range lib.Tracks {
+		if tr.Location != "" {
+			tracks = append(tracks, tr)
+		}
+	}
+	tracks.DefaultSort()
+	for _, tr := range tracks {
+		dir := dirName("", artistDirName(tr))
+		if tr.Album != "" {
+			dir = dirName(dir, tr.Album)
+		}
+		base := songFileName(tr)
+		ext := path.Ext(base)
+		uri := path.Join(dir, base)
+		for i := 2; db.byURI[uri] != nil; i++ {
+			uri = path.Join(dir, fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(base, ext), i, ext))
+		}
+		s := &song{uri: uri, track: tr}
+		db.songs = append(db.songs, s)
+		db.byURI[uri] = s
+		db.byID[tr.PersistentID] = s
+		d := db.mkdir(dir)
+		d.songs = append(d.songs, s)
+	}
+	for _, d := range db.dirs {
+		sort.Slice(d.dirs, func(i, j int) bool { return d.dirs[i].path < d.dirs[j].path })
+	}
+	var add func(prefix string, pls []*itunes.Playlist)
+	add = func(prefix string, pls []*itunes.Playlist) {
+		for _, p := range pls {
+			name := path.Join(prefix, strings.Replace(p.Name, "/", "_", -1))
+			if p.Folder {
+				add(name, p.Children)
+				continue
+			}
+			if db.playlistsByName[name] != nil {
+				continue
+			}
+			sp := &storedPlaylist{name: name, playlist: p}
+			db.playlists = append(db.playlists, sp)
+			db.playlistsByName[name] = sp
+		}
+	}
+	add("", lib.PlaylistTree)
+	sort.Slice(db.playlists, func(i, j int) bool { return db.playlists[i].name < db.playlists[j].name })
+	return db
+}
+
+func (db *database) mkdir(p string) *directory {
+	d, ok := db.dirs[p]
+	if ok {
+		return d
+	}
+	d = &directory{path: p}
+	db.dirs[p] = d
+	dir := path.Dir(p)
+	if dir == "." {
+		dir = ""
+	}
+	parent := db.mkdir(dir)
+	parent.dirs = append(parent.dirs, d)
+	return d
+}
+
+// walk calls f for every song at or below uri, which may name a
+// directory or a song.
+func (db *database) walk(uri string, f func(s *song)) bool {
+	uri = strings.Trim(uri, "/")
+	if s, ok := db.byURI[uri]; ok {
+		f(s)
+		return true
+	}
+	d, ok := db.dirs[uri]
+	if !ok {
+		return false
+	}
+	var rec func(d *directory)
+	rec = func(d *directory) {
+		for _, s := range d.songs {
+			f(s)
+		}
+		for _, sub := range d.dirs {
+			rec(sub)
+		}
+	}
+	rec(d)
+	return true
+}
+
+// playlistSongs returns the songs of a stored playlist, evaluating smart
+// playlists.
+func (db *database) playlistSongs(lib *itunes.Library, sp *storedPlaylist) []*song {
+	songs := []*song{}
+	for _, tr := range sp.playlist.Populate(lib).PlaylistItems {
+		if tr == nil {
+			continue
+		}
+		if s, ok := db.byID[tr.PersistentID]; ok {
+			songs = append(songs, s)
+		}
+	}
+	return songs
+}
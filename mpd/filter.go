@@ -0,0 +1,370 @@
+package mpd
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rclancey/itunes"
+)
+
+// tagNames lists the tags reported for songs, in output order.
+var tagNames = []string{
+	"Artist",
+	"ArtistSort",
+	"Album",
+	"AlbumSort",
+	"AlbumArtist",
+	"AlbumArtistSort",
+	"Title",
+	"TitleSort",
+	"Track",
+	"Genre",
+	"Date",
+	"Composer",
+	"ComposerSort",
+	"Disc",
+	"Comment",
+	"Grouping",
+}
+
+var tagsByLower = map[string]string{}
+
+func init() {
+	for _, name := range tagNames {
+		tagsByLower[strings.ToLower(name)] = name
+	}
+}
+
+// canonicalTag returns the spelling of a tag name used in responses, or
+// "" if it isn't a known tag.
+func canonicalTag(name string) string {
+	return tagsByLower[strings.ToLower(name)]
+}
+
+func tagValue(tr *itunes.Track, tag string) string {
+	switch tag {
+	case "Artist":
+		return tr.Artist
+	case "ArtistSort":
+		return tr.SortArtist
+	case "Album":
+		return tr.Album
+	case "AlbumSort":
+		return tr.SortAlbum
+	case "AlbumArtist":
+		return tr.AlbumArtist
+	case "AlbumArtistSort":
+		return tr.SortAlbumArtist
+	case "Title":
+		return tr.Name
+	case "TitleSort":
+		return tr.SortName
+	case "Track":
+		if tr.TrackNumber > 0 {
+			return strconv.Itoa(int(tr.TrackNumber))
+		}
+	case "Genre":
+		return tr.Genre
+	case "Date":
+		if tr.ReleaseDate != nil {
+			return strconv.Itoa(tr.ReleaseDate.Year())
+		}
+	case "Composer":
+		return tr.Composer
+	case "ComposerSort":
+		return tr.SortComposer
+	case "Disc":
+		if tr.DiscNumber > 0 {
+			return strconv.Itoa(int(tr.DiscNumber))
+		}
+	case "Comment":
+		return tr.Comments
+	case "Grouping":
+		return tr.Grouping
+	}
+	return ""
+}
+
+func lastModified(tr *itunes.Track) *time.Time {
+	t := tr.DateModified
+	if t == nil {
+		t = tr.DateAdded
+	}
+	if t == nil {
+		return nil
+	}
+	return &t.Time
+}
+
+type filter func(s *song) bool
+
+func matchAll(filters []filter) filter {
+	return func(s *song) bool {
+		for _, f := range filters {
+			if !f(s) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// values returns the values of a tag, or of every tag for "any".
+func values(s *song, tag string) []string {
+	switch tag {
+	case "file":
+		return []string{s.uri}
+	case "any":
+		vals := []string{s.uri}
+		for _, name := range tagNames {
+			if v := tagValue(s.track, name); v != "" {
+				vals = append(vals, v)
+			}
+		}
+		return vals
+	}
+	return []string{tagValue(s.track, tag)}
+}
+
+func compare(tag, op, value string, fold bool) (filter, error) {
+	if tag != "file" && tag != "any" {
+		tag = canonicalTag(tag)
+		if tag == "" {
+			return nil, errors.New("unknown filter type")
+		}
+	}
+	if fold {
+		value = strings.ToLower(value)
+	}
+	var test func(v string) bool
+	switch op {
+	case "==":
+		test = func(v string) bool { return v == value }
+	case "!=":
+		test = func(v string) bool { return v != value }
+	case "contains":
+		test = func(v string) bool { return strings.Contains(v, value) }
+	case "starts_with":
+		test = func(v string) bool { return strings.HasPrefix(v, value) }
+	case "=~", "!~":
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return nil, err
+		}
+		neg := op == "!~"
+		test = func(v string) bool { return re.MatchString(v) != neg }
+	default:
+		return nil, errors.New("unknown filter operator " + op)
+	}
+	return func(s *song) bool {
+		for _, v := range values(s, tag) {
+			if fold {
+				v = strings.ToLower(v)
+			}
+			if test(v) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+func baseFilter(uri string) filter {
+	uri = strings.Trim(uri, "/")
+	return func(s *song) bool {
+		return uri == "" || s.uri == uri || strings.HasPrefix(s.uri, uri + "/")
+	}
+}
+
+func modifiedSince(value string) (filter, error) {
+	var since time.Time
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err == nil {
+		since = time.Unix(n, 0)
+	} else {
+		since, err = time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, errors.New("invalid modified-since time")
+		}
+	}
+	return func(s *song) bool {
+		t := lastModified(s.track)
+		return t != nil && !t.Before(since)
+	}, nil
+}
+
+// parseFilter parses the arguments of find, search, list and count: either
+// an expression such as "((artist == 'x') AND (album != 'y'))" or the
+// older tag/value pairs.  Exact comparisons are case-insensitive
+// substring matches when fold is set, as for search.
+func parseFilter(args []string, fold bool) (filter, error) {
+	filters := []filter{}
+	for len(args) > 0 {
+		if strings.HasPrefix(args[0], "(") {
+			p := &exprParser{s: args[0], fold: fold}
+			f, err := p.parse()
+			if err != nil {
+				return nil, err
+			}
+			filters = append(filters, f)
+			args = args[1:]
+			continue
+		}
+		if len(args) < 2 {
+			return nil, errors.New("incorrect number of filter arguments")
+		}
+		tag, value := strings.ToLower(args[0]), args[1]
+		args = args[2:]
+		var f filter
+		var err error
+		switch tag {
+		case "base":
+			f = baseFilter(value)
+		case "modified-since":
+			f, err = modifiedSince(value)
+		default:
+			op := "=="
+			if fold {
+				op = "contains"
+			}
+			f, err = compare(tag, op, value, fold)
+		}
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, f)
+	}
+	return matchAll(filters), nil
+}
+
+type exprParser struct {
+	s string
+	pos int
+	fold bool
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.s) && p.s[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+func (p *exprParser) expect(tok string) error {
+	p.skipSpace()
+	if !strings.HasPrefix(p.s[p.pos:], tok) {
+		return errors.New("expected '" + tok + "' in filter expression")
+	}
+	p.pos += len(tok)
+	return nil
+}
+
+func (p *exprParser) word() string {
+	p.skipSpace()
+	start := p.pos
+	for p.pos < len(p.s) && p.s[p.pos] != ' ' && p.s[p.pos] != '\'' && p.s[p.pos] != '"' && p.s[p.pos] != ')' {
+		p.pos++
+	}
+	return p.s[start:p.pos]
+}
+
+func (p *exprParser) quoted() (string, error) {
+	p.skipSpace()
+	if p.pos >= len(p.s) || (p.s[p.pos] != '\'' && p.s[p.pos] != '"') {
+		return "", errors.New("expected a quoted value in filter expression")
+	}
+	q := p.s[p.pos]
+	p.pos++
+	var b strings.Builder
+	for p.pos < len(p.s) {
+		c := p.s[p.pos]
+		p.pos++
+		switch {
+		case c == '\\' && p.pos < len(p.s):
+			b.WriteByte(p.s[p.pos])
+			p.pos++
+		case c == q:
+			return b.String(), nil
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", errors.New("unterminated string in filter expression")
+}
+
+func (p *exprParser) parse() (filter, error) {
+	f, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if p.pos != len(p.s) {
+		return nil, errors.New("trailing characters after filter expression")
+	}
+	return f, nil
+}
+
+func (p *exprParser) expr() (filter, error) {
+	err := p.expect("(")
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if strings.HasPrefix(p.s[p.pos:], "!") {
+		p.pos++
+		sub, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		return func(s *song) bool { return !sub(s) }, p.expect(")")
+	}
+	if strings.HasPrefix(p.s[p.pos:], "(") {
+		subs := []filter{}
+		for {
+			sub, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			subs = append(subs, sub)
+			p.skipSpace()
+			if strings.HasPrefix(p.s[p.pos:], ")") {
+				p.pos++
+				return matchAll(subs), nil
+			}
+			err = p.expect("AND")
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	tag := strings.ToLower(p.word())
+	var f filter
+	switch tag {
+	case "base", "modified-since":
+		value, err := p.quoted()
+		if err != nil {
+			return nil, err
+		}
+		if tag == "base" {
+			f = baseFilter(value)
+		} else {
+			f, err = modifiedSince(value)
+			if err != nil {
+				return nil, err
+			}
+		}
+	default:
+		op := p.word()
+		value, err := p.quoted()
+		if err != nil {
+			return nil, err
+		}
+		f, err = compare(tag, op, value, p.fold)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return f, p.expect(")")
+}
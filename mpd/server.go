@@ -0,0 +1,343 @@
+// Package mpd lets MPD clients browse an itunes.Library.  It implements
+// the database and stored playlist commands of the MPD protocol; there is
+// no queue or playback, so players can search and list but not play.
+package mpd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rclancey/itunes"
+)
+
+const ProtocolVersion = "0.21.0"
+
+// ACK error codes
+const (
+	AckNotList = 1
+	AckArg = 2
+	AckPassword = 3
+	AckPermission = 4
+	AckUnknown = 5
+	AckNoExist = 50
+)
+
+type AckError struct {
+	Code int
+	Message string
+}
+
+func (e *AckError) Error() string {
+	return e.Message
+}
+
+func ack(code int, format string, args ...interface{}) error {
+	return &AckError{code, fmt.Sprintf(format, args...)}
+}
+
+type Server struct {
+	lib *itunes.Library
+	mutex sync.Mutex
+	db *database
+	// versions counts the changes to each idle subsystem
+	versions map[string]int
+	changed chan bool
+	started time.Time
+	unsubscribe func()
+}
+
+func NewServer(lib *itunes.Library) *Server {
+	s := &Server{
+		lib: lib,
+		versions: map[string]int{},
+		changed: make(chan bool),
+		started: time.Now(),
+	}
+	s.unsubscribe = lib.Subscribe(func(events []*itunes.Event) {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		s.db = nil
+		for _, ev := range events {
+			if ev.TrackID != nil {
+				s.versions["database"]++
+			}
+			if ev.PlaylistID != nil {
+				s.versions["stored_playlist"]++
+			}
+		}
+		close(s.changed)
+		s.changed = make(chan bool)
+	})
+	return s
+}
+
+func (s *Server) Close() {
+	s.unsubscribe()
+}
+
+// database returns the MPD view of the library, rebuilding it after the
+// library changes.  The caller must hold the library's read lock.
+func (s *Server) database() *database {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.db == nil {
+		s.db = newDatabase(s.lib)
+	}
+	return s.db
+}
+
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+func (s *Server) Serve(l net.Listener) error {
+	defer l.Close()
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.ServeConn(c)
+	}
+}
+
+type conn struct {
+	s *Server
+	rw io.ReadWriteCloser
+	w *bufio.Writer
+	lines chan string
+	done chan bool
+	tags map[string]bool
+	versions map[string]int
+}
+
+// ServeConn speaks the protocol on a single connection until the client
+// closes it or sends "close".
+func (s *Server) ServeConn(rw io.ReadWriteCloser) {
+	c := &conn{
+		s: s,
+		rw: rw,
+		w: bufio.NewWriter(rw),
+		lines: make(chan string),
+		done: make(chan bool),
+		tags: map[string]bool{},
+		versions: s.snapshot(),
+	}
+	for _, name := range tagNames {
+		c.tags[name] = true
+	}
+	defer rw.Close()
+	defer close(c.done)
+	go c.read()
+	fmt.Fprintf(c.w, "OK MPD %s\n", ProtocolVersion)
+	c.w.Flush()
+	for {
+		line, ok := <-c.lines
+		if !ok {
+			return
+		}
+		if !c.handle(line) {
+			return
+		}
+		if c.w.Flush() != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) snapshot() map[string]int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	v := map[string]int{}
+	for k, n := range s.versions {
+		v[k] = n
+	}
+	return v
+}
+
+func (c *conn) read() {
+	defer close(c.lines)
+	scanner := bufio.NewScanner(c.rw)
+	scanner.Buffer(make([]byte, 4096), 1 << 20)
+	for scanner.Scan() {
+		select {
+		case c.lines <- scanner.Text():
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// handle runs one line, or a whole command list, and reports whether the
+// connection should stay open.
+func (c *conn) handle(line string) bool {
+	name, args, err := tokenize(line)
+	if err != nil {
+		c.writeAck(0, "", err)
+		return true
+	}
+	switch name {
+	case "close":
+		return false
+	case "idle":
+		return c.idle(args)
+	case "noidle":
+		return true
+	case "command_list_begin", "command_list_ok_begin":
+		return c.commandList(name == "command_list_ok_begin")
+	}
+	out := &bytes.Buffer{}
+	err = c.run(out, name, args)
+	if err != nil {
+		c.writeAck(0, name, err)
+		return true
+	}
+	c.w.Write(out.Bytes())
+	c.w.WriteString("OK\n")
+	return true
+}
+
+func (c *conn) commandList(listOK bool) bool {
+	cmds := []string{}
+	for {
+		line, ok := <-c.lines
+		if !ok {
+			return false
+		}
+		if line == "command_list_end" {
+			break
+		}
+		cmds = append(cmds, line)
+	}
+	for i, line := range cmds {
+		name, args, err := tokenize(line)
+		if err == nil {
+			out := &bytes.Buffer{}
+			err = c.run(out, name, args)
+			c.w.Write(out.Bytes())
+		}
+		if err != nil {
+			c.writeAck(i, name, err)
+			return true
+		}
+		if listOK {
+			c.w.WriteString("list_OK\n")
+		}
+	}
+	c.w.WriteString("OK\n")
+	return true
+}
+
+func (c *conn) run(out *bytes.Buffer, name string, args []string) error {
+	cmd, ok := commands[name]
+	if !ok {
+		return ack(AckUnknown, "unknown command \"%s\"", name)
+	}
+	return cmd(c, out, args)
+}
+
+func (c *conn) writeAck(index int, name string, err error) {
+	code := AckArg
+	if aerr, ok := err.(*AckError); ok {
+		code = aerr.Code
+	}
+	fmt.Fprintf(c.w, "ACK [%d@%d] {%s} %s\n", code, index, name, err.Error())
+}
+
+// idle waits until one of the requested subsystems (all of them if none
+// are given) changes, or until the client sends noidle.
+func (c *conn) idle(args []string) bool {
+	want := map[string]bool{}
+	for _, a := range args {
+		want[strings.ToLower(a)] = true
+	}
+	for {
+		c.s.mutex.Lock()
+		changed := c.s.changed
+		c.s.mutex.Unlock()
+		cur := c.s.snapshot()
+		subsystems := []string{}
+		for _, name := range []string{"database", "stored_playlist"} {
+			if cur[name] != c.versions[name] && (len(want) == 0 || want[name]) {
+				subsystems = append(subsystems, name)
+			}
+		}
+		if len(subsystems) > 0 {
+			c.versions = cur
+			for _, name := range subsystems {
+				fmt.Fprintf(c.w, "changed: %s\n", name)
+			}
+			c.w.WriteString("OK\n")
+			return true
+		}
+		select {
+		case <-changed:
+		case line, ok := <-c.lines:
+			if !ok {
+				return false
+			}
+			if strings.TrimSpace(line) != "noidle" {
+				// only noidle is allowed while idle
+				return false
+			}
+			c.w.WriteString("OK\n")
+			return true
+		}
+	}
+}
+
+// tokenize splits a command line into the command name and its
+// arguments, which may be double quoted with backslash escapes.
+func tokenize(line string) (string, []string, error) {
+	tokens := []string{}
+	i := 0
+	for i < len(line) {
+		for i < len(line) && (line[i] == ' ' || line[i] == '\t') {
+			i++
+		}
+		if i >= len(line) {
+			break
+		}
+		var b strings.Builder
+		if line[i] == '"' {
+			i++
+			closed := false
+			for i < len(line) {
+				ch := line[i]
+				i++
+				if ch == '\\' && i < len(line) {
+					b.WriteByte(line[i])
+					i++
+				} else if ch == '"' {
+					closed = true
+					break
+				} else {
+					b.WriteByte(ch)
+				}
+			}
+			if !closed {
+				return "", nil, ack(AckArg, "Invalid unquoted character")
+			}
+		} else {
+			for i < len(line) && line[i] != ' ' && line[i] != '\t' {
+				b.WriteByte(line[i])
+				i++
+			}
+		}
+		tokens = append(tokens, b.String())
+	}
+	if len(tokens) == 0 {
+		return "", nil, ack(AckUnknown, "No command given")
+	}
+	return strings.ToLower(tokens[0]), tokens[1:], nil
+}
@@ -0,0 +1,320 @@
+package mpd
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rclancey/itunes"
+	"github.com/rclancey/itunes/persistentId"
+)
+
+type fixture struct {
+	lib *itunes.Library
+	s *Server
+	tracks []*itunes.Track
+	// late is in the Moods folder; trip has a slash in its name
+	late *itunes.Playlist
+	trip *itunes.Playlist
+}
+
+// newFixture lays out as
+//   Miles Davis/Kind of Blue/01 So What.mp3
+//   Miles Davis/Kind of Blue/02 Freddie Freeloader.mp3
+//   Radiohead/OK Computer/02 Paranoid Android.flac
+//   Various Artists/Jazz Hits/2-03 Take Five.m4a
+// with Airbag left out for having no file.
+func newFixture(t *testing.T) *fixture {
+	lib := itunes.NewLibrary()
+	f := &fixture{lib: lib}
+	for i, tr := range []*itunes.Track{
+		{Name: "So What", Artist: "Miles Davis", Album: "Kind of Blue", Genre: "Jazz", TrackNumber: 1, Location: "file:///music/so-what.mp3", TotalTime: 562000},
+		{Name: "Freddie Freeloader", Artist: "Miles Davis", Album: "Kind of Blue", Genre: "Jazz", TrackNumber: 2, Location: "file:///music/freddie.mp3", TotalTime: 586000},
+		{Name: "Take Five", Artist: "Dave Brubeck Quartet", AlbumArtist: "Various Artists", Album: "Jazz Hits", Genre: "Jazz", DiscNumber: 2, DiscCount: 2, TrackNumber: 3, Location: "file:///music/take-five.m4a", TotalTime: 324000},
+		{Name: "Paranoid Android", Artist: "Radiohead", Album: "OK Computer", Genre: "Rock", TrackNumber: 2, Location: "file:///music/paranoid.flac", TotalTime: 383000},
+		{Name: "Airbag", Artist: "Radiohead", Album: "OK Computer", Genre: "Rock", TrackNumber: 1, TotalTime: 284000},
+	} {
+		tr.PersistentID = pid.PersistentID(i + 1)
+		lib.AddTrack(tr)
+		f.tracks = append(f.tracks, tr)
+	}
+	moods := lib.CreateFolder("Moods", nil)
+	f.late = lib.CreatePlaylist("Late Night", &moods.PersistentID)
+	lib.AddToPlaylist(f.late, f.tracks[2], f.tracks[0], f.tracks[4])
+	f.trip = lib.CreatePlaylist("Road Trip/2020", nil)
+	lib.AddToPlaylist(f.trip, f.tracks[3])
+	f.s = NewServer(lib)
+	t.Cleanup(f.s.Close)
+	return f
+}
+
+// client is a scripted MPD client talking to ServeConn over a pipe.
+type client struct {
+	t *testing.T
+	conn net.Conn
+	r *bufio.Reader
+}
+
+func (f *fixture) connect(t *testing.T) *client {
+	t.Helper()
+	local, remote := net.Pipe()
+	go f.s.ServeConn(remote)
+	c := &client{t: t, conn: local, r: bufio.NewReader(local)}
+	t.Cleanup(func() { local.Close() })
+	if line := c.line(); line != "OK MPD " + ProtocolVersion {
+		t.Fatalf("got greeting %q", line)
+	}
+	return c
+}
+
+func (c *client) line() string {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.t.Fatalf("reading response: %s", err)
+	}
+	return strings.TrimSuffix(line, "\n")
+}
+
+func (c *client) send(lines ...string) {
+	c.t.Helper()
+	c.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	_, err := c.conn.Write([]byte(strings.Join(lines, "\n") + "\n"))
+	if err != nil {
+		c.t.Fatalf("sending %q: %s", lines, err)
+	}
+}
+
+// response reads lines up to and including the final OK or ACK.
+func (c *client) response() []string {
+	c.t.Helper()
+	lines := []string{}
+	for {
+		line := c.line()
+		lines = append(lines, line)
+		if line == "OK" || strings.HasPrefix(line, "ACK ") {
+			return lines
+		}
+	}
+}
+
+// do sends a command and returns its response, without the lines that
+// don't start with one of the keys, if any are given.
+func (c *client) do(cmd string, keys ...string) []string {
+	c.t.Helper()
+	c.send(cmd)
+	lines := c.response()
+	if len(keys) == 0 {
+		return lines
+	}
+	out := []string{}
+	for _, line := range lines {
+		for _, k := range keys {
+			if strings.HasPrefix(line, k + ": ") || line == "OK" || strings.HasPrefix(line, "ACK ") {
+				out = append(out, line)
+				break
+			}
+		}
+	}
+	return out
+}
+
+func expect(t *testing.T, what string, got []string, want ...string) {
+	t.Helper()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("%s:\n got %q\nwant %q", what, got, want)
+	}
+}
+
+func TestCommands(t *testing.T) {
+	c := newFixture(t).connect(t)
+	expect(t, "ping", c.do("ping"), "OK")
+	expect(t, "unknown", c.do("bogus"), `ACK [5@0] {bogus} unknown command "bogus"`)
+	expect(t, "bad quoting", c.do(`find artist "Miles`), "ACK [2@0] {} Invalid unquoted character")
+	c.send("close")
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.r.ReadString('\n'); err == nil {
+		t.Errorf("connection still open after close")
+	}
+}
+
+func TestCommandList(t *testing.T) {
+	c := newFixture(t).connect(t)
+	c.send("command_list_begin", "ping", `find title "Take Five"`, "ping", "command_list_end")
+	expect(t, "command list", c.response(),
+		"file: Various Artists/Jazz Hits/2-03 Take Five.m4a",
+		"Artist: Dave Brubeck Quartet",
+		"Album: Jazz Hits",
+		"AlbumArtist: Various Artists",
+		"Title: Take Five",
+		"Track: 3",
+		"Genre: Jazz",
+		"Disc: 2",
+		"Time: 324",
+		"duration: 324.000",
+		"OK",
+	)
+	c.send("command_list_ok_begin", "ping", "list album artist Radiohead", "command_list_end")
+	expect(t, "ok list", c.response(), "list_OK", "Album: OK Computer", "list_OK", "OK")
+	// output from the commands before a failure is still sent, and the
+	// ACK gives the failing command's position
+	c.send("command_list_ok_begin", "ping", "bogus", "ping", "command_list_end")
+	expect(t, "failing list", c.response(), "list_OK", `ACK [5@1] {bogus} unknown command "bogus"`)
+	c.send("command_list_begin", "ping", "listplaylist nope", "command_list_end")
+	expect(t, "no such playlist", c.response(), "ACK [50@1] {listplaylist} No such playlist")
+	expect(t, "after lists", c.do("ping"), "OK")
+}
+
+func TestFind(t *testing.T) {
+	c := newFixture(t).connect(t)
+	expect(t, "find", c.do(`find album "Kind of Blue"`, "file"),
+		"file: Miles Davis/Kind of Blue/01 So What.mp3",
+		"file: Miles Davis/Kind of Blue/02 Freddie Freeloader.mp3",
+		"OK",
+	)
+	expect(t, "find is exact", c.do(`find album "kind of blue"`, "file"), "OK")
+	expect(t, "find expression", c.do(`find "((genre == 'Jazz') AND (albumartist != 'Various Artists'))"`, "Title"),
+		"Title: So What",
+		"Title: Freddie Freeloader",
+		"OK",
+	)
+	expect(t, "find sort window", c.do(`find "(genre == 'Jazz')" sort -Title window 0:2`, "Title"),
+		"Title: Take Five",
+		"Title: So What",
+		"OK",
+	)
+	expect(t, "find base", c.do(`find base "Various Artists"`, "file"), "file: Various Artists/Jazz Hits/2-03 Take Five.m4a", "OK")
+	expect(t, "songs without files", c.do(`find any "OK Computer"`, "Title"), "Title: Paranoid Android", "OK")
+	expect(t, "find negated", c.do(`find "(!(genre == 'Jazz'))"`, "Title"), "Title: Paranoid Android", "OK")
+	expect(t, "bad tag", c.do(`find nosuchtag x`), "ACK [2@0] {find} unknown filter type")
+	expect(t, "odd arguments", c.do(`find artist`), "ACK [2@0] {find} incorrect number of filter arguments")
+	expect(t, "no arguments", c.do(`find`), "ACK [2@0] {find} too few arguments")
+}
+
+func TestSearch(t *testing.T) {
+	c := newFixture(t).connect(t)
+	expect(t, "search folds case", c.do(`search title FIVE`, "Title"), "Title: Take Five", "OK")
+	expect(t, "search any", c.do(`search any davis`, "Title"),
+		"Title: So What",
+		"Title: Freddie Freeloader",
+		"OK",
+	)
+	expect(t, "search expression", c.do(`search "(artist == 'radiohead')"`, "Title"), "Title: Paranoid Android", "OK")
+	expect(t, "search regexp", c.do(`search "(title =~ '^(so|take) ')"`, "Title"),
+		"Title: So What",
+		"Title: Take Five",
+		"OK",
+	)
+}
+
+func TestList(t *testing.T) {
+	c := newFixture(t).connect(t)
+	expect(t, "list album", c.do("list album"), "Album: Jazz Hits", "Album: Kind of Blue", "Album: OK Computer", "OK")
+	expect(t, "legacy artist", c.do(`list album "Miles Davis"`), "Album: Kind of Blue", "OK")
+	expect(t, "filtered", c.do(`list title genre Jazz`),
+		"Title: Freddie Freeloader",
+		"Title: So What",
+		"Title: Take Five",
+		"OK",
+	)
+	expect(t, "grouped", c.do("list album group artist"),
+		"Artist: Dave Brubeck Quartet",
+		"Album: Jazz Hits",
+		"Artist: Miles Davis",
+		"Album: Kind of Blue",
+		"Artist: Radiohead",
+		"Album: OK Computer",
+		"OK",
+	)
+	expect(t, "files", c.do(`list file album "OK Computer"`), "file: Radiohead/OK Computer/02 Paranoid Android.flac", "OK")
+	expect(t, "unknown tag", c.do("list nosuchtag"), "ACK [2@0] {list} Unknown tag type: nosuchtag")
+}
+
+func TestPlaylists(t *testing.T) {
+	c := newFixture(t).connect(t)
+	expect(t, "listplaylists", c.do("listplaylists", "playlist"), "playlist: Moods/Late Night", "playlist: Road Trip_2020", "OK")
+	expect(t, "listplaylist", c.do(`listplaylist "Moods/Late Night"`),
+		"file: Various Artists/Jazz Hits/2-03 Take Five.m4a",
+		"file: Miles Davis/Kind of Blue/01 So What.mp3",
+		"OK",
+	)
+	expect(t, "listplaylistinfo", c.do(`listplaylistinfo "Moods/Late Night"`, "file", "Title", "Time"),
+		"file: Various Artists/Jazz Hits/2-03 Take Five.m4a",
+		"Title: Take Five",
+		"Time: 324",
+		"file: Miles Davis/Kind of Blue/01 So What.mp3",
+		"Title: So What",
+		"Time: 562",
+		"OK",
+	)
+	expect(t, "missing", c.do(`listplaylistinfo "Late Night"`), "ACK [50@0] {listplaylistinfo} No such playlist")
+	expect(t, "no name", c.do("listplaylistinfo"), "ACK [2@0] {listplaylistinfo} wrong number of arguments")
+}
+
+func TestIdle(t *testing.T) {
+	f := newFixture(t)
+	c := f.connect(t)
+	c.send("idle")
+	expect(t, "noidle", c.do("noidle"), "OK")
+
+	// a change while idle wakes the client
+	c.send("idle")
+	f.lib.Lock()
+	f.lib.AddToPlaylist(f.trip, f.tracks[0])
+	f.lib.Unlock()
+	expect(t, "playlist change", c.response(), "changed: stored_playlist", "OK")
+	expect(t, "updated playlist", c.do(`listplaylist "Road Trip_2020"`),
+		"file: Radiohead/OK Computer/02 Paranoid Android.flac",
+		"file: Miles Davis/Kind of Blue/01 So What.mp3",
+		"OK",
+	)
+
+	// changes between idles are reported straight away
+	f.lib.Lock()
+	f.lib.RenamePlaylist(f.trip, "Summer")
+	f.lib.Unlock()
+	expect(t, "missed change", c.do("idle"), "changed: stored_playlist", "OK")
+
+	// only the requested subsystems wake the client
+	c.send("idle database")
+	f.lib.Lock()
+	f.lib.RenamePlaylist(f.trip, "Winter")
+	f.lib.SetLocation(f.tracks[4], "file:///music/airbag.flac")
+	f.lib.Unlock()
+	expect(t, "filtered idle", c.response(), "changed: database", "OK")
+	expect(t, "found file", c.do(`find album "OK Computer"`, "file"),
+		"file: Radiohead/OK Computer/01 Airbag.flac",
+		"file: Radiohead/OK Computer/02 Paranoid Android.flac",
+		"OK",
+	)
+	// as in MPD, waking up clears the changes that weren't asked for too
+	c.send("idle")
+	expect(t, "nothing pending", c.do("noidle"), "OK")
+
+	// anything but noidle while idle drops the connection
+	c.send("idle", "ping")
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if line, err := c.r.ReadString('\n'); err == nil {
+		t.Errorf("got %q, want the connection closed", line)
+	}
+}
+
+func TestIdleClients(t *testing.T) {
+	f := newFixture(t)
+	clients := []*client{f.connect(t), f.connect(t)}
+	for _, c := range clients {
+		c.send("idle stored_playlist")
+	}
+	f.lib.Lock()
+	f.lib.DeletePlaylist(f.late)
+	f.lib.Unlock()
+	for i, c := range clients {
+		expect(t, fmt.Sprintf("client %d", i), c.response(), "changed: stored_playlist", "OK")
+	}
+	expect(t, "deleted", clients[0].do("listplaylists", "playlist"), "playlist: Road Trip_2020", "OK")
+}
@@ -0,0 +1,402 @@
+package itunes
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/rclancey/itunes/persistentId"
+)
+
+// DefaultOrganizeTemplate matches the layout iTunes uses when it keeps the
+// media folder organized.
+const DefaultOrganizeTemplate = "{{.Artist}}/{{.Album}}/{{.DiscTrack}}{{.Name}}"
+
+type OrganizeOptions struct {
+	// Root is the folder files are organized into.  It defaults to the
+	// first target path of the global file finder.
+	Root string
+	// Template is a text/template producing the slash separated path of
+	// a track under Root, without its extension.  Every field is made
+	// filesystem safe before it is substituted.
+	Template string
+	// CompilationArtist replaces the artist folder of compilation
+	// tracks.  Set it to "" to file compilations under their artist.
+	CompilationArtist string
+	// Copy leaves the original files in place.
+	Copy bool
+}
+
+func DefaultOrganizeOptions() *OrganizeOptions {
+	return &OrganizeOptions{
+		Template: DefaultOrganizeTemplate,
+		CompilationArtist: "Compilations",
+	}
+}
+
+// organizeFields are the values available to an organize template.
+type organizeFields struct {
+	Artist string
+	AlbumArtist string
+	TrackArtist string
+	Album string
+	Name string
+	Composer string
+	Genre string
+	Year string
+	Disc string
+	Track string
+	DiscTrack string
+}
+
+func newOrganizeFields(tr *Track, opts *OrganizeOptions) *organizeFields {
+	f := &organizeFields{
+		TrackArtist: tr.Artist,
+		AlbumArtist: tr.AlbumArtist,
+		Album: tr.Album,
+		Name: tr.Name,
+		Composer: tr.Composer,
+		Genre: tr.Genre,
+	}
+	if f.AlbumArtist == "" {
+		f.AlbumArtist = tr.Artist
+	}
+	f.Artist = f.AlbumArtist
+	if tr.Compilation && opts.CompilationArtist != "" {
+		f.Artist = opts.CompilationArtist
+	}
+	if f.Artist == "" {
+		f.Artist = "Unknown Artist"
+	}
+	if f.Album == "" {
+		f.Album = "Unknown Album"
+	}
+	if f.Name == "" {
+		f.Name = strings.TrimSuffix(filepath.Base(tr.Path()), filepath.Ext(tr.Path()))
+	}
+	if tr.ReleaseDate != nil {
+		f.Year = fmt.Sprintf("%04d", tr.ReleaseDate.Year())
+	}
+	if tr.DiscNumber > 0 {
+		f.Disc = fmt.Sprintf("%d", tr.DiscNumber)
+	}
+	if tr.TrackNumber > 0 {
+		f.Track = fmt.Sprintf("%02d", tr.TrackNumber)
+		f.DiscTrack = f.Track + " "
+		if tr.DiscCount > 1 && tr.DiscNumber > 0 {
+			f.DiscTrack = f.Disc + "-" + f.DiscTrack
+		}
+	}
+	f.Artist = SafeFileName(f.Artist)
+	f.AlbumArtist = SafeFileName(f.AlbumArtist)
+	f.TrackArtist = SafeFileName(f.TrackArtist)
+	f.Album = SafeFileName(f.Album)
+	f.Name = SafeFileName(f.Name)
+	f.Composer = SafeFileName(f.Composer)
+	f.Genre = SafeFileName(f.Genre)
+	return f
+}
+
+type OrganizeStep struct {
+	TrackID pid.PersistentID `json:"track_id"`
+	From string `json:"from"`
+	To string `json:"to"`
+	Done bool `json:"done"`
+	Error string `json:"error,omitempty"`
+}
+
+// OrganizePlan lists the file moves needed to organize a library.  Plans
+// can be saved and reloaded, so an interrupted run can be resumed with
+// the same destinations.
+type OrganizePlan struct {
+	Copy bool `json:"copy"`
+	Steps []*OrganizeStep `json:"steps"`
+}
+
+// OrganizePath works out where a track belongs under opts.Root.
+func (t *Track) OrganizePath(opts *OrganizeOptions) (string, error) {
+	if opts == nil {
+		opts = DefaultOrganizeOptions()
+	}
+	src := opts.Template
+	if src == "" {
+		src = DefaultOrganizeTemplate
+	}
+	tmpl, err := template.New("organize").Parse(src)
+	if err != nil {
+		return "", err
+	}
+	return organizePath(tmpl, t, opts)
+}
+
+func organizePath(tmpl *template.Template, tr *Track, opts *OrganizeOptions) (string, error) {
+	buf := &bytes.Buffer{}
+	err := tmpl.Execute(buf, newOrganizeFields(tr, opts))
+	if err != nil {
+		return "", err
+	}
+	parts := []string{organizeRoot(opts)}
+	for _, part := range strings.Split(buf.String(), "/") {
+		part = strings.TrimSpace(part)
+		if part != "" {
+			parts = append(parts, SafeFileName(part))
+		}
+	}
+	if len(parts) == 1 {
+		return "", errors.New("template produced an empty path")
+	}
+	return filepath.Join(parts...) + strings.ToLower(filepath.Ext(tr.Path())), nil
+}
+
+func organizeRoot(opts *OrganizeOptions) string {
+	if opts.Root != "" {
+		return opts.Root
+	}
+	finder := GetGlobalFinder()
+	if finder != nil && len(finder.TargetPath) > 0 {
+		return finder.TargetPath[0]
+	}
+	return "."
+}
+
+// PlanOrganize works out the destination of every track whose file isn't
+// already where opts says it should be.  Destinations that collide with
+// each other or with existing files get a numeric suffix.
+func (lib *Library) PlanOrganize(opts *OrganizeOptions) (*OrganizePlan, error) {
+	if opts == nil {
+		opts = DefaultOrganizeOptions()
+	}
+	src := opts.Template
+	if src == "" {
+		src = DefaultOrganizeTemplate
+	}
+	tmpl, err := template.New("organize").Parse(src)
+	if err != nil {
+		return nil, err
+	}
+	plan := &OrganizePlan{Copy: opts.Copy, Steps: []*OrganizeStep{}}
+	used := map[string]bool{}
+	for _, tr := range lib.Tracks {
+		if tr.Location == "" {
+			continue
+		}
+		from := tr.Path()
+		if _, err := os.Stat(from); err != nil {
+			continue
+		}
+		to, err := organizePath(tmpl, tr, opts)
+		if err != nil {
+			return nil, err
+		}
+		ext := filepath.Ext(to)
+		base := strings.TrimSuffix(to, ext)
+		for i := 2; ; i++ {
+			if fileKey(to) == fileKey(from) {
+				break
+			}
+			if !used[fileKey(to)] {
+				if _, err := os.Stat(to); os.IsNotExist(err) {
+					break
+				}
+			}
+			to = fmt.Sprintf("%s %d%s", base, i, ext)
+		}
+		used[fileKey(to)] = true
+		if fileKey(to) == fileKey(from) {
+			continue
+		}
+		plan.Steps = append(plan.Steps, &OrganizeStep{TrackID: tr.PersistentID, From: from, To: to})
+	}
+	return plan, nil
+}
+
+func LoadOrganizePlan(fn string) (*OrganizePlan, error) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	plan := &OrganizePlan{}
+	err = json.Unmarshal(data, plan)
+	if err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+func (plan *OrganizePlan) Save(fn string) error {
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpfn := fn + ".tmp"
+	err = ioutil.WriteFile(tmpfn, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpfn, fn)
+}
+
+// Execute moves or copies each file that isn't done yet and points its
+// track at the new location.  A step whose source is gone but whose
+// destination exists is assumed to have been moved by an earlier, failed
+// run, as is one whose destination already holds the same contents.  If progressFn is not empty the plan is saved there after every
+// step.  Errors are recorded on their steps; the number of failed steps
+// is returned.
+func (plan *OrganizePlan) Execute(lib *Library, progressFn string) (int, error) {
+	lib.Begin()
+	defer lib.Commit()
+	failed := 0
+	for _, step := range plan.Steps {
+		if step.Done {
+			continue
+		}
+		tr := lib.GetTrack(step.TrackID)
+		if tr == nil {
+			step.Error = "track not in library"
+			failed++
+			continue
+		}
+		err := plan.execute(step)
+		if err != nil {
+			step.Error = err.Error()
+			failed++
+		} else {
+			step.Done = true
+			step.Error = ""
+			lib.SetLocation(tr, step.To)
+		}
+		if progressFn != "" {
+			err = plan.Save(progressFn)
+			if err != nil {
+				return failed, err
+			}
+		}
+	}
+	return failed, nil
+}
+
+func (plan *OrganizePlan) execute(step *OrganizeStep) error {
+	_, serr := os.Stat(step.From)
+	_, derr := os.Stat(step.To)
+	if os.IsNotExist(serr) && derr == nil && !plan.Copy {
+		return nil
+	}
+	if serr != nil {
+		return serr
+	}
+	if derr == nil {
+		// an earlier run may have stopped after copying but before
+		// recording the step
+		same, err := sameContents(step.From, step.To)
+		if err != nil {
+			return err
+		}
+		if !same {
+			return fmt.Errorf("%s already exists", step.To)
+		}
+		if plan.Copy {
+			return nil
+		}
+		return os.Remove(step.From)
+	}
+	err := EnsureDir(step.To)
+	if err != nil {
+		return err
+	}
+	if plan.Copy {
+		return copyFile(step.From, step.To)
+	}
+	err = os.Rename(step.From, step.To)
+	if err == nil {
+		return nil
+	}
+	// probably a different filesystem
+	err = copyFile(step.From, step.To)
+	if err != nil {
+		return err
+	}
+	return os.Remove(step.From)
+}
+
+// sameContents reports whether two files have the same size and bytes.
+func sameContents(a, b string) (bool, error) {
+	ast, err := os.Stat(a)
+	if err != nil {
+		return false, err
+	}
+	bst, err := os.Stat(b)
+	if err != nil {
+		return false, err
+	}
+	if ast.Size() != bst.Size() {
+		return false, nil
+	}
+	af, err := os.Open(a)
+	if err != nil {
+		return false, err
+	}
+	defer af.Close()
+	bf, err := os.Open(b)
+	if err != nil {
+		return false, err
+	}
+	defer bf.Close()
+	abuf := make([]byte, 64 * 1024)
+	bbuf := make([]byte, 64 * 1024)
+	for {
+		an, aerr := io.ReadFull(af, abuf)
+		bn, berr := io.ReadFull(bf, bbuf)
+		if an != bn || !bytes.Equal(abuf[:an], bbuf[:bn]) {
+			return false, nil
+		}
+		if aerr == io.EOF || aerr == io.ErrUnexpectedEOF {
+			return berr == aerr, nil
+		}
+		if aerr != nil {
+			return false, aerr
+		}
+		if berr != nil {
+			return false, berr
+		}
+	}
+}
+
+// copyFile copies src to dst through a temporary file, so that dst is
+// either complete or absent.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	st, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	tmpfn := dst + ".part"
+	out, err := os.OpenFile(tmpfn, os.O_WRONLY | os.O_CREATE | os.O_TRUNC, st.Mode())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	cerr := out.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmpfn)
+		return err
+	}
+	os.Chtimes(tmpfn, st.ModTime(), st.ModTime())
+	return os.Rename(tmpfn, dst)
+}
@@ -65,6 +65,9 @@ func (p *Playlist) Populate(lib *Library) *Playlist {
 	return &clone
 }
 
+// Nest links p into lib's playlist tree under its parent.  It is low
+// level and emits no events; use Library.CreatePlaylist, CreateFolder or
+// MovePlaylist instead.
 func (p *Playlist) Nest(lib *Library) {
 	if p.ParentPersistentID != nil {
 		parent, ok := lib.Playlists[*p.ParentPersistentID]
@@ -76,6 +79,8 @@ func (p *Playlist) Nest(lib *Library) {
 	lib.PlaylistTree = append(lib.PlaylistTree, p)
 }
 
+// Unnest unlinks p from lib's playlist tree.  Like Nest it emits no
+// events; use Library.MovePlaylist or DeletePlaylist instead.
 func (p *Playlist) Unnest(lib *Library) {
 	var orig []*Playlist
 	var ppl *Playlist
@@ -106,16 +111,7 @@ func (p *Playlist) Unnest(lib *Library) {
 }
 
 func (p *Playlist) Move(lib *Library, parentId *pid.PersistentID) error {
-	if p.ParentPersistentID == nil && parentId == nil {
-		return nil
-	}
-	if p.ParentPersistentID != nil && parentId != nil && *p.ParentPersistentID == *parentId {
-		return nil
-	}
-	p.Unnest(lib)
-	p.ParentPersistentID = parentId
-	p.Nest(lib)
-	return nil
+	return lib.MovePlaylist(p, parentId)
 }
 
 func (p *Playlist) Dedup() {
@@ -155,10 +151,57 @@ func (p *Playlist) Prune() *Playlist {
 	return &clone
 }
 
+// AddTrack appends t to the playlist without emitting an event; use
+// Library.AddToPlaylist so that subscribers hear about it.
 func (p *Playlist) AddTrack(t *Track) {
 	p.TrackIDs = append(p.TrackIDs, t.PersistentID)
 }
 
+func (p *Playlist) RemoveTracks(ids ...pid.PersistentID) int {
+	remove := map[pid.PersistentID]bool{}
+	for _, id := range ids {
+		remove[id] = true
+	}
+	keep := make([]pid.PersistentID, 0, len(p.TrackIDs))
+	for _, id := range p.TrackIDs {
+		if !remove[id] {
+			keep = append(keep, id)
+		}
+	}
+	n := len(p.TrackIDs) - len(keep)
+	if n > 0 {
+		p.TrackIDs = keep
+	}
+	return n
+}
+
+// ReplaceTrack points entries for old at replacement instead, dropping
+// them if replacement is already in the playlist.
+func (p *Playlist) ReplaceTrack(old, replacement pid.PersistentID) bool {
+	has := false
+	found := false
+	for _, id := range p.TrackIDs {
+		if id == replacement {
+			has = true
+		} else if id == old {
+			found = true
+		}
+	}
+	if !found {
+		return false
+	}
+	if has {
+		p.RemoveTracks(old)
+		return true
+	}
+	for i, id := range p.TrackIDs {
+		if id == old {
+			p.TrackIDs[i] = replacement
+		}
+	}
+	return true
+}
+
 func (p *Playlist) DescendantCount() int {
 	i := 0
 	if p.Folder == false {
@@ -240,6 +283,8 @@ func (p *Playlist) Priority() int {
 	return 200
 }
 
+// Update applies the changes from orig to cur to p without emitting
+// events; use Library.UpdatePlaylist instead.
 func (p *Playlist) Update(orig, cur *Playlist) (*pid.PersistentID, bool) {
 	if p.Folder != cur.Folder {
 		return nil, false
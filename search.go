@@ -0,0 +1,432 @@
+package itunes
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+
+	"github.com/rclancey/itunes/persistentId"
+)
+
+type searchField struct {
+	name string
+	field string
+	weight float64
+	get func(tr *Track) string
+}
+
+// searchFields are the indexed fields, named as in the track JSON.  At
+// most 32, as fields are kept in a bit mask.
+var searchFields = []searchField{
+	{"name", "Name", 3, func(tr *Track) string { return tr.Name }},
+	{"artist", "Artist", 2, func(tr *Track) string { return tr.Artist }},
+	{"album_artist", "AlbumArtist", 1.5, func(tr *Track) string { return tr.AlbumArtist }},
+	{"album", "Album", 2, func(tr *Track) string { return tr.Album }},
+	{"composer", "Composer", 1, func(tr *Track) string { return tr.Composer }},
+	{"work", "Work", 1, func(tr *Track) string { return tr.Work }},
+	{"grouping", "Grouping", 0.75, func(tr *Track) string { return tr.Grouping }},
+	{"comments", "Comments", 0.5, func(tr *Track) string { return tr.Comments }},
+}
+
+var searchFieldsByGoName = map[string]bool{}
+
+func init() {
+	for _, f := range searchFields {
+		searchFieldsByGoName[f.field] = true
+	}
+}
+
+// letters that don't decompose into a base letter and a combining mark
+var foldLetters = strings.NewReplacer(
+	"ø", "o", "Ø", "o",
+	"ł", "l", "Ł", "l",
+	"đ", "d", "Đ", "d",
+	"ð", "d", "Ð", "d",
+	"þ", "th", "Þ", "th",
+	"æ", "ae", "Æ", "ae",
+	"œ", "oe", "Œ", "oe",
+	"ı", "i",
+)
+
+// foldText lower cases s and strips its diacritics, so that "Björk" and
+// "bjork" index the same.
+func foldText(s string) string {
+	t := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+	folded, _, err := transform.String(t, s)
+	if err != nil {
+		folded = s
+	}
+	return cases.Fold().String(foldLetters.Replace(folded))
+}
+
+// searchTerms splits text into folded words.  Apostrophes are dropped
+// rather than splitting words, so "don't" matches "dont".
+func searchTerms(s string) []string {
+	s = foldText(s)
+	terms := []string{}
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			b.WriteRune(r)
+		case r == '\'' || r == '’':
+		default:
+			if b.Len() > 0 {
+				terms = append(terms, b.String())
+				b.Reset()
+			}
+		}
+	}
+	if b.Len() > 0 {
+		terms = append(terms, b.String())
+	}
+	return terms
+}
+
+// SearchIndex is an inverted index of the text fields of tracks.  It is
+// safe for concurrent use.
+type SearchIndex struct {
+	mutex sync.RWMutex
+	// postings maps each word to the tracks containing it and, as a
+	// bit mask, the fields it appears in
+	postings map[string]map[pid.PersistentID]uint32
+	// vocabulary holds the words in sorted order, for prefix matching
+	vocabulary []string
+	tracks map[pid.PersistentID]*Track
+	terms map[pid.PersistentID]map[string]uint32
+}
+
+type SearchOptions struct {
+	// Fields limits the search to the named fields: name, artist,
+	// album_artist, album, composer, work, grouping and comments.  All of
+	// them are searched when it is empty.
+	Fields []string
+	// Prefix lets query words match the start of longer words.  The last
+	// word of a query is always matched as a prefix.
+	Prefix bool
+	// Fuzzy lets query words match with a typo: one edit in words of four
+	// or more letters, two in words of eight or more.
+	Fuzzy bool
+	// Any returns tracks that match any of the query words instead of all
+	// of them.
+	Any bool
+	// Limit is the maximum number of results; zero means no limit.
+	Limit int
+}
+
+func DefaultSearchOptions() *SearchOptions {
+	return &SearchOptions{
+		Prefix: true,
+		Fuzzy: true,
+		Limit: 100,
+	}
+}
+
+type SearchResult struct {
+	Track *Track `json:"track"`
+	Score float64 `json:"score"`
+	// Fields lists the fields that matched.
+	Fields []string `json:"fields"`
+}
+
+func NewSearchIndex(tl *TrackList) *SearchIndex {
+	idx := &SearchIndex{
+		postings: map[string]map[pid.PersistentID]uint32{},
+		vocabulary: []string{},
+		tracks: map[pid.PersistentID]*Track{},
+		terms: map[pid.PersistentID]map[string]uint32{},
+	}
+	if tl != nil {
+		for _, tr := range *tl {
+			idx.add(tr)
+		}
+	}
+	return idx
+}
+
+// Follow keeps the index up to date as tracks in lib are added, removed
+// and edited.  The returned function stops following.  Events are
+// delivered after the library is unlocked, so the handler takes a read
+// lock while it reads the tracks.
+func (idx *SearchIndex) Follow(lib *Library) func() {
+	return lib.Subscribe(func(events []*Event) {
+		lib.RLock()
+		defer lib.RUnlock()
+		for _, ev := range events {
+			if ev.TrackID == nil {
+				continue
+			}
+			switch ev.Type {
+			case TrackAdded, TrackModified:
+				if ev.Type == TrackModified && !indexedChange(ev.Fields) {
+					continue
+				}
+				tr := lib.GetTrack(*ev.TrackID)
+				if tr != nil {
+					idx.Add(tr)
+				}
+			case TrackRemoved:
+				idx.Remove(*ev.TrackID)
+			}
+		}
+	})
+}
+
+func indexedChange(fields []string) bool {
+	for _, f := range fields {
+		if searchFieldsByGoName[f] {
+			return true
+		}
+	}
+	return false
+}
+
+func (idx *SearchIndex) Len() int {
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+	return len(idx.tracks)
+}
+
+// Add indexes a track, replacing what was indexed for it before.
+func (idx *SearchIndex) Add(tr *Track) {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+	idx.add(tr)
+}
+
+func (idx *SearchIndex) Remove(id pid.PersistentID) {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+	idx.remove(id)
+}
+
+func (idx *SearchIndex) add(tr *Track) {
+	idx.remove(tr.PersistentID)
+	terms := map[string]uint32{}
+	for i, f := range searchFields {
+		for _, term := range searchTerms(f.get(tr)) {
+			terms[term] |= 1 << uint(i)
+		}
+	}
+	idx.tracks[tr.PersistentID] = tr
+	idx.terms[tr.PersistentID] = terms
+	for term, mask := range terms {
+		docs, ok := idx.postings[term]
+		if !ok {
+			docs = map[pid.PersistentID]uint32{}
+			idx.postings[term] = docs
+			i := sort.SearchStrings(idx.vocabulary, term)
+			idx.vocabulary = append(idx.vocabulary, "")
+			copy(idx.vocabulary[i+1:], idx.vocabulary[i:])
+			idx.vocabulary[i] = term
+		}
+		docs[tr.PersistentID] = mask
+	}
+}
+
+func (idx *SearchIndex) remove(id pid.PersistentID) {
+	terms, ok := idx.terms[id]
+	if !ok {
+		return
+	}
+	for term := range terms {
+		docs := idx.postings[term]
+		delete(docs, id)
+		if len(docs) == 0 {
+			delete(idx.postings, term)
+			i := sort.SearchStrings(idx.vocabulary, term)
+			if i < len(idx.vocabulary) && idx.vocabulary[i] == term {
+				idx.vocabulary = append(idx.vocabulary[:i], idx.vocabulary[i+1:]...)
+			}
+		}
+	}
+	delete(idx.terms, id)
+	delete(idx.tracks, id)
+}
+
+// match is an indexed word that a query word matches, with how good a
+// match it is, from 1 for an exact match down.
+type match struct {
+	term string
+	quality float64
+}
+
+func (idx *SearchIndex) matches(q string, prefix, fuzzy bool) []match {
+	ms := []match{}
+	if _, ok := idx.postings[q]; ok {
+		ms = append(ms, match{q, 1})
+	}
+	if prefix {
+		i := sort.SearchStrings(idx.vocabulary, q)
+		for ; i < len(idx.vocabulary) && strings.HasPrefix(idx.vocabulary[i], q); i++ {
+			t := idx.vocabulary[i]
+			if t != q {
+				ms = append(ms, match{t, 0.5 + 0.3 * float64(len(q)) / float64(len(t))})
+			}
+		}
+	}
+	max := maxEdits(q)
+	if fuzzy && max > 0 {
+		n := len([]rune(q))
+		for _, t := range idx.vocabulary {
+			if t == q || (prefix && strings.HasPrefix(t, q)) {
+				continue
+			}
+			tn := len([]rune(t))
+			if tn < n - max || tn > n + max {
+				continue
+			}
+			if d := editDistance(q, t, max); d <= max {
+				ms = append(ms, match{t, 0.6 - 0.2 * float64(d)})
+			}
+		}
+	}
+	return ms
+}
+
+func maxEdits(q string) int {
+	n := len([]rune(q))
+	switch {
+	case n >= 8:
+		return 2
+	case n >= 4:
+		return 1
+	}
+	return 0
+}
+
+// editDistance is the optimal string alignment distance between a and b,
+// counting a transposition of adjacent letters as one edit.  It gives up
+// and returns max + 1 once the distance must exceed max.
+func editDistance(a, b string, max int) int {
+	ra, rb := []rune(a), []rune(b)
+	prev2 := make([]int, len(rb) + 1)
+	prev := make([]int, len(rb) + 1)
+	cur := make([]int, len(rb) + 1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		best := cur[0]
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			d := prev[j-1] + cost
+			if prev[j] + 1 < d {
+				d = prev[j] + 1
+			}
+			if cur[j-1] + 1 < d {
+				d = cur[j-1] + 1
+			}
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] && prev2[j-2] + 1 < d {
+				d = prev2[j-2] + 1
+			}
+			cur[j] = d
+			if d < best {
+				best = d
+			}
+		}
+		if best > max {
+			return max + 1
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	return prev[len(rb)]
+}
+
+// Search finds the tracks matching query, best first.  Each matching word
+// scores by how well it matched, the weight of the field it's in and how
+// rare it is in the index.  Ties go to the most played track.
+func (idx *SearchIndex) Search(query string, opts *SearchOptions) []*SearchResult {
+	if opts == nil {
+		opts = DefaultSearchOptions()
+	}
+	var fieldMask uint32
+	if len(opts.Fields) == 0 {
+		fieldMask = ^uint32(0)
+	} else {
+		for _, name := range opts.Fields {
+			for i, f := range searchFields {
+				if f.name == name {
+					fieldMask |= 1 << uint(i)
+				}
+			}
+		}
+	}
+	words := searchTerms(query)
+	if len(words) == 0 || fieldMask == 0 {
+		return []*SearchResult{}
+	}
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+	n := float64(len(idx.tracks))
+	scores := map[pid.PersistentID]float64{}
+	fields := map[pid.PersistentID]uint32{}
+	hits := map[pid.PersistentID]int{}
+	for wi, w := range words {
+		prefix := opts.Prefix || wi == len(words) - 1
+		best := map[pid.PersistentID]float64{}
+		for _, m := range idx.matches(w, prefix, opts.Fuzzy) {
+			docs := idx.postings[m.term]
+			idf := math.Log(1 + n / float64(len(docs)))
+			for id, mask := range docs {
+				mask &= fieldMask
+				if mask == 0 {
+					continue
+				}
+				weight := 0.0
+				for i, f := range searchFields {
+					if mask & (1 << uint(i)) != 0 && f.weight > weight {
+						weight = f.weight
+					}
+				}
+				score := m.quality * weight * idf
+				if score > best[id] {
+					best[id] = score
+				}
+				fields[id] |= mask
+			}
+		}
+		for id, score := range best {
+			scores[id] += score
+			hits[id]++
+		}
+	}
+	results := []*SearchResult{}
+	for id, score := range scores {
+		if !opts.Any && hits[id] < len(words) {
+			continue
+		}
+		res := &SearchResult{Track: idx.tracks[id], Score: score, Fields: []string{}}
+		for i, f := range searchFields {
+			if fields[id] & (1 << uint(i)) != 0 {
+				res.Fields = append(res.Fields, f.name)
+			}
+		}
+		results = append(results, res)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		if a.Track.PlayCount != b.Track.PlayCount {
+			return a.Track.PlayCount > b.Track.PlayCount
+		}
+		return a.Track.PersistentID < b.Track.PersistentID
+	})
+	if opts.Limit > 0 && len(results) > opts.Limit {
+		results = results[:opts.Limit]
+	}
+	return results
+}
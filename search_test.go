@@ -0,0 +1,215 @@
+package itunes
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/rclancey/itunes/persistentId"
+)
+
+func newSearchTracks() *TrackList {
+	return &TrackList{
+		{PersistentID: 1, Name: "Jóga", Artist: "Björk", Album: "Homogenic"},
+		{PersistentID: 2, Name: "Paranoid Android", Artist: "Radiohead", Album: "OK Computer"},
+		{PersistentID: 3, Name: "Svefn-g-englar", Artist: "Sigur Rós", Album: "Ágætis byrjun"},
+		{PersistentID: 4, Name: "So What", Artist: "Miles Davis", Album: "Kind of Blue", Composer: "Miles Davis"},
+		{PersistentID: 5, Name: "Miles Runs the Voodoo Down", Artist: "Miles Davis", Album: "Bitches Brew", PlayCount: 5},
+		{PersistentID: 6, Name: "Miles Away", Artist: "Various", Album: "Miles", Comments: "android"},
+		{PersistentID: 7, Name: "Don't Stop Me Now", Artist: "Queen", Album: "Jazz"},
+	}
+}
+
+func searchIDs(results []*SearchResult) []pid.PersistentID {
+	ids := []pid.PersistentID{}
+	for _, res := range results {
+		ids = append(ids, res.Track.PersistentID)
+	}
+	return ids
+}
+
+func TestSearch(t *testing.T) {
+	idx := NewSearchIndex(newSearchTracks())
+	exact := &SearchOptions{}
+	tests := []struct {
+		name string
+		query string
+		opts *SearchOptions
+		want []pid.PersistentID
+	}{
+		{"folding", "bjork", exact, []pid.PersistentID{1}},
+		{"folding", "BJÖRK joga", exact, []pid.PersistentID{1}},
+		{"folding", "sigur ros agaetis", exact, []pid.PersistentID{3}},
+		{"apostrophe", "dont stop", exact, []pid.PersistentID{7}},
+		{"last word prefix", "paranoid andr", exact, []pid.PersistentID{2}},
+		{"no prefix", "para android", exact, []pid.PersistentID{}},
+		{"prefix", "para android", &SearchOptions{Prefix: true}, []pid.PersistentID{2}},
+		{"no fuzzy", "radoihead", exact, []pid.PersistentID{}},
+		{"fuzzy transposition", "radoihead", &SearchOptions{Fuzzy: true}, []pid.PersistentID{2}},
+		{"fuzzy substitution", "homogenix", &SearchOptions{Fuzzy: true}, []pid.PersistentID{1}},
+		{"fuzzy short word", "jazs", &SearchOptions{Fuzzy: true}, []pid.PersistentID{7}},
+		{"fuzzy too short", "jag", &SearchOptions{Fuzzy: true}, []pid.PersistentID{}},
+		{"all words", "miles brew", exact, []pid.PersistentID{5}},
+		{"any word", "joga brew", &SearchOptions{Any: true}, []pid.PersistentID{1, 5}},
+		{"fields", "android", &SearchOptions{Fields: []string{"name"}}, []pid.PersistentID{2}},
+		{"fields", "android", &SearchOptions{Fields: []string{"comments"}}, []pid.PersistentID{6}},
+		{"fields", "miles", &SearchOptions{Fields: []string{"composer"}}, []pid.PersistentID{4}},
+		{"unknown field", "miles", &SearchOptions{Fields: []string{"nope"}}, []pid.PersistentID{}},
+		{"limit", "miles", &SearchOptions{Limit: 2}, nil},
+		{"empty", " - ", nil, []pid.PersistentID{}},
+	}
+	for _, test := range tests {
+		got := searchIDs(idx.Search(test.query, test.opts))
+		if test.want == nil {
+			if len(got) != 2 {
+				t.Errorf("%s: %q got %v, want 2 results", test.name, test.query, got)
+			}
+			continue
+		}
+		// compare as sets; order is checked by TestSearchRanking
+		if len(test.want) > 1 {
+			set := map[pid.PersistentID]bool{}
+			for _, id := range got {
+				set[id] = true
+			}
+			got = []pid.PersistentID{}
+			for _, id := range test.want {
+				if set[id] {
+					got = append(got, id)
+				}
+			}
+			if len(set) != len(got) {
+				got = append(got, 0)
+			}
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: %q got %v, want %v", test.name, test.query, got, test.want)
+		}
+	}
+}
+
+func TestSearchRanking(t *testing.T) {
+	idx := NewSearchIndex(newSearchTracks())
+
+	// a match in the name beats one in the comments
+	res := idx.Search("android", &SearchOptions{})
+	if got := searchIDs(res); !reflect.DeepEqual(got, []pid.PersistentID{2, 6}) {
+		t.Errorf("got %v, want the name match before the comment match", got)
+	}
+	if !reflect.DeepEqual(res[0].Fields, []string{"name"}) || !reflect.DeepEqual(res[1].Fields, []string{"comments"}) {
+		t.Errorf("got fields %v and %v", res[0].Fields, res[1].Fields)
+	}
+
+	// equal scores go to the most played track
+	res = idx.Search("miles davis", &SearchOptions{Fields: []string{"artist"}})
+	if got := searchIDs(res); !reflect.DeepEqual(got, []pid.PersistentID{5, 4}) {
+		t.Errorf("got %v, want the most played first", got)
+	}
+
+	// an exact word beats a prefix, which beats a typo
+	idx = NewSearchIndex(&TrackList{
+		{PersistentID: 1, Name: "Blackbirds"},
+		{PersistentID: 2, Name: "Blackbird"},
+		{PersistentID: 3, Name: "Blackbyrd"},
+	})
+	res = idx.Search("blackbird", DefaultSearchOptions())
+	if got := searchIDs(res); !reflect.DeepEqual(got, []pid.PersistentID{2, 1, 3}) {
+		t.Errorf("got %v, want exact, prefix, fuzzy", got)
+	}
+	if !(res[0].Score > res[1].Score && res[1].Score > res[2].Score) {
+		t.Errorf("got scores %v, %v, %v", res[0].Score, res[1].Score, res[2].Score)
+	}
+}
+
+func TestSearchFollow(t *testing.T) {
+	lib := NewLibrary()
+	for _, tr := range *newSearchTracks() {
+		lib.AddTrack(tr)
+	}
+	tl := TrackList(lib.Tracks)
+	idx := NewSearchIndex(&tl)
+	stop := idx.Follow(lib)
+	find := func(q string) []pid.PersistentID {
+		return searchIDs(idx.Search(q, &SearchOptions{}))
+	}
+
+	lib.AddTrack(&Track{PersistentID: 8, Name: "Hyperballad", Artist: "Björk"})
+	if got := find("hyperballad"); !reflect.DeepEqual(got, []pid.PersistentID{8}) {
+		t.Errorf("got %v after adding a track", got)
+	}
+	if idx.Len() != 8 {
+		t.Errorf("got %d indexed tracks, want 8", idx.Len())
+	}
+
+	tr := lib.GetTrack(1)
+	cur := *tr
+	cur.Name = "Bachelorette"
+	lib.UpdateTrack(tr, tr, &cur)
+	if got := find("joga"); len(got) != 0 {
+		t.Errorf("old name still found: %v", got)
+	}
+	if got := find("bachelorette"); !reflect.DeepEqual(got, []pid.PersistentID{1}) {
+		t.Errorf("got %v for the new name", got)
+	}
+
+	lib.RemoveTrack(2)
+	if got := find("android"); !reflect.DeepEqual(got, []pid.PersistentID{6}) {
+		t.Errorf("got %v after removing a track", got)
+	}
+	if got := find("radiohead"); len(got) != 0 {
+		t.Errorf("removed track still found: %v", got)
+	}
+	// words only the removed track had leave the vocabulary
+	if got := idx.Search("radioh", &SearchOptions{Prefix: true, Fuzzy: true}); len(got) != 0 {
+		t.Errorf("removed track's words still match: %v", searchIDs(got))
+	}
+
+	stop()
+	lib.AddTrack(&Track{PersistentID: 9, Name: "Army of Me"})
+	if got := find("army"); len(got) != 0 {
+		t.Errorf("indexed %v after unfollowing", got)
+	}
+}
+
+// TestSearchFollowLocking edits a track the way the api handlers do,
+// under the library lock with events committed after unlocking, while
+// another goroutine writes to it under the lock; run it with -race.
+func TestSearchFollowLocking(t *testing.T) {
+	lib := NewLibrary()
+	for _, tr := range *newSearchTracks() {
+		lib.AddTrack(tr)
+	}
+	idx := NewSearchIndex(nil)
+	defer idx.Follow(lib)()
+	tr := lib.GetTrack(1)
+	done := make(chan bool)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			lib.Lock()
+			tr.Artist = []string{"Gamma", "Delta"}[i % 2]
+			lib.Unlock()
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		lib.Begin()
+		lib.Lock()
+		cur := *tr
+		cur.Name = []string{"Alpha", "Beta"}[i % 2]
+		lib.UpdateTrack(tr, tr, &cur)
+		lib.Unlock()
+		lib.Commit()
+	}
+	close(done)
+	wg.Wait()
+	if got := searchIDs(idx.Search("beta", &SearchOptions{})); !reflect.DeepEqual(got, []pid.PersistentID{1}) {
+		t.Errorf("got %v, want the last name indexed", got)
+	}
+}
@@ -0,0 +1,307 @@
+package itunes
+
+import (
+	"sort"
+	"time"
+)
+
+type GrowthInterval string
+
+const (
+	GrowthMonthly GrowthInterval = "month"
+	GrowthYearly GrowthInterval = "year"
+)
+
+type StatsOptions struct {
+	// Top is the length of the top and least recently played lists.
+	Top int
+	// Growth is the period library growth is reported by.
+	Growth GrowthInterval
+	// Location is the time zone periods are computed in.  The default
+	// is the local time zone.
+	Location *time.Location
+}
+
+func DefaultStatsOptions() *StatsOptions {
+	return &StatsOptions{
+		Top: 25,
+		Growth: GrowthMonthly,
+		Location: time.Local,
+	}
+}
+
+type StatsTotals struct {
+	Tracks int `json:"tracks"`
+	Albums int `json:"albums"`
+	Artists int `json:"artists"`
+	Genres int `json:"genres"`
+	// TotalTime is in milliseconds.
+	TotalTime uint64 `json:"total_time"`
+	TotalSize uint64 `json:"total_size"`
+	PlayCount uint64 `json:"play_count"`
+	// ListeningTime estimates the time spent listening, in milliseconds,
+	// as play count times duration.
+	ListeningTime uint64 `json:"listening_time"`
+	Played int `json:"played"`
+	NeverPlayed int `json:"never_played"`
+}
+
+// StatsEntry totals the tracks of one artist, album or genre.
+type StatsEntry struct {
+	Name string `json:"name"`
+	Artist string `json:"artist,omitempty"`
+	Tracks int `json:"tracks"`
+	PlayCount uint64 `json:"play_count"`
+	ListeningTime uint64 `json:"listening_time"`
+	LastPlayed *Time `json:"last_played,omitempty"`
+}
+
+// RatingDistribution counts items by star rating, from unrated (0) to five
+// stars.
+type RatingDistribution [6]int
+
+type GrowthPoint struct {
+	Period string `json:"period"`
+	Start *Time `json:"start"`
+	Added int `json:"added"`
+	AddedSize uint64 `json:"added_size"`
+	AddedTime uint64 `json:"added_time"`
+	// Tracks is the size of the library at the end of the period.
+	Tracks int `json:"tracks"`
+}
+
+type LibraryStats struct {
+	Totals *StatsTotals `json:"totals"`
+	TopArtistsByPlays []*StatsEntry `json:"top_artists_by_plays"`
+	TopArtistsByTime []*StatsEntry `json:"top_artists_by_time"`
+	TopAlbumsByPlays []*StatsEntry `json:"top_albums_by_plays"`
+	TopAlbumsByTime []*StatsEntry `json:"top_albums_by_time"`
+	TopGenresByPlays []*StatsEntry `json:"top_genres_by_plays"`
+	TopGenresByTime []*StatsEntry `json:"top_genres_by_time"`
+	TrackRatings RatingDistribution `json:"track_ratings"`
+	AlbumRatings RatingDistribution `json:"album_ratings"`
+	Growth []*GrowthPoint `json:"growth"`
+	// LeastRecentlyPlayed lists tracks and albums that have been played,
+	// the longest ago first.
+	LeastRecentlyPlayed []*Track `json:"least_recently_played"`
+	LeastRecentlyPlayedAlbums []*StatsEntry `json:"least_recently_played_albums"`
+}
+
+// statsGroup collects the entries for one way of grouping tracks, naming
+// each entry with the most common spelling among its tracks.
+type statsGroup struct {
+	entries map[string]*StatsEntry
+	names map[string]map[string]int
+}
+
+func newStatsGroup() *statsGroup {
+	return &statsGroup{
+		entries: map[string]*StatsEntry{},
+		names: map[string]map[string]int{},
+	}
+}
+
+func (g *statsGroup) add(key, name string, tr *Track) *StatsEntry {
+	e, ok := g.entries[key]
+	if !ok {
+		e = &StatsEntry{}
+		g.entries[key] = e
+		g.names[key] = map[string]int{}
+	}
+	g.names[key][name]++
+	e.Tracks++
+	e.PlayCount += uint64(tr.PlayCount)
+	e.ListeningTime += listeningTime(tr)
+	if tr.PlayDate != nil && (e.LastPlayed == nil || tr.PlayDate.After(e.LastPlayed.Time)) {
+		e.LastPlayed = tr.PlayDate
+	}
+	return e
+}
+
+func (g *statsGroup) list() []*StatsEntry {
+	list := make([]*StatsEntry, 0, len(g.entries))
+	for key, e := range g.entries {
+		best := -1
+		for name, n := range g.names[key] {
+			if n > best || (n == best && name < e.Name) {
+				e.Name = name
+				best = n
+			}
+		}
+		list = append(list, e)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+func top(list []*StatsEntry, n int, value func(e *StatsEntry) uint64) []*StatsEntry {
+	out := make([]*StatsEntry, 0, len(list))
+	for _, e := range list {
+		if value(e) > 0 {
+			out = append(out, e)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return value(out[i]) > value(out[j]) })
+	if n > 0 && len(out) > n {
+		out = out[:n]
+	}
+	return out
+}
+
+func byPlays(e *StatsEntry) uint64 { return e.PlayCount }
+func byTime(e *StatsEntry) uint64 { return e.ListeningTime }
+
+func listeningTime(tr *Track) uint64 {
+	return uint64(tr.PlayCount) * uint64(tr.TotalTime)
+}
+
+func stars(rating uint8) int {
+	s := (int(rating) + 10) / 20
+	if s > 5 {
+		return 5
+	}
+	return s
+}
+
+func statsArtist(tr *Track) string {
+	if tr.Artist != "" {
+		return tr.Artist
+	}
+	return tr.AlbumArtist
+}
+
+func periodStart(t time.Time, interval GrowthInterval) (time.Time, string) {
+	if interval == GrowthYearly {
+		start := time.Date(t.Year(), 1, 1, 0, 0, 0, 0, t.Location())
+		return start, start.Format("2006")
+	}
+	start := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+	return start, start.Format("2006-01")
+}
+
+// Stats computes totals, top lists, rating distributions, growth and
+// least recently played content for the tracks in tl.  Artists are
+// grouped by track artist, so compilations count toward the artists on
+// them.  Tracks without a date added are left out of the growth figures.
+func (tl *TrackList) Stats(opts *StatsOptions) *LibraryStats {
+	if opts == nil {
+		opts = DefaultStatsOptions()
+	}
+	loc := opts.Location
+	if loc == nil {
+		loc = time.Local
+	}
+	stats := &LibraryStats{Totals: &StatsTotals{}}
+	artists := newStatsGroup()
+	albums := newStatsGroup()
+	genres := newStatsGroup()
+	albumArtists := map[string]map[string]int{}
+	albumRatings := map[string]uint8{}
+	growth := map[string]*GrowthPoint{}
+	played := []*Track{}
+	t := stats.Totals
+	for _, tr := range *tl {
+		t.Tracks++
+		t.TotalTime += uint64(tr.TotalTime)
+		t.TotalSize += tr.Size
+		t.PlayCount += uint64(tr.PlayCount)
+		t.ListeningTime += listeningTime(tr)
+		if tr.PlayCount > 0 || tr.PlayDate != nil {
+			t.Played++
+		} else {
+			t.NeverPlayed++
+		}
+		if tr.PlayDate != nil {
+			played = append(played, tr)
+		}
+		stats.TrackRatings[stars(tr.Rating)]++
+		if name := statsArtist(tr); name != "" {
+			artists.add(MakeKey(name), name, tr)
+		}
+		if tr.Genre != "" {
+			genres.add(MakeKey(tr.Genre), tr.Genre, tr)
+		}
+		if key := tr.AlbumKey(); key != "" {
+			albums.add(key, tr.Album, tr)
+			artist := tr.AlbumArtist
+			if artist == "" {
+				artist = tr.Artist
+			}
+			if albumArtists[key] == nil {
+				albumArtists[key] = map[string]int{}
+			}
+			albumArtists[key][artist]++
+			if tr.AlbumRating > albumRatings[key] {
+				albumRatings[key] = tr.AlbumRating
+			}
+		}
+		if tr.DateAdded != nil && !tr.DateAdded.IsZero() {
+			start, period := periodStart(tr.DateAdded.In(loc), opts.Growth)
+			p, ok := growth[period]
+			if !ok {
+				p = &GrowthPoint{Period: period, Start: &Time{start}}
+				growth[period] = p
+			}
+			p.Added++
+			p.AddedSize += tr.Size
+			p.AddedTime += uint64(tr.TotalTime)
+		}
+	}
+	artistList := artists.list()
+	albumList := albums.list()
+	genreList := genres.list()
+	t.Artists = len(artistList)
+	t.Albums = len(albumList)
+	t.Genres = len(genreList)
+	for key, e := range albums.entries {
+		best := -1
+		for name, n := range albumArtists[key] {
+			if n > best || (n == best && name < e.Artist) {
+				e.Artist = name
+				best = n
+			}
+		}
+		stats.AlbumRatings[stars(albumRatings[key])]++
+	}
+	stats.TopArtistsByPlays = top(artistList, opts.Top, byPlays)
+	stats.TopArtistsByTime = top(artistList, opts.Top, byTime)
+	stats.TopAlbumsByPlays = top(albumList, opts.Top, byPlays)
+	stats.TopAlbumsByTime = top(albumList, opts.Top, byTime)
+	stats.TopGenresByPlays = top(genreList, opts.Top, byPlays)
+	stats.TopGenresByTime = top(genreList, opts.Top, byTime)
+
+	stats.Growth = make([]*GrowthPoint, 0, len(growth))
+	for _, p := range growth {
+		stats.Growth = append(stats.Growth, p)
+	}
+	sort.Slice(stats.Growth, func(i, j int) bool { return stats.Growth[i].Period < stats.Growth[j].Period })
+	total := 0
+	for _, p := range stats.Growth {
+		total += p.Added
+		p.Tracks = total
+	}
+
+	sort.SliceStable(played, func(i, j int) bool { return played[i].PlayDate.Before(played[j].PlayDate.Time) })
+	if opts.Top > 0 && len(played) > opts.Top {
+		played = played[:opts.Top]
+	}
+	stats.LeastRecentlyPlayed = played
+	lrp := []*StatsEntry{}
+	for _, e := range albumList {
+		if e.LastPlayed != nil {
+			lrp = append(lrp, e)
+		}
+	}
+	sort.SliceStable(lrp, func(i, j int) bool { return lrp[i].LastPlayed.Before(lrp[j].LastPlayed.Time) })
+	if opts.Top > 0 && len(lrp) > opts.Top {
+		lrp = lrp[:opts.Top]
+	}
+	stats.LeastRecentlyPlayedAlbums = lrp
+	return stats
+}
+
+// Stats reports on every track in the library.  The caller must hold the
+// library's read lock.
+func (lib *Library) Stats(opts *StatsOptions) *LibraryStats {
+	return lib.TrackList().Stats(opts)
+}
@@ -0,0 +1,142 @@
+package subsonic
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rclancey/itunes"
+)
+
+// update runs f with the library locked for writing, committing its
+// events once the lock is released.
+func (s *Server) update(f func() error) error {
+	s.lib.Begin()
+	defer s.lib.Commit()
+	s.lib.Lock()
+	defer s.lib.Unlock()
+	return f()
+}
+
+func (s *Server) tracks(ids []string) ([]*itunes.Track, error) {
+	tracks := make([]*itunes.Track, len(ids))
+	for i, id := range ids {
+		tr, err := s.track(id)
+		if err != nil {
+			return nil, err
+		}
+		tracks[i] = tr
+	}
+	return tracks, nil
+}
+
+// scrobble records plays of songs.  Now-playing notifications
+// (submission=false) are accepted and ignored.
+func scrobble(s *Server, r *http.Request, resp *Response) error {
+	ids := r.Form["id"]
+	if len(ids) == 0 {
+		return newError(ErrMissingParameter, "required parameter id is missing")
+	}
+	if r.Form.Get("submission") == "false" {
+		return nil
+	}
+	times := r.Form["time"]
+	return s.update(func() error {
+		tracks, err := s.tracks(ids)
+		if err != nil {
+			return err
+		}
+		for i, tr := range tracks {
+			played := time.Now()
+			if i < len(times) {
+				ms, err := strconv.ParseInt(times[i], 10, 64)
+				if err == nil {
+					played = time.Unix(ms / 1000, (ms % 1000) * int64(time.Millisecond))
+				}
+			}
+			orig := *tr
+			cur := *tr
+			cur.PlayCount++
+			cur.PlayDate = &itunes.Time{Time: played}
+			cur.Unplayed = false
+			s.lib.UpdateTrack(tr, &orig, &cur)
+		}
+		return nil
+	})
+}
+
+// setLoved marks songs, and every song of albums and artists, as loved,
+// or clears the mark.
+func (s *Server) setLoved(r *http.Request, loved bool) error {
+	ids := r.Form["id"]
+	albumIDs := r.Form["albumId"]
+	artistIDs := r.Form["artistId"]
+	if len(ids) + len(albumIDs) + len(artistIDs) == 0 {
+		return newError(ErrMissingParameter, "required parameter id is missing")
+	}
+	return s.update(func() error {
+		tracks, err := s.tracks(ids)
+		if err != nil {
+			return err
+		}
+		cat := s.catalog()
+		for _, id := range albumIDs {
+			al, err := cat.album(id)
+			if err != nil {
+				return err
+			}
+			tracks = append(tracks, al.tracks...)
+		}
+		for _, id := range artistIDs {
+			ar, err := cat.artist(id)
+			if err != nil {
+				return err
+			}
+			for _, al := range ar.albums {
+				tracks = append(tracks, al.tracks...)
+			}
+		}
+		var v *bool
+		if loved {
+			v = &loved
+		}
+		for _, tr := range tracks {
+			orig := *tr
+			cur := *tr
+			cur.Loved = v
+			s.lib.UpdateTrack(tr, &orig, &cur)
+		}
+		return nil
+	})
+}
+
+func star(s *Server, r *http.Request, resp *Response) error {
+	return s.setLoved(r, true)
+}
+
+func unstar(s *Server, r *http.Request, resp *Response) error {
+	return s.setLoved(r, false)
+}
+
+// setRating sets the rating of a song from 0 to 5 stars.
+func setRating(s *Server, r *http.Request, resp *Response) error {
+	id, err := requireParam(r, "id")
+	if err != nil {
+		return err
+	}
+	rating, err := strconv.Atoi(r.Form.Get("rating"))
+	if err != nil || rating < 0 || rating > 5 {
+		return newError(ErrGeneric, "rating must be between 0 and 5")
+	}
+	return s.update(func() error {
+		tr, err := s.track(id)
+		if err != nil {
+			return err
+		}
+		orig := *tr
+		cur := *tr
+		cur.Rating = uint8(rating * 20)
+		s.lib.UpdateTrack(tr, &orig, &cur)
+		return nil
+	})
+}
@@ -0,0 +1,465 @@
+package subsonic
+
+import (
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/rclancey/itunes"
+)
+
+const ignoredArticles = "The An A"
+
+func indexName(key string) string {
+	if key == "" || key[0] < 'a' || key[0] > 'z' {
+		return "#"
+	}
+	return strings.ToUpper(key[:1])
+}
+
+func (cat *catalog) index() []*Index {
+	idx := []*Index{}
+	var cur *Index
+	for _, ar := range cat.artists {
+		name := indexName(ar.key)
+		if cur == nil || cur.Name != name {
+			cur = &Index{Name: name}
+			idx = append(idx, cur)
+		}
+		cur.Artists = append(cur.Artists, ar.artist(false))
+	}
+	return idx
+}
+
+func getArtists(s *Server, r *http.Request, resp *Response) error {
+	s.lib.RLock()
+	defer s.lib.RUnlock()
+	resp.Artists = &Artists{IgnoredArticles: ignoredArticles, Index: s.catalog().index()}
+	return nil
+}
+
+func getIndexes(s *Server, r *http.Request, resp *Response) error {
+	s.lib.RLock()
+	defer s.lib.RUnlock()
+	resp.Indexes = &Indexes{
+		LastModified: s.lib.Date.Unix() * 1000,
+		IgnoredArticles: ignoredArticles,
+		Index: s.catalog().index(),
+	}
+	return nil
+}
+
+func (cat *catalog) artist(id string) (*artistEntry, error) {
+	kind, key := parseID(id)
+	ar, ok := cat.artistsByKey[key]
+	if kind != "ar" || !ok {
+		return nil, notFound("artist")
+	}
+	return ar, nil
+}
+
+func (cat *catalog) album(id string) (*albumEntry, error) {
+	kind, key := parseID(id)
+	al, ok := cat.albumsByKey[key]
+	if kind != "al" || !ok {
+		return nil, notFound("album")
+	}
+	return al, nil
+}
+
+func getArtist(s *Server, r *http.Request, resp *Response) error {
+	id, err := requireParam(r, "id")
+	if err != nil {
+		return err
+	}
+	s.lib.RLock()
+	defer s.lib.RUnlock()
+	ar, err := s.catalog().artist(id)
+	if err != nil {
+		return err
+	}
+	resp.Artist = ar.artist(true)
+	return nil
+}
+
+func getAlbum(s *Server, r *http.Request, resp *Response) error {
+	id, err := requireParam(r, "id")
+	if err != nil {
+		return err
+	}
+	s.lib.RLock()
+	defer s.lib.RUnlock()
+	al, err := s.catalog().album(id)
+	if err != nil {
+		return err
+	}
+	resp.Album = al.album(true)
+	return nil
+}
+
+func getSong(s *Server, r *http.Request, resp *Response) error {
+	id, err := requireParam(r, "id")
+	if err != nil {
+		return err
+	}
+	s.lib.RLock()
+	defer s.lib.RUnlock()
+	tr, err := s.track(id)
+	if err != nil {
+		return err
+	}
+	resp.Song = song(tr)
+	return nil
+}
+
+// getMusicDirectory presents artists and albums as folders, for clients
+// that browse by folder.
+func getMusicDirectory(s *Server, r *http.Request, resp *Response) error {
+	id, err := requireParam(r, "id")
+	if err != nil {
+		return err
+	}
+	s.lib.RLock()
+	defer s.lib.RUnlock()
+	cat := s.catalog()
+	dir := &Directory{ID: id, Children: []*Song{}}
+	switch kind, _ := parseID(id); kind {
+	case "ar":
+		ar, err := cat.artist(id)
+		if err != nil {
+			return err
+		}
+		dir.Name = ar.name
+		for _, al := range ar.albums {
+			a := al.album(false)
+			dir.Children = append(dir.Children, &Song{
+				ID: a.ID,
+				Parent: id,
+				IsDir: true,
+				Title: a.Name,
+				Album: a.Name,
+				Artist: a.Artist,
+				Year: a.Year,
+				Genre: a.Genre,
+				CoverArt: a.CoverArt,
+				Created: a.Created,
+				Starred: a.Starred,
+			})
+		}
+	case "al":
+		al, err := cat.album(id)
+		if err != nil {
+			return err
+		}
+		dir.Name = al.name
+		dir.Parent = "ar-" + al.artist.key
+		for _, tr := range al.tracks {
+			dir.Children = append(dir.Children, song(tr))
+		}
+	default:
+		return notFound("directory")
+	}
+	resp.Directory = dir
+	return nil
+}
+
+func getGenres(s *Server, r *http.Request, resp *Response) error {
+	s.lib.RLock()
+	defer s.lib.RUnlock()
+	tl := s.lib.TrackList()
+	genres := map[string]*Genre{}
+	list := []*Genre{}
+	for _, v := range tl.Genres() {
+		g := &Genre{Name: v[0]}
+		genres[v[1]] = g
+		list = append(list, g)
+	}
+	for _, tr := range s.lib.Tracks {
+		if g, ok := genres[itunes.MakeKey(tr.Genre)]; ok && tr.Location != "" {
+			g.SongCount++
+		}
+	}
+	for _, al := range s.catalog().albums {
+		if g, ok := genres[itunes.MakeKey(al.genre())]; ok {
+			g.AlbumCount++
+		}
+	}
+	resp.Genres = &Genres{list}
+	return nil
+}
+
+func page(n, offset, size int) (int, int) {
+	if offset > n {
+		offset = n
+	}
+	end := offset + size
+	if end > n {
+		end = n
+	}
+	return offset, end
+}
+
+func (s *Server) songs(match func(tr *itunes.Track) bool) []*itunes.Track {
+	tracks := []*itunes.Track{}
+	for _, tr := range s.lib.Tracks {
+		if tr.Location != "" && match(tr) {
+			tracks = append(tracks, tr)
+		}
+	}
+	return tracks
+}
+
+func songList(tracks []*itunes.Track) []*Song {
+	songs := make([]*Song, len(tracks))
+	for i, tr := range tracks {
+		songs[i] = song(tr)
+	}
+	return songs
+}
+
+func getSongsByGenre(s *Server, r *http.Request, resp *Response) error {
+	genre, err := requireParam(r, "genre")
+	if err != nil {
+		return err
+	}
+	key := itunes.MakeKey(genre)
+	s.lib.RLock()
+	defer s.lib.RUnlock()
+	tracks := s.songs(func(tr *itunes.Track) bool { return itunes.MakeKey(tr.Genre) == key })
+	start, end := page(len(tracks), intParam(r, "offset", 0, 0), intParam(r, "count", 10, 500))
+	resp.SongsByGenre = &Songs{songList(tracks[start:end])}
+	return nil
+}
+
+func yearRange(r *http.Request) (int, int, bool) {
+	from := intParam(r, "fromYear", 0, 0)
+	to := intParam(r, "toYear", 9999, 0)
+	if from > to {
+		return to, from, true
+	}
+	return from, to, false
+}
+
+func getRandomSongs(s *Server, r *http.Request, resp *Response) error {
+	key := itunes.MakeKey(r.Form.Get("genre"))
+	from, to, _ := yearRange(r)
+	s.lib.RLock()
+	defer s.lib.RUnlock()
+	tracks := s.songs(func(tr *itunes.Track) bool {
+		if key != "" && itunes.MakeKey(tr.Genre) != key {
+			return false
+		}
+		y := trackYear(tr)
+		return y == 0 && from == 0 || y >= from && y <= to
+	})
+	rand.Shuffle(len(tracks), func(i, j int) { tracks[i], tracks[j] = tracks[j], tracks[i] })
+	_, end := page(len(tracks), 0, intParam(r, "size", 10, 500))
+	resp.RandomSongs = &Songs{songList(tracks[:end])}
+	return nil
+}
+
+func getAlbumList2(s *Server, r *http.Request, resp *Response) error {
+	typ, err := requireParam(r, "type")
+	if err != nil {
+		return err
+	}
+	s.lib.RLock()
+	defer s.lib.RUnlock()
+	albums := append([]*albumEntry{}, s.catalog().albums...)
+	filter := func(f func(al *albumEntry) bool) {
+		out := albums[:0]
+		for _, al := range albums {
+			if f(al) {
+				out = append(out, al)
+			}
+		}
+		albums = out
+	}
+	switch typ {
+	case "alphabeticalByName":
+		sort.SliceStable(albums, func(i, j int) bool {
+			return itunes.MakeKey(albums[i].name) < itunes.MakeKey(albums[j].name)
+		})
+	case "alphabeticalByArtist":
+		sort.SliceStable(albums, func(i, j int) bool {
+			return albums[i].artist.key < albums[j].artist.key
+		})
+	case "random":
+		rand.Shuffle(len(albums), func(i, j int) { albums[i], albums[j] = albums[j], albums[i] })
+	case "newest":
+		sort.SliceStable(albums, func(i, j int) bool {
+			ci, cj := albums[i].created(), albums[j].created()
+			return ci != nil && (cj == nil || ci.After(*cj))
+		})
+	case "frequent":
+		filter(func(al *albumEntry) bool { return al.playCount() > 0 })
+		sort.SliceStable(albums, func(i, j int) bool {
+			return albums[i].playCount() > albums[j].playCount()
+		})
+	case "recent":
+		filter(func(al *albumEntry) bool { return !al.played().IsZero() })
+		sort.SliceStable(albums, func(i, j int) bool {
+			return albums[i].played().After(albums[j].played())
+		})
+	case "starred":
+		filter(func(al *albumEntry) bool { return al.starred() != nil })
+	case "byYear":
+		from, to, desc := yearRange(r)
+		filter(func(al *albumEntry) bool { y := al.year(); return y >= from && y <= to })
+		sort.SliceStable(albums, func(i, j int) bool {
+			if desc {
+				return albums[i].year() > albums[j].year()
+			}
+			return albums[i].year() < albums[j].year()
+		})
+	case "byGenre":
+		genre, err := requireParam(r, "genre")
+		if err != nil {
+			return err
+		}
+		key := itunes.MakeKey(genre)
+		filter(func(al *albumEntry) bool { return itunes.MakeKey(al.genre()) == key })
+	default:
+		return newError(ErrGeneric, "unknown album list type " + typ)
+	}
+	start, end := page(len(albums), intParam(r, "offset", 0, 0), intParam(r, "size", 10, 500))
+	list := &AlbumList{Albums: []*Album{}}
+	for _, al := range albums[start:end] {
+		list.Albums = append(list.Albums, al.album(false))
+	}
+	resp.AlbumList2 = list
+	return nil
+}
+
+// search3 matches case-insensitive substrings of names.  An empty query
+// matches everything, which some clients use to fetch the whole library.
+func search3(s *Server, r *http.Request, resp *Response) error {
+	query := strings.ToLower(strings.Trim(strings.TrimSpace(r.Form.Get("query")), `"`))
+	match := func(names ...string) bool {
+		if query == "" {
+			return true
+		}
+		for _, name := range names {
+			if strings.Contains(strings.ToLower(name), query) {
+				return true
+			}
+		}
+		return false
+	}
+	s.lib.RLock()
+	defer s.lib.RUnlock()
+	cat := s.catalog()
+	result := &SearchResult{Artists: []*Artist{}, Albums: []*Album{}, Songs: []*Song{}}
+	artists := []*artistEntry{}
+	for _, ar := range cat.artists {
+		if match(ar.name) {
+			artists = append(artists, ar)
+		}
+	}
+	start, end := page(len(artists), intParam(r, "artistOffset", 0, 0), intParam(r, "artistCount", 20, 500))
+	for _, ar := range artists[start:end] {
+		result.Artists = append(result.Artists, ar.artist(false))
+	}
+	albums := []*albumEntry{}
+	for _, al := range cat.albums {
+		if match(al.name) {
+			albums = append(albums, al)
+		}
+	}
+	start, end = page(len(albums), intParam(r, "albumOffset", 0, 0), intParam(r, "albumCount", 20, 500))
+	for _, al := range albums[start:end] {
+		result.Albums = append(result.Albums, al.album(false))
+	}
+	tracks := s.songs(func(tr *itunes.Track) bool { return match(tr.Name, tr.Artist, tr.Album) })
+	start, end = page(len(tracks), intParam(r, "songOffset", 0, 0), intParam(r, "songCount", 20, 500))
+	result.Songs = songList(tracks[start:end])
+	resp.SearchResult3 = result
+	return nil
+}
+
+func getStarred2(s *Server, r *http.Request, resp *Response) error {
+	s.lib.RLock()
+	defer s.lib.RUnlock()
+	cat := s.catalog()
+	result := &SearchResult{Artists: []*Artist{}, Albums: []*Album{}}
+	for _, ar := range cat.artists {
+		loved := true
+		for _, al := range ar.albums {
+			if al.starred() == nil {
+				loved = false
+				break
+			}
+		}
+		if loved {
+			a := ar.artist(false)
+			a.Starred = ar.albums[0].starred()
+			result.Artists = append(result.Artists, a)
+		}
+	}
+	for _, al := range cat.albums {
+		if al.starred() != nil {
+			result.Albums = append(result.Albums, al.album(false))
+		}
+	}
+	result.Songs = songList(s.songs(func(tr *itunes.Track) bool { return starred(tr) != nil }))
+	resp.Starred2 = result
+	return nil
+}
+
+func (s *Server) playlistInfo(pl *itunes.Playlist, withSongs bool) *Playlist {
+	items := pl.Populate(s.lib).PlaylistItems
+	tracks := []*itunes.Track{}
+	for _, tr := range items {
+		if tr != nil && tr.Location != "" {
+			tracks = append(tracks, tr)
+		}
+	}
+	p := &Playlist{
+		ID: "pl-" + pl.PersistentID.String(),
+		Name: pl.Name,
+		SongCount: len(tracks),
+		Created: s.lib.Date.Time,
+		Changed: s.lib.Date.Time,
+	}
+	for _, tr := range tracks {
+		p.Duration += int(tr.TotalTime / 1000)
+	}
+	if withSongs {
+		p.Songs = songList(tracks)
+	}
+	return p
+}
+
+func getPlaylists(s *Server, r *http.Request, resp *Response) error {
+	s.lib.RLock()
+	defer s.lib.RUnlock()
+	pls := []*itunes.Playlist{}
+	for _, pl := range s.lib.Playlists {
+		if !pl.Folder {
+			pls = append(pls, pl)
+		}
+	}
+	sort.Sort(itunes.SortablePlaylistList(pls))
+	list := &Playlists{Playlists: []*Playlist{}}
+	for _, pl := range pls {
+		list.Playlists = append(list.Playlists, s.playlistInfo(pl, false))
+	}
+	resp.Playlists = list
+	return nil
+}
+
+func getPlaylist(s *Server, r *http.Request, resp *Response) error {
+	id, err := requireParam(r, "id")
+	if err != nil {
+		return err
+	}
+	s.lib.RLock()
+	defer s.lib.RUnlock()
+	pl, err := s.playlist(id)
+	if err != nil {
+		return err
+	}
+	resp.Playlist = s.playlistInfo(pl, true)
+	return nil
+}
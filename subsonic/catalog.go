@@ -0,0 +1,364 @@
+package subsonic
+
+import (
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rclancey/itunes"
+	"github.com/rclancey/itunes/persistentId"
+)
+
+type artistEntry struct {
+	key string
+	name string
+	albums []*albumEntry
+}
+
+type albumEntry struct {
+	key string
+	name string
+	artist *artistEntry
+	tracks itunes.TrackList
+}
+
+// catalog groups the tracks of the library by album artist and album,
+// using the same MakeKey normalization as TrackList.Artists and Albums.
+// Tracks without an album are only reachable through songs, search and
+// playlists.
+type catalog struct {
+	artists []*artistEntry
+	artistsByKey map[string]*artistEntry
+	albums []*albumEntry
+	albumsByKey map[string]*albumEntry
+}
+
+func artistKeySource(tr *itunes.Track) (string, string) {
+	name := tr.AlbumArtist
+	if name == "" {
+		name = tr.Artist
+	}
+	switch {
+	case tr.SortAlbumArtist != "":
+		return name, tr.SortAlbumArtist
+	case tr.AlbumArtist != "":
+		return name, tr.AlbumArtist
+	case tr.SortArtist != "":
+		return name, tr.SortArtist
+	}
+	return name, tr.Artist
+}
+
+func artistKey(tr *itunes.Track) string {
+	_, src := artistKeySource(tr)
+	return itunes.MakeKey(src)
+}
+
+// canonical picks the most common of the names seen for a key.
+func canonical(counts map[string]int) string {
+	best := ""
+	n := 0
+	for name, c := range counts {
+		if c > n || (c == n && name < best) {
+			best = name
+			n = c
+		}
+	}
+	return best
+}
+
+func newCatalog(lib *itunes.Library) *catalog {
+	cat := &catalog{
+		artistsByKey: map[string]*artistEntry{},
+		albumsByKey: map[string]*albumEntry{},
+	}
+	artistNames := map[string]map[string]int{}
+	albumNames := map[string]map[string]int{}
+	for _, tr := range lib.Tracks {
+		if tr.Location == "" || tr.Album == "" {
+			continue
+		}
+		name, src := artistKeySource(tr)
+		akey := itunes.MakeKey(src)
+		ar, ok := cat.artistsByKey[akey]
+		if !ok {
+			ar = &artistEntry{key: akey}
+			cat.artistsByKey[akey] = ar
+			cat.artists = append(cat.artists, ar)
+			artistNames[akey] = map[string]int{}
+		}
+		artistNames[akey][name]++
+		key := tr.AlbumKey()
+		al, ok := cat.albumsByKey[key]
+		if !ok {
+			al = &albumEntry{key: key, artist: ar}
+			cat.albumsByKey[key] = al
+			cat.albums = append(cat.albums, al)
+			ar.albums = append(ar.albums, al)
+			albumNames[key] = map[string]int{}
+		}
+		albumNames[key][tr.Album]++
+		al.tracks = append(al.tracks, tr)
+	}
+	for _, ar := range cat.artists {
+		ar.name = canonical(artistNames[ar.key])
+		sort.SliceStable(ar.albums, func(i, j int) bool {
+			yi, yj := ar.albums[i].year(), ar.albums[j].year()
+			if yi != yj {
+				return yi < yj
+			}
+			return ar.albums[i].key < ar.albums[j].key
+		})
+	}
+	for _, al := range cat.albums {
+		al.name = canonical(albumNames[al.key])
+		al.tracks.DefaultSort()
+	}
+	sort.Slice(cat.artists, func(i, j int) bool { return cat.artists[i].key < cat.artists[j].key })
+	sort.Slice(cat.albums, func(i, j int) bool { return cat.albums[i].key < cat.albums[j].key })
+	return cat
+}
+
+// catalog returns the grouping of the library, rebuilding it after the
+// library changes.  The caller must hold the library's read lock.
+func (s *Server) catalog() *catalog {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.cat == nil {
+		s.cat = newCatalog(s.lib)
+	}
+	return s.cat
+}
+
+func trackYear(tr *itunes.Track) int {
+	if tr.ReleaseDate == nil {
+		return 0
+	}
+	return tr.ReleaseDate.Year()
+}
+
+func timep(t *itunes.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	tm := t.Time
+	return &tm
+}
+
+// starred returns a time for loved tracks.  Libraries don't record when
+// a track was loved, so the modification date stands in for it.
+func starred(tr *itunes.Track) *time.Time {
+	if tr.Loved == nil || !*tr.Loved {
+		return nil
+	}
+	if tr.DateModified != nil {
+		return timep(tr.DateModified)
+	}
+	if tr.DateAdded != nil {
+		return timep(tr.DateAdded)
+	}
+	tm := time.Unix(0, 0).UTC()
+	return &tm
+}
+
+func (al *albumEntry) year() int {
+	year := 0
+	for _, tr := range al.tracks {
+		if y := trackYear(tr); y > year {
+			year = y
+		}
+	}
+	return year
+}
+
+func (al *albumEntry) created() *time.Time {
+	var created *time.Time
+	for _, tr := range al.tracks {
+		if t := timep(tr.DateAdded); t != nil && (created == nil || t.Before(*created)) {
+			created = t
+		}
+	}
+	return created
+}
+
+func (al *albumEntry) played() time.Time {
+	var played time.Time
+	for _, tr := range al.tracks {
+		if tr.PlayDate != nil && tr.PlayDate.After(played) {
+			played = tr.PlayDate.Time
+		}
+	}
+	return played
+}
+
+func (al *albumEntry) playCount() uint {
+	var n uint
+	for _, tr := range al.tracks {
+		n += tr.PlayCount
+	}
+	return n
+}
+
+// starred returns a time if every track of the album is loved.
+func (al *albumEntry) starred() *time.Time {
+	var latest *time.Time
+	for _, tr := range al.tracks {
+		t := starred(tr)
+		if t == nil {
+			return nil
+		}
+		if latest == nil || t.After(*latest) {
+			latest = t
+		}
+	}
+	return latest
+}
+
+func (al *albumEntry) genre() string {
+	counts := map[string]int{}
+	for _, tr := range al.tracks {
+		if tr.Genre != "" {
+			counts[tr.Genre]++
+		}
+	}
+	return canonical(counts)
+}
+
+func (al *albumEntry) album(withSongs bool) *Album {
+	a := &Album{
+		ID: "al-" + al.key,
+		Name: al.name,
+		Artist: al.artist.name,
+		ArtistID: "ar-" + al.artist.key,
+		CoverArt: "al-" + al.key,
+		SongCount: len(al.tracks),
+		PlayCount: al.playCount(),
+		Created: al.created(),
+		Starred: al.starred(),
+		Year: al.year(),
+		Genre: al.genre(),
+	}
+	for _, tr := range al.tracks {
+		a.Duration += int(tr.TotalTime / 1000)
+	}
+	if withSongs {
+		a.Songs = make([]*Song, len(al.tracks))
+		for i, tr := range al.tracks {
+			a.Songs[i] = song(tr)
+		}
+	}
+	return a
+}
+
+func (ar *artistEntry) artist(withAlbums bool) *Artist {
+	a := &Artist{
+		ID: "ar-" + ar.key,
+		Name: ar.name,
+		AlbumCount: len(ar.albums),
+	}
+	if len(ar.albums) > 0 {
+		a.CoverArt = "al-" + ar.albums[0].key
+	}
+	if withAlbums {
+		a.Albums = make([]*Album, len(ar.albums))
+		for i, al := range ar.albums {
+			a.Albums[i] = al.album(false)
+		}
+	}
+	return a
+}
+
+var contentTypes = map[string]string{
+	"mp3": "audio/mpeg",
+	"m4a": "audio/mp4",
+	"m4b": "audio/mp4",
+	"m4p": "audio/mp4",
+	"aac": "audio/aac",
+	"wav": "audio/wav",
+	"aif": "audio/aiff",
+	"aiff": "audio/aiff",
+	"flac": "audio/flac",
+	"ogg": "audio/ogg",
+	"m4v": "video/mp4",
+	"mp4": "video/mp4",
+	"mov": "video/quicktime",
+}
+
+func song(tr *itunes.Track) *Song {
+	suffix := strings.TrimPrefix(strings.ToLower(tr.GetExt()), ".")
+	s := &Song{
+		ID: "tr-" + tr.PersistentID.String(),
+		Title: tr.Name,
+		Album: tr.Album,
+		Artist: tr.Artist,
+		Track: int(tr.TrackNumber),
+		Year: trackYear(tr),
+		Genre: tr.Genre,
+		CoverArt: "tr-" + tr.PersistentID.String(),
+		Size: tr.Size,
+		ContentType: contentTypes[suffix],
+		Suffix: suffix,
+		Duration: int(tr.TotalTime / 1000),
+		PlayCount: tr.PlayCount,
+		Played: timep(tr.PlayDate),
+		DiscNumber: int(tr.DiscNumber),
+		Created: timep(tr.DateAdded),
+		Starred: starred(tr),
+		UserRating: int(tr.Rating) / 20,
+		Type: "music",
+	}
+	if tr.TotalTime > 0 {
+		s.BitRate = int(tr.Size * 8 / uint64(tr.TotalTime))
+	}
+	name, _ := artistKeySource(tr)
+	s.Path = path.Join(itunes.SafeFileName(name), itunes.SafeFileName(tr.Album), itunes.SafeFileName(tr.Name) + "." + suffix)
+	if tr.Album != "" {
+		s.AlbumID = "al-" + tr.AlbumKey()
+		s.Parent = s.AlbumID
+		s.ArtistID = "ar-" + artistKey(tr)
+	}
+	return s
+}
+
+// parseID splits an id into its kind prefix and its key.
+func parseID(id string) (string, string) {
+	if len(id) < 3 || id[2] != '-' {
+		return "", id
+	}
+	return id[:2], id[3:]
+}
+
+func (s *Server) track(id string) (*itunes.Track, error) {
+	kind, key := parseID(id)
+	if kind != "tr" {
+		return nil, notFound("song")
+	}
+	var p pid.PersistentID
+	err := (&p).Decode(key)
+	if err != nil {
+		return nil, notFound("song")
+	}
+	tr := s.lib.GetTrack(p)
+	if tr == nil {
+		return nil, notFound("song")
+	}
+	return tr, nil
+}
+
+func (s *Server) playlist(id string) (*itunes.Playlist, error) {
+	kind, key := parseID(id)
+	if kind != "pl" {
+		return nil, notFound("playlist")
+	}
+	var p pid.PersistentID
+	err := (&p).Decode(key)
+	if err != nil {
+		return nil, notFound("playlist")
+	}
+	pl, ok := s.lib.Playlists[p]
+	if !ok || pl.Folder {
+		return nil, notFound("playlist")
+	}
+	return pl, nil
+}
@@ -0,0 +1,123 @@
+package subsonic
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rclancey/itunes/artwork"
+	"github.com/rclancey/itunes/persistentId"
+)
+
+// stream serves the original file; transcoding parameters such as
+// maxBitRate and format are ignored.
+func stream(s *Server, w http.ResponseWriter, r *http.Request) error {
+	id, err := requireParam(r, "id")
+	if err != nil {
+		return err
+	}
+	s.lib.RLock()
+	tr, err := s.track(id)
+	var fn string
+	if err == nil {
+		fn = tr.Path()
+	}
+	s.lib.RUnlock()
+	if err != nil {
+		return err
+	}
+	if fn == "" {
+		return notFound("file")
+	}
+	f, err := os.Open(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return notFound("file")
+		}
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	ct := contentTypes[strings.TrimPrefix(strings.ToLower(filepath.Ext(fn)), ".")]
+	if ct != "" {
+		w.Header().Set("Content-Type", ct)
+	}
+	http.ServeContent(w, r, filepath.Base(fn), st.ModTime(), f)
+	return nil
+}
+
+type thumbnailer interface {
+	GetThumbnail(id pid.PersistentID, size int, format string) ([]byte, error)
+}
+
+// getCoverArt serves the artwork of a song, or of the first song of an
+// album.  If the artwork source can make thumbnails (for instance an
+// artwork.ThumbnailCache) it is used for sized requests.
+func getCoverArt(s *Server, w http.ResponseWriter, r *http.Request) error {
+	id, err := requireParam(r, "id")
+	if err != nil {
+		return err
+	}
+	if s.art == nil {
+		return notFound("artwork")
+	}
+	size := intParam(r, "size", 0, 0)
+	s.lib.RLock()
+	var tid pid.PersistentID
+	switch kind, _ := parseID(id); kind {
+	case "tr":
+		tr, err := s.track(id)
+		if err == nil {
+			tid = tr.PersistentID
+		}
+	case "al":
+		al, err := s.catalog().album(id)
+		if err == nil {
+			tid = al.tracks[0].PersistentID
+		}
+	}
+	s.lib.RUnlock()
+	if tid == 0 {
+		return notFound("artwork")
+	}
+	var data []byte
+	if th, ok := s.art.(thumbnailer); ok && size > 0 {
+		data, err = th.GetThumbnail(tid, size, artwork.FormatJPEG)
+	} else {
+		data, err = s.art.GetJPEG(tid)
+		if err == nil && size > 0 {
+			data, err = resizeJPEG(data, size)
+		}
+	}
+	if err != nil || len(data) == 0 {
+		return notFound("artwork")
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	return nil
+}
+
+func resizeJPEG(data []byte, size int) ([]byte, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	b := img.Bounds()
+	if b.Dx() <= size && b.Dy() <= size {
+		return data, nil
+	}
+	buf := &bytes.Buffer{}
+	err = jpeg.Encode(buf, artwork.Resize(img, size), &jpeg.Options{Quality: 85})
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,217 @@
+// Package subsonic serves an itunes.Library through the Subsonic API
+// (with the OpenSubsonic response fields), for mobile players.
+//
+// Ids are prefixed by kind: "ar-" and "al-" followed by the MakeKey of an
+// artist or album, "tr-" and "pl-" followed by a persistent id.
+package subsonic
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/rclancey/itunes"
+	"github.com/rclancey/itunes/artwork"
+)
+
+type handlerFunc func(s *Server, r *http.Request, resp *Response) error
+type rawHandlerFunc func(s *Server, w http.ResponseWriter, r *http.Request) error
+
+var handlers = map[string]handlerFunc{
+	"ping": ping,
+	"getLicense": getLicense,
+	"getOpenSubsonicExtensions": getOpenSubsonicExtensions,
+	"getMusicFolders": getMusicFolders,
+	"getIndexes": getIndexes,
+	"getMusicDirectory": getMusicDirectory,
+	"getArtists": getArtists,
+	"getArtist": getArtist,
+	"getAlbum": getAlbum,
+	"getSong": getSong,
+	"getGenres": getGenres,
+	"getSongsByGenre": getSongsByGenre,
+	"getRandomSongs": getRandomSongs,
+	"getAlbumList2": getAlbumList2,
+	"search3": search3,
+	"getStarred2": getStarred2,
+	"getPlaylists": getPlaylists,
+	"getPlaylist": getPlaylist,
+	"scrobble": scrobble,
+	"star": star,
+	"unstar": unstar,
+	"setRating": setRating,
+}
+
+var rawHandlers = map[string]rawHandlerFunc{
+	"stream": stream,
+	"download": stream,
+	"getCoverArt": getCoverArt,
+}
+
+// Server handles requests to {Prefix}/rest/{method}[.view].  Users maps
+// user names to passwords; both plain ("p") and token ("t", "s")
+// authentication are accepted.
+type Server struct {
+	lib *itunes.Library
+	art artwork.ArtworkSource
+	Prefix string
+	Users map[string]string
+	mutex sync.Mutex
+	cat *catalog
+	unsubscribe func()
+}
+
+func NewServer(lib *itunes.Library, art artwork.ArtworkSource, users map[string]string) *Server {
+	s := &Server{lib: lib, art: art, Users: users}
+	s.unsubscribe = lib.Subscribe(func(events []*itunes.Event) {
+		s.mutex.Lock()
+		s.cat = nil
+		s.mutex.Unlock()
+	})
+	return s
+}
+
+func (s *Server) Close() {
+	s.unsubscribe()
+}
+
+func newError(code int, msg string) *Error {
+	return &Error{Code: code, Message: msg}
+}
+
+func notFound(what string) *Error {
+	return newError(ErrNotFound, what + " not found")
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, s.Prefix), "/")
+	method := strings.TrimSuffix(strings.TrimPrefix(path, "rest/"), ".view")
+	err := s.authenticate(r)
+	if err != nil {
+		s.write(w, r, &Response{}, err)
+		return
+	}
+	if h, ok := rawHandlers[method]; ok {
+		err = h(s, w, r)
+		if err != nil {
+			s.write(w, r, &Response{}, err)
+		}
+		return
+	}
+	h, ok := handlers[method]
+	if !ok {
+		s.write(w, r, &Response{}, newError(ErrGeneric, "unknown method " + method))
+		return
+	}
+	resp := &Response{}
+	err = h(s, r, resp)
+	s.write(w, r, resp, err)
+}
+
+func (s *Server) authenticate(r *http.Request) error {
+	user := r.Form.Get("u")
+	if user == "" {
+		return newError(ErrMissingParameter, "required parameter u is missing")
+	}
+	password, ok := s.Users[user]
+	if !ok {
+		return newError(ErrWrongCredentials, "wrong username or password")
+	}
+	if token := r.Form.Get("t"); token != "" {
+		sum := md5.Sum([]byte(password + r.Form.Get("s")))
+		if strings.ToLower(token) == hex.EncodeToString(sum[:]) {
+			return nil
+		}
+		return newError(ErrWrongCredentials, "wrong username or password")
+	}
+	p := r.Form.Get("p")
+	if strings.HasPrefix(p, "enc:") {
+		data, err := hex.DecodeString(p[4:])
+		if err != nil {
+			return newError(ErrWrongCredentials, "wrong username or password")
+		}
+		p = string(data)
+	}
+	if p == "" || p != password {
+		return newError(ErrWrongCredentials, "wrong username or password")
+	}
+	return nil
+}
+
+// write fills in the envelope and encodes resp as XML, or as JSON when
+// f=json.  Subsonic reports errors with a 200 status.
+func (s *Server) write(w http.ResponseWriter, r *http.Request, resp *Response, err error) {
+	resp.Xmlns = xmlns
+	resp.Status = "ok"
+	resp.Version = APIVersion
+	resp.Type = "itunes"
+	resp.ServerVersion = "1.0"
+	resp.OpenSubsonic = true
+	if err != nil {
+		serr, ok := err.(*Error)
+		if !ok {
+			serr = newError(ErrGeneric, err.Error())
+		}
+		*resp = Response{
+			Xmlns: resp.Xmlns,
+			Status: "failed",
+			Version: resp.Version,
+			Type: resp.Type,
+			ServerVersion: resp.ServerVersion,
+			OpenSubsonic: true,
+			Error: serr,
+		}
+	}
+	if r.Form.Get("f") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]*Response{"subsonic-response": resp})
+		return
+	}
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(resp)
+}
+
+func requireParam(r *http.Request, key string) (string, error) {
+	v := r.Form.Get(key)
+	if v == "" {
+		return "", newError(ErrMissingParameter, "required parameter " + key + " is missing")
+	}
+	return v, nil
+}
+
+func intParam(r *http.Request, key string, def, max int) int {
+	v, err := strconv.Atoi(r.Form.Get(key))
+	if err != nil || v < 0 {
+		return def
+	}
+	if max > 0 && v > max {
+		return max
+	}
+	return v
+}
+
+func ping(s *Server, r *http.Request, resp *Response) error {
+	return nil
+}
+
+func getLicense(s *Server, r *http.Request, resp *Response) error {
+	resp.License = &License{Valid: true}
+	return nil
+}
+
+func getOpenSubsonicExtensions(s *Server, r *http.Request, resp *Response) error {
+	resp.Extensions = []*Extension{}
+	return nil
+}
+
+func getMusicFolders(s *Server, r *http.Request, resp *Response) error {
+	resp.MusicFolders = &MusicFolders{[]*MusicFolder{{ID: 1, Name: "Music"}}}
+	return nil
+}
@@ -0,0 +1,195 @@
+package subsonic
+
+import (
+	"encoding/xml"
+	"time"
+)
+
+const (
+	APIVersion = "1.16.1"
+	xmlns = "http://subsonic.org/restapi"
+)
+
+// Response is the subsonic-response envelope.  Exactly one of the
+// payload fields is set on success.
+type Response struct {
+	XMLName xml.Name `xml:"subsonic-response" json:"-"`
+	Xmlns string `xml:"xmlns,attr" json:"-"`
+	Status string `xml:"status,attr" json:"status"`
+	Version string `xml:"version,attr" json:"version"`
+	Type string `xml:"type,attr" json:"type"`
+	ServerVersion string `xml:"serverVersion,attr" json:"serverVersion"`
+	OpenSubsonic bool `xml:"openSubsonic,attr" json:"openSubsonic"`
+	Error *Error `xml:"error,omitempty" json:"error,omitempty"`
+	License *License `xml:"license,omitempty" json:"license,omitempty"`
+	Extensions []*Extension `xml:"openSubsonicExtensions,omitempty" json:"openSubsonicExtensions,omitempty"`
+	MusicFolders *MusicFolders `xml:"musicFolders,omitempty" json:"musicFolders,omitempty"`
+	Indexes *Indexes `xml:"indexes,omitempty" json:"indexes,omitempty"`
+	Directory *Directory `xml:"directory,omitempty" json:"directory,omitempty"`
+	Artists *Artists `xml:"artists,omitempty" json:"artists,omitempty"`
+	Artist *Artist `xml:"artist,omitempty" json:"artist,omitempty"`
+	Album *Album `xml:"album,omitempty" json:"album,omitempty"`
+	Song *Song `xml:"song,omitempty" json:"song,omitempty"`
+	Genres *Genres `xml:"genres,omitempty" json:"genres,omitempty"`
+	SongsByGenre *Songs `xml:"songsByGenre,omitempty" json:"songsByGenre,omitempty"`
+	RandomSongs *Songs `xml:"randomSongs,omitempty" json:"randomSongs,omitempty"`
+	AlbumList2 *AlbumList `xml:"albumList2,omitempty" json:"albumList2,omitempty"`
+	SearchResult3 *SearchResult `xml:"searchResult3,omitempty" json:"searchResult3,omitempty"`
+	Starred2 *SearchResult `xml:"starred2,omitempty" json:"starred2,omitempty"`
+	Playlists *Playlists `xml:"playlists,omitempty" json:"playlists,omitempty"`
+	Playlist *Playlist `xml:"playlist,omitempty" json:"playlist,omitempty"`
+}
+
+// Error is both a Go error and the error element of a failed response.
+type Error struct {
+	Code int `xml:"code,attr" json:"code"`
+	Message string `xml:"message,attr" json:"message"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+const (
+	ErrGeneric = 0
+	ErrMissingParameter = 10
+	ErrWrongCredentials = 40
+	ErrNotAuthorized = 50
+	ErrNotFound = 70
+)
+
+type License struct {
+	Valid bool `xml:"valid,attr" json:"valid"`
+}
+
+type Extension struct {
+	Name string `xml:"name,attr" json:"name"`
+	Versions []int `xml:"versions" json:"versions"`
+}
+
+type MusicFolder struct {
+	ID int `xml:"id,attr" json:"id"`
+	Name string `xml:"name,attr" json:"name"`
+}
+
+type MusicFolders struct {
+	Folders []*MusicFolder `xml:"musicFolder" json:"musicFolder"`
+}
+
+type Index struct {
+	Name string `xml:"name,attr" json:"name"`
+	Artists []*Artist `xml:"artist" json:"artist"`
+}
+
+type Indexes struct {
+	LastModified int64 `xml:"lastModified,attr" json:"lastModified"`
+	IgnoredArticles string `xml:"ignoredArticles,attr" json:"ignoredArticles"`
+	Index []*Index `xml:"index" json:"index"`
+}
+
+type Artists struct {
+	IgnoredArticles string `xml:"ignoredArticles,attr" json:"ignoredArticles"`
+	Index []*Index `xml:"index" json:"index"`
+}
+
+type Artist struct {
+	ID string `xml:"id,attr" json:"id"`
+	Name string `xml:"name,attr" json:"name"`
+	CoverArt string `xml:"coverArt,attr,omitempty" json:"coverArt,omitempty"`
+	AlbumCount int `xml:"albumCount,attr" json:"albumCount"`
+	Starred *time.Time `xml:"starred,attr,omitempty" json:"starred,omitempty"`
+	Albums []*Album `xml:"album,omitempty" json:"album,omitempty"`
+}
+
+type Album struct {
+	ID string `xml:"id,attr" json:"id"`
+	Name string `xml:"name,attr" json:"name"`
+	Artist string `xml:"artist,attr,omitempty" json:"artist,omitempty"`
+	ArtistID string `xml:"artistId,attr,omitempty" json:"artistId,omitempty"`
+	CoverArt string `xml:"coverArt,attr,omitempty" json:"coverArt,omitempty"`
+	SongCount int `xml:"songCount,attr" json:"songCount"`
+	Duration int `xml:"duration,attr" json:"duration"`
+	PlayCount uint `xml:"playCount,attr,omitempty" json:"playCount,omitempty"`
+	Created *time.Time `xml:"created,attr,omitempty" json:"created,omitempty"`
+	Starred *time.Time `xml:"starred,attr,omitempty" json:"starred,omitempty"`
+	Year int `xml:"year,attr,omitempty" json:"year,omitempty"`
+	Genre string `xml:"genre,attr,omitempty" json:"genre,omitempty"`
+	Songs []*Song `xml:"song,omitempty" json:"song,omitempty"`
+}
+
+// Song is the Subsonic "Child" type, used for both songs and
+// directories.
+type Song struct {
+	ID string `xml:"id,attr" json:"id"`
+	Parent string `xml:"parent,attr,omitempty" json:"parent,omitempty"`
+	IsDir bool `xml:"isDir,attr" json:"isDir"`
+	Title string `xml:"title,attr" json:"title"`
+	Album string `xml:"album,attr,omitempty" json:"album,omitempty"`
+	Artist string `xml:"artist,attr,omitempty" json:"artist,omitempty"`
+	Track int `xml:"track,attr,omitempty" json:"track,omitempty"`
+	Year int `xml:"year,attr,omitempty" json:"year,omitempty"`
+	Genre string `xml:"genre,attr,omitempty" json:"genre,omitempty"`
+	CoverArt string `xml:"coverArt,attr,omitempty" json:"coverArt,omitempty"`
+	Size uint64 `xml:"size,attr,omitempty" json:"size,omitempty"`
+	ContentType string `xml:"contentType,attr,omitempty" json:"contentType,omitempty"`
+	Suffix string `xml:"suffix,attr,omitempty" json:"suffix,omitempty"`
+	Duration int `xml:"duration,attr,omitempty" json:"duration,omitempty"`
+	BitRate int `xml:"bitRate,attr,omitempty" json:"bitRate,omitempty"`
+	Path string `xml:"path,attr,omitempty" json:"path,omitempty"`
+	PlayCount uint `xml:"playCount,attr,omitempty" json:"playCount,omitempty"`
+	Played *time.Time `xml:"played,attr,omitempty" json:"played,omitempty"`
+	DiscNumber int `xml:"discNumber,attr,omitempty" json:"discNumber,omitempty"`
+	Created *time.Time `xml:"created,attr,omitempty" json:"created,omitempty"`
+	Starred *time.Time `xml:"starred,attr,omitempty" json:"starred,omitempty"`
+	UserRating int `xml:"userRating,attr,omitempty" json:"userRating,omitempty"`
+	AlbumID string `xml:"albumId,attr,omitempty" json:"albumId,omitempty"`
+	ArtistID string `xml:"artistId,attr,omitempty" json:"artistId,omitempty"`
+	Type string `xml:"type,attr,omitempty" json:"type,omitempty"`
+}
+
+type Directory struct {
+	ID string `xml:"id,attr" json:"id"`
+	Parent string `xml:"parent,attr,omitempty" json:"parent,omitempty"`
+	Name string `xml:"name,attr" json:"name"`
+	Children []*Song `xml:"child" json:"child"`
+}
+
+type Genre struct {
+	Name string `xml:",chardata" json:"value"`
+	SongCount int `xml:"songCount,attr" json:"songCount"`
+	AlbumCount int `xml:"albumCount,attr" json:"albumCount"`
+}
+
+type Genres struct {
+	Genres []*Genre `xml:"genre" json:"genre"`
+}
+
+type Songs struct {
+	Songs []*Song `xml:"song" json:"song"`
+}
+
+type AlbumList struct {
+	Albums []*Album `xml:"album" json:"album"`
+}
+
+type SearchResult struct {
+	Artists []*Artist `xml:"artist" json:"artist"`
+	Albums []*Album `xml:"album" json:"album"`
+	Songs []*Song `xml:"song" json:"song"`
+}
+
+type Playlists struct {
+	Playlists []*Playlist `xml:"playlist" json:"playlist"`
+}
+
+type Playlist struct {
+	ID string `xml:"id,attr" json:"id"`
+	Name string `xml:"name,attr" json:"name"`
+	Owner string `xml:"owner,attr,omitempty" json:"owner,omitempty"`
+	Public bool `xml:"public,attr" json:"public"`
+	SongCount int `xml:"songCount,attr" json:"songCount"`
+	Duration int `xml:"duration,attr" json:"duration"`
+	Created time.Time `xml:"created,attr" json:"created"`
+	Changed time.Time `xml:"changed,attr" json:"changed"`
+	Songs []*Song `xml:"entry,omitempty" json:"entry,omitempty"`
+}
@@ -0,0 +1,113 @@
+package itunes
+
+import (
+	"errors"
+
+	"github.com/rclancey/itunes/media"
+)
+
+var tagFields = map[string]bool{
+	"Name": true,
+	"Artist": true,
+	"AlbumArtist": true,
+	"Album": true,
+	"Composer": true,
+	"Genre": true,
+	"Grouping": true,
+	"Work": true,
+	"Comments": true,
+	"SortName": true,
+	"SortArtist": true,
+	"SortAlbumArtist": true,
+	"SortAlbum": true,
+	"SortComposer": true,
+	"TrackNumber": true,
+	"TrackCount": true,
+	"DiscNumber": true,
+	"DiscCount": true,
+	"ReleaseDate": true,
+	"Compilation": true,
+	"Rating": true,
+}
+
+// Tags returns the track's metadata in the form written to media files.
+func (t *Track) Tags() *media.Tags {
+	tags := &media.Tags{
+		Title: t.Name,
+		Artist: t.Artist,
+		AlbumArtist: t.AlbumArtist,
+		Album: t.Album,
+		Composer: t.Composer,
+		Genre: t.Genre,
+		Grouping: t.Grouping,
+		Work: t.Work,
+		Comment: t.Comments,
+		SortTitle: t.SortName,
+		SortArtist: t.SortArtist,
+		SortAlbumArtist: t.SortAlbumArtist,
+		SortAlbum: t.SortAlbum,
+		SortComposer: t.SortComposer,
+		TrackNumber: int(t.TrackNumber),
+		TrackCount: int(t.TrackCount),
+		DiscNumber: int(t.DiscNumber),
+		DiscCount: int(t.DiscCount),
+		Compilation: t.Compilation,
+		Rating: int(t.Rating),
+	}
+	if t.ReleaseDate != nil {
+		tags.Year = t.ReleaseDate.Year()
+	}
+	return tags
+}
+
+// SyncTags writes the track's metadata into its media file and returns the
+// fields that differed.  With dryRun set the file is left untouched.
+func (t *Track) SyncTags(dryRun bool) ([]media.TagDiff, error) {
+	fn := t.Path()
+	if fn == "" {
+		return nil, errors.New("track has no file")
+	}
+	cur, err := media.ReadTags(fn)
+	if err != nil {
+		return nil, err
+	}
+	want := t.Tags()
+	want.Format = cur.Format
+	diffs := cur.Diff(want)
+	if dryRun || len(diffs) == 0 {
+		return diffs, nil
+	}
+	return diffs, media.WriteTags(fn, want)
+}
+
+// SyncTagsOnChange writes tags back to media files whenever a track's
+// tagged metadata is edited.  Changes picked up by Reload came from the
+// library file, not an edit, and aren't written back.  The returned
+// function stops syncing.
+func (lib *Library) SyncTagsOnChange(onError func(*Track, error)) func() {
+	return lib.Subscribe(func(events []*Event) {
+		for _, ev := range events {
+			if ev.Type != TrackModified || ev.TrackID == nil || ev.Reload {
+				continue
+			}
+			tagged := false
+			for _, f := range ev.Fields {
+				if tagFields[f] {
+					tagged = true
+					break
+				}
+			}
+			if !tagged {
+				continue
+			}
+			tr := lib.GetTrack(*ev.TrackID)
+			if tr == nil {
+				continue
+			}
+			_, err := tr.SyncTags(false)
+			if err != nil && onError != nil {
+				onError(tr, err)
+			}
+		}
+	})
+}
@@ -6,6 +6,7 @@ import (
 	"path/filepath"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -120,7 +121,7 @@ func (t *Track) Path() string {
 			return fn
 		}
 	}
-	return t.Location
+	return mapLocation(t.Location)
 }
 
 func (t *Track) getTag() (tag.Metadata, error) {
@@ -163,26 +164,48 @@ func (t *Track) GetPurchaseDate() (*Time, error) {
 	return t.PurchaseDate, nil
 }
 
+var leadingTrackNumber = regexp.MustCompile(`^(\d{1,2}[\.\-])?(\d+)[ \.\-]+\s*`)
+
+// stripTrackNumber removes a track number from the start of a file name.
+// Only zero padded ("01 ") and disc-track ("1-01 ") numbers, or ones
+// matching the known track number, are taken to be track numbers, so
+// that titles such as "99 Luftballons" are left alone.
+func stripTrackNumber(name string, track uint8) string {
+	m := leadingTrackNumber.FindStringSubmatch(name)
+	if m == nil || len(m[0]) == len(name) {
+		return name
+	}
+	n := m[2]
+	switch {
+	case m[1] != "" && len(n) == 2:
+	case len(n) == 2 && n[0] == '0':
+	case track > 0 && n == strconv.Itoa(int(track)):
+	default:
+		return name
+	}
+	return name[len(m[0]):]
+}
+
 func (t *Track) GetName() (string, error) {
 	if t.Name != "" {
 		return t.Name, nil
 	}
 	m, err := t.getTag()
-	if err != nil {
-		return "", err
-	}
-	v := m.Title()
-	if v != "" {
-		t.Name = v
-		return v, nil
+	if err == nil {
+		v := m.Title()
+		if v != "" {
+			t.Name = v
+			return v, nil
+		}
 	}
+	// untagged files fall back to the file name, less any leading track
+	// number
 	fn := t.Path()
 	_, name := filepath.Split(fn)
 	ext := filepath.Ext(fn)
 	name = strings.TrimSuffix(name, ext)
 	name = strings.Replace(name, "_", " ", -1)
-	reg := regexp.MustCompile(`^\d+(\.\d+)[ \.\-]\s*`)
-	name = reg.ReplaceAllString(name, "")
+	name = stripTrackNumber(name, t.TrackNumber)
 	t.Name = name
 	return name, nil
 }
@@ -192,17 +215,19 @@ func (t *Track) GetAlbum() (string, error) {
 		return t.Album, nil
 	}
 	m, err := t.getTag()
-	if err != nil {
-		return "", err
-	}
-	v := m.Album()
-	if v != "" {
-		t.Album = v
-		return v, nil
+	if err == nil {
+		v := m.Album()
+		if v != "" {
+			t.Album = v
+			return v, nil
+		}
 	}
+	// then the directory the file is in
 	fn := t.Path()
-	dir, _ := filepath.Split(fn)
-	_, name := filepath.Split(dir)
+	if fn == "" {
+		return "", nil
+	}
+	name := filepath.Base(filepath.Dir(fn))
 	name = strings.Replace(name, "_", " ", -1)
 	t.Album = name
 	return name, nil
@@ -213,18 +238,19 @@ func (t *Track) GetArtist() (string, error) {
 		return t.Artist, nil
 	}
 	m, err := t.getTag()
-	if err != nil {
-		return "", err
-	}
-	v := m.Artist()
-	if v != "" {
-		t.Artist = v
-		return v, nil
+	if err == nil {
+		v := m.Artist()
+		if v != "" {
+			t.Artist = v
+			return v, nil
+		}
 	}
+	// then the directory above the album's
 	fn := t.Path()
-	dir, _ := filepath.Split(fn)
-	dir, _ = filepath.Split(dir)
-	_, name := filepath.Split(dir)
+	if fn == "" {
+		return "", nil
+	}
+	name := filepath.Base(filepath.Dir(filepath.Dir(fn)))
 	name = strings.Replace(name, "_", " ", -1)
 	t.Artist = name
 	return name, nil
@@ -254,140 +280,151 @@ func (t *Track) GetExt() string {
 	return ""
 }
 
-func (t *Track) Update(orig, cur *Track) {
-	mod := false
+func boolpEqual(a, b *bool) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// Update applies the changes from orig to cur to t and returns the names
+// of the fields it changed.  It emits no events; use Library.UpdateTrack
+// instead.
+func (t *Track) Update(orig, cur *Track) []string {
+	fields := []string{}
 	if cur.Album != orig.Album {
 		t.Album = cur.Album
-		mod = true
+		fields = append(fields, "Album")
 	}
 	if cur.AlbumArtist != orig.AlbumArtist {
 		t.AlbumArtist = cur.AlbumArtist
-		mod = true
+		fields = append(fields, "AlbumArtist")
 	}
 	if cur.Artist != orig.Artist {
 		t.Artist = cur.Artist
-		mod = true
+		fields = append(fields, "Artist")
 	}
 	if cur.Comments != orig.Comments {
 		t.Comments = cur.Comments
-		mod = true
+		fields = append(fields, "Comments")
 	}
 	if cur.Compilation != orig.Compilation {
 		t.Compilation = cur.Compilation
-		mod = true
+		fields = append(fields, "Compilation")
 	}
 	if cur.Composer != orig.Composer {
 		t.Composer = cur.Composer
-		mod = true
+		fields = append(fields, "Composer")
 	}
 	if cur.DiscCount != orig.DiscCount {
 		t.DiscCount = cur.DiscCount
-		mod = true
+		fields = append(fields, "DiscCount")
 	}
 	if cur.DiscNumber != orig.DiscNumber {
 		t.DiscNumber = cur.DiscNumber
-		mod = true
+		fields = append(fields, "DiscNumber")
 	}
 	if cur.Genre != orig.Genre {
 		t.Genre = cur.Genre
-		mod = true
+		fields = append(fields, "Genre")
 	}
 	if cur.Grouping != orig.Grouping {
 		t.Grouping = cur.Grouping
-		mod = true
+		fields = append(fields, "Grouping")
 	}
-	if cur.Loved != orig.Loved {
+	if !boolpEqual(cur.Loved, orig.Loved) {
 		t.Loved = cur.Loved
-		mod = true
+		fields = append(fields, "Loved")
 	}
 	if cur.Name != orig.Name {
 		t.Name = cur.Name
-		mod = true
+		fields = append(fields, "Name")
 	}
 	if cur.PartOfGaplessAlbum != orig.PartOfGaplessAlbum {
 		t.PartOfGaplessAlbum = cur.PartOfGaplessAlbum
-		mod = true
+		fields = append(fields, "PartOfGaplessAlbum")
 	}
 	if cur.Rating != orig.Rating {
 		t.Rating = cur.Rating
-		mod = true
+		fields = append(fields, "Rating")
 	}
 	if cur.ReleaseDate == nil {
 		if orig.ReleaseDate != nil {
 			t.ReleaseDate = nil
-			mod = true
+			fields = append(fields, "ReleaseDate")
 		}
 	} else {
 		if orig.ReleaseDate == nil {
 			t.ReleaseDate = cur.ReleaseDate
-			mod = true
+			fields = append(fields, "ReleaseDate")
 		} else if !cur.ReleaseDate.Equal(orig.ReleaseDate.Get()) {
 			t.ReleaseDate = cur.ReleaseDate
-			mod = true
+			fields = append(fields, "ReleaseDate")
 		}
 	}
 	if cur.SortAlbum != orig.SortAlbum {
 		t.SortAlbum = cur.SortAlbum
-		mod = true
+		fields = append(fields, "SortAlbum")
 	}
 	if cur.SortAlbumArtist != orig.SortAlbumArtist {
 		t.SortAlbumArtist = cur.SortAlbumArtist
-		mod = true
+		fields = append(fields, "SortAlbumArtist")
 	}
 	if cur.SortArtist != orig.SortArtist {
 		t.SortArtist = cur.SortArtist
-		mod = true
+		fields = append(fields, "SortArtist")
 	}
 	if cur.SortComposer != orig.SortComposer {
 		t.SortComposer = cur.SortComposer
-		mod = true
+		fields = append(fields, "SortComposer")
 	}
 	if cur.SortName != orig.SortName {
 		t.SortName = cur.SortName
-		mod = true
+		fields = append(fields, "SortName")
 	}
 	if cur.TrackCount != orig.TrackCount {
 		t.TrackCount = cur.TrackCount
-		mod = true
+		fields = append(fields, "TrackCount")
 	}
 	if cur.TrackNumber != orig.TrackNumber {
 		t.TrackNumber = cur.TrackNumber
-		mod = true
+		fields = append(fields, "TrackNumber")
 	}
 	if cur.VolumeAdjustment != orig.VolumeAdjustment {
 		t.VolumeAdjustment = cur.VolumeAdjustment
-		mod = true
+		fields = append(fields, "VolumeAdjustment")
 	}
 	if cur.Work != orig.Work {
 		t.Work = cur.Work
-		mod = true
+		fields = append(fields, "Work")
 	}
 	if cur.PlayDate != nil {
 		if t.PlayDate == nil || cur.PlayDate.After(t.PlayDate.Get()) {
 			t.PlayDate = cur.PlayDate
-			mod = true
+			fields = append(fields, "PlayDate")
 		}
 	}
 	if cur.SkipDate != nil {
 		if t.SkipDate == nil || cur.SkipDate.After(t.SkipDate.Get()) {
 			t.SkipDate = cur.SkipDate
-			mod = true
+			fields = append(fields, "SkipDate")
 		}
 	}
 	if cur.PlayCount > orig.PlayCount {
 		t.PlayCount += (cur.PlayCount - orig.PlayCount)
-		mod = true
+		fields = append(fields, "PlayCount")
 	}
 	if cur.SkipCount > orig.SkipCount {
 		t.SkipCount += (cur.SkipCount - orig.SkipCount)
-		mod = true
+		fields = append(fields, "SkipCount")
 	}
 	if !cur.Unplayed && t.Unplayed {
 		t.Unplayed = false
-		mod = true
+		fields = append(fields, "Unplayed")
 	}
-	if mod {
+	if len(fields) > 0 {
 		t.DateModified = &Time{time.Now().In(time.UTC)}
 	}
+	return fields
 }
 
@@ -0,0 +1,276 @@
+package itunes
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/rclancey/itunes/persistentId"
+)
+
+// RLock and RUnlock guard reads against a concurrent Reload.  Reload parses
+// the new library file without holding the lock and only takes the write
+// lock while it applies the differences.
+func (lib *Library) RLock() {
+	lib.mutex.RLock()
+}
+
+func (lib *Library) RUnlock() {
+	lib.mutex.RUnlock()
+}
+
+// Lock and Unlock guard changes made from other goroutines.  Release the
+// lock before committing a transaction, so that event handlers can read
+// the library.
+func (lib *Library) Lock() {
+	lib.mutex.Lock()
+}
+
+func (lib *Library) Unlock() {
+	lib.mutex.Unlock()
+}
+
+// Reload re-parses fn and applies whatever changed to lib, emitting the
+// corresponding events in a single batch.
+func (lib *Library) Reload(fn string) error {
+	next := NewLibrary()
+	err := next.Load(fn)
+	if err != nil {
+		return err
+	}
+	lib.ApplyDelta(next)
+	return nil
+}
+
+// ApplyDelta makes lib match next, matching tracks and playlists by
+// persistent ID.  Existing *Track and *Playlist values are updated in
+// place so that references held elsewhere stay valid.
+func (lib *Library) ApplyDelta(next *Library) {
+	lib.mutex.Lock()
+	lib.Begin()
+	lib.FileName = next.FileName
+	lib.MajorVersion = next.MajorVersion
+	lib.MinorVersion = next.MinorVersion
+	lib.ApplicationVersion = next.ApplicationVersion
+	lib.Date = next.Date
+	lib.Features = next.Features
+	lib.ShowContentRatings = next.ShowContentRatings
+	lib.PersistentID = next.PersistentID
+	lib.MusicFolder = next.MusicFolder
+	lib.applying = true
+	lib.applyTrackDelta(next)
+	lib.applyPlaylistDelta(next)
+	lib.applying = false
+	lib.mutex.Unlock()
+	lib.Commit()
+}
+
+func (lib *Library) applyTrackDelta(next *Library) {
+	removed := []pid.PersistentID{}
+	for _, tr := range lib.Tracks {
+		if next.GetTrack(tr.PersistentID) == nil {
+			removed = append(removed, tr.PersistentID)
+		}
+	}
+	for _, id := range removed {
+		lib.RemoveTrack(id)
+	}
+	for _, tr := range next.Tracks {
+		cur := lib.GetTrack(tr.PersistentID)
+		if cur == nil {
+			lib.AddTrack(tr)
+			continue
+		}
+		fields := diffFields(cur, tr)
+		if len(fields) > 0 {
+			*cur = *tr
+			lib.emitTrack(TrackModified, cur.PersistentID, fields)
+		}
+	}
+}
+
+func (lib *Library) applyPlaylistDelta(next *Library) {
+	added := []*Playlist{}
+	for id, npl := range next.Playlists {
+		if _, ok := lib.Playlists[id]; !ok {
+			if npl.Folder {
+				npl.Children = []*Playlist{}
+			} else {
+				npl.Children = nil
+			}
+			lib.Playlists[id] = npl
+			added = append(added, npl)
+		}
+	}
+	for _, npl := range added {
+		npl.Nest(lib)
+		lib.emitPlaylist(PlaylistCreated, npl.PersistentID)
+	}
+	moves := map[*Playlist]*pid.PersistentID{}
+	for id, npl := range next.Playlists {
+		pl := lib.Playlists[id]
+		if pl == npl {
+			continue
+		}
+		lib.RenamePlaylist(pl, npl.Name)
+		fields := []string{}
+		for _, f := range diffFields(pl, npl) {
+			switch f {
+			case "ParentPersistentID", "TrackIDs", "Children", "PlaylistItems":
+				// the tree and track list have their own events below
+			case "Smart":
+				if !smartEqual(pl.Smart, npl.Smart) {
+					fields = append(fields, f)
+				}
+			default:
+				fields = append(fields, f)
+			}
+		}
+		if len(fields) > 0 {
+			parentId, trackIds, children, items := pl.ParentPersistentID, pl.TrackIDs, pl.Children, pl.PlaylistItems
+			*pl = *npl
+			pl.ParentPersistentID, pl.TrackIDs, pl.Children, pl.PlaylistItems = parentId, trackIds, children, items
+			lib.emit(&Event{Type: PlaylistModified, PlaylistID: id.Pointer(), Fields: fields})
+		}
+		if !pidsEqual(pl.TrackIDs, npl.TrackIDs) {
+			pl.TrackIDs = npl.TrackIDs
+			lib.emitPlaylist(PlaylistTracksChanged, id)
+		}
+		moves[pl] = npl.ParentPersistentID
+	}
+	// a move can look like a cycle until another folder has moved out of
+	// the way, so retry failed moves while any succeed
+	for len(moves) > 0 {
+		n := len(moves)
+		for pl, parentId := range moves {
+			if lib.MovePlaylist(pl, parentId) == nil {
+				delete(moves, pl)
+			}
+		}
+		if len(moves) == n {
+			break
+		}
+	}
+	// deleting a folder deletes its contents, so anything moved out of a
+	// deleted folder has to be moved first
+	for id, pl := range lib.Playlists {
+		if _, ok := next.Playlists[id]; !ok {
+			lib.DeletePlaylist(pl)
+		}
+	}
+}
+
+func smartEqual(a, b *SmartPlaylist) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	aInfo, aCrit, aErr := a.Encode()
+	bInfo, bCrit, bErr := b.Encode()
+	if aErr != nil || bErr != nil {
+		return reflect.DeepEqual(a, b)
+	}
+	return bytes.Equal(aInfo, bInfo) && bytes.Equal(aCrit, bCrit)
+}
+
+func diffFields(a, b interface{}) []string {
+	av := reflect.ValueOf(a).Elem()
+	bv := reflect.ValueOf(b).Elem()
+	rt := av.Type()
+	fields := []string{}
+	n := rt.NumField()
+	for i := 0; i < n; i++ {
+		if !reflect.DeepEqual(av.Field(i).Interface(), bv.Field(i).Interface()) {
+			fields = append(fields, rt.Field(i).Name)
+		}
+	}
+	return fields
+}
+
+// Watcher polls a library file's size and modification time and reloads
+// the library when they change.  Polling is used rather than filesystem
+// notifications so that it also works on network mounts.
+type Watcher struct {
+	lib *Library
+	fn string
+	interval time.Duration
+	modTime time.Time
+	size int64
+	quit chan bool
+	wg sync.WaitGroup
+	OnError func(error)
+}
+
+func NewWatcher(lib *Library, fn string, interval time.Duration) *Watcher {
+	w := &Watcher{
+		lib: lib,
+		fn: fn,
+		interval: interval,
+		OnError: func(err error) {
+			log.Println("error reloading library", fn, err)
+		},
+	}
+	st, err := os.Stat(fn)
+	if err == nil {
+		w.modTime = st.ModTime()
+		w.size = st.Size()
+	}
+	return w
+}
+
+// Check reloads the library if the file has changed since the last
+// successful reload.  A failed reload leaves the recorded state alone so
+// that a file caught mid-write is retried on the next poll.
+func (w *Watcher) Check() (bool, error) {
+	st, err := os.Stat(w.fn)
+	if err != nil {
+		return false, err
+	}
+	if st.Size() == w.size && st.ModTime().Equal(w.modTime) {
+		return false, nil
+	}
+	err = w.lib.Reload(w.fn)
+	if err != nil {
+		return false, err
+	}
+	w.modTime = st.ModTime()
+	w.size = st.Size()
+	return true, nil
+}
+
+func (w *Watcher) Start() {
+	if w.quit != nil {
+		return
+	}
+	w.quit = make(chan bool)
+	w.wg.Add(1)
+	go w.run(w.quit)
+}
+
+func (w *Watcher) run(quit chan bool) {
+	defer w.wg.Done()
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+			_, err := w.Check()
+			if err != nil && w.OnError != nil {
+				w.OnError(err)
+			}
+		}
+	}
+}
+
+func (w *Watcher) Stop() {
+	if w.quit == nil {
+		return
+	}
+	close(w.quit)
+	w.wg.Wait()
+	w.quit = nil
+}